@@ -2,22 +2,417 @@
 // Use of this source code is governed by licenses granted by the
 // copyright holder including that found in the LICENSE file.
 
-// Common support for all HTTP topic handlers
+// Protection against abusive senders, shared by every ingress path.  Addresses in
+// the configured allow list are never limited and those in the deny list are always
+// refused.  Otherwise, each address and each device has a token bucket that limits it
+// to a sustained rate with bursts, and an address that sends a flood of malformed
+// payloads is banned for a while.  State is kept in memory by each instance.
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
-// Filter abusive ports
+// Defaults for that which isn't configured
+const abuseIPPerMinuteDefault = 600
+const abuseIPBurstDefault = 300
+const abuseDevicePerMinuteDefault = 30
+const abuseDeviceBurstDefault = 30
+const abuseMalformedThresholdDefault = 30
+const abuseBanMinutesDefault = 60
+
+// Addresses refused unless otherwise configured, being the tencent cloud, which was constantly hammering us
+var abuseDenyDefault = []string{"118.24.0.0/16", "118.25.0.0/16"}
+
+// How long a bucket may sit idle, by which time it is surely full, before being forgotten
+const abuseIdleMinutes = 15
+
+// A token bucket, refilled at a steady rate up to a maximum
+type abuseBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Malformed payloads received from an address within the current minute
+type abuseMalformedCount struct {
+	count int
+	start time.Time
+}
+
+// Statics
+var abuseLock sync.Mutex
+var abuseIPBuckets = map[string]*abuseBucket{}
+var abuseDeviceBuckets = map[uint32]*abuseBucket{}
+var abuseMalformedCounts = map[string]*abuseMalformedCount{}
+var abuseBans = map[string]time.Time{}
+var abuseNetsCache = map[string][]*net.IPNet{}
+
+// abuseParseCIDR parses an address range, or a single address
+func abuseParseCIDR(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address '%s'", cidr)
+		}
+		if ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address range '%s'", cidr)
+	}
+	return ipnet, nil
+}
+
+// abuseValidateConfig makes sure that the configured address ranges are usable
+func abuseValidateConfig(config TTServeConfig) error {
+	for _, cidr := range append(append(append([]string{}, config.AllowCIDRs...), config.DenyCIDRs...), config.TrustedProxyCIDRs...) {
+		_, err := abuseParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abuseNets gets the parsed form of a list of address ranges, which must be called with the lock held
+func abuseNets(cidrs []string) []*net.IPNet {
+	key := strings.Join(cidrs, ",")
+	nets, present := abuseNetsCache[key]
+	if present {
+		return nets
+	}
+	for _, cidr := range cidrs {
+		ipnet, err := abuseParseCIDR(cidr)
+		if err == nil {
+			nets = append(nets, ipnet)
+		}
+	}
+	abuseNetsCache[key] = nets
+	return nets
+}
+
+// abuseContains returns true if the address is within any of the ranges
+func abuseContains(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// abuseLimit gets a configured limit, substituting the default if unconfigured
+func abuseLimit(configured float64, def float64) float64 {
+	if configured == 0 {
+		return def
+	}
+	return configured
+}
+
+// abuseTake takes a token from a bucket, returning false if none are left.  It must be called with the lock held.
+func abuseTake(bucket *abuseBucket, perMinute float64, burst float64, now time.Time) bool {
+	bucket.tokens += now.Sub(bucket.last).Minutes() * perMinute
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// abuseRefused returns true if the address is denied or banned, which must be called with the lock held
+func abuseRefused(config TTServeConfig, ipaddr string, ip net.IP, now time.Time) bool {
+	if abuseContains(abuseNets(config.DenyCIDRs), ip) {
+		return true
+	}
+	until, banned := abuseBans[ipaddr]
+	if banned && now.Before(until) {
+		return true
+	}
+	return false
+}
+
+// abuseTrustedProxy returns true if the address is that of a proxy whose forwarding headers we trust
+func abuseTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	config := CurrentServiceConfig()
+	if len(config.TrustedProxyCIDRs) == 0 {
+		return ip.IsLoopback() || isPrivateSubnet(ip)
+	}
+	abuseLock.Lock()
+	defer abuseLock.Unlock()
+	return abuseContains(abuseNets(config.TrustedProxyCIDRs), ip)
+}
+
+// isAbusiveIP returns true if the address is denied or banned, without counting it against its rate
 func isAbusiveIP(ipaddr string) bool {
+	ip := net.ParseIP(ipaddr)
+	if ip == nil {
+		return false
+	}
+	config := CurrentServiceConfig()
+	abuseLock.Lock()
+	defer abuseLock.Unlock()
+	if abuseContains(abuseNets(config.AllowCIDRs), ip) {
+		return false
+	}
+	return abuseRefused(config, ipaddr, ip, time.Now())
+}
 
-	// Block all from the tencent cloud, which is constantly hammering us
-	if strings.HasPrefix(ipaddr, "118.24.") || strings.HasPrefix(ipaddr, "118.25.") {
+// abuseIPAllowed decides whether or not to accept something from an address, counting it against its rate
+func abuseIPAllowed(ipaddr string) bool {
+
+	ip := net.ParseIP(ipaddr)
+	if ip == nil {
 		return true
 	}
 
-	// Not known to be abusive
-	return false
+	config := CurrentServiceConfig()
+	abuseLock.Lock()
+	defer abuseLock.Unlock()
+
+	if abuseContains(abuseNets(config.AllowCIDRs), ip) {
+		return true
+	}
+	now := time.Now()
+	if abuseRefused(config, ipaddr, ip, now) {
+		stats.Count.Refused++
+		return false
+	}
+
+	perMinute := abuseLimit(config.RateLimitIPPerMinute, abuseIPPerMinuteDefault)
+	if perMinute < 0 {
+		return true
+	}
+	burst := abuseLimit(float64(config.RateLimitIPBurst), abuseIPBurstDefault)
+	bucket, present := abuseIPBuckets[ipaddr]
+	if !present {
+		bucket = &abuseBucket{tokens: burst, last: now}
+		abuseIPBuckets[ipaddr] = bucket
+	}
+	if !abuseTake(bucket, perMinute, burst, now) {
+		stats.Count.RateLimited++
+		return false
+	}
+	return true
+
+}
+
+// abuseDeviceAllowed decides whether or not to accept a measurement from a device, counting it against its rate
+func abuseDeviceAllowed(deviceID uint32) bool {
+
+	if deviceID == 0 {
+		return true
+	}
+
+	config := CurrentServiceConfig()
+	perMinute := abuseLimit(config.RateLimitDevicePerMinute, abuseDevicePerMinuteDefault)
+	if perMinute < 0 {
+		return true
+	}
+	burst := abuseLimit(float64(config.RateLimitDeviceBurst), abuseDeviceBurstDefault)
+
+	abuseLock.Lock()
+	defer abuseLock.Unlock()
+	now := time.Now()
+	bucket, present := abuseDeviceBuckets[deviceID]
+	if !present {
+		bucket = &abuseBucket{tokens: burst, last: now}
+		abuseDeviceBuckets[deviceID] = bucket
+	}
+	if !abuseTake(bucket, perMinute, burst, now) {
+		stats.Count.RateLimited++
+		return false
+	}
+	return true
+
+}
+
+// abuseMalformed counts a malformed payload from an address, banning it if it has sent too many
+func abuseMalformed(ipaddr string) {
+
+	stats.Count.Malformed++
+
+	ip := net.ParseIP(ipaddr)
+	if ip == nil || isPrivateSubnet(ip) {
+		return
+	}
+
+	config := CurrentServiceConfig()
+	threshold := config.MalformedBanThreshold
+	if threshold == 0 {
+		threshold = abuseMalformedThresholdDefault
+	}
+	if threshold < 0 {
+		return
+	}
+	banMinutes := config.MalformedBanMinutes
+	if banMinutes <= 0 {
+		banMinutes = abuseBanMinutesDefault
+	}
+
+	abuseLock.Lock()
+	defer abuseLock.Unlock()
+	if abuseContains(abuseNets(config.AllowCIDRs), ip) {
+		return
+	}
+	now := time.Now()
+	mc, present := abuseMalformedCounts[ipaddr]
+	if !present || now.Sub(mc.start) > time.Minute {
+		mc = &abuseMalformedCount{start: now}
+		abuseMalformedCounts[ipaddr] = mc
+	}
+	mc.count++
+	if mc.count < threshold {
+		return
+	}
+
+	delete(abuseMalformedCounts, ipaddr)
+	abuseBans[ipaddr] = now.Add(time.Duration(banMinutes) * time.Minute)
+	stats.Count.Bans++
+	ServerLog(fmt.Sprintf("ABUSE banned %s for %d minutes after %d malformed payloads\n", ipaddr, banMinutes, threshold))
+
+}
 
+// abuseTransportIP extracts the address from a transport such as "device-udp:1.2.3.4", if it has one
+func abuseTransportIP(transport string) string {
+	_, ipaddr, _ := strings.Cut(transport, ":")
+	if net.ParseIP(ipaddr) == nil {
+		return ""
+	}
+	return ipaddr
+}
+
+// abuseBanned gets the addresses currently banned, along with when they will be let back in
+func abuseBanned() (banned map[string]string) {
+	abuseLock.Lock()
+	defer abuseLock.Unlock()
+	now := time.Now()
+	var addresses []string
+	for ipaddr, until := range abuseBans {
+		if now.Before(until) {
+			addresses = append(addresses, ipaddr)
+		}
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	sort.Strings(addresses)
+	banned = map[string]string{}
+	for _, ipaddr := range addresses {
+		banned[ipaddr] = abuseBans[ipaddr].UTC().Format("2006-01-02T15:04:05Z")
+	}
+	return
+}
+
+// abuseExpire forgets the state of those who have been quiet for a while, and expired bans
+func abuseExpire() {
+	abuseLock.Lock()
+	defer abuseLock.Unlock()
+	now := time.Now()
+	idle := abuseIdleMinutes * time.Minute
+	for ipaddr, bucket := range abuseIPBuckets {
+		if now.Sub(bucket.last) > idle {
+			delete(abuseIPBuckets, ipaddr)
+		}
+	}
+	for deviceID, bucket := range abuseDeviceBuckets {
+		if now.Sub(bucket.last) > idle {
+			delete(abuseDeviceBuckets, deviceID)
+		}
+	}
+	for ipaddr, mc := range abuseMalformedCounts {
+		if now.Sub(mc.start) > time.Minute {
+			delete(abuseMalformedCounts, ipaddr)
+		}
+	}
+	for ipaddr, until := range abuseBans {
+		if !now.Before(until) {
+			delete(abuseBans, ipaddr)
+		}
+	}
+	if len(abuseNetsCache) > 10 {
+		abuseNetsCache = map[string][]*net.IPNet{}
+	}
+}
+
+// abuseHandler refuses HTTP requests from abusive addresses before they reach any topic handler.
+// Requests from internal addresses are passed through, as are UDP payloads signed by the instance
+// that relayed them through the web load balancer, because they were already checked where they
+// arrived, and those from our own Notehub routes, which send for many devices from a few shared
+// addresses.
+func abuseHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requestor, isReal, _ := getRequestorIPv4(req)
+		if isReal && !abuseNoteRouteTrusted(req) && !abuseRelayTrusted(req) && !abuseIPAllowed(requestor) {
+			stats.Count.HTTP++
+			status := http.StatusTooManyRequests
+			if isAbusiveIP(requestor) {
+				status = http.StatusForbidden
+			}
+			http.Error(rw, http.StatusText(status), status)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// abuseNoteRouteTrusted returns true if the request is to a note topic from one of our authenticated
+// Notehub routes, leaving the body in place to be read again by the topic handler
+func abuseNoteRouteTrusted(req *http.Request) bool {
+	if req.URL.Path != TTServerTopicNote && req.URL.Path != TTServerTopicNoteTest {
+		return false
+	}
+	if len(CurrentServiceConfig().NoteSecrets) == 0 {
+		return false
+	}
+	body, err := abuseReadBody(req)
+	if err != nil {
+		return false
+	}
+	return noteRequestTrusted(req, body)
+}
+
+// abuseRelayTrusted returns true if the request is a UDP payload relayed and signed by one of our
+// own instances, leaving the body in place to be read again by the topic handler
+func abuseRelayTrusted(req *http.Request) bool {
+	if req.URL.Path != TTServerTopicSend || req.UserAgent() != relayUserAgent {
+		return false
+	}
+	if len(CurrentServiceConfig().RelaySecrets) == 0 {
+		return false
+	}
+	body, err := abuseReadBody(req)
+	if err != nil {
+		return false
+	}
+	return relayRequestTrusted(req, body)
+}
+
+// abuseReadBody reads the body of a request, replacing it so that it can be read again
+func abuseReadBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, fmt.Errorf("no body")
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, err
 }
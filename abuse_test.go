@@ -0,0 +1,337 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// abuseTestSetup uses a service config, and a limiter that knows of no one, for the duration of a test
+func abuseTestSetup(t *testing.T, config TTServeConfig) {
+	t.Helper()
+	testServiceConfig(t, config)
+	abuseLock.Lock()
+	prevIP, prevDevice, prevMalformed, prevBans := abuseIPBuckets, abuseDeviceBuckets, abuseMalformedCounts, abuseBans
+	abuseIPBuckets = map[string]*abuseBucket{}
+	abuseDeviceBuckets = map[uint32]*abuseBucket{}
+	abuseMalformedCounts = map[string]*abuseMalformedCount{}
+	abuseBans = map[string]time.Time{}
+	abuseLock.Unlock()
+	t.Cleanup(func() {
+		abuseLock.Lock()
+		abuseIPBuckets, abuseDeviceBuckets, abuseMalformedCounts, abuseBans = prevIP, prevDevice, prevMalformed, prevBans
+		abuseLock.Unlock()
+	})
+}
+
+func TestAbuseTake(t *testing.T) {
+	type step struct {
+		after time.Duration
+		want  bool
+	}
+	tests := []struct {
+		name      string
+		perMinute float64
+		burst     float64
+		steps     []step
+	}{
+		{"burst, then nothing", 60, 3, []step{{0, true}, {0, true}, {0, true}, {0, false}, {0, false}}},
+		{"refilled at the rate", 60, 3, []step{{0, true}, {0, true}, {0, true}, {0, false}, {time.Second, true}, {0, false}, {500 * time.Millisecond, false}, {500 * time.Millisecond, true}}},
+		{"refilled no further than the burst", 60, 2, []step{{0, true}, {0, true}, {0, false}, {time.Hour, true}, {0, true}, {0, false}}},
+		{"fractional rate", 0.5, 1, []step{{0, true}, {time.Minute, false}, {time.Minute, true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+			bucket := &abuseBucket{tokens: tt.burst, last: now}
+			for i, s := range tt.steps {
+				now = now.Add(s.after)
+				if got := abuseTake(bucket, tt.perMinute, tt.burst, now); got != s.want {
+					t.Errorf("step %d: got %t, want %t", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAbuseIPAllowed(t *testing.T) {
+	const allowed = "203.0.113.5"
+	const denied = "198.51.100.5"
+	const other = "192.0.2.5"
+	tests := []struct {
+		name      string
+		config    TTServeConfig
+		address   string
+		want      []bool
+		refused   uint32
+		ratelimit uint32
+	}{
+		{"limited", TTServeConfig{RateLimitIPPerMinute: 1, RateLimitIPBurst: 2}, other, []bool{true, true, false, false}, 0, 2},
+		{"allowed", TTServeConfig{RateLimitIPPerMinute: 1, RateLimitIPBurst: 2, AllowCIDRs: []string{"203.0.113.0/24"}}, allowed, []bool{true, true, true, true}, 0, 0},
+		{"denied", TTServeConfig{RateLimitIPPerMinute: 1, RateLimitIPBurst: 2, DenyCIDRs: []string{"198.51.100.0/24"}}, denied, []bool{false, false}, 2, 0},
+		{"allowed and denied", TTServeConfig{AllowCIDRs: []string{allowed}, DenyCIDRs: []string{"203.0.113.0/24"}}, allowed, []bool{true, true}, 0, 0},
+		{"denied by default", TTServeConfig{DenyCIDRs: abuseDenyDefault}, "118.24.1.2", []bool{false}, 1, 0},
+		{"unlimited", TTServeConfig{RateLimitIPPerMinute: -1, RateLimitIPBurst: 1}, other, []bool{true, true, true}, 0, 0},
+		{"not an address", TTServeConfig{RateLimitIPPerMinute: 1, RateLimitIPBurst: 1}, "", []bool{true, true}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			abuseTestSetup(t, tt.config)
+			prev := stats.Count
+			for i, want := range tt.want {
+				if got := abuseIPAllowed(tt.address); got != want {
+					t.Errorf("request %d: got %t, want %t", i, got, want)
+				}
+			}
+			if n := stats.Count.Refused - prev.Refused; n != tt.refused {
+				t.Errorf("refused: counted %d, want %d", n, tt.refused)
+			}
+			if n := stats.Count.RateLimited - prev.RateLimited; n != tt.ratelimit {
+				t.Errorf("rate limited: counted %d, want %d", n, tt.ratelimit)
+			}
+		})
+	}
+}
+
+func TestAbuseDeviceAllowed(t *testing.T) {
+	abuseTestSetup(t, TTServeConfig{RateLimitDevicePerMinute: 1, RateLimitDeviceBurst: 2})
+	for i, want := range []bool{true, true, false} {
+		if got := abuseDeviceAllowed(7); got != want {
+			t.Errorf("device 7, message %d: got %t, want %t", i, got, want)
+		}
+	}
+	if !abuseDeviceAllowed(8) {
+		t.Errorf("device 8 limited by device 7")
+	}
+	if !abuseDeviceAllowed(0) || !abuseDeviceAllowed(0) || !abuseDeviceAllowed(0) {
+		t.Errorf("messages without a device limited")
+	}
+}
+
+func TestAbuseMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TTServeConfig
+		address string
+		count   int
+		banned  bool
+	}{
+		{"below the threshold", TTServeConfig{MalformedBanThreshold: 3}, "192.0.2.5", 2, false},
+		{"at the threshold", TTServeConfig{MalformedBanThreshold: 3}, "192.0.2.5", 3, true},
+		{"default threshold", TTServeConfig{}, "192.0.2.5", abuseMalformedThresholdDefault, true},
+		{"disabled", TTServeConfig{MalformedBanThreshold: -1}, "192.0.2.5", 100, false},
+		{"private", TTServeConfig{MalformedBanThreshold: 1}, "10.1.2.3", 10, false},
+		{"allowed", TTServeConfig{MalformedBanThreshold: 1, AllowCIDRs: []string{"192.0.2.0/24"}}, "192.0.2.5", 10, false},
+		{"not an address", TTServeConfig{MalformedBanThreshold: 1}, "", 10, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			abuseTestSetup(t, tt.config)
+			testDataDirectory(t)
+			os.MkdirAll(SafecastDirectory()+TTServerLogPath, 0777)
+			prev := stats.Count
+			for i := 0; i < tt.count; i++ {
+				abuseMalformed(tt.address)
+			}
+			if n := stats.Count.Malformed - prev.Malformed; n != uint32(tt.count) {
+				t.Errorf("malformed: counted %d, want %d", n, tt.count)
+			}
+			_, banned := abuseBanned()[tt.address]
+			if banned != tt.banned || isAbusiveIP(tt.address) != tt.banned {
+				t.Errorf("banned %t, abusive %t, want %t", banned, isAbusiveIP(tt.address), tt.banned)
+			}
+			wantBans := uint32(0)
+			if tt.banned {
+				wantBans = 1
+			}
+			if n := stats.Count.Bans - prev.Bans; n != wantBans {
+				t.Errorf("bans: counted %d, want %d", n, wantBans)
+			}
+		})
+	}
+}
+
+// An address is banned once it sends too many malformed payloads within a minute, refused while it is
+// banned, and let back in once the ban expires
+func TestAbuseBanEscalation(t *testing.T) {
+	abuseTestSetup(t, TTServeConfig{MalformedBanThreshold: 3, MalformedBanMinutes: 5})
+	testDataDirectory(t)
+	os.MkdirAll(SafecastDirectory()+TTServerLogPath, 0777)
+	const address = "192.0.2.9"
+
+	// Those spread out over more than a minute don't add up
+	abuseMalformed(address)
+	abuseMalformed(address)
+	abuseLock.Lock()
+	abuseMalformedCounts[address].start = time.Now().Add(-2 * time.Minute)
+	abuseLock.Unlock()
+	abuseMalformed(address)
+	if isAbusiveIP(address) || !abuseIPAllowed(address) {
+		t.Fatalf("banned for malformed payloads more than a minute apart")
+	}
+
+	// Those within a minute do
+	abuseMalformed(address)
+	abuseMalformed(address)
+	if !isAbusiveIP(address) || abuseIPAllowed(address) {
+		t.Fatalf("not banned at the threshold")
+	}
+	abuseLock.Lock()
+	until := abuseBans[address]
+	abuseLock.Unlock()
+	if d := time.Until(until); d < 4*time.Minute || d > 5*time.Minute {
+		t.Errorf("banned for %s, want 5m", d)
+	}
+
+	// Once the ban is over it is let back in and forgotten
+	abuseLock.Lock()
+	abuseBans[address] = time.Now().Add(-time.Second)
+	abuseLock.Unlock()
+	if isAbusiveIP(address) || !abuseIPAllowed(address) {
+		t.Errorf("still refused after the ban")
+	}
+	abuseExpire()
+	abuseLock.Lock()
+	_, present := abuseBans[address]
+	abuseLock.Unlock()
+	if present {
+		t.Errorf("expired ban not forgotten")
+	}
+}
+
+func TestRequestorIPv4(t *testing.T) {
+	tests := []struct {
+		name      string
+		trusted   []string
+		remote    string
+		forwarded string
+		realIP    string
+		want      string
+		isReal    bool
+	}{
+		{"direct", nil, "192.0.2.5:1234", "", "", "192.0.2.5", true},
+		{"direct, claiming to be forwarded", nil, "192.0.2.5:1234", "203.0.113.9", "203.0.113.9", "192.0.2.5", true},
+		{"private proxy", nil, "10.0.0.2:1234", "203.0.113.9", "", "203.0.113.9", true},
+		{"private proxy, chain", nil, "10.0.0.2:1234", "198.51.100.1, 203.0.113.9", "", "203.0.113.9", true},
+		{"private proxy, real IP", nil, "10.0.0.2:1234", "", "203.0.113.9", "203.0.113.9", true},
+		{"private proxy, nothing forwarded", nil, "10.0.0.2:1234", "", "", "10.0.0.2", false},
+		{"private proxy, private client", nil, "10.0.0.2:1234", "10.0.0.3", "", "10.0.0.2", false},
+		{"loopback proxy", nil, "127.0.0.1:1234", "203.0.113.9", "", "203.0.113.9", true},
+		{"configured proxy", []string{"192.0.2.0/24"}, "192.0.2.10:1234", "203.0.113.9", "", "203.0.113.9", true},
+		{"configured proxies, chain", []string{"192.0.2.0/24"}, "192.0.2.10:1234", "198.51.100.1, 203.0.113.9, 192.0.2.11", "", "203.0.113.9", true},
+		{"private address not configured as a proxy", []string{"192.0.2.10"}, "10.0.0.2:1234", "203.0.113.9", "", "10.0.0.2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			abuseTestSetup(t, TTServeConfig{TrustedProxyCIDRs: tt.trusted})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-Ip", tt.realIP)
+			}
+			got, isReal, _ := getRequestorIPv4(req)
+			if got != tt.want || isReal != tt.isReal {
+				t.Errorf("got %s %t, want %s %t", got, isReal, tt.want, tt.isReal)
+			}
+		})
+	}
+}
+
+// UDP payloads relayed through the web load balancer are only exempt from limiting when signed by our instances
+func TestAbuseRelayTrusted(t *testing.T) {
+	const requestor = "192.0.2.5"
+	const body = `{"transport":"device-udp:198.51.100.7"}`
+	tests := []struct {
+		name      string
+		secrets   []string
+		userAgent string
+		signature string
+		limited   bool
+	}{
+		{"signed", []string{"old-secret", "relay-secret"}, relayUserAgent, relaySignature("relay-secret", []byte(body)), false},
+		{"unsigned", []string{"relay-secret"}, relayUserAgent, "", true},
+		{"wrong secret", []string{"relay-secret"}, relayUserAgent, relaySignature("guess", []byte(body)), true},
+		{"signed, other user agent", []string{"relay-secret"}, "TTGATE", relaySignature("relay-secret", []byte(body)), true},
+		{"no secrets", nil, relayUserAgent, relaySignature("", []byte(body)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			abuseTestSetup(t, TTServeConfig{RelaySecrets: tt.secrets, RateLimitIPPerMinute: 1, RateLimitIPBurst: 1})
+			var handled []string
+			handler := abuseHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				b, _ := io.ReadAll(req.Body)
+				handled = append(handled, string(b))
+			}))
+			limited := false
+			for i := 0; i < 3; i++ {
+				req := httptest.NewRequest(http.MethodPost, TTServerTopicSend, strings.NewReader(body))
+				req.RemoteAddr = requestor + ":4321"
+				req.Header.Set("User-Agent", tt.userAgent)
+				if tt.signature != "" {
+					req.Header.Set(relaySignatureHeader, tt.signature)
+				}
+				rw := httptest.NewRecorder()
+				handler.ServeHTTP(rw, req)
+				if rw.Code == http.StatusTooManyRequests {
+					limited = true
+				}
+			}
+			if limited != tt.limited {
+				t.Errorf("limited %t, want %t", limited, tt.limited)
+			}
+			for _, h := range handled {
+				if h != body {
+					t.Errorf("body not left in place: %q", h)
+				}
+			}
+		})
+	}
+}
+
+// Relayed payloads must be signed when relay secrets are configured
+func TestSendRelaySignature(t *testing.T) {
+	const body = `{"payload":""}`
+	tests := []struct {
+		name      string
+		secrets   []string
+		signature string
+		status    int
+	}{
+		{"signed", []string{"relay-secret"}, relaySignature("relay-secret", []byte(body)), http.StatusOK},
+		{"unsigned", []string{"relay-secret"}, "", http.StatusForbidden},
+		{"wrong secret", []string{"relay-secret"}, relaySignature("guess", []byte(body)), http.StatusForbidden},
+		{"no secrets", nil, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			abuseTestSetup(t, TTServeConfig{RelaySecrets: tt.secrets})
+			testDataDirectory(t)
+			os.MkdirAll(SafecastDirectory()+TTServerLogPath, 0777)
+			req := httptest.NewRequest(http.MethodPost, TTServerTopicSend, strings.NewReader(body))
+			req.Header.Set("User-Agent", relayUserAgent)
+			if tt.signature != "" {
+				req.Header.Set(relaySignatureHeader, tt.signature)
+			}
+			rw := httptest.NewRecorder()
+			inboundWebSendHandler(rw, req)
+			if rw.Code != tt.status {
+				t.Errorf("got %d, want %d", rw.Code, tt.status)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			trackedWait(ctx)
+		})
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Authentication of messages from devices.  A device that has a key in the device
+// registry may sign each message of a signed payload buffer with an HMAC-SHA256 of
+// the message, using that key.  Messages whose signature doesn't verify are always
+// rejected, and devices marked as secure must sign every message.  Because a signature
+// only proves who sent a message and not when, signed messages must say when they
+// were captured, and those that are stale or that were already accepted are rejected.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	ttproto "github.com/Safecast/ttproto/golang"
+)
+
+// Length of the signature that follows each message in a signed payload buffer
+const appReqSignatureLen = sha256.Size
+
+// How long before the latest of a device's signed messages one may have been captured before it
+// is considered stale, which is also how long we remember the signed messages that we've accepted
+const appReqReplayWindow = 1 * time.Hour
+
+// How far ahead of our clock a signed message may say that it was captured
+const appReqFutureWindow = 10 * time.Minute
+
+// The signed messages recently accepted from a device, which is shared among instances
+type appReqReplayState struct {
+	Latest time.Time            `json:"latest,omitempty"`
+	Seen   map[string]time.Time `json:"seen,omitempty"`
+}
+
+// appReqSignature computes the signature of a message
+func appReqSignature(key []byte, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// appReqKey decodes a key from the device registry, which is in hex
+func appReqKey(key string) ([]byte, error) {
+	k, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("key must be hex: %s", err)
+	}
+	if len(k) == 0 {
+		return nil, fmt.Errorf("key must not be empty")
+	}
+	return k, nil
+}
+
+// appReqAuthenticate decides whether or not a message claiming to be from the device that it names is
+// to be accepted, counting those that aren't
+func appReqAuthenticate(AppReq IncomingAppReq, msg *ttproto.Telecast) error {
+
+	deviceID := msg.GetDeviceId()
+	device, _ := registryGet(deviceID, "")
+
+	// Unsigned messages are fine unless the device must sign them
+	if AppReq.Signature == nil {
+		if device.Secure {
+			stats.Count.DeviceUnsigned++
+			return fmt.Errorf("unsigned message from secure device %d", deviceID)
+		}
+		return nil
+	}
+
+	// A signature that we can't verify is only fine if the device isn't secure
+	if device.Key == "" {
+		if device.Secure {
+			stats.Count.DeviceBadSigned++
+			return fmt.Errorf("secure device %d has no key", deviceID)
+		}
+		return nil
+	}
+	key, err := appReqKey(device.Key)
+	if err != nil {
+		stats.Count.DeviceBadSigned++
+		return fmt.Errorf("device %d: %s", deviceID, err)
+	}
+	if !hmac.Equal(AppReq.Signature, appReqSignature(key, AppReq.Payload)) {
+		stats.Count.DeviceBadSigned++
+		return fmt.Errorf("bad signature on message from device %d", deviceID)
+	}
+
+	// Make sure that it isn't an old message being sent again
+	err = appReqReplayCheck(deviceID, AppReq.Signature, msg, time.Now())
+	if err != nil {
+		stats.Count.DeviceReplayed++
+		return fmt.Errorf("device %d: %s", deviceID, err)
+	}
+
+	return nil
+
+}
+
+// appReqCapturedAt gets when a message says that it was captured, if it says so by itself
+// rather than by referring to a stamp sent earlier
+func appReqCapturedAt(msg *ttproto.Telecast) (capturedAt time.Time, found bool) {
+	when := ""
+	if msg.CapturedAt != nil {
+		when = msg.GetCapturedAt()
+	} else if msg.CapturedAtDate != nil && msg.CapturedAtTime != nil {
+		when = GetWhenFromOffset(msg.GetCapturedAtDate(), msg.GetCapturedAtTime(), msg.GetCapturedAtOffset())
+	}
+	capturedAt, err := time.Parse(time.RFC3339, when)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return capturedAt.UTC(), true
+}
+
+// appReqReplayCheck accepts a signed message only if it was captured no earlier than the replay window
+// before the latest accepted from the device, and isn't one of those already accepted.  What was
+// accepted is recorded in the store so that a message can't be accepted again by another instance.
+func appReqReplayCheck(deviceID uint32, signature []byte, msg *ttproto.Telecast, now time.Time) error {
+
+	capturedAt, found := appReqCapturedAt(msg)
+	if !found {
+		return fmt.Errorf("signed message doesn't say when it was captured")
+	}
+	if capturedAt.After(now.Add(appReqFutureWindow)) {
+		return fmt.Errorf("signed message captured in the future at %s", capturedAt.Format(time.RFC3339))
+	}
+
+	sig := hex.EncodeToString(signature)
+	return store.Update(TTDeviceSignedPath, fmt.Sprintf("%d", deviceID), func(contents []byte) ([]byte, error) {
+
+		state := appReqReplayState{}
+		if contents != nil {
+			err := json.Unmarshal(contents, &state)
+			if err != nil {
+				state = appReqReplayState{}
+			}
+		}
+
+		if capturedAt.Before(state.Latest.Add(-appReqReplayWindow)) {
+			return nil, fmt.Errorf("stale signed message captured at %s", capturedAt.Format(time.RFC3339))
+		}
+		if _, present := state.Seen[sig]; present {
+			return nil, fmt.Errorf("signed message captured at %s was already received", capturedAt.Format(time.RFC3339))
+		}
+
+		// Remember it, forgetting those that are now too old to be accepted anyway
+		if capturedAt.After(state.Latest) {
+			state.Latest = capturedAt
+		}
+		seen := map[string]time.Time{sig: capturedAt}
+		for s, t := range state.Seen {
+			if !t.Before(state.Latest.Add(-appReqReplayWindow)) {
+				seen[s] = t
+			}
+		}
+		state.Seen = seen
+
+		return json.Marshal(state)
+
+	})
+
+}
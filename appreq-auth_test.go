@@ -0,0 +1,202 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	ttproto "github.com/Safecast/ttproto/golang"
+	"google.golang.org/protobuf/proto"
+)
+
+// The key of the devices in these tests
+const appReqTestKey = "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+
+// appReqTestStore uses an empty memory store for the duration of a test
+func appReqTestStore(t *testing.T) {
+	t.Helper()
+	testServiceConfig(t, TTServeConfig{})
+	prev := store
+	store = storeMemoryNew()
+	t.Cleanup(func() { store = prev })
+}
+
+// appReqTestMessage gets a message from a device, captured at the specified time
+func appReqTestMessage(t *testing.T, deviceID uint32, capturedAt time.Time, voltage float32) (msg *ttproto.Telecast, payload []byte) {
+	t.Helper()
+	msg = &ttproto.Telecast{DeviceId: proto.Uint32(deviceID), BatVoltage: proto.Float32(voltage)}
+	if !capturedAt.IsZero() {
+		msg.CapturedAt = proto.String(capturedAt.UTC().Format(time.RFC3339))
+	}
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg, payload
+}
+
+// appReqTestSign signs a message with the specified key
+func appReqTestSign(t *testing.T, key string, payload []byte) []byte {
+	t.Helper()
+	k, err := appReqKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return appReqSignature(k, payload)
+}
+
+func TestAppReqAuthenticate(t *testing.T) {
+	appReqTestStore(t)
+	tubeTestRegistry(t,
+		RegistryDevice{DeviceID: 2, Key: appReqTestKey},
+		RegistryDevice{DeviceID: 3, Key: appReqTestKey, Secure: true},
+		RegistryDevice{DeviceID: 4, Secure: true},
+		RegistryDevice{DeviceID: 5, Key: "not hex", Secure: true},
+	)
+
+	const (
+		unsigned = iota
+		signed
+		wrongKey
+	)
+	tests := []struct {
+		name      string
+		deviceID  uint32
+		signature int
+		accepted  bool
+		unsigned  uint32
+		badSigned uint32
+	}{
+		{"unregistered, unsigned", 1, unsigned, true, 0, 0},
+		{"unregistered, signed", 1, signed, true, 0, 0},
+		{"keyed, unsigned", 2, unsigned, true, 0, 0},
+		{"keyed, signed", 2, signed, true, 0, 0},
+		{"keyed, wrong key", 2, wrongKey, false, 0, 1},
+		{"secure, unsigned", 3, unsigned, false, 1, 0},
+		{"secure, signed", 3, signed, true, 0, 0},
+		{"secure, wrong key", 3, wrongKey, false, 0, 1},
+		{"secure without key, unsigned", 4, unsigned, false, 1, 0},
+		{"secure without key, signed", 4, signed, false, 0, 1},
+		{"secure with bad key, signed", 5, signed, false, 0, 1},
+	}
+	now := time.Now()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, payload := appReqTestMessage(t, tt.deviceID, now, float32(i))
+			AppReq := IncomingAppReq{Payload: payload}
+			switch tt.signature {
+			case signed:
+				AppReq.Signature = appReqTestSign(t, appReqTestKey, payload)
+			case wrongKey:
+				AppReq.Signature = appReqTestSign(t, "ff", payload)
+			}
+			prev := stats.Count
+			err := appReqAuthenticate(AppReq, msg)
+			if (err == nil) != tt.accepted {
+				t.Errorf("accepted %t, want %t: %v", err == nil, tt.accepted, err)
+			}
+			if n := stats.Count.DeviceUnsigned - prev.DeviceUnsigned; n != tt.unsigned {
+				t.Errorf("unsigned: counted %d, want %d", n, tt.unsigned)
+			}
+			if n := stats.Count.DeviceBadSigned - prev.DeviceBadSigned; n != tt.badSigned {
+				t.Errorf("bad signature: counted %d, want %d", n, tt.badSigned)
+			}
+		})
+	}
+}
+
+func TestAppReqReplay(t *testing.T) {
+	appReqTestStore(t)
+	tubeTestRegistry(t, RegistryDevice{DeviceID: 2, Key: appReqTestKey, Secure: true})
+
+	now := time.Now().UTC().Truncate(time.Second)
+	type frame struct {
+		capturedAt time.Time
+		voltage    float32
+	}
+	tests := []struct {
+		name     string
+		frame    frame
+		accepted bool
+	}{
+		{"first", frame{now, 1}, true},
+		{"repeated", frame{now, 1}, false},
+		{"another captured at the same time", frame{now, 2}, true},
+		{"later", frame{now.Add(5 * time.Minute), 3}, true},
+		{"earlier within the window", frame{now.Add(-30 * time.Minute), 4}, true},
+		{"earlier within the window, repeated", frame{now.Add(-30 * time.Minute), 4}, false},
+		{"stale", frame{now.Add(5*time.Minute - appReqReplayWindow - time.Second), 5}, false},
+		{"in the future", frame{now.Add(appReqFutureWindow + time.Minute), 6}, false},
+		{"without a capture time", frame{time.Time{}, 7}, false},
+		{"first, repeated after the others", frame{now, 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, payload := appReqTestMessage(t, 2, tt.frame.capturedAt, tt.frame.voltage)
+			AppReq := IncomingAppReq{Payload: payload, Signature: appReqTestSign(t, appReqTestKey, payload)}
+			prev := stats.Count.DeviceReplayed
+			err := appReqAuthenticate(AppReq, msg)
+			if (err == nil) != tt.accepted {
+				t.Errorf("accepted %t, want %t: %v", err == nil, tt.accepted, err)
+			}
+			if n := stats.Count.DeviceReplayed - prev; (n == 1) == tt.accepted {
+				t.Errorf("counted %d as replayed", n)
+			}
+		})
+	}
+
+	// Those that are too old to be accepted anyway are forgotten
+	contents, err := store.Get(TTDeviceSignedPath, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents) == 0 {
+		t.Fatal("nothing recorded")
+	}
+	later := now.Add(2 * appReqReplayWindow)
+	msg, payload := appReqTestMessage(t, 2, later, 8)
+	err = appReqReplayCheck(2, appReqTestSign(t, appReqTestKey, payload), msg, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := appReqReplayState{}
+	contents, _ = store.Get(TTDeviceSignedPath, "2")
+	err = json.Unmarshal(contents, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Seen) != 1 || !state.Latest.Equal(later) {
+		t.Errorf("remembered %d, latest %s", len(state.Seen), state.Latest)
+	}
+}
+
+func TestAppReqCapturedAt(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *ttproto.Telecast
+		want string
+	}{
+		{"captured at", &ttproto.Telecast{CapturedAt: proto.String("2024-05-06T07:08:09Z")}, "2024-05-06T07:08:09Z"},
+		{"date and time", &ttproto.Telecast{CapturedAtDate: proto.Uint32(60524), CapturedAtTime: proto.Uint32(70809)}, "2024-05-06T07:08:09Z"},
+		{"date, time, and offset", &ttproto.Telecast{CapturedAtDate: proto.Uint32(60524), CapturedAtTime: proto.Uint32(70809), CapturedAtOffset: proto.Uint32(60)}, "2024-05-06T07:09:09Z"},
+		{"stamp offset only", &ttproto.Telecast{Stamp: proto.Uint32(1), CapturedAtOffset: proto.Uint32(60)}, ""},
+		{"garbage", &ttproto.Telecast{CapturedAt: proto.String("yesterday")}, ""},
+		{"nothing", &ttproto.Telecast{}, ""},
+	}
+	for _, tt := range tests {
+		got, found := appReqCapturedAt(tt.msg)
+		if tt.want == "" {
+			if found {
+				t.Errorf("%s: got %s", tt.name, got)
+			}
+			continue
+		}
+		if !found || got.Format(time.RFC3339) != tt.want {
+			t.Errorf("%s: got %s %t, want %s", tt.name, got, found, tt.want)
+		}
+	}
+}
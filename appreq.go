@@ -15,6 +15,7 @@ import (
 // IncomingAppReq is the common request format that we process as a goroutine
 type IncomingAppReq struct {
 	Payload      []byte
+	Signature    []byte
 	GwLongitude  *float64
 	GwLatitude   *float64
 	GwAltitude   *float64
@@ -34,6 +35,7 @@ func AppReqProcess(AppReq IncomingAppReq) {
 	msg := &ttproto.Telecast{}
 	err := proto.Unmarshal(AppReq.Payload, msg)
 	if err != nil {
+		abuseMalformed(abuseTransportIP(AppReq.SvTransport))
 		fmt.Printf("*** PB unmarshaling error: %s\n", err)
 		fmt.Printf("*** ")
 		for i := 0; i < len(AppReq.Payload); i++ {
@@ -46,6 +48,19 @@ func AppReqProcess(AppReq IncomingAppReq) {
 	// Display the actual unmarshaled value received in the payload
 	fmt.Printf("%v\n", msg)
 
+	// Make sure that it's really from the device that it claims to be from
+	err = appReqAuthenticate(AppReq, msg)
+	if err != nil {
+		ServerLog(fmt.Sprintf("DEVICE message rejected from %s: %s\n", AppReq.SvTransport, err))
+		return
+	}
+
+	// Drop it if the device is sending far more often than it should
+	if !abuseDeviceAllowed(msg.GetDeviceId()) {
+		fmt.Printf("%s *** Ignoring because device %d is rate limited\n", LogTime(), msg.GetDeviceId())
+		return
+	}
+
 	// Display info about the received message
 	if msg.RelayDevice1 != nil {
 		fmt.Printf("%s RELAYED thru hop #1 %d\n", LogTime(), msg.GetRelayDevice1())
@@ -87,15 +102,23 @@ func AppReqProcess(AppReq IncomingAppReq) {
 func AppReqPushPayload(req IncomingAppReq, buf []byte, from string) {
 	var AppReq = req
 
+	if len(buf) == 0 {
+		abuseMalformed(abuseTransportIP(AppReq.SvTransport))
+		fmt.Printf("\n%s Received empty payload from %s %s\n", LogTime(), from, AppReq.SvTransport)
+		return
+	}
+
 	bufFormat := buf[0]
 	bufLength := len(buf)
 
 	switch bufFormat {
 
-	case BuffFormatPBArray:
+	case BuffFormatPBArray, BuffFormatPBArraySigned:
 		{
 
+			signed := bufFormat == BuffFormatPBArraySigned
 			if !validBulkPayload(buf, bufLength) {
+				abuseMalformed(abuseTransportIP(AppReq.SvTransport))
 				fmt.Printf("\n%s Received INVALID %d-byte payload from %s %s\n", LogTime(), bufLength, from, AppReq.SvTransport)
 				return
 			}
@@ -111,8 +134,20 @@ func AppReqPushPayload(req IncomingAppReq, buf []byte, from string) {
 				// Extract the length
 				length := int(buf[lengthArrayOffset+i])
 
-				// Construct the app request
+				// Construct the app request, separating the signature from the message if signed
 				AppReq.Payload = buf[payloadOffset : payloadOffset+length]
+				AppReq.Signature = nil
+				if signed {
+					if length < appReqSignatureLen {
+						abuseMalformed(abuseTransportIP(AppReq.SvTransport))
+						fmt.Printf("\n%s Received INVALID %d-byte signed payload from %s %s\n", LogTime(), length, from, AppReq.SvTransport)
+						stats.Count.DeviceBadSigned++
+						payloadOffset += length
+						continue
+					}
+					AppReq.Signature = AppReq.Payload[length-appReqSignatureLen:]
+					AppReq.Payload = AppReq.Payload[:length-appReqSignatureLen]
+				}
 
 				if count == 1 {
 					fmt.Printf("\n%s Received %d-byte payload from %s %s\n", LogTime(), len(AppReq.Payload), from, AppReq.SvTransport)
@@ -132,6 +167,7 @@ func AppReqPushPayload(req IncomingAppReq, buf []byte, from string) {
 
 	default:
 		{
+			abuseMalformed(abuseTransportIP(AppReq.SvTransport))
 			isASCII := true
 			for i := 0; i < len(buf); i++ {
 				if buf[i] > 0x7f || (buf[i] < ' ' && buf[i] != '\r' && buf[i] != '\n' && buf[i] != '\t') {
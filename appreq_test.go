@@ -0,0 +1,83 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// appReqTestBuffer builds a payload buffer of the specified format holding the specified frames
+func appReqTestBuffer(format byte, frames ...[]byte) []byte {
+	buf := []byte{format, byte(len(frames))}
+	for _, f := range frames {
+		buf = append(buf, byte(len(f)))
+	}
+	for _, f := range frames {
+		buf = append(buf, f...)
+	}
+	return buf
+}
+
+func TestAppReqPushPayloadSigned(t *testing.T) {
+	s := noteBatchTestSetup(t, TTServeConfig{})
+	tubeTestRegistry(t,
+		RegistryDevice{DeviceID: 2, Key: appReqTestKey, Secure: true},
+		RegistryDevice{DeviceID: 3},
+	)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	signedFrame := func(deviceID uint32, capturedAt time.Time, voltage float32) []byte {
+		_, payload := appReqTestMessage(t, deviceID, capturedAt, voltage)
+		return append(payload, appReqTestSign(t, appReqTestKey, payload)...)
+	}
+	good1 := signedFrame(2, now, 1)
+	good2 := signedFrame(2, now.Add(time.Minute), 2)
+	badSignature := signedFrame(2, now.Add(2*time.Minute), 3)
+	badSignature[len(badSignature)-1] ^= 0xff
+	short := make([]byte, appReqSignatureLen-1)
+	_, unsigned := appReqTestMessage(t, 2, now.Add(3*time.Minute), 4)
+	unsignedOther := signedFrame(3, now, 5)
+
+	prev := stats.Count
+	AppReqPushPayload(IncomingAppReq{SvTransport: "udp:10.0.0.1"}, appReqTestBuffer(BuffFormatPBArraySigned, good1, short, badSignature, good1, good2), "test")
+	AppReqPushPayload(IncomingAppReq{SvTransport: "udp:10.0.0.1"}, appReqTestBuffer(BuffFormatPBArray, unsigned), "test")
+	AppReqPushPayload(IncomingAppReq{SvTransport: "udp:10.0.0.1"}, appReqTestBuffer(BuffFormatPBArraySigned, unsignedOther), "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	trackedWait(ctx)
+
+	// Only the good frames of the secure device, and the frame of the device without a key
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, voltages := range s.voltages {
+		sort.Float64s(voltages)
+	}
+	uid := func(deviceID uint32) string {
+		deviceType, _ := SafecastDeviceType(deviceID)
+		return fmt.Sprintf("%s:%d", deviceType, deviceID)
+	}
+	want := map[string][]float64{uid(2): {1, 2}, uid(3): {5}}
+	if !reflect.DeepEqual(s.voltages, want) {
+		t.Errorf("sent %v, want %v", s.voltages, want)
+	}
+	if n := stats.Count.DeviceBadSigned - prev.DeviceBadSigned; n != 2 {
+		t.Errorf("bad signature: counted %d, want 2 for the short frame and the bad signature", n)
+	}
+	if n := stats.Count.DeviceReplayed - prev.DeviceReplayed; n != 1 {
+		t.Errorf("replayed: counted %d, want 1", n)
+	}
+	if n := stats.Count.DeviceUnsigned - prev.DeviceUnsigned; n != 1 {
+		t.Errorf("unsigned: counted %d, want 1", n)
+	}
+	if n := stats.Count.Malformed - prev.Malformed; n != 1 {
+		t.Errorf("malformed: counted %d, want 1 for the short frame", n)
+	}
+}
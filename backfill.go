@@ -0,0 +1,380 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Backfill, which re-sends what was logged for a device or a range of dates to the
+// sinks, for when ingest was down or a mapping bug has been fixed.  Entries that were
+// logged more than once are only sent once, the derived values may be recalculated,
+// and the rate is limited so as not to overwhelm the sinks.  Backfill may be run from
+// the command line or requested of a running server through the "/backfill" topic.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ttdata "github.com/Safecast/safecast-go"
+)
+
+// BackfillRequest describes what is to be backfilled
+type BackfillRequest struct {
+	Device      string   `json:"device,omitempty"`
+	From        string   `json:"from,omitempty"`
+	To          string   `json:"to,omitempty"`
+	Recalculate bool     `json:"recalculate,omitempty"`
+	Sinks       []string `json:"sinks,omitempty"`
+	Rate        float64  `json:"rate,omitempty"`
+	DryRun      bool     `json:"dry_run,omitempty"`
+}
+
+// BackfillStatus is the progress of a backfill
+type BackfillStatus struct {
+	ID         string          `json:"id,omitempty"`
+	Request    BackfillRequest `json:"request"`
+	Started    string          `json:"started,omitempty"`
+	Finished   string          `json:"finished,omitempty"`
+	Files      int             `json:"files"`
+	Entries    int             `json:"entries"`
+	Matched    int             `json:"matched"`
+	Duplicates int             `json:"duplicates"`
+	Sent       int             `json:"sent"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Entries sent per second unless otherwise requested, and the range of rates that may be requested
+const backfillRateDefault = 10
+const backfillRateMin = 0.01
+const backfillRateMax = 1000
+
+// Number of finished backfills that we remember
+const backfillHistory = 20
+
+// Statics
+var backfillLock sync.Mutex
+var backfillJobs []*BackfillStatus
+var backfillCount int
+
+// backfillRange gets the range of times requested, which is unbounded where unspecified
+func backfillRange(req BackfillRequest) (from time.Time, to time.Time, err error) {
+	if req.From != "" {
+		from, err = ParseDateOrTime(req.From, false)
+		if err != nil {
+			return
+		}
+	}
+	to = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	if req.To != "" {
+		to, err = ParseDateOrTime(req.To, true)
+		if err != nil {
+			return
+		}
+	}
+	if to.Before(from) {
+		err = fmt.Errorf("'to' is before 'from'")
+	}
+	return
+}
+
+// backfillValidate makes sure that a request can be carried out
+func backfillValidate(req BackfillRequest) error {
+	_, _, err := backfillRange(req)
+	if err != nil {
+		return err
+	}
+	if req.Device == "" && req.From == "" && req.To == "" {
+		return fmt.Errorf("a device or a range of dates is required")
+	}
+	if math.IsNaN(req.Rate) || req.Rate < 0 || (req.Rate != 0 && req.Rate < backfillRateMin) || req.Rate > backfillRateMax {
+		return fmt.Errorf("rate must be from %g to %g entries per second", float64(backfillRateMin), float64(backfillRateMax))
+	}
+	for _, name := range req.Sinks {
+		found := false
+		for _, entry := range sinksEnabled() {
+			if entry.sink.Name() == name {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no enabled sink named '%s'", name)
+		}
+	}
+	return nil
+}
+
+// backfillLogs lists the logs that may hold what was requested, oldest first
+func backfillLogs(req BackfillRequest, from time.Time, to time.Time) (logs []string, err error) {
+
+	// A device UID is only ever in its own logs, but a device ID may be in any
+	_, err2 := strconv.ParseUint(req.Device, 10, 32)
+	if req.Device != "" && err2 != nil {
+		return DeviceLogMonths(req.Device, from, to)
+	}
+
+	entries, err := store.List(TTDeviceLogPath)
+	if err != nil {
+		return
+	}
+
+	fromMonth := from.UTC().Format("2006-01")
+	toMonth := to.UTC().Format("2006-01")
+	for _, entry := range entries {
+		month, _, found := strings.Cut(entry.Key, DeviceLogSep())
+		if !found {
+			continue
+		}
+		if month < fromMonth || month > toMonth {
+			continue
+		}
+		logs = append(logs, entry.Key)
+	}
+	sort.Strings(logs)
+
+	return
+
+}
+
+// backfillEntryTime gets the time at which an entry was captured or, failing that, uploaded
+func backfillEntryTime(sd ttdata.SafecastData) (t time.Time, ok bool) {
+	when := ""
+	if sd.CapturedAt != nil {
+		when = *sd.CapturedAt
+	} else if sd.Service != nil && sd.Service.UploadedAt != nil {
+		when = *sd.Service.UploadedAt
+	}
+	t, err := time.Parse(time.RFC3339, when)
+	return t, err == nil
+}
+
+// backfillRun carries out a backfill, updating its status as it goes
+func backfillRun(status *BackfillStatus) {
+
+	backfillLock.Lock()
+	req := status.Request
+	backfillLock.Unlock()
+
+	err := backfillDo(req, status)
+
+	backfillLock.Lock()
+	status.Finished = NowInUTC()
+	if err != nil {
+		status.Error = ErrorString(err)
+	}
+	summary := fmt.Sprintf("BACKFILL %s finished: %d files, %d entries, %d matched, %d duplicates, %d sent %s\n",
+		status.ID, status.Files, status.Entries, status.Matched, status.Duplicates, status.Sent, status.Error)
+	backfillLock.Unlock()
+
+	ServerLog(summary)
+
+}
+
+// backfillDo reads the logs, sending each matching entry that hasn't already been sent
+func backfillDo(req BackfillRequest, status *BackfillStatus) error {
+
+	from, to, err := backfillRange(req)
+	if err != nil {
+		return err
+	}
+	logs, err := backfillLogs(req, from, to)
+	if err != nil {
+		return err
+	}
+
+	var deviceID uint64
+	if req.Device != "" {
+		deviceID, _ = strconv.ParseUint(req.Device, 10, 32)
+	}
+
+	rate := req.Rate
+	if rate == 0 {
+		rate = backfillRateDefault
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+
+	sent := map[string]bool{}
+	var last time.Time
+	for _, log := range logs {
+
+		entries, err := DeviceLogRead(log)
+		if err != nil {
+			return err
+		}
+		backfillLock.Lock()
+		status.Files++
+		status.Entries += len(entries)
+		backfillLock.Unlock()
+
+		for _, sd := range entries {
+
+			if ShuttingDown() {
+				return fmt.Errorf("interrupted by shutdown")
+			}
+
+			// Only those of the device and in the range of dates requested
+			if deviceID != 0 && uint64(sd.DeviceID) != deviceID {
+				continue
+			}
+			captured, ok := backfillEntryTime(sd)
+			if !ok || captured.Before(from) || captured.After(to) {
+				continue
+			}
+
+			// Only once, no matter how many times it was logged
+			hash := HashSafecastData(sd)
+			duplicate := sent[hash]
+			sent[hash] = true
+			backfillLock.Lock()
+			status.Matched++
+			if duplicate {
+				status.Duplicates++
+			}
+			backfillLock.Unlock()
+			if duplicate || req.DryRun {
+				continue
+			}
+
+			if req.Recalculate {
+				tubeCalculate(&sd)
+				aqiCalculate(&sd)
+			}
+			if sd.Service == nil {
+				sd.Service = &ttdata.Service{}
+			}
+			sd.Service.Handler = &TTServeInstanceID
+
+			// Pace ourselves
+			wait := interval - time.Since(last)
+			if wait > 0 {
+				time.Sleep(wait)
+			}
+			last = time.Now()
+
+			if len(req.Sinks) == 0 {
+				Upload(sd)
+			} else {
+				for _, entry := range sinksEnabled() {
+					for _, name := range req.Sinks {
+						if entry.sink.Name() == name {
+							trackedGo(func() { sinkSend(entry, sd) })
+						}
+					}
+				}
+			}
+
+			backfillLock.Lock()
+			status.Sent++
+			backfillLock.Unlock()
+
+		}
+
+	}
+
+	return nil
+
+}
+
+// backfillStart begins a backfill in the background
+func backfillStart(req BackfillRequest) (status BackfillStatus, err error) {
+
+	err = backfillValidate(req)
+	if err != nil {
+		return
+	}
+
+	backfillLock.Lock()
+	backfillCount++
+	job := &BackfillStatus{}
+	job.ID = fmt.Sprintf("%s-%d", time.Now().UTC().Format("20060102-150405"), backfillCount)
+	job.Request = req
+	job.Started = NowInUTC()
+	backfillJobs = append(backfillJobs, job)
+
+	// Forget the oldest of those that have finished
+	for len(backfillJobs) > backfillHistory && backfillJobs[0].Finished != "" {
+		backfillJobs = backfillJobs[1:]
+	}
+	status = *job
+	backfillLock.Unlock()
+
+	ServerLog(fmt.Sprintf("BACKFILL %s started: device '%s' from '%s' to '%s'\n", job.ID, req.Device, req.From, req.To))
+	trackedGo(func() { backfillRun(job) })
+
+	return
+
+}
+
+// backfillStatuses gets the status of the backfills that we know about, most recent first
+func backfillStatuses() (statuses []BackfillStatus) {
+	backfillLock.Lock()
+	defer backfillLock.Unlock()
+	statuses = []BackfillStatus{}
+	for i := len(backfillJobs) - 1; i >= 0; i-- {
+		statuses = append(statuses, *backfillJobs[i])
+	}
+	return
+}
+
+// backfillCommand runs a backfill from the command line, as "backfill [flags] <folder>", and exits
+func backfillCommand(args []string) {
+
+	req := BackfillRequest{}
+	flag.StringVar(&req.Device, "device", "", "device UID or device ID to backfill (default all)")
+	flag.StringVar(&req.From, "from", "", "first date, as YYYY-MM-DD or RFC3339, to backfill (default earliest)")
+	flag.StringVar(&req.To, "to", "", "last date, as YYYY-MM-DD or RFC3339, to backfill (default latest)")
+	flag.BoolVar(&req.Recalculate, "recalculate", false, "recalculate dose rate and AQI before sending")
+	sinkNames := flag.String("sinks", "", "comma-separated names of the sinks to send to (default all)")
+	flag.Float64Var(&req.Rate, "rate", backfillRateDefault, "entries sent per second")
+	flag.BoolVar(&req.DryRun, "dry-run", false, "count what would be sent without sending it")
+	flagParse(args)
+	if *sinkNames != "" {
+		req.Sinks = strings.Split(*sinkNames, ",")
+	}
+
+	// Set up just enough to upload, attributing what we send to ourselves
+	ServiceReadConfig()
+	config := CurrentServiceConfig()
+	instanceConfigure(config)
+	TTServeInstanceID = config.InstanceID
+	if TTServeInstanceID == "" {
+		hostname, _ := os.Hostname()
+		TTServeInstanceID = hostname + "-backfill"
+	}
+	storeInit()
+	registryInit()
+	sinkInit()
+
+	err := backfillValidate(req)
+	if err != nil {
+		fmt.Printf("backfill: %s\n", err)
+		os.Exit(1)
+	}
+
+	status := &BackfillStatus{Request: req, Started: NowInUTC()}
+	err = backfillDo(req, status)
+	status.Finished = NowInUTC()
+	if err != nil {
+		status.Error = ErrorString(err)
+	}
+
+	// Wait for what we've sent to get where it's going
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	trackedWait(ctx)
+	store.Close()
+
+	statusJSON, _ := json.MarshalIndent(status, "", "    ")
+	fmt.Printf("%s\n", statusJSON)
+	if err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// backfillTestLogs fills the device logs with entries of device IDs, device UIDs, capture times, and voltages
+func backfillTestLogs(t *testing.T) {
+	t.Helper()
+	entries := []struct {
+		log        string
+		deviceUID  string
+		deviceID   uint32
+		capturedAt string
+		voltage    float64
+	}{
+		{"2024-05$safecast-7", "safecast:7", 7, "2024-05-03T01:02:03Z", 1},
+		{"2024-05$safecast-7", "safecast:7", 7, "2024-05-03T01:02:03Z", 1},
+		{"2024-05$safecast-7", "safecast:7", 7, "2024-05-20T01:02:03Z", 2},
+		{"2024-06$safecast-7", "safecast:7", 7, "2024-06-02T01:02:03Z", 3},
+		{"2024-05$pointcast-7", "pointcast:7", 7, "2024-05-10T01:02:03Z", 4},
+		{"2024-05$safecast-8", "safecast:8", 8, "2024-05-10T01:02:03Z", 5},
+	}
+	for _, e := range entries {
+		line := fmt.Sprintf(`{"device_urn":"%s","device":%d,"when_captured":"%s","bat_voltage":%g}`+"\n", e.deviceUID, e.deviceID, e.capturedAt, e.voltage)
+		err := store.Append(TTDeviceLogPath, e.log, []byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackfillRange(t *testing.T) {
+	unbounded := time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		from     string
+		to       string
+		wantFrom time.Time
+		wantTo   time.Time
+		err      bool
+	}{
+		{"", "", time.Time{}, unbounded, false},
+		{"2024-05-01", "2024-05-31", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 31, 23, 59, 59, 999999999, time.UTC), false},
+		{"2024-05-01", "2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 1, 23, 59, 59, 999999999, time.UTC), false},
+		{"2024-05-01T12:00:00Z", "2024-05-01T13:00:00+01:00", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), false},
+		{"2024-05-01", "", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), unbounded, false},
+		{"", "2024-05-01", time.Time{}, time.Date(2024, 5, 1, 23, 59, 59, 999999999, time.UTC), false},
+		{"2024-05-02", "2024-05-01", time.Time{}, time.Time{}, true},
+		{"2024-13-01", "", time.Time{}, time.Time{}, true},
+		{"May 1", "", time.Time{}, time.Time{}, true},
+		{"", "tomorrow", time.Time{}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		from, to, err := backfillRange(BackfillRequest{From: tt.from, To: tt.to})
+		if (err != nil) != tt.err {
+			t.Errorf("'%s' to '%s': error %v", tt.from, tt.to, err)
+			continue
+		}
+		if err == nil && (!from.Equal(tt.wantFrom) || !to.Equal(tt.wantTo)) {
+			t.Errorf("'%s' to '%s': got %s to %s, want %s to %s", tt.from, tt.to, from, to, tt.wantFrom, tt.wantTo)
+		}
+	}
+}
+
+func TestBackfillValidate(t *testing.T) {
+	noteBatchTestSetup(t, TTServeConfig{})
+	tests := []struct {
+		name string
+		req  BackfillRequest
+		err  bool
+	}{
+		{"device", BackfillRequest{Device: "7"}, false},
+		{"dates", BackfillRequest{From: "2024-05-01"}, false},
+		{"nothing", BackfillRequest{}, true},
+		{"bad range", BackfillRequest{From: "2024-05-02", To: "2024-05-01"}, true},
+		{"default rate", BackfillRequest{Device: "7", Rate: 0}, false},
+		{"slowest rate", BackfillRequest{Device: "7", Rate: backfillRateMin}, false},
+		{"fastest rate", BackfillRequest{Device: "7", Rate: backfillRateMax}, false},
+		{"too slow", BackfillRequest{Device: "7", Rate: backfillRateMin / 2}, true},
+		{"too fast", BackfillRequest{Device: "7", Rate: backfillRateMax + 1}, true},
+		{"negative rate", BackfillRequest{Device: "7", Rate: -1}, true},
+		{"NaN rate", BackfillRequest{Device: "7", Rate: math.NaN()}, true},
+		{"infinite rate", BackfillRequest{Device: "7", Rate: math.Inf(1)}, true},
+		{"negative infinite rate", BackfillRequest{Device: "7", Rate: math.Inf(-1)}, true},
+		{"enabled sink", BackfillRequest{Device: "7", Sinks: []string{"test"}}, false},
+		{"unknown sink", BackfillRequest{Device: "7", Sinks: []string{"test", "other"}}, true},
+	}
+	for _, tt := range tests {
+		err := backfillValidate(tt.req)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+		}
+	}
+}
+
+// A device UID selects only its own logs, but a device ID may be in the logs of any device
+func TestBackfillLogs(t *testing.T) {
+	noteBatchTestSetup(t, TTServeConfig{})
+	backfillTestLogs(t)
+	tests := []struct {
+		name   string
+		device string
+		from   string
+		to     string
+		want   []string
+	}{
+		{"device UID", "safecast:7", "", "", []string{"2024-05$safecast-7", "2024-06$safecast-7"}},
+		{"device UID, one month", "safecast:7", "2024-06-01", "2024-06-30", []string{"2024-06$safecast-7"}},
+		{"device UID without logs", "safecast:9", "", "", nil},
+		{"device ID", "7", "2024-05-01", "2024-05-31", []string{"2024-05$pointcast-7", "2024-05$safecast-7", "2024-05$safecast-8"}},
+		{"all devices", "", "2024-06-01", "", []string{"2024-06$safecast-7"}},
+	}
+	for _, tt := range tests {
+		req := BackfillRequest{Device: tt.device, From: tt.from, To: tt.to}
+		from, to, err := backfillRange(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs, err := backfillLogs(req, from, to)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if !reflect.DeepEqual(logs, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, logs, tt.want)
+		}
+	}
+}
+
+// Only the matching entries are sent, each only once no matter how many times it was logged
+func TestBackfillDo(t *testing.T) {
+	tests := []struct {
+		name       string
+		req        BackfillRequest
+		matched    int
+		duplicates int
+		sent       map[string][]float64
+	}{
+		{"device UID", BackfillRequest{Device: "safecast:7"}, 4, 1, map[string][]float64{"safecast:7": {1, 2, 3}}},
+		{"device ID", BackfillRequest{Device: "7", From: "2024-05-01", To: "2024-05-31"}, 4, 1, map[string][]float64{"safecast:7": {1, 2}, "pointcast:7": {4}}},
+		{"range", BackfillRequest{From: "2024-05-04", To: "2024-05-31"}, 3, 0, map[string][]float64{"safecast:7": {2}, "pointcast:7": {4}, "safecast:8": {5}}},
+		{"dry run", BackfillRequest{Device: "safecast:7", DryRun: true}, 4, 1, map[string][]float64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := noteBatchTestSetup(t, TTServeConfig{})
+			backfillTestLogs(t)
+			tt.req.Rate = backfillRateMax
+			status := &BackfillStatus{Request: tt.req}
+			err := backfillDo(tt.req, status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			trackedWait(ctx)
+
+			sent := 0
+			for _, voltages := range tt.sent {
+				sent += len(voltages)
+			}
+			if status.Matched != tt.matched || status.Duplicates != tt.duplicates || status.Sent != sent {
+				t.Errorf("matched %d, duplicates %d, sent %d, want %d, %d, %d", status.Matched, status.Duplicates, status.Sent, tt.matched, tt.duplicates, sent)
+			}
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			for _, voltages := range s.voltages {
+				sort.Float64s(voltages)
+			}
+			if !reflect.DeepEqual(s.voltages, tt.sent) {
+				t.Errorf("sent %v, want %v", s.voltages, tt.sent)
+			}
+		})
+	}
+}
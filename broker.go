@@ -19,15 +19,15 @@ var brokerMqttClient MQTT.Client
 func brokerOutboundPublisher() {
 
 	mqttOpts := MQTT.NewClientOptions()
-	mqttOpts.AddBroker(ServiceConfig.BrokerHost)
-	mqttOpts.SetUsername(ServiceConfig.BrokerUsername)
-	mqttOpts.SetPassword(ServiceConfig.BrokerPassword)
+	mqttOpts.AddBroker(CurrentServiceConfig().BrokerHost)
+	mqttOpts.SetUsername(CurrentServiceConfig().BrokerUsername)
+	mqttOpts.SetPassword(CurrentServiceConfig().BrokerPassword)
 
 	mqttOpts.SetAutoReconnect(true)
 	mqttOpts.SetCleanSession(true)
 
 	onMqConnectionLost := func(client MQTT.Client, err error) {
-		fmt.Printf("\n%s *** MQTT broker connection lost: %s: %v\n\n", LogTime(), ServiceConfig.BrokerHost, err)
+		fmt.Printf("\n%s *** MQTT broker connection lost: %s: %v\n\n", LogTime(), CurrentServiceConfig().BrokerHost, err)
 	}
 	mqttOpts.SetConnectionLostHandler(onMqConnectionLost)
 
@@ -44,17 +44,7 @@ func brokerOutboundPublisher() {
 }
 
 // Send to anyone/everyone listening on that MQTT topic
-func brokerPublish(sd ttdata.SafecastData) {
-
-	// Init
-	if !brokerConnected {
-		return
-	}
-
-	// We don't publish anything without a captured date, because it confuses too many systems
-	if sd.CapturedAt == nil || *sd.CapturedAt == "" {
-		return
-	}
+func brokerPublish(sd ttdata.SafecastData) (err error) {
 
 	// Delete the legacy device ID so that it doesn't confuse anyone.  It has been superceded
 	// by the device URN
@@ -65,6 +55,9 @@ func brokerPublish(sd ttdata.SafecastData) {
 	topic := fmt.Sprintf("device/%s", sd.DeviceUID)
 	if token := brokerMqttClient.Publish(topic, 0, false, scJSON); token.Wait() && token.Error() != nil {
 		fmt.Printf("broker: %s\n", token.Error())
+		err = fmt.Errorf("broker: %s", token.Error())
 	}
 
+	return
+
 }
@@ -23,4 +23,115 @@ type TTServeConfig struct {
 	// Notehub URL
 	NotehubURL   string `json:"notehub_url,omitempty"`
 	NotehubToken string `json:"notehub_token,omitempty"`
+
+	// Standalone operation, without AWS instance metadata or checkip, and the
+	// roles of this instance if they aren't to be discovered through DNS
+	Standalone    bool     `json:"standalone,omitempty"`
+	InstanceID    string   `json:"instance_id,omitempty"`
+	PublicIPv4    string   `json:"public_ip,omitempty"`
+	DataDirectory string   `json:"data_directory,omitempty"`
+	Roles         []string `json:"roles,omitempty"`
+
+	// Where the status of devices, gateways, and servers, device stamps, and device logs are
+	// kept, being "file" (the default), "bolt" for an embedded database, or "memory"
+	Store     string `json:"store,omitempty"`
+	StorePath string `json:"store_path,omitempty"`
+
+	// Addresses and ports, defaulting to those of the production service
+	HTTPAddress       string `json:"http_address,omitempty"`
+	UDPAddress        string `json:"udp_address,omitempty"`
+	HTTPPort          string `json:"http_port,omitempty"`
+	HTTPPortAlternate string `json:"http_port_alternate,omitempty"`
+	UDPPort           string `json:"udp_port,omitempty"`
+	TCPPort           string `json:"tcp_port,omitempty"`
+
+	// HTTPS, enabled by a port along with either certificate files (the key may be in
+	// the cert file) or an ACME provider whose certificates are cached in a directory
+	HTTPSPort     string   `json:"https_port,omitempty"`
+	TLSCertFile   string   `json:"tls_cert_file,omitempty"`
+	TLSKeyFile    string   `json:"tls_key_file,omitempty"`
+	ACMEDirectory string   `json:"acme_directory,omitempty"`
+	ACMEHosts     []string `json:"acme_hosts,omitempty"`
+	ACMEEmail     string   `json:"acme_email,omitempty"`
+	HTTPSRedirect bool     `json:"https_redirect,omitempty"`
+
+	// Safecast services, defaulting to those of the production service
+	IngestURLs           []string `json:"ingest_urls,omitempty"`
+	V1UploadDomain       string   `json:"v1_upload_domain,omitempty"`
+	V1UploadDomainDev    string   `json:"v1_upload_domain_dev,omitempty"`
+	V1SolarcastUploadURL string   `json:"v1_solarcast_upload_url,omitempty"`
+
+	// Authentication of Notehub routes posting to the note topics.  When secrets are
+	// configured, a request must carry one in the secret header or sign its body with
+	// one using HMAC-SHA256, and when products are configured, events must be from one.
+	NoteSecrets         []string `json:"note_secrets,omitempty"`
+	NoteSecretHeader    string   `json:"note_secret_header,omitempty"`
+	NoteSignatureHeader string   `json:"note_signature_header,omitempty"`
+	NoteProductUIDs     []string `json:"note_product_uids,omitempty"`
+
+	// Secrets, any of which must be presented in the admin secret header by those changing
+	// the device registry or requesting other administrative operations, if configured
+	AdminSecrets []string `json:"admin_secrets,omitempty"`
+
+	// The tracker sheet, consulted for devices that aren't in the device registry
+	// and from which the registry may be imported, defaulting to the Solarcast Tracker
+	DeviceSheetURL      string `json:"device_sheet_url,omitempty"`
+	DeviceSheetDisabled bool   `json:"device_sheet_disabled,omitempty"`
+
+	// Protection against abusive senders.  Addresses in the allow list are never limited and
+	// those in the deny list are always refused.  Otherwise, each address and device may send
+	// at a sustained rate per minute with bursts, and an address sending the threshold number
+	// of malformed payloads within a minute is banned.  Limits of 0 take the defaults, and a
+	// negative rate or threshold disables that protection.
+	AllowCIDRs               []string `json:"allow_cidrs,omitempty"`
+	DenyCIDRs                []string `json:"deny_cidrs,omitempty"`
+	RateLimitIPPerMinute     float64  `json:"rate_limit_ip_per_minute,omitempty"`
+	RateLimitIPBurst         int      `json:"rate_limit_ip_burst,omitempty"`
+	RateLimitDevicePerMinute float64  `json:"rate_limit_device_per_minute,omitempty"`
+	RateLimitDeviceBurst     int      `json:"rate_limit_device_burst,omitempty"`
+	MalformedBanThreshold    int      `json:"malformed_ban_threshold,omitempty"`
+	MalformedBanMinutes      int      `json:"malformed_ban_minutes,omitempty"`
+
+	// Proxies, such as load balancers, whose forwarding headers are trusted to say who sent a
+	// request, defaulting to those at private or loopback addresses, and secrets with which our
+	// own instances sign the UDP payloads that they relay through the web load balancer, which
+	// when configured are never limited by address and are the only relayed payloads accepted
+	TrustedProxyCIDRs []string `json:"trusted_proxy_cidrs,omitempty"`
+	RelaySecrets      []string `json:"relay_secrets,omitempty"`
+
+	// Destinations to which measurements are uploaded, overriding or adding to the defaults
+	Sinks []SinkConfig `json:"sinks,omitempty"`
+
+	// Calibration of Geiger tube models, overriding or adding to the defaults, and the tubes
+	// fitted to particular devices, which take precedence over the defaults
+	TubeModels  []TubeModelConfig  `json:"tube_models,omitempty"`
+	TubeDevices []TubeDeviceConfig `json:"tube_devices,omitempty"`
+}
+
+// TubeModelConfig is the calibration of a model of Geiger tube, such as "U7318"
+type TubeModelConfig struct {
+	Name      string  `json:"name,omitempty"`
+	Field     string  `json:"field,omitempty"`
+	CPMPerUSv float64 `json:"cpm_per_usv,omitempty"`
+}
+
+// TubeDeviceConfig is the tube fitted to a device, or class of devices, optionally with its own calibration
+type TubeDeviceConfig struct {
+	DeviceID    uint32  `json:"device,omitempty"`
+	DeviceClass string  `json:"device_class,omitempty"`
+	V1Suffix    string  `json:"v1_suffix,omitempty"`
+	Tube        string  `json:"tube,omitempty"`
+	CPMPerUSv   float64 `json:"cpm_per_usv,omitempty"`
+}
+
+// SinkConfig is the configuration of a single upload destination
+type SinkConfig struct {
+	Name        string            `json:"name,omitempty"`
+	Type        string            `json:"type,omitempty"`
+	URL         string            `json:"url,omitempty"`
+	Token       string            `json:"token,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	TimeoutSecs int               `json:"timeout_secs,omitempty"`
+	Class       string            `json:"class,omitempty"`
+	Disabled    bool              `json:"disabled,omitempty"`
 }
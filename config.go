@@ -6,9 +6,15 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,7 +32,7 @@ const ttnTopic string = "+/devices/+/up"
 // Google Sheets ID of published (File/Publish to Web) doc, as CSV
 const sheetsSolarcastTracker = "https://docs.google.com/spreadsheets/d/1lvB_0XFFSwON4PQFoC8NdDv6INJTCw2f_KBZuMTZhZA/export?format=csv"
 
-// Safecast service info
+// Safecast service info, used unless overridden by config or environment
 
 // SafecastV1UploadDomainDev is developer API server
 const SafecastV1UploadDomainDev = "dev.safecast.cc"
@@ -40,10 +46,8 @@ const SafecastV1UploadPattern = "https://%s/measurements.json?%s"
 // SafecastV1SolarcastUploadURL is the url where to upload solarcast data
 const SafecastV1SolarcastUploadURL = "https://api.safecast.cc/measurements.json?api_key=z3sHhgousVDDrCVXhzMT"
 
-// SafecastUploadURLs are the places we should upload V2 measurements
-var SafecastUploadURLs = [...]string{
-	"http://ingest.safecast.cc/v1/measurements",
-}
+// SafecastUploadURL is the place we should upload V2 measurements
+const SafecastUploadURL = "http://ingest.safecast.cc/v1/measurements"
 
 // Slack service info
 
@@ -68,8 +72,13 @@ const SlackMsgUnsolicitedOps = 1
 // SlackMsgReply means to reply to the SlackCommandSource
 const SlackMsgReply = 2
 
-// ServiceConfig is our configuration, read out of a file for security reasons
-var ServiceConfig TTServeConfig
+// Our configuration, read out of a file for security reasons, and replaced
+// in its entirety whenever the file changes
+var serviceConfig atomic.Pointer[TTServeConfig]
+var serviceConfigModTime time.Time
+
+// Held while checking for a changed config, so that concurrent checks don't both reload it
+var serviceConfigCheckLock sync.Mutex
 
 // Paths for the file system shared among all TTSERVE instances
 
@@ -85,12 +94,30 @@ const TTFilePath = "/files"
 // TTDeviceStampPath (here for golint)
 const TTDeviceStampPath = "/device-stamp"
 
+// TTDeviceSignedPath (here for golint)
+const TTDeviceSignedPath = "/device-signed"
+
 // TTDeviceStatusPath (here for golint)
 const TTDeviceStatusPath = "/device-status"
 
 // TTQueryPath (here for golint)
 const TTQueryPath = "/query"
 
+// TTDeviceRegistryPath (here for golint)
+const TTDeviceRegistryPath = "/device-registry.json"
+
+// TTDeviceSheetCachePath (here for golint)
+const TTDeviceSheetCachePath = "/device-sheet.json"
+
+// TTQuarantinePath (here for golint)
+const TTQuarantinePath = "/quarantine"
+
+// TTUploadQueuePath (here for golint)
+const TTUploadQueuePath = "/upload-queue"
+
+// TTServerACMEPath (here for golint)
+const TTServerACMEPath = "/acme"
+
 // TTServerLogPath (here for golint)
 const TTServerLogPath = "/server-log"
 
@@ -115,7 +142,7 @@ const TTServerRestartAllControlFile = "restart_all.txt"
 // TTServeInstanceID is the AWS instance ID for the current instance
 var TTServeInstanceID = ""
 
-// TTSERVE's address and ports
+// TTSERVE's address and ports, used unless overridden by config or environment
 
 // TTServerHTTPAddress (here for golint)
 const TTServerHTTPAddress = "tt.safecast.cc"
@@ -207,6 +234,18 @@ const TTServerTopicNote string = "/note"
 // TTServerTopicNoteTest (here for golint)
 const TTServerTopicNoteTest string = "/notetest"
 
+// TTServerTopicMetrics (here for golint)
+const TTServerTopicMetrics string = "/metrics"
+
+// TTServerTopicQuarantine (here for golint)
+const TTServerTopicQuarantine string = "/quarantine"
+
+// TTServerTopicBackfill (here for golint)
+const TTServerTopicBackfill string = "/backfill"
+
+// TTServerTopicRegistry (here for golint)
+const TTServerTopicRegistry string = "/registry"
+
 // ThisServerAddressIPv4 is looked up dynamically
 var ThisServerAddressIPv4 = ""
 
@@ -233,54 +272,361 @@ var AllServersGithubRestartRequestTime time.Time
 // BuffFormatPBArray is the payload buffer format
 const BuffFormatPBArray byte = 0
 
+// BuffFormatPBArraySigned is the payload buffer format in which each entry is followed by its signature
+const BuffFormatPBArraySigned byte = 1
+
 // Log-related
 const logDateFormat string = "2006-01-02 15:04:05"
 
 // TTServeCounts is our global statistics structure
 type TTServeCounts struct {
-	Restarts     uint32 `json:"restarts,omitempty"`
-	UDP          uint32 `json:"received_device_udp,omitempty"`
-	TCP          uint32 `json:"received_device_tcp,omitempty"`
-	HTTP         uint32 `json:"received_all_http,omitempty"`
-	HTTPSlack    uint32 `json:"received_slack_http,omitempty"`
-	HTTPGithub   uint32 `json:"received_github_http,omitempty"`
-	HTTPGUpdate  uint32 `json:"received_gateway_update_http,omitempty"`
-	HTTPDevice   uint32 `json:"received_device_msg_http,omitempty"`
-	HTTPGateway  uint32 `json:"received_gateway_msg_http,omitempty"`
-	HTTPRelay    uint32 `json:"received_udp_to_http,omitempty"`
-	HTTPRedirect uint32 `json:"received_redirect_http,omitempty"`
-	HTTPTTN      uint32 `json:"received_ttn_http,omitempty"`
-	MQTTTTN      uint32 `json:"received_ttn_mqtt,omitempty"`
+	Restarts         uint32 `json:"restarts,omitempty"`
+	UDP              uint32 `json:"received_device_udp,omitempty"`
+	TCP              uint32 `json:"received_device_tcp,omitempty"`
+	HTTP             uint32 `json:"received_all_http,omitempty"`
+	HTTPSlack        uint32 `json:"received_slack_http,omitempty"`
+	HTTPGithub       uint32 `json:"received_github_http,omitempty"`
+	HTTPGUpdate      uint32 `json:"received_gateway_update_http,omitempty"`
+	HTTPDevice       uint32 `json:"received_device_msg_http,omitempty"`
+	HTTPGateway      uint32 `json:"received_gateway_msg_http,omitempty"`
+	HTTPRelay        uint32 `json:"received_udp_to_http,omitempty"`
+	HTTPRedirect     uint32 `json:"received_redirect_http,omitempty"`
+	HTTPTTN          uint32 `json:"received_ttn_http,omitempty"`
+	MQTTTTN          uint32 `json:"received_ttn_mqtt,omitempty"`
+	HTTPNote         uint32 `json:"received_note_http,omitempty"`
+	HTTPNoteRejected uint32 `json:"rejected_note_http,omitempty"`
+	DeviceUnsigned   uint32 `json:"rejected_device_unsigned,omitempty"`
+	DeviceBadSigned  uint32 `json:"rejected_device_signature,omitempty"`
+	DeviceReplayed   uint32 `json:"rejected_device_replayed,omitempty"`
+	Refused          uint32 `json:"rejected_refused,omitempty"`
+	RateLimited      uint32 `json:"rejected_rate_limited,omitempty"`
+	Malformed        uint32 `json:"received_malformed,omitempty"`
+	Bans             uint32 `json:"bans,omitempty"`
 }
 
 // TTServeStatus is our global status
 type TTServeStatus struct {
-	Started     time.Time           `json:"started,omitempty"`
-	AddressIPv4 string              `json:"publicIp,omitempty"`
-	Services    string              `json:"services,omitempty"`
-	AWSInstance AWSInstanceIdentity `json:"aws,omitempty"`
-	Count       TTServeCounts       `json:"counts,omitempty"`
+	Started     time.Time                     `json:"started,omitempty"`
+	AddressIPv4 string                        `json:"publicIp,omitempty"`
+	Services    string                        `json:"services,omitempty"`
+	AWSInstance AWSInstanceIdentity           `json:"aws,omitempty"`
+	Count       TTServeCounts                 `json:"counts,omitempty"`
+	UploadQueue map[string]uint32             `json:"upload_queue,omitempty"`
+	Sinks       map[string]SinkStatus         `json:"sinks,omitempty"`
+	Uploads     map[string]TransactionMetrics `json:"uploads,omitempty"`
+	Banned      map[string]string             `json:"banned,omitempty"`
 }
 
 var stats TTServeStatus
 
-// ServiceReadConfig gets the current value of the service config
-func ServiceReadConfig() TTServeConfig {
+// ServiceReadConfig reads the service config at startup, exiting if it is unusable
+func ServiceReadConfig() {
 
-	// Read the file and unmarshall if no error
-	contents, err := os.ReadFile(SafecastDirectory() + TTConfigPath)
+	config, modTime, err := serviceLoadConfig()
 	if err != nil {
-		fmt.Printf("Can't start service: %s %v\n", TTConfigPath, err)
+		fmt.Printf("Can't start service: %s\n", err)
 		os.Exit(0)
 	}
 
-	value := TTServeConfig{}
-	err = json.Unmarshal(contents, &value)
+	serviceConfig.Store(&config)
+	serviceConfigModTime = modTime
+
+}
+
+// CurrentServiceConfig gets the current value of the service config
+func CurrentServiceConfig() TTServeConfig {
+	return *serviceConfig.Load()
+}
+
+// ServiceConfigCheck re-reads the service config if it has changed.  If the new config
+// is unusable we complain about it and keep using the one that we've got.
+func ServiceConfigCheck() {
+
+	serviceConfigCheckLock.Lock()
+	defer serviceConfigCheckLock.Unlock()
+
+	file, err := os.Stat(SafecastConfigDirectory() + TTConfigPath)
+	if err != nil || file.ModTime().Equal(serviceConfigModTime) {
+		return
+	}
+
+	config, modTime, err := serviceLoadConfig()
+	serviceConfigModTime = modTime
 	if err != nil {
-		fmt.Printf("Can't parse JSON: %s %v\n", TTConfigPath, err)
-		os.Exit(0)
+		ServerLog(fmt.Sprintf("*** CONFIG not reloaded: %s\n", err))
+		sendToSafecastOps(fmt.Sprintf("** %s is ignoring the changed service config: %s **", TTServeInstanceID, err), SlackMsgUnsolicitedOps)
+		return
+	}
+
+	// Those things that are only used at startup can't be changed by reloading
+	previous := CurrentServiceConfig()
+	restartNeeded := []string{}
+	if config.HTTPPort != previous.HTTPPort || config.HTTPPortAlternate != previous.HTTPPortAlternate ||
+		config.UDPPort != previous.UDPPort || config.TCPPort != previous.TCPPort ||
+		config.HTTPSPort != previous.HTTPSPort {
+		restartNeeded = append(restartNeeded, "ports")
+	}
+	if config.Standalone != previous.Standalone || config.InstanceID != previous.InstanceID ||
+		config.PublicIPv4 != previous.PublicIPv4 || config.DataDirectory != previous.DataDirectory ||
+		strings.Join(config.Roles, ",") != strings.Join(previous.Roles, ",") || config.UDPAddress != previous.UDPAddress {
+		restartNeeded = append(restartNeeded, "instance identity or roles")
+	}
+	if config.Store != previous.Store || config.StorePath != previous.StorePath {
+		restartNeeded = append(restartNeeded, "store")
+	}
+	if config.BrokerHost != previous.BrokerHost || config.BrokerUsername != previous.BrokerUsername ||
+		config.BrokerPassword != previous.BrokerPassword || config.TtnAppAccessKey != previous.TtnAppAccessKey {
+		restartNeeded = append(restartNeeded, "MQTT credentials")
+	}
+	if config.ACMEDirectory != previous.ACMEDirectory || config.ACMEEmail != previous.ACMEEmail ||
+		strings.Join(config.ACMEHosts, ",") != strings.Join(previous.ACMEHosts, ",") ||
+		(config.TLSCertFile == "") != (previous.TLSCertFile == "") {
+		restartNeeded = append(restartNeeded, "HTTPS certificate source")
+	}
+
+	serviceConfig.Store(&config)
+	ServerLog("*** CONFIG reloaded\n")
+	if len(restartNeeded) != 0 {
+		ServerLog(fmt.Sprintf("*** CONFIG changes to %s will take effect upon restart\n", strings.Join(restartNeeded, ", ")))
+	}
+
+	// Rebuild what was derived from the config
+	sinkInit()
+
+}
+
+// serviceLoadConfig reads, completes, and validates the service config, returning the file's modified time
+func serviceLoadConfig() (config TTServeConfig, modTime time.Time, err error) {
+
+	filename := SafecastConfigDirectory() + TTConfigPath
+
+	// Read the file and unmarshall if no error
+	file, err := os.Stat(filename)
+	if err != nil {
+		return config, modTime, fmt.Errorf("%s: %s", TTConfigPath, ErrorString(err))
+	}
+	modTime = file.ModTime()
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return config, modTime, fmt.Errorf("%s: %s", TTConfigPath, ErrorString(err))
+	}
+	err = json.Unmarshal(contents, &config)
+	if err != nil {
+		return config, modTime, fmt.Errorf("can't parse JSON: %s: %s", TTConfigPath, err)
+	}
+
+	// Allow this particular instance to override what's in the shared file
+	ServiceConfigEnvironment(&config)
+	instanceFlags(&config)
+	ServiceConfigDefaults(&config)
+
+	err = serviceValidateConfig(config)
+	if err != nil {
+		return config, modTime, fmt.Errorf("%s: %s", TTConfigPath, err)
+	}
+
+	return
+
+}
+
+// serviceValidateConfig checks that a config is usable
+func serviceValidateConfig(config TTServeConfig) error {
+
+	if config.SlackOutboundUrls != "" {
+		for _, slackURL := range strings.Split(config.SlackOutboundUrls, ",") {
+			u, err := url.Parse(slackURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid slack outbound url '%s'", slackURL)
+			}
+		}
+	}
+
+	if config.NotehubURL != "" {
+		u, err := url.Parse(config.NotehubURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid notehub url '%s'", config.NotehubURL)
+		}
+	}
+
+	for _, ingestURL := range config.IngestURLs {
+		u, err := url.Parse(ingestURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid ingest url '%s'", ingestURL)
+		}
+	}
+
+	if config.TLSCertFile != "" && config.HTTPSPort != "" {
+		keyFile := config.TLSKeyFile
+		if keyFile == "" {
+			keyFile = config.TLSCertFile
+		}
+		_, err := tls.LoadX509KeyPair(config.TLSCertFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("tls certificate: %s", ErrorString(err))
+		}
+	}
+
+	err := tubeValidateConfig(config)
+	if err != nil {
+		return err
+	}
+
+	err = abuseValidateConfig(config)
+	if err != nil {
+		return err
+	}
+
+	err = storeValidateConfig(config)
+	if err != nil {
+		return err
+	}
+
+	for _, sc := range sinkConfigs(config) {
+		if sc.Disabled {
+			continue
+		}
+		_, err := sinkNew(sc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Environment variables that override the service config of this instance
+const envStandalone = "TTSERVE_STANDALONE"
+const envInstanceID = "TTSERVE_INSTANCE_ID"
+const envPublicIPv4 = "TTSERVE_PUBLIC_IP"
+const envDataDirectory = "TTSERVE_DATA_DIRECTORY"
+const envRoles = "TTSERVE_ROLES"
+const envStore = "TTSERVE_STORE"
+const envStorePath = "TTSERVE_STORE_PATH"
+const envHTTPAddress = "TTSERVE_HTTP_ADDRESS"
+const envUDPAddress = "TTSERVE_UDP_ADDRESS"
+const envHTTPPort = "TTSERVE_HTTP_PORT"
+const envHTTPPortAlternate = "TTSERVE_HTTP_PORT_ALTERNATE"
+const envUDPPort = "TTSERVE_UDP_PORT"
+const envTCPPort = "TTSERVE_TCP_PORT"
+const envHTTPSPort = "TTSERVE_HTTPS_PORT"
+const envTLSCertFile = "TTSERVE_TLS_CERT_FILE"
+const envTLSKeyFile = "TTSERVE_TLS_KEY_FILE"
+const envACMEDirectory = "TTSERVE_ACME_DIRECTORY"
+const envIngestURLs = "TTSERVE_INGEST_URLS"
+const envV1UploadDomain = "TTSERVE_V1_UPLOAD_DOMAIN"
+const envV1UploadDomainDev = "TTSERVE_V1_UPLOAD_DOMAIN_DEV"
+const envV1SolarcastUploadURL = "TTSERVE_V1_SOLARCAST_UPLOAD_URL"
+
+// ServiceConfigEnvironment overrides the service config with whatever is set in the environment
+func ServiceConfigEnvironment(config *TTServeConfig) {
+
+	fields := map[string]*string{
+		envInstanceID:           &config.InstanceID,
+		envPublicIPv4:           &config.PublicIPv4,
+		envDataDirectory:        &config.DataDirectory,
+		envStore:                &config.Store,
+		envStorePath:            &config.StorePath,
+		envHTTPAddress:          &config.HTTPAddress,
+		envUDPAddress:           &config.UDPAddress,
+		envHTTPPort:             &config.HTTPPort,
+		envHTTPPortAlternate:    &config.HTTPPortAlternate,
+		envUDPPort:              &config.UDPPort,
+		envTCPPort:              &config.TCPPort,
+		envHTTPSPort:            &config.HTTPSPort,
+		envTLSCertFile:          &config.TLSCertFile,
+		envTLSKeyFile:           &config.TLSKeyFile,
+		envACMEDirectory:        &config.ACMEDirectory,
+		envV1UploadDomain:       &config.V1UploadDomain,
+		envV1UploadDomainDev:    &config.V1UploadDomainDev,
+		envV1SolarcastUploadURL: &config.V1SolarcastUploadURL,
+	}
+	for name, field := range fields {
+		value, present := os.LookupEnv(name)
+		if present {
+			*field = value
+		}
 	}
 
-	return value
+	lists := map[string]*[]string{
+		envRoles:      &config.Roles,
+		envIngestURLs: &config.IngestURLs,
+	}
+	for name, field := range lists {
+		value, present := os.LookupEnv(name)
+		if present {
+			*field = configList(value)
+		}
+	}
+
+	value, present := os.LookupEnv(envStandalone)
+	if present {
+		config.Standalone, _ = strconv.ParseBool(value)
+	}
+
+}
+
+// ServiceConfigDefaults fills in whatever wasn't configured with the values of the production service
+func ServiceConfigDefaults(config *TTServeConfig) {
+
+	if config.HTTPAddress == "" {
+		config.HTTPAddress = TTServerHTTPAddress
+	}
+	if config.UDPAddress == "" {
+		config.UDPAddress = TTServerUDPAddress
+	}
+	config.HTTPPort = configPort(config.HTTPPort, TTServerHTTPPort)
+	config.HTTPPortAlternate = configPort(config.HTTPPortAlternate, TTServerHTTPPortAlternate)
+	config.UDPPort = configPort(config.UDPPort, TTServerUDPPort)
+	config.TCPPort = configPort(config.TCPPort, TTServerTCPPort)
+	config.HTTPSPort = configPort(config.HTTPSPort, "")
+
+	if len(config.IngestURLs) == 0 {
+		config.IngestURLs = []string{SafecastUploadURL}
+	}
+	if config.V1UploadDomain == "" {
+		config.V1UploadDomain = SafecastV1UploadDomain
+	}
+	if config.V1UploadDomainDev == "" {
+		config.V1UploadDomainDev = SafecastV1UploadDomainDev
+	}
+	if config.V1SolarcastUploadURL == "" {
+		config.V1SolarcastUploadURL = SafecastV1SolarcastUploadURL
+	}
 
+	if config.NoteSecretHeader == "" {
+		config.NoteSecretHeader = noteSecretHeaderDefault
+	}
+	if config.NoteSignatureHeader == "" {
+		config.NoteSignatureHeader = noteSignatureHeaderDefault
+	}
+	if config.DeviceSheetURL == "" {
+		config.DeviceSheetURL = sheetsSolarcastTracker
+	}
+	if config.DenyCIDRs == nil {
+		config.DenyCIDRs = abuseDenyDefault
+	}
+
+}
+
+// Split a comma-separated list, dropping empty entries
+func configList(value string) (list []string) {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
+
+// Convert a port to the ":port" or "host:port" form used when listening
+func configPort(port string, defaultPort string) string {
+	if port == "" {
+		return defaultPort
+	}
+	if !strings.Contains(port, ":") {
+		return ":" + port
+	}
+	return port
 }
@@ -8,6 +8,7 @@ package main
 import (
 	"fmt"
 	"sort"
+	"sync"
 	"time"
 )
 
@@ -23,6 +24,7 @@ type seenDevice struct {
 }
 
 var seenDevices []seenDevice
+var seenDevicesLock sync.Mutex
 
 // Class used to sort seen devices
 type byDeviceKey []seenDevice
@@ -53,6 +55,9 @@ func trackDevice(DeviceUID string, DeviceID uint32, whenSeen time.Time) {
 	dev.deviceUID = DeviceUID
 	dev.deviceID = DeviceID
 
+	seenDevicesLock.Lock()
+	defer seenDevicesLock.Unlock()
+
 	// Attempt to update the existing entry if we can find it
 	found := false
 	for i := 0; i < len(seenDevices); i++ {
@@ -90,6 +95,13 @@ func trackDevice(DeviceUID string, DeviceID uint32, whenSeen time.Time) {
 
 }
 
+// seenDeviceCount gets the number of devices seen since restart
+func seenDeviceCount() int {
+	seenDevicesLock.Lock()
+	defer seenDevicesLock.Unlock()
+	return len(seenDevices)
+}
+
 // Update message ages and notify
 func sendExpiredSafecastDevicesToSlack() {
 
@@ -176,9 +188,9 @@ func sendSafecastDeviceSummaryToSlack(user string, header string, fOffline bool)
 		// Refresh cached label
 		sortedDevices[i].label = label
 
-		s += fmt.Sprintf("<http://%s%s%s|%s> ", TTServerHTTPAddress, TTServerTopicDeviceStatus, id, id)
-		s += fmt.Sprintf("<http://%s%s%s|chk> ", TTServerHTTPAddress, TTServerTopicDeviceCheck, id)
-		s += fmt.Sprintf("<http://%s%s%s%s.json|log> ", TTServerHTTPAddress, TTServerTopicDeviceLog, time.Now().UTC().Format("2006-01"+DeviceLogSep()), DeviceUIDFilename(id))
+		s += fmt.Sprintf("<http://%s%s%s|%s> ", CurrentServiceConfig().HTTPAddress, TTServerTopicDeviceStatus, id, id)
+		s += fmt.Sprintf("<http://%s%s%s|chk> ", CurrentServiceConfig().HTTPAddress, TTServerTopicDeviceCheck, id)
+		s += fmt.Sprintf("<http://%s%s%s%s.json|log> ", CurrentServiceConfig().HTTPAddress, TTServerTopicDeviceLog, time.Now().UTC().Format("2006-01"+DeviceLogSep()), DeviceUIDFilename(id))
 		if gps != "" {
 			s += gps + " "
 		} else {
@@ -0,0 +1,130 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Conversion of device logs written in the legacy format, with entries separated by
+// commas on lines of their own, to newline-delimited JSON.  Each log is replaced in place,
+// keeping every entry exactly as it was logged, such that anything appended while it is
+// being converted is kept.  Logs that are already newline-delimited JSON are left alone.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Returned by an update that leaves the log alone
+var errDeviceLogUnchanged = errors.New("unchanged")
+
+// deviceLogConvert converts the contents of a log to newline-delimited JSON, returning the
+// number of entries and the number of fragments that couldn't be read and were dropped
+func deviceLogConvert(contents []byte) (converted []byte, entries int, skipped int) {
+	var buf bytes.Buffer
+	reader := NewDeviceLogReader(bytes.NewReader(contents))
+	for {
+		raw, ok := reader.NextRaw()
+		if !ok {
+			break
+		}
+		err := json.Compact(&buf, raw)
+		if err != nil {
+			skipped++
+			continue
+		}
+		buf.WriteByte('\n')
+		entries++
+	}
+	return buf.Bytes(), entries, skipped + reader.Skipped
+}
+
+// What was done by a conversion of the device logs
+type deviceLogConvertSummary struct {
+	converted int
+	unchanged int
+	entries   int
+	skipped   int
+	failed    int
+}
+
+// deviceLogConvertLogs converts the device logs of the month, as YYYY-MM, or of every month if
+// not specified, only counting what would be converted if this is a dry run
+func deviceLogConvertLogs(month string, dryRun bool) (summary deviceLogConvertSummary, err error) {
+
+	logs, err := store.List(TTDeviceLogPath)
+	if err != nil {
+		return
+	}
+
+	for _, log := range logs {
+		if month != "" && !strings.HasPrefix(log.Key, month+DeviceLogSep()) {
+			continue
+		}
+
+		// Convert it under the store's lock, leaving it alone if there's nothing to do
+		changed := false
+		logEntries, logSkipped := 0, 0
+		err := store.Update(TTDeviceLogPath, log.Key, func(contents []byte) ([]byte, error) {
+			var result []byte
+			result, logEntries, logSkipped = deviceLogConvert(contents)
+			changed = !bytes.Equal(result, contents)
+			if !changed || dryRun {
+				return nil, errDeviceLogUnchanged
+			}
+			return result, nil
+		})
+		if err != nil && err != errDeviceLogUnchanged {
+			fmt.Printf("convert-logs: %s: %s\n", log.Key, err)
+			summary.failed++
+			continue
+		}
+
+		summary.entries += logEntries
+		summary.skipped += logSkipped
+		if !changed {
+			summary.unchanged++
+			continue
+		}
+		summary.converted++
+		fmt.Printf("%s: %d entries, %d skipped\n", log.Key, logEntries, logSkipped)
+	}
+
+	return
+
+}
+
+// deviceLogConvertCommand converts the device logs from the command line, as
+// "convert-logs [flags] <folder>", and exits
+func deviceLogConvertCommand(args []string) {
+
+	month := flag.String("month", "", "only convert the logs of this month, as YYYY-MM (default all)")
+	dryRun := flag.Bool("dry-run", false, "count what would be converted without converting it")
+	flagParse(args)
+
+	ServiceReadConfig()
+	instanceConfigure(CurrentServiceConfig())
+	storeInit()
+
+	summary, err := deviceLogConvertLogs(*month, *dryRun)
+	if err != nil {
+		fmt.Printf("convert-logs: %s\n", err)
+		os.Exit(1)
+	}
+
+	verb := "converted"
+	if *dryRun {
+		verb = "would convert"
+	}
+	fmt.Printf("convert-logs: %s %d logs, %d already converted, %d entries, %d skipped\n", verb, summary.converted, summary.unchanged, summary.entries, summary.skipped)
+
+	store.Close()
+	if summary.failed != 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestDeviceLogConvert(t *testing.T) {
+	tests := []struct {
+		name    string
+		log     string
+		want    string
+		entries int
+		skipped int
+	}{
+		{"empty", "", "", 0, 0},
+		{"legacy", "{\"a\":1}\n,\n{\"a\":2}\n,\n{\"a\":3}", "{\"a\":1}\n{\"a\":2}\n{\"a\":3}\n", 3, 0},
+		{"legacy, commas beginning lines", "{\"a\":1}\n,{\"a\":2}\n", "{\"a\":1}\n{\"a\":2}\n", 2, 0},
+		{"already converted", "{\"a\":1}\n{\"a\":2}\n", "{\"a\":1}\n{\"a\":2}\n", 2, 0},
+		{"whitespace within entries", "{ \"a\" : 1 }\r\n,\n{\"b\":[1, 2]}\n", "{\"a\":1}\n{\"b\":[1,2]}\n", 2, 0},
+		{"run together", "{\"a\":1}{\"a\":2}\n", "{\"a\":1}\n{\"a\":2}\n", 2, 0},
+		{"truncated", "{\"a\":1}\n,\n{\"a\":", "{\"a\":1}\n", 1, 1},
+		{"garbage", "{\"a\":1}\n,\nnot json\n,\n{\"a\":2}\n", "{\"a\":1}\n{\"a\":2}\n", 2, 1},
+		{"field order and values kept", "{\"z\":\"\\u00e9\",\"a\":1.50}\n", "{\"z\":\"\\u00e9\",\"a\":1.50}\n", 1, 0},
+	}
+	for _, tt := range tests {
+		converted, entries, skipped := deviceLogConvert([]byte(tt.log))
+		if string(converted) != tt.want || entries != tt.entries || skipped != tt.skipped {
+			t.Errorf("%s: got %q, %d entries, %d skipped, want %q, %d, %d", tt.name, converted, entries, skipped, tt.want, tt.entries, tt.skipped)
+		}
+
+		// Converting again changes nothing
+		again, _, _ := deviceLogConvert(converted)
+		if string(again) != string(converted) {
+			t.Errorf("%s: converting again got %q", tt.name, again)
+		}
+	}
+}
+
+func TestDeviceLogConvertLogs(t *testing.T) {
+	logs := map[string]string{
+		"2024-05$safecast-7": "{\"a\":1}\n,\n{\"a\":2}\n",
+		"2024-05$safecast-8": "{\"a\":3}\n{\"a\":4}\n",
+		"2024-06$safecast-7": "{\"a\":5}\n,\ngarbage\n",
+	}
+	converted := map[string]string{
+		"2024-05$safecast-7": "{\"a\":1}\n{\"a\":2}\n",
+		"2024-05$safecast-8": "{\"a\":3}\n{\"a\":4}\n",
+		"2024-06$safecast-7": "{\"a\":5}\n",
+	}
+	tests := []struct {
+		name    string
+		month   string
+		dryRun  bool
+		summary deviceLogConvertSummary
+		changed []string
+	}{
+		{"all", "", false, deviceLogConvertSummary{converted: 2, unchanged: 1, entries: 5, skipped: 1}, []string{"2024-05$safecast-7", "2024-06$safecast-7"}},
+		{"one month", "2024-05", false, deviceLogConvertSummary{converted: 1, unchanged: 1, entries: 4}, []string{"2024-05$safecast-7"}},
+		{"dry run", "", true, deviceLogConvertSummary{converted: 2, unchanged: 1, entries: 5, skipped: 1}, nil},
+		{"no such month", "2024-07", false, deviceLogConvertSummary{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			noteBatchTestSetup(t, TTServeConfig{})
+			for key, log := range logs {
+				store.Put(TTDeviceLogPath, key, []byte(log))
+			}
+			summary, err := deviceLogConvertLogs(tt.month, tt.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if summary != tt.summary {
+				t.Errorf("got %+v, want %+v", summary, tt.summary)
+			}
+			changed := map[string]bool{}
+			for _, key := range tt.changed {
+				changed[key] = true
+			}
+			for key, log := range logs {
+				want := log
+				if changed[key] {
+					want = converted[key]
+				}
+				got, _ := store.Get(TTDeviceLogPath, key)
+				if string(got) != want {
+					t.Errorf("%s: got %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+// What is appended to a log after it is converted is kept
+func TestDeviceLogConvertThenAppend(t *testing.T) {
+	noteBatchTestSetup(t, TTServeConfig{})
+	store.Put(TTDeviceLogPath, "2024-05$safecast-7", []byte("{\"a\":1}\n,\n"))
+	_, err := deviceLogConvertLogs("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Append(TTDeviceLogPath, "2024-05$safecast-7", []byte("{\"a\":2}\n"))
+	got, _ := store.Get(TTDeviceLogPath, "2024-05$safecast-7")
+	if string(got) != "{\"a\":1}\n{\"a\":2}\n" {
+		t.Errorf("got %q", got)
+	}
+}
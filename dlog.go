@@ -2,92 +2,212 @@
 // Use of this source code is governed by licenses granted by the
 // copyright holder including that found in the LICENSE file.
 
-// Log file handling
+// Log file handling.  Device logs are newline-delimited JSON, with one entry per line
+// written in a single append.  Logs written before that have entries separated by
+// commas on lines of their own, and may have entries that were interleaved by concurrent
+// writers, and so the reader accepts either and skips what it can't make sense of.
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"time"
 
 	ttdata "github.com/Safecast/safecast-go"
 )
 
+// The month of the earliest device logs, before which there is nothing to look for
+var deviceLogEarliest = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
 // DeviceLogSep is the date/time separator
 func DeviceLogSep() string {
 	return "$"
 }
 
-// DeviceLogFilename constructs path of a log file
-func DeviceLogFilename(DeviceUID string, Extension string) string {
-	fn := time.Now().UTC().Format("2006-01" + DeviceLogSep())
-	fn += DeviceUIDFilename(DeviceUID)
-	return SafecastDirectory() + TTDeviceLogPath + "/" + fn + Extension
+// DeviceLogName constructs the name of a device's log for the current month
+func DeviceLogName(DeviceUID string) string {
+	return time.Now().UTC().Format("2006-01"+DeviceLogSep()) + DeviceUIDFilename(DeviceUID)
 }
 
-// WriteToLogs writes logs.
-// Note that we don't do this with a goroutine because the serialization is helpful
-// in log-ordering for buffered I/O messages where there are a huge batch of readings
-// that are updated in sequence very quickly.
+// DeviceLogMonths gets the names of a device's logs for the months within a range of times, oldest
+// first, looking only for those months' logs rather than listing the logs of every device
+func DeviceLogMonths(DeviceUID string, from time.Time, to time.Time) (logs []string, err error) {
+
+	month := time.Date(from.UTC().Year(), from.UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+	if month.Before(deviceLogEarliest) {
+		month = deviceLogEarliest
+	}
+	now := time.Now().UTC()
+	if to.After(now) {
+		to = now
+	}
+
+	device := DeviceUIDFilename(DeviceUID)
+	for ; !month.After(to); month = month.AddDate(0, 1, 0) {
+		name := month.Format("2006-01"+DeviceLogSep()) + device
+		fd, err := store.Open(TTDeviceLogPath, name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		fd.Close()
+		logs = append(logs, name)
+	}
+
+	return
+
+}
+
+// WriteToLogs writes logs in the background, and so successive entries may be logged
+// out of order.  Those for which the order matters, such as the huge batches of readings
+// of buffered I/O that are updated in sequence very quickly, use WriteToLogsInOrder.
 func WriteToLogs(sd ttdata.SafecastData) {
 	go trackDevice(sd.DeviceUID, sd.DeviceID, time.Now())
-	go WriteDeviceStatus(sd)
-	go JSONDeviceLog(sd)
+	trackedGo(func() { WriteDeviceStatus(sd) })
+	trackedGo(func() { JSONDeviceLog(sd) })
+}
+
+// WriteToLogsInOrder writes logging info, only returning once it has been written
+func WriteToLogsInOrder(sd ttdata.SafecastData) {
+	go trackDevice(sd.DeviceUID, sd.DeviceID, time.Now())
+	JSONDeviceLog(sd)
+	WriteDeviceStatus(sd)
 }
 
 // JSONDeviceLog writes the value to the log
 func JSONDeviceLog(sd ttdata.SafecastData) {
 
-	file := DeviceLogFilename(sd.DeviceUID, ".json")
+	// Turn stats into a safe string writing
+	if sd.Service == nil {
+		var svc ttdata.Service
+		sd.Service = &svc
+	}
+	scJSON, _ := json.Marshal(sd)
+	scJSON = append(scJSON, '\n')
 
-	// Open it
-	fd, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0666)
+	// Append it to the log, creating it if necessary
+	name := DeviceLogName(sd.DeviceUID)
+	err := store.Append(TTDeviceLogPath, name, scJSON)
 	if err != nil {
+		fmt.Printf("Logging: Can't log to %s: %s\n", name, err)
+	}
+
+}
+
+// DeviceLogReader reads the entries of a device log in either format, one at a time
+type DeviceLogReader struct {
+	r       *bufio.Reader
+	pending [][]byte
+	err     error
+	// Skipped is the number of entries, or fragments of entries, that couldn't be read
+	Skipped int
+}
+
+// NewDeviceLogReader creates a reader of the device log being read by r
+func NewDeviceLogReader(r io.Reader) *DeviceLogReader {
+	return &DeviceLogReader{r: bufio.NewReader(r)}
+}
 
-		// Don't attempt to create it if it already exists
-		_, err2 := os.Stat(file)
-		if err2 == nil {
-			fmt.Printf("Logging: Can't log to %s: %s\n", file, err)
-			return
+// NextRaw gets the JSON of the next entry, exactly as it was logged, returning false at the end of the log
+func (d *DeviceLogReader) NextRaw() (raw []byte, ok bool) {
+
+	for len(d.pending) == 0 {
+		if d.err != nil {
+			return nil, false
+		}
+
+		// Get the next line.  Neither format ever has a newline within an entry.
+		line, err := d.r.ReadBytes('\n')
+		if err != nil {
+			d.err = err
 		}
-		if err2 == nil {
-			if !os.IsNotExist(err2) {
-				fmt.Printf("Logging: Ignoring attempt to create %s: %s\n", file, err2)
-				return
+
+		// Remove the commas of the legacy format, which begin or end lines, or are on lines of their own
+		line = bytes.TrimSpace(line)
+		line = bytes.TrimSpace(bytes.TrimPrefix(line, []byte(",")))
+		line = bytes.TrimSpace(bytes.TrimSuffix(line, []byte(",")))
+		if len(line) == 0 {
+			continue
+		}
+
+		// Usually a line is one entry, but concurrent writers may have run several together
+		dec := json.NewDecoder(bytes.NewReader(line))
+		for {
+			var entry json.RawMessage
+			err := dec.Decode(&entry)
+			if err == io.EOF {
+				break
 			}
+			if err != nil || len(entry) == 0 || entry[0] != '{' {
+				d.Skipped++
+				break
+			}
+			d.pending = append(d.pending, entry)
 		}
+	}
 
-		// Attempt to create the file because it doesn't already exist
-		fd, err = os.OpenFile(file, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
-		if err != nil {
-			fmt.Printf("Logging: error creating %s: %s\n", file, err)
-			return
+	raw = d.pending[0]
+	d.pending = d.pending[1:]
+	return raw, true
+
+}
+
+// Next gets the next entry, returning false at the end of the log
+func (d *DeviceLogReader) Next() (sd ttdata.SafecastData, ok bool) {
+	for {
+		raw, ok := d.NextRaw()
+		if !ok {
+			return sd, false
+		}
+		value := ttdata.SafecastData{}
+		if json.Unmarshal(raw, &value) == nil {
+			return value, true
 		}
+		d.Skipped++
+	}
+}
 
+// Err gets the error, other than the end of the log, that stopped the reader
+func (d *DeviceLogReader) Err() error {
+	if d.err == io.EOF {
+		return nil
 	}
+	return d.err
+}
 
-	// Turn stats into a safe string writing
-	if sd.Service == nil {
-		var svc ttdata.Service
-		sd.Service = &svc
+// DeviceLogRead reads all the entries of a device log, skipping any that are badly formatted
+func DeviceLogRead(name string) (entries []ttdata.SafecastData, err error) {
+
+	fd, err := store.Open(TTDeviceLogPath, name)
+	if err != nil {
+		return
 	}
-	scJSON, _ := json.Marshal(sd)
-	fd.WriteString(string(scJSON))
-	fd.WriteString("\r\n,\r\n")
+	defer fd.Close()
 
-	// Close and exit
-	fd.Close()
+	reader := NewDeviceLogReader(fd)
+	for {
+		value, ok := reader.Next()
+		if !ok {
+			break
+		}
+		entries = append(entries, value)
+	}
+
+	return entries, reader.Err()
 
 }
 
 // DeleteLogs clears the logs
 func DeleteLogs(DeviceUID string) string {
 
-	jsonFilename := DeviceLogFilename(DeviceUID, ".json")
-
 	deleted := false
-	err := os.Remove(SafecastDirectory() + jsonFilename)
+	err := store.Delete(TTDeviceLogPath, DeviceLogName(DeviceUID))
 	if err == nil {
 		deleted = true
 	}
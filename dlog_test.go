@@ -0,0 +1,111 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDeviceLogReaderRaw(t *testing.T) {
+	tests := []struct {
+		name    string
+		log     string
+		want    []string
+		skipped int
+	}{
+		{"empty", "", nil, 0},
+		{"newline-delimited", "{\"a\":1}\n{\"a\":2}\n", []string{`{"a":1}`, `{"a":2}`}, 0},
+		{"newline-delimited, unterminated", "{\"a\":1}\n{\"a\":2}", []string{`{"a":1}`, `{"a":2}`}, 0},
+		{"legacy, commas on lines of their own", "{\"a\":1}\n,\n{\"a\":2}\n,\n{\"a\":3}", []string{`{"a":1}`, `{"a":2}`, `{"a":3}`}, 0},
+		{"legacy, commas beginning lines", "{\"a\":1}\n,{\"a\":2}\n,{\"a\":3}\n", []string{`{"a":1}`, `{"a":2}`, `{"a":3}`}, 0},
+		{"legacy, commas ending lines", "{\"a\":1},\n{\"a\":2},\n", []string{`{"a":1}`, `{"a":2}`}, 0},
+		{"mixed", "{\"a\":1}\n,\n{\"a\":2}\n{\"a\":3}\n", []string{`{"a":1}`, `{"a":2}`, `{"a":3}`}, 0},
+		{"kept exactly as logged", "{ \"a\" : 1 }\r\n\t{\"b\":[1, 2]}  \n", []string{`{ "a" : 1 }`, `{"b":[1, 2]}`}, 0},
+		{"run together", "{\"a\":1}{\"a\":2} {\"a\":3}\n", []string{`{"a":1}`, `{"a":2}`, `{"a":3}`}, 0},
+		{"blank lines", "\n\n{\"a\":1}\n\n\n{\"a\":2}\n\n", []string{`{"a":1}`, `{"a":2}`}, 0},
+		{"truncated", "{\"a\":1}\n{\"a\":2}\n{\"a\":", []string{`{"a":1}`, `{"a":2}`}, 1},
+		{"truncated within", "{\"a\":1}\n{\"a\":\n{\"a\":3}\n", []string{`{"a":1}`, `{"a":3}`}, 1},
+		{"garbage", "{\"a\":1}\nnot json\n{\"a\":2}\n\x00\x01\x02\n", []string{`{"a":1}`, `{"a":2}`}, 2},
+		{"garbage after an entry on the same line", "{\"a\":1} trailing\n{\"a\":2}\n", []string{`{"a":1}`, `{"a":2}`}, 1},
+		{"not objects", "[1,2]\n\"string\"\n42\n{\"a\":1}\n", []string{`{"a":1}`}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewDeviceLogReader(strings.NewReader(tt.log))
+			var got []string
+			for {
+				raw, ok := reader.NextRaw()
+				if !ok {
+					break
+				}
+				got = append(got, string(raw))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if reader.Skipped != tt.skipped {
+				t.Errorf("skipped %d, want %d", reader.Skipped, tt.skipped)
+			}
+			if reader.Err() != nil {
+				t.Errorf("error %v", reader.Err())
+			}
+		})
+	}
+}
+
+func TestDeviceLogReaderNext(t *testing.T) {
+	log := "{\"device_urn\":\"safecast:7\",\"device\":7}\n,\n{\"device\":\"seven\"}\n{\"device_urn\":\"safecast:8\",\"device\":8}\n"
+	reader := NewDeviceLogReader(strings.NewReader(log))
+	var got []string
+	for {
+		sd, ok := reader.Next()
+		if !ok {
+			break
+		}
+		got = append(got, sd.DeviceUID)
+	}
+	if !reflect.DeepEqual(got, []string{"safecast:7", "safecast:8"}) || reader.Skipped != 1 {
+		t.Errorf("got %v, skipped %d", got, reader.Skipped)
+	}
+}
+
+// A read error other than the end of the log stops the reader, and is reported
+func TestDeviceLogReaderError(t *testing.T) {
+	failure := errors.New("disk on fire")
+	reader := NewDeviceLogReader(io.MultiReader(strings.NewReader("{\"a\":1}\n{\"a\":2}\n"), iotest.ErrReader(failure)))
+	var got []string
+	for {
+		raw, ok := reader.NextRaw()
+		if !ok {
+			break
+		}
+		got = append(got, string(raw))
+	}
+	if len(got) != 2 || reader.Err() != failure {
+		t.Errorf("got %q, error %v", got, reader.Err())
+	}
+}
+
+func TestDeviceLogRead(t *testing.T) {
+	noteBatchTestSetup(t, TTServeConfig{})
+	store.Append(TTDeviceLogPath, "2024-05$safecast-7", []byte("{\"device_urn\":\"safecast:7\",\"bat_voltage\":1}\n,\n"))
+	store.Append(TTDeviceLogPath, "2024-05$safecast-7", []byte("{\"device_urn\":\"safecast:7\",\"bat_voltage\":2}\n"))
+	entries, err := DeviceLogRead("2024-05$safecast-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || *entries[0].Bat.Voltage != 1 || *entries[1].Bat.Voltage != 2 {
+		t.Errorf("got %+v", entries)
+	}
+	_, err = DeviceLogRead("2024-05$safecast-8")
+	if err == nil {
+		t.Errorf("no error reading a log that isn't there")
+	}
+}
@@ -13,7 +13,6 @@ import (
 	"net/http"
 	"os"
 	"strings"
-	"time"
 
 	ttdata "github.com/Safecast/safecast-go"
 )
@@ -31,15 +30,11 @@ type DeviceStatus struct {
 
 // ReadDeviceStatus gets the current value
 func ReadDeviceStatus(deviceUID string) (isAvail bool, isReset bool, sv DeviceStatus) {
-	valueEmpty := DeviceStatus{}
-	valueEmpty.DeviceUID = deviceUID
 
-	// Generate the filename, which we'll use twice
-	filename := GetDeviceStatusFilePath(deviceUID)
-
-	// If the file doesn't exist, don't even try
-	_, err := os.Stat(filename)
+	contents, err := store.Get(TTDeviceStatusPath, DeviceUIDFilename(deviceUID))
 	if err != nil {
+		valueEmpty := DeviceStatus{}
+		valueEmpty.DeviceUID = deviceUID
 		if os.IsNotExist(err) {
 			// We did not reinitialize it - it's truly empty.
 			return true, false, valueEmpty
@@ -47,58 +42,29 @@ func ReadDeviceStatus(deviceUID string) (isAvail bool, isReset bool, sv DeviceSt
 		return false, true, valueEmpty
 	}
 
-	// Try reading the file several times, now that we know it exists.
-	// We retry just in case of file system errors on contention.
-	for i := 0; i < 5; i++ {
-
-		// Read the file and unmarshall if no error
-		contents, errRead := os.ReadFile(filename)
-		if errRead == nil {
-			valueToRead := DeviceStatus{}
-			errRead = json.Unmarshal(contents, &valueToRead)
-			if errRead == nil {
-				return true, false, valueToRead
-			}
-			// Malformed JSON can easily occur because of multiple concurrent
-			// writers, and so this self-corrects the situation.
-			fmt.Printf("*** %s appears to be corrupt *** (%s)\n", filename, errRead)
-			return true, true, valueEmpty
-		}
-		err = errRead
-
-		// Delay before trying again
-		time.Sleep(5 * time.Second)
+	isReset, sv = deviceStatusParse(deviceUID, contents)
+	return true, isReset, sv
 
-	}
+}
 
-	// Error
-	if os.IsNotExist(err) {
-		return true, true, valueEmpty
+// deviceStatusParse unmarshals a device status, which is reset to empty if it is corrupt.  Because
+// the store never lets a reader see a partially-written status, a corrupt one is truly damaged.
+func deviceStatusParse(deviceUID string, contents []byte) (isReset bool, value DeviceStatus) {
+	if contents != nil {
+		err := json.Unmarshal(contents, &value)
+		if err == nil {
+			return false, value
+		}
+		fmt.Printf("*** status of %s appears to be corrupt *** (%s)\n", deviceUID, err)
+		isReset = true
 	}
-	return false, true, valueEmpty
-
+	value = DeviceStatus{}
+	value.DeviceUID = deviceUID
+	return
 }
 
-// WriteDeviceStatus saves the last value in a file
+// WriteDeviceStatus saves the last value in the store
 func WriteDeviceStatus(sc ttdata.SafecastData) {
-	var ChangedLoc = false
-	var ChangedPms = false
-	var ChangedPms2 = false
-	var ChangedOpc = false
-	var ChangedGeiger = false
-	var value DeviceStatus
-
-	// Delay a random amount just in case we get called very quickly
-	// with two sequential values by the same device.  While no guarantee,
-	// this reduces the chance that we will overwrite each other.
-	// This happens ALL THE TIME when there are multiple LoRa gateways
-	// that receive and upload the same message from the same device,
-	// and are typically received by different TTSERVE instances because
-	// of load balancing.  This simply reduces the possibility of
-	// file corruption due to multiple concurrent writers.  (The corruption
-	// is self-correcting, but it's still good to avoid.)
-	sleepSeconds := Random(0, 30)
-	time.Sleep(time.Duration(sleepSeconds) * time.Second)
 
 	// Use the supplied upload time as our modification time
 	if sc.Service == nil {
@@ -106,18 +72,35 @@ func WriteDeviceStatus(sc ttdata.SafecastData) {
 		sc.Service = &svc
 	}
 
-	// Read the current value, or a blank value structure if it's blank.
-	// If the value isn't available it's because of a nonrecoverable  error.
-	// If it was reset, try waiting around a bit until it is fixed.
-	for i := 0; i < 4; i++ {
-		isAvail, isReset, rvalue := ReadDeviceStatus(sc.DeviceUID)
-		value = rvalue
-		if isAvail && !isReset {
-			break
+	// Look up where the device's address is before updating, because it may take a while
+	ipInfo, ipInfoValid := deviceStatusIPInfo(sc)
+
+	// Update the status such that no other instance can update it in between.  This happens
+	// ALL THE TIME when there are multiple LoRa gateways that receive and upload the same
+	// message from the same device, and are typically received by different TTSERVE
+	// instances because of load balancing.
+	err := store.Update(TTDeviceStatusPath, DeviceUIDFilename(sc.DeviceUID), func(contents []byte) ([]byte, error) {
+		_, value := deviceStatusParse(sc.DeviceUID, contents)
+		value = deviceStatusUpdate(value, sc)
+		if ipInfoValid {
+			value.IPInfo = ipInfo
 		}
-		time.Sleep(time.Duration(Random(1, 6)) * time.Second)
+		return json.MarshalIndent(value, "", "    ")
+	})
+	if err != nil {
+		fmt.Printf("*** Unable to update status of %s: %s\n", sc.DeviceUID, err)
 	}
 
+}
+
+// deviceStatusUpdate merges a new value into the status of a device
+func deviceStatusUpdate(value DeviceStatus, sc ttdata.SafecastData) DeviceStatus {
+	var ChangedLoc = false
+	var ChangedPms = false
+	var ChangedPms2 = false
+	var ChangedOpc = false
+	var ChangedGeiger = false
+
 	// Update the identity-related fields that are unconditionally specified
 	value.DeviceUID = sc.DeviceUID
 	value.DeviceClass = sc.DeviceClass
@@ -128,9 +111,9 @@ func WriteDeviceStatus(sc ttdata.SafecastData) {
 	value.DeviceContactRole = sc.DeviceContactRole
 	value.DeviceContactEmail = sc.DeviceContactEmail
 
-	// Copy extra info from the sheet
+	// Copy extra info from the registry
 	if value.DeviceID != 0 || value.DeviceSN != "" {
-		si, err := sheetDeviceInfo(value.DeviceID, value.DeviceSN)
+		si, err := registryDeviceInfo(value.DeviceID, value.DeviceSN)
 		if err == nil {
 			if si.Custodian != "" || si.CustodianContact != "" {
 				if si.Custodian != "" {
@@ -825,56 +808,37 @@ func WriteDeviceStatus(sc ttdata.SafecastData) {
 		value.GeigerHistory[0] = new
 	}
 
-	// If the current transport has an IP address, try to
-	// get the IP info
+	return value
+
+}
 
-	if value.Service != nil && value.Service.Transport != nil {
-		ipInfo := IPInfoData{}
-		Str1 := strings.Split(*value.Service.Transport, ":")
-		IP := Str1[len(Str1)-1]
-		Str2 := strings.Split(IP, ".")
-		isValidIP := len(Str1) > 1 && len(Str2) == 4
-		if isValidIP {
-			response, err := http.Get("http://ip-api.com/json/" + IP)
+// deviceStatusIPInfo gets the IP info of the address that a value was transported from, if it has one
+func deviceStatusIPInfo(sc ttdata.SafecastData) (ipInfo IPInfoData, valid bool) {
+
+	if sc.Service == nil || sc.Service.Transport == nil {
+		return
+	}
+
+	Str1 := strings.Split(*sc.Service.Transport, ":")
+	IP := Str1[len(Str1)-1]
+	Str2 := strings.Split(IP, ".")
+	isValidIP := len(Str1) > 1 && len(Str2) == 4
+	if isValidIP {
+		response, err := http.Get("http://ip-api.com/json/" + IP)
+		if err == nil {
+			defer response.Body.Close()
+			contents, err := io.ReadAll(response.Body)
 			if err == nil {
-				defer response.Body.Close()
-				contents, err := io.ReadAll(response.Body)
+				var info IPInfoData
+				err = json.Unmarshal(contents, &info)
 				if err == nil {
-					var info IPInfoData
-					err = json.Unmarshal(contents, &info)
-					if err == nil {
-						ipInfo = info
-					}
+					ipInfo = info
 				}
 			}
 		}
-		value.IPInfo = ipInfo
 	}
 
-	// Write it to the file until it's written correctly, to allow for concurrency
-	filename := GetDeviceStatusFilePath(sc.DeviceUID)
-	valueJSON, _ := json.MarshalIndent(value, "", "    ")
-
-	for {
-
-		// Write the value
-		fd, err := os.OpenFile(filename, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
-		if err != nil {
-			fmt.Printf("*** Unable to write %s: %v\n", filename, err)
-			break
-		}
-		fd.WriteString(string(valueJSON))
-		fd.Close()
-
-		// Delay, to increase the chance that we will catch a concurrent update/overwrite
-		time.Sleep(time.Duration(Random(1, 6)) * time.Second)
-
-		// Do an integrity check, and re-write the value if necessary
-		_, isEmpty, _ := ReadDeviceStatus(sc.DeviceUID)
-		if !isEmpty {
-			break
-		}
-	}
+	return ipInfo, true
 
 }
 
@@ -887,7 +851,7 @@ func GetDeviceStatusSummary(DeviceUID string) (label string, gps string, Lat flo
 	// If this device maps to a safecast device, look up its spreadsheet info
 	var info string
 	if value.DeviceID != 0 {
-		value.DeviceSN, info = sheetDeviceIDToSN(value.DeviceID)
+		value.DeviceSN, info = registryDeviceIDToSN(value.DeviceID)
 	}
 	label = value.DeviceSN
 	if info != "" {
@@ -986,10 +950,3 @@ func DeviceUIDFilename(DeviceUID string) (clean string) {
 	clean = strings.ReplaceAll(clean, ".", "-")
 	return
 }
-
-// GetDeviceStatusFilePath generates a device status filename in the local file store
-func GetDeviceStatusFilePath(DeviceUID string) string {
-
-	return SafecastDirectory() + TTDeviceStatusPath + "/" + DeviceUIDFilename(DeviceUID) + ".json"
-
-}
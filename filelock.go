@@ -0,0 +1,78 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Coordination of updates to files on the file system shared among instances.  A
+// read-modify-write is done while holding an advisory lock on a companion lock file,
+// and the result is written to a temp file that is renamed into place, so that readers
+// never see a partially-written file and concurrent writers never lose each other's updates.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// How long we'll wait for another writer, in this or another instance, to release a lock
+const fileLockTimeout = 30 * time.Second
+
+// How often we retry a lock that is held
+const fileLockRetry = 10 * time.Millisecond
+
+// fileLockName gets the name of the lock file of a file, which is hidden alongside it so that those
+// listing the folder skip it.  Lock files are never removed, because removing one while another
+// is waiting on it would let two writers in at once.
+func fileLockName(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".lock")
+}
+
+// fileLock takes the exclusive lock on a file, which must be released with fileUnlock
+func fileLock(filename string) (lock *flock.Flock, err error) {
+	lock = flock.New(fileLockName(filename))
+	ctx, cancel := context.WithTimeout(context.Background(), fileLockTimeout)
+	defer cancel()
+	locked, err := lock.TryLockContext(ctx, fileLockRetry)
+	if err == nil && !locked {
+		err = fmt.Errorf("timeout")
+	}
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("can't lock %s: %s", filename, err)
+	}
+	return lock, nil
+}
+
+// fileUnlock releases a lock taken by fileLock
+func fileUnlock(lock *flock.Flock) {
+	lock.Unlock()
+	lock.Close()
+}
+
+// fileWriteAtomic replaces the contents of a file so that readers see either the old or the new contents
+func fileWriteAtomic(filename string, contents []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempname := temp.Name()
+	_, err = temp.Write(contents)
+	if err == nil {
+		err = temp.Chmod(0644)
+	}
+	err2 := temp.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tempname, filename)
+	}
+	if err != nil {
+		os.Remove(tempname)
+	}
+	return err
+}
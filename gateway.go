@@ -7,9 +7,9 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,6 +27,7 @@ type seenGateway struct {
 }
 
 var seenGateways []seenGateway
+var seenGatewaysLock sync.Mutex
 
 // Class used to sort seen devices
 type byGatewayKey []seenGateway
@@ -56,6 +57,9 @@ func trackGateway(GatewayID string, whenSeen time.Time) {
 	var dev seenGateway
 	dev.gatewayid = GatewayID
 
+	seenGatewaysLock.Lock()
+	defer seenGatewaysLock.Unlock()
+
 	// Attempt to update the existing entry if we can find it
 	found := false
 	for i := 0; i < len(seenGateways); i++ {
@@ -100,32 +104,22 @@ func trackGateway(GatewayID string, whenSeen time.Time) {
 // Update the list of seen devices
 func trackAllGateways() {
 
-	// Loop over the file system, tracking all devices
-	files, err := os.ReadDir(SafecastDirectory() + TTGatewayStatusPath)
+	// Loop over the store, tracking all of them
+	entries, err := store.List(TTGatewayStatusPath)
 	if err == nil {
-
-		// Iterate over each of the values
-		for _, file := range files {
-
-			if !file.IsDir() {
-
-				// Extract device ID from filename
-				Str0 := file.Name()
-				gatewayID := strings.Split(Str0, ".")[0]
-
-				// Track the device
-				if gatewayID != "" {
-					info, err := file.Info()
-					if err == nil {
-						trackGateway(gatewayID, info.ModTime())
-					}
-				}
-
-			}
+		for _, entry := range entries {
+			trackGateway(entry.Key, entry.Modified)
 		}
 	}
 }
 
+// seenGatewayCount gets the number of gateways seen since restart
+func seenGatewayCount() int {
+	seenGatewaysLock.Lock()
+	defer seenGatewaysLock.Unlock()
+	return len(seenGateways)
+}
+
 // Update message ages and notify
 func sendExpiredSafecastGatewaysToSlack() {
 
@@ -179,7 +173,7 @@ func sendSafecastGatewaySummaryToSlack(header string) {
 			if s != "" {
 				s += "\n"
 			}
-			s += fmt.Sprintf("<http://%s%s%s|%s>", TTServerHTTPAddress, TTServerTopicGatewayStatus, gatewayID, gatewayID)
+			s += fmt.Sprintf("<http://%s%s%s|%s>", CurrentServiceConfig().HTTPAddress, TTServerTopicGatewayStatus, gatewayID, gatewayID)
 			if summary != "" {
 				s += fmt.Sprintf(" %s", summary)
 			}
@@ -10,7 +10,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 )
 
 // Github webhook
@@ -41,7 +40,7 @@ func inboundWebGithubHandler(rw http.ResponseWriter, req *http.Request) {
 			p.Pusher.Name, p.HeadCommit.Commit.Committer.Name, p.HeadCommit.Commit.Message))
 	}
 
-	// Exit
-	os.Exit(0)
+	// Exit, but only after we've responded to the webhook
+	go Shutdown()
 
 }
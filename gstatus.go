@@ -29,89 +29,57 @@ type GatewayStatus struct {
 
 // ReadGatewayStatus gets the current value
 func ReadGatewayStatus(gatewayID string) (isAvail bool, isReset bool, sv GatewayStatus) {
-	valueEmpty := GatewayStatus{}
-	valueEmpty.UpdatedAt = time.Now().UTC().Format("2006-01-02T15:04:05Z")
-	valueEmpty.Ttg.GatewayID = gatewayID
 
-	// Generate the filename, which we'll use twice
-	filename := SafecastDirectory() + TTGatewayStatusPath + "/" + gatewayID + ".json"
-
-	// If the file doesn't exist, don't even try
-	_, err := os.Stat(filename)
+	contents, err := store.Get(TTGatewayStatusPath, gatewayID)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// We did not reinitialize it - it's truly empty.
-			return true, false, valueEmpty
+			return true, false, gatewayStatusEmpty(gatewayID)
 		}
-		return false, true, valueEmpty
+		return false, true, gatewayStatusEmpty(gatewayID)
 	}
 
-	// Try reading the file several times, now that we know it exists.
-	// We retry just in case of file system errors on contention.
-	for i := 0; i < 5; i++ {
-
-		// Read the file and unmarshall if no error
-		contents, errRead := os.ReadFile(filename)
-		if errRead == nil {
-			valueToRead := GatewayStatus{}
-			errRead = json.Unmarshal(contents, &valueToRead)
-			if errRead == nil {
-				// Backward compatbility with old field names
-				if valueToRead.UploadedAt != "" {
-					valueToRead.UpdatedAt = valueToRead.UploadedAt
-					valueToRead.UploadedAt = ""
-				}
-				return true, false, valueToRead
-			}
-			// Malformed JSON can easily occur because of multiple concurrent
-			// writers, and so this self-corrects the situation.
-			if false {
-				fmt.Printf("*** %s appears to be corrupt - erasing ***\n", filename)
-			}
-			return true, true, valueEmpty
-		}
-		err = errRead
+	isReset, sv = gatewayStatusParse(gatewayID, contents)
+	return true, isReset, sv
+
+}
 
-		// Delay before trying again
-		time.Sleep(5 * time.Second)
+// gatewayStatusEmpty gets the status of a gateway that we know nothing about
+func gatewayStatusEmpty(gatewayID string) (value GatewayStatus) {
+	value.UpdatedAt = time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	value.Ttg.GatewayID = gatewayID
+	return
+}
 
+// gatewayStatusParse unmarshals a gateway status, which is reset to empty if there is none or it is corrupt
+func gatewayStatusParse(gatewayID string, contents []byte) (isReset bool, value GatewayStatus) {
+	if contents == nil {
+		return false, gatewayStatusEmpty(gatewayID)
 	}
-
-	// Error
-	if os.IsNotExist(err) {
-		return true, true, valueEmpty
+	err := json.Unmarshal(contents, &value)
+	if err != nil {
+		return true, gatewayStatusEmpty(gatewayID)
 	}
-	return false, true, valueEmpty
-
+	// Backward compatbility with old field names
+	if value.UploadedAt != "" {
+		value.UpdatedAt = value.UploadedAt
+		value.UploadedAt = ""
+	}
+	return false, value
 }
 
-// WriteGatewayStatus saves the last value in a file
+// WriteGatewayStatus saves the last value in the store
 func WriteGatewayStatus(ttg TTGateReq, IP string) {
-	var value GatewayStatus
 
 	// Read the current value, or a blank value structure if it's blank.
 	// If the value isn't available it's because of a nonrecoverable  error.
-	// If it was reset, try waiting around a bit until it is fixed.
-	for i := 0; i < 5; i++ {
-		isAvail, isReset, rvalue := ReadGatewayStatus(ttg.GatewayID)
-		value = rvalue
-		if !isAvail {
-			return
-		}
-		if !isReset {
-			break
-		}
-		time.Sleep(time.Duration(Random(1, 6)) * time.Second)
+	isAvail, _, value := ReadGatewayStatus(ttg.GatewayID)
+	if !isAvail {
+		return
 	}
 
-	// Copy over all the values directly.  If someday we need to aggregate
-	// values rather than replace them, this is the place to do it
-	value.Ttg = ttg
-
-	// Update the uploaded at
-	value.UpdatedAt = time.Now().UTC().Format("2006-01-02T15:04:05Z")
-
-	// If the new one doesn't have a successful IPInfo, we'd like to fetch it
+	// If the new one doesn't have a successful IPInfo, we'd like to fetch it.  We do
+	// this before updating, because it may take a while.
 
 	// If the IP info isn't filled in, fill it in.  This will only happen once.
 	needUpdate := false
@@ -123,6 +91,7 @@ func WriteGatewayStatus(ttg TTGateReq, IP string) {
 		fmt.Printf("*** Updating gateway IPInfo because of IP change from %s to %s\n", value.IPInfo.IP.String(), IP)
 		needUpdate = true
 	}
+	var ipInfo IPInfoData
 	if needUpdate {
 		response, err := http.Get("http://ip-api.com/json/" + IP)
 		if err == nil {
@@ -132,35 +101,31 @@ func WriteGatewayStatus(ttg TTGateReq, IP string) {
 				var info IPInfoData
 				err = json.Unmarshal(contents, &info)
 				if err == nil {
-					value.IPInfo = info
+					ipInfo = info
 				}
 			}
 		}
 	}
 
-	// Write it to the file
-	filename := SafecastDirectory() + TTGatewayStatusPath + "/" + ttg.GatewayID + ".json"
-	valueJSON, _ := json.MarshalIndent(value, "", "    ")
-
-	for {
+	// Update the status such that no other instance can update it in between
+	err := store.Update(TTGatewayStatusPath, ttg.GatewayID, func(contents []byte) ([]byte, error) {
+		_, value := gatewayStatusParse(ttg.GatewayID, contents)
 
-		// Write the value
-		fd, err := os.OpenFile(filename, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
-		if err != nil {
-			fmt.Printf("*** Unable to write %s: %v\n", filename, err)
-			break
-		}
-		fd.WriteString(string(valueJSON))
-		fd.Close()
+		// Copy over all the values directly.  If someday we need to aggregate
+		// values rather than replace them, this is the place to do it
+		value.Ttg = ttg
 
-		// Delay, to increase the chance that we will catch a concurrent update/overwrite
-		time.Sleep(time.Duration(Random(1, 6)) * time.Second)
+		// Update the uploaded at
+		value.UpdatedAt = time.Now().UTC().Format("2006-01-02T15:04:05Z")
 
-		// Do an integrity check, and re-write the value if necessary
-		_, isEmpty, _ := ReadGatewayStatus(ttg.GatewayID)
-		if !isEmpty {
-			break
+		if needUpdate {
+			value.IPInfo = ipInfo
 		}
+
+		return json.MarshalIndent(value, "", "    ")
+	})
+	if err != nil {
+		fmt.Printf("*** Unable to update status of gateway %s: %s\n", ttg.GatewayID, err)
 	}
 
 }
@@ -217,7 +182,7 @@ func GetGatewaySummary(GatewayID string, bol string) (Summary string, Label stri
 			for _, d := range devices {
 				i64, _ := strconv.ParseUint(d, 10, 32)
 				deviceID := uint32(i64)
-				s += fmt.Sprintf("<http://%s%s%d|%010d> ", TTServerHTTPAddress, TTServerTopicDeviceStatus, deviceID, deviceID)
+				s += fmt.Sprintf("<http://%s%s%d|%010d> ", CurrentServiceConfig().HTTPAddress, TTServerTopicDeviceStatus, deviceID, deviceID)
 			}
 		}
 	}
@@ -0,0 +1,84 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Inbound support for the "/backfill" HTTP topic, where GET lists the backfills
+// that have been run and their progress, and POST, with a JSON BackfillRequest as
+// its body or with the same fields as query arguments, begins a new one.  POST must
+// present an admin secret, and is refused unless one is configured.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Handle inbound HTTP requests to backfill from the device logs
+func inboundWebBackfillHandler(rw http.ResponseWriter, req *http.Request) {
+	stats.Count.HTTP++
+
+	_, args, err := HTTPArgs(req, TTServerTopicBackfill)
+	if err != nil {
+		http.Error(rw, ErrorString(err), http.StatusBadRequest)
+		return
+	}
+
+	switch req.Method {
+
+	case http.MethodGet, http.MethodHead:
+		httpRespondJSON(rw, http.StatusOK, backfillStatuses())
+
+	case http.MethodPost:
+		status, err := adminAuthenticate(req)
+		if err != nil {
+			requestor, _, _ := getRequestorIPv4(req)
+			ServerLog(fmt.Sprintf("BACKFILL rejected from %s: %s\n", requestor, err))
+			http.Error(rw, http.StatusText(status), status)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(rw, ErrorString(err), http.StatusBadRequest)
+			return
+		}
+		bfreq := BackfillRequest{}
+		if len(strings.TrimSpace(string(body))) != 0 {
+			err = json.Unmarshal(body, &bfreq)
+			if err != nil {
+				http.Error(rw, fmt.Sprintf("can't parse JSON: %s", err), http.StatusBadRequest)
+				return
+			}
+		} else {
+			bfreq.Device = args["device"]
+			bfreq.From = args["from"]
+			bfreq.To = args["to"]
+			bfreq.Recalculate, _ = strconv.ParseBool(args["recalculate"])
+			bfreq.DryRun, _ = strconv.ParseBool(args["dry_run"])
+			if args["rate"] != "" {
+				bfreq.Rate, err = strconv.ParseFloat(args["rate"], 64)
+				if err != nil {
+					http.Error(rw, "invalid rate", http.StatusBadRequest)
+					return
+				}
+			}
+			if args["sinks"] != "" {
+				bfreq.Sinks = strings.Split(args["sinks"], ",")
+			}
+		}
+		job, err := backfillStart(bfreq)
+		if err != nil {
+			http.Error(rw, ErrorString(err), http.StatusBadRequest)
+			return
+		}
+		httpRespondJSON(rw, http.StatusAccepted, job)
+
+	default:
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+	}
+
+}
@@ -6,15 +6,9 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"strings"
-	"time"
-
-	ttdata "github.com/Safecast/safecast-go"
 )
 
 // Handle inbound HTTP requests to do a quick analysis of a device's log file
@@ -26,13 +20,12 @@ func inboundWebDeviceCheckHandler(rw http.ResponseWriter, req *http.Request) {
 
 	// Log it
 	deviceidstr := req.RequestURI[len(TTServerTopicDeviceCheck):]
-	timeRange := time.Now().UTC().Format("2006-01")
-	filename := fmt.Sprintf("%s/%s$%s.json", TTDeviceLogPath, timeRange, DeviceUIDFilename(deviceidstr))
+	name := DeviceLogName(deviceidstr)
 
-	fmt.Printf("%s LOG ANALYSIS request for %s\n", LogTime(), filename)
+	fmt.Printf("%s LOG ANALYSIS request for %s\n", LogTime(), name)
 
 	// Check it
-	success, s := CheckJSON(SafecastDirectory() + filename)
+	success, s := CheckJSON(name)
 	if !success {
 		io.WriteString(rw, s)
 	}
@@ -42,37 +35,26 @@ func inboundWebDeviceCheckHandler(rw http.ResponseWriter, req *http.Request) {
 
 }
 
-// CheckJSON performs a standard check on a JSON file
-func CheckJSON(infile string) (success bool, result string) {
+// CheckJSON performs a standard check on a device log
+func CheckJSON(name string) (success bool, result string) {
 
-	// Read the log
-	contents, err := os.ReadFile(infile)
+	// Open the log
+	fd, err := store.Open(TTDeviceLogPath, name)
 	if err != nil {
 		return false, ErrorString(err)
 	}
+	defer fd.Close()
 
 	// Begin taking stats
 	stats := NewMeasurementDataset()
 
-	// Split the contents into a number of slices based on the commas
-	ctmp := strings.Replace(string(contents), "\n,", ",\n", -1)
-	splitContents := strings.Split(ctmp, ",\n")
-	for _, c := range splitContents {
-
-		// Generate a clean json entry
-		clean := strings.Replace(c, "\n", "", -1)
-		if len(clean) == 0 {
-			continue
-		}
-
-		// Unmarshal it.  Badly-formatted json occasionally occurs because of
-		// concurrent file writes to the log from different process instances,
-		// but this is rare - so no worry.
-		value := ttdata.SafecastData{}
-		err = json.Unmarshal([]byte(clean), &value)
-		if err != nil {
-			fmt.Printf("CHECK: error unmarshaling data: %s\n", err)
-			continue
+	// Read each entry of the log.  Badly-formatted entries occasionally occur in old logs
+	// because of concurrent writes from different process instances, and are skipped.
+	reader := NewDeviceLogReader(fd)
+	for {
+		value, ok := reader.Next()
+		if !ok {
+			break
 		}
 
 		// Take a measurement
@@ -82,6 +64,12 @@ func CheckJSON(infile string) (success bool, result string) {
 		AggregateMeasurementIntoDataset(&stats, MeasurementStat)
 
 	}
+	if reader.Skipped != 0 {
+		fmt.Printf("CHECK: skipped %d badly-formatted entries of %s\n", reader.Skipped, name)
+	}
+	if reader.Err() != nil {
+		return false, ErrorString(reader.Err())
+	}
 
 	// Measurements completed
 	AggregationCompleted(&stats)
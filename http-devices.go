@@ -2,21 +2,73 @@
 // Use of this source code is governed by licenses granted by the
 // copyright holder including that found in the LICENSE file.
 
-// Inbound support for the "/log" HTTP topic
+// Inbound support for the "/devices" HTTP topic, which returns the current values of
+// devices as JSON, as a GeoJSON FeatureCollection of where each was last located, or as
+// CSV, filtered by class, by bounding box, by when they were last seen, and by their sensors.
 package main
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
-	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	ttdata "github.com/Safecast/safecast-go"
 )
 
+// Formats in which devices may be returned, beyond JSON
+const devicesFormatGeoJSON = "geojson"
+const devicesFormatCSV = "csv"
+
+// The fields of each device in CSV, and other than its location in the properties of its GeoJSON feature
+var devicesFields = []string{"device_urn", "device_class", "device_sn", "device", "when_captured", "service_uploaded",
+	"loc_lat", "loc_lon", "lnd_7318u", "lnd_7318c", "lnd_7128ec", "lnd_712u", "lnd_78017w", "lnd_usv",
+	"pms_pm01_0", "pms_pm02_5", "pms_pm10_0", "pms_aqi", "pms_aqi_level", "pms2_pm02_5", "pms2_aqi",
+	"opc_pm02_5", "opc_aqi", "env_temp", "env_humid"}
+
+// The sensors by which devices may be filtered, and whether a device has reported from each
+var devicesSensors = map[string]func(sd ttdata.SafecastData) bool{
+	"lnd":  func(sd ttdata.SafecastData) bool { return sd.Lnd != nil },
+	"pms":  func(sd ttdata.SafecastData) bool { return sd.Pms != nil },
+	"pms2": func(sd ttdata.SafecastData) bool { return sd.Pms2 != nil },
+	"opc":  func(sd ttdata.SafecastData) bool { return sd.Opc != nil },
+	"env":  func(sd ttdata.SafecastData) bool { return sd.Env != nil },
+	"bat":  func(sd ttdata.SafecastData) bool { return sd.Bat != nil },
+	"loc":  func(sd ttdata.SafecastData) bool { return devicesLocated(sd) },
+}
+
+// The filters of devices other than by class
+type devicesFilter struct {
+	bbox    []float64
+	maxAge  time.Duration
+	sensors []string
+}
+
+// A GeoJSON feature of a device
+type devicesFeature struct {
+	Type       string                     `json:"type"`
+	Geometry   devicesPoint               `json:"geometry"`
+	Properties map[string]json.RawMessage `json:"properties"`
+}
+
+// A GeoJSON point, as longitude and latitude
+type devicesPoint struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// A GeoJSON FeatureCollection of devices
+type devicesFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []devicesFeature `json:"features"`
+}
+
 // Handle inbound HTTP requests to fetch the entire list of devices
 func inboundWebDevicesHandler(rw http.ResponseWriter, req *http.Request) {
 	stats.Count.HTTP++
@@ -51,9 +103,19 @@ func inboundWebDevicesHandler(rw http.ResponseWriter, req *http.Request) {
 
 	// Get the filters
 	filterClass := args["class"]
+	filter, err := devicesParseFilter(args)
+	if err != nil {
+		http.Error(rw, ErrorString(err), http.StatusBadRequest)
+		return
+	}
+	format := args["format"]
+	if format != "" && format != "json" && format != devicesFormatGeoJSON && format != devicesFormatCSV {
+		http.Error(rw, fmt.Sprintf("unknown format '%s'", format), http.StatusBadRequest)
+		return
+	}
 
-	// Loop over the file system, tracking all devices
-	files, err := os.ReadDir(SafecastDirectory() + TTDeviceStatusPath)
+	// Loop over the store, tracking all devices
+	entries, err := store.List(TTDeviceStatusPath)
 	if err != nil {
 		io.WriteString(rw, fmt.Sprintf("%s", err))
 		return
@@ -64,21 +126,10 @@ func inboundWebDevicesHandler(rw http.ResponseWriter, req *http.Request) {
 	var allStatusTemplated []map[string]interface{}
 
 	// Iterate over each of the values
-	for _, file := range files {
+	for _, entry := range entries {
 
-		// Skip directories
-		if file.IsDir() {
-			continue
-		}
-
-		// Skip if we're still processing an offset
-		if offset > 0 {
-			offset--
-			continue
-		}
-
-		// Read the file
-		contents, err := os.ReadFile(SafecastDirectory() + TTDeviceStatusPath + "/" + file.Name())
+		// Read the status
+		contents, err := store.Get(TTDeviceStatusPath, entry.Key)
 		if err != nil {
 			continue
 		}
@@ -96,6 +147,17 @@ func inboundWebDevicesHandler(rw http.ResponseWriter, req *http.Request) {
 			}
 		}
 
+		// Filter by location, age, and sensors
+		if !filter.matches(dstatus.SafecastData) {
+			continue
+		}
+
+		// Skip if we're still processing an offset, which is into the devices that pass the filters
+		if offset > 0 {
+			offset--
+			continue
+		}
+
 		// Copy only the "current values" to the output, not the historical data
 		allStatus = append(allStatus, dstatus.SafecastData)
 
@@ -126,6 +188,19 @@ func inboundWebDevicesHandler(rw http.ResponseWriter, req *http.Request) {
 
 	}
 
+	// Output it in the other formats
+	switch format {
+	case devicesFormatGeoJSON:
+		rw.Header().Set("Content-Type", "application/geo+json")
+		allJSON, _ := json.Marshal(devicesGeoJSON(allStatus))
+		io.Writer.Write(rw, allJSON)
+		return
+	case devicesFormatCSV:
+		rw.Header().Set("Content-Type", "text/csv")
+		devicesCSV(rw, allStatus)
+		return
+	}
+
 	// Marshal it
 	var allJSON []byte
 	if templateJSON == "" {
@@ -141,3 +216,152 @@ func inboundWebDevicesHandler(rw http.ResponseWriter, req *http.Request) {
 	io.Writer.Write(rw, allJSON)
 
 }
+
+// devicesParseFilter interprets the filters of "bbox=west,south,east,north", "max_age=<duration>",
+// and "sensors=<sensor>,<sensor>"
+func devicesParseFilter(args map[string]string) (filter devicesFilter, err error) {
+
+	if args["bbox"] != "" {
+		for _, coord := range strings.Split(args["bbox"], ",") {
+			value, err := strconv.ParseFloat(strings.TrimSpace(coord), 64)
+			if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+				return filter, fmt.Errorf("invalid bbox '%s'", args["bbox"])
+			}
+			filter.bbox = append(filter.bbox, value)
+		}
+		if len(filter.bbox) != 4 || filter.bbox[1] > filter.bbox[3] {
+			return filter, fmt.Errorf("bbox must be west,south,east,north")
+		}
+		west, south, east, north := filter.bbox[0], filter.bbox[1], filter.bbox[2], filter.bbox[3]
+		if west < -180 || west > 180 || east < -180 || east > 180 || south < -90 || north > 90 {
+			return filter, fmt.Errorf("bbox must be within longitudes of -180 to 180 and latitudes of -90 to 90")
+		}
+	}
+
+	if args["max_age"] != "" {
+		filter.maxAge, err = time.ParseDuration(args["max_age"])
+		if err != nil || filter.maxAge <= 0 {
+			return filter, fmt.Errorf("invalid max_age '%s'", args["max_age"])
+		}
+	}
+
+	for _, sensor := range strings.Split(args["sensors"], ",") {
+		sensor = strings.TrimSpace(sensor)
+		if sensor == "" {
+			continue
+		}
+		if devicesSensors[sensor] == nil {
+			return filter, fmt.Errorf("unknown sensor '%s'", sensor)
+		}
+		filter.sensors = append(filter.sensors, sensor)
+	}
+
+	return
+
+}
+
+// matches returns true if the device passes the filter
+func (filter devicesFilter) matches(sd ttdata.SafecastData) bool {
+
+	// Within the bounding box, which may cross the antimeridian
+	if filter.bbox != nil {
+		if !devicesLocated(sd) {
+			return false
+		}
+		west, south, east, north := filter.bbox[0], filter.bbox[1], filter.bbox[2], filter.bbox[3]
+		lat, lon := *sd.Loc.Lat, *sd.Loc.Lon
+		if lat < south || lat > north {
+			return false
+		}
+		if west <= east && (lon < west || lon > east) {
+			return false
+		}
+		if west > east && lon < west && lon > east {
+			return false
+		}
+	}
+
+	// Seen recently enough
+	if filter.maxAge != 0 {
+		seen, ok := devicesLastSeen(sd)
+		if !ok || time.Since(seen) > filter.maxAge {
+			return false
+		}
+	}
+
+	// Having reported from every sensor
+	for _, sensor := range filter.sensors {
+		if !devicesSensors[sensor](sd) {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// devicesLocated returns true if the device has a location
+func devicesLocated(sd ttdata.SafecastData) bool {
+	return sd.Loc != nil && sd.Loc.Lat != nil && sd.Loc.Lon != nil
+}
+
+// devicesLastSeen gets when the device was last uploaded or, failing that, captured
+func devicesLastSeen(sd ttdata.SafecastData) (t time.Time, ok bool) {
+	when := ""
+	if sd.Service != nil && sd.Service.UploadedAt != nil {
+		when = *sd.Service.UploadedAt
+	} else if sd.CapturedAt != nil {
+		when = *sd.CapturedAt
+	}
+	t, err := time.Parse(time.RFC3339, when)
+	return t, err == nil
+}
+
+// devicesValues gets the fields of a device by name, omitting those it doesn't have
+func devicesValues(sd ttdata.SafecastData) map[string]json.RawMessage {
+	sdJSON, _ := json.Marshal(sd)
+	all := map[string]json.RawMessage{}
+	json.Unmarshal(sdJSON, &all)
+	values := map[string]json.RawMessage{}
+	for _, field := range devicesFields {
+		value, present := all[field]
+		if present {
+			values[field] = value
+		}
+	}
+	return values
+}
+
+// devicesGeoJSON makes a FeatureCollection of the devices that have a location
+func devicesGeoJSON(devices []ttdata.SafecastData) (fc devicesFeatureCollection) {
+	fc.Type = "FeatureCollection"
+	fc.Features = []devicesFeature{}
+	for _, sd := range devices {
+		if !devicesLocated(sd) {
+			continue
+		}
+		properties := devicesValues(sd)
+		delete(properties, "loc_lat")
+		delete(properties, "loc_lon")
+		feature := devicesFeature{Type: "Feature", Properties: properties}
+		feature.Geometry.Type = "Point"
+		feature.Geometry.Coordinates = []float64{*sd.Loc.Lon, *sd.Loc.Lat}
+		fc.Features = append(fc.Features, feature)
+	}
+	return
+}
+
+// devicesCSV writes the devices as CSV, with a header of their fields
+func devicesCSV(w io.Writer, devices []ttdata.SafecastData) {
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(devicesFields)
+	for _, sd := range devices {
+		values := devicesValues(sd)
+		record := make([]string, len(devicesFields))
+		for i, field := range devicesFields {
+			record[i] = deviceLogCSVValue(values[field])
+		}
+		csvWriter.Write(record)
+	}
+	csvWriter.Flush()
+}
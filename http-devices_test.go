@@ -0,0 +1,222 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	ttdata "github.com/Safecast/safecast-go"
+)
+
+// devicesTestSetup stores the status of devices of a class at locations, in order of their device IDs
+func devicesTestSetup(t *testing.T) {
+	t.Helper()
+	noteBatchTestSetup(t, TTServeConfig{})
+	devices := []struct {
+		id    uint32
+		class string
+		lat   float64
+		lon   float64
+	}{
+		{1, "pointcast", 35.6, 139.7},
+		{2, "pointcast", 51.5, -0.1},
+		{3, "solarcast", -17.7, 178.0},
+		{4, "solarcast", -17.7, -179.0},
+		{5, "ngeigie", 0, 0},
+	}
+	for _, d := range devices {
+		uid := fmt.Sprintf("safecast:%d", d.id)
+		lat, lon, cpm := d.lat, d.lon, float64(10*d.id)
+		sd := ttdata.SafecastData{DeviceUID: uid, DeviceClass: d.class, Loc: &ttdata.Loc{Lat: &lat, Lon: &lon}}
+		sd.Lnd = &ttdata.Lnd{U7318: &cpm}
+		contents, err := json.Marshal(DeviceStatus{SafecastData: sd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Put(TTDeviceStatusPath, fmt.Sprintf("safecast-%d", d.id), contents)
+	}
+}
+
+// devicesTestRequest gets devices and the status of the request
+func devicesTestRequest(t *testing.T, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, TTServerTopicDevices+query, nil)
+	rw := httptest.NewRecorder()
+	inboundWebDevicesHandler(rw, req)
+	return rw
+}
+
+// devicesTestUIDs gets the UIDs of the devices returned as JSON
+func devicesTestUIDs(t *testing.T, rw *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var devices []ttdata.SafecastData
+	err := json.Unmarshal(rw.Body.Bytes(), &devices)
+	if err != nil {
+		t.Fatalf("%s: %q", err, rw.Body.String())
+	}
+	uids := []string{}
+	for _, sd := range devices {
+		uids = append(uids, sd.DeviceUID)
+	}
+	return uids
+}
+
+func TestDevicesParseFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]string
+		err  bool
+	}{
+		{"nothing", map[string]string{}, false},
+		{"bbox", map[string]string{"bbox": "-10, 40, 10, 60"}, false},
+		{"bbox across the antimeridian", map[string]string{"bbox": "170,-30,-170,0"}, false},
+		{"bbox of the world", map[string]string{"bbox": "-180,-90,180,90"}, false},
+		{"bbox of three", map[string]string{"bbox": "1,2,3"}, true},
+		{"bbox of five", map[string]string{"bbox": "1,2,3,4,5"}, true},
+		{"bbox not numbers", map[string]string{"bbox": "a,b,c,d"}, true},
+		{"bbox south of north", map[string]string{"bbox": "0,10,10,0"}, true},
+		{"bbox NaN", map[string]string{"bbox": "NaN,0,10,10"}, true},
+		{"bbox infinite", map[string]string{"bbox": "0,0,+Inf,10"}, true},
+		{"bbox negative infinite", map[string]string{"bbox": "0,-Inf,10,10"}, true},
+		{"bbox west out of range", map[string]string{"bbox": "-181,0,10,10"}, true},
+		{"bbox east out of range", map[string]string{"bbox": "0,0,180.5,10"}, true},
+		{"bbox south out of range", map[string]string{"bbox": "0,-91,10,10"}, true},
+		{"bbox north out of range", map[string]string{"bbox": "0,0,10,90.1"}, true},
+		{"max_age", map[string]string{"max_age": "24h"}, false},
+		{"bad max_age", map[string]string{"max_age": "a day"}, true},
+		{"negative max_age", map[string]string{"max_age": "-1h"}, true},
+		{"sensors", map[string]string{"sensors": "lnd, pms,,loc"}, false},
+		{"unknown sensor", map[string]string{"sensors": "lnd,xyz"}, true},
+	}
+	for _, tt := range tests {
+		_, err := devicesParseFilter(tt.args)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+		}
+	}
+}
+
+func TestDevicesFilter(t *testing.T) {
+	devicesTestSetup(t)
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"all", "", []string{"safecast:1", "safecast:2", "safecast:3", "safecast:4", "safecast:5"}},
+		{"class", "?class=^solar", []string{"safecast:3", "safecast:4"}},
+		{"bbox", "?bbox=-10,40,10,60", []string{"safecast:2"}},
+		{"bbox edges are within", "?bbox=0,0,139.7,35.6", []string{"safecast:1", "safecast:5"}},
+		{"bbox across the antimeridian", "?bbox=170,-30,-170,0", []string{"safecast:3", "safecast:4"}},
+		{"bbox not across the antimeridian", "?bbox=-170,-30,170,0", []string{"safecast:5"}},
+		{"sensors", "?sensors=lnd,loc", []string{"safecast:1", "safecast:2", "safecast:3", "safecast:4", "safecast:5"}},
+		{"sensors not reported", "?sensors=pms", []string{}},
+		{"count", "?count=2", []string{"safecast:1", "safecast:2"}},
+		{"offset and count", "?offset=1&count=2", []string{"safecast:2", "safecast:3"}},
+		{"offset after filtering", "?class=^solar&offset=1&count=5", []string{"safecast:4"}},
+		{"offset after bbox", "?bbox=-180,-90,0,90&offset=1&count=5", []string{"safecast:4", "safecast:5"}},
+		{"offset past the end", "?class=^solar&offset=2&count=5", []string{}},
+	}
+	for _, tt := range tests {
+		rw := devicesTestRequest(t, tt.query)
+		if rw.Code != http.StatusOK {
+			t.Errorf("%s: got %d, %s", tt.name, rw.Code, rw.Body.String())
+			continue
+		}
+		if got := devicesTestUIDs(t, rw); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDevicesBadRequest(t *testing.T) {
+	devicesTestSetup(t)
+	for _, query := range []string{"?bbox=NaN,0,10,10", "?bbox=0,0,200,10", "?max_age=soon", "?sensors=xyz", "?format=xml"} {
+		if rw := devicesTestRequest(t, query); rw.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", query, rw.Code)
+		}
+	}
+}
+
+func TestDevicesGeoJSON(t *testing.T) {
+	devicesTestSetup(t)
+	store.Put(TTDeviceStatusPath, "safecast-6", []byte(`{"current_values":{"device_urn":"safecast:6"}}`))
+	rw := devicesTestRequest(t, "?format=geojson&bbox=170,-30,-170,0")
+	if rw.Code != http.StatusOK || rw.Header().Get("Content-Type") != "application/geo+json" {
+		t.Fatalf("got %d, %s", rw.Code, rw.Header().Get("Content-Type"))
+	}
+	var fc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Type     string `json:"type"`
+			Geometry struct {
+				Type        string    `json:"type"`
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	err := json.Unmarshal(rw.Body.Bytes(), &fc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc.Type != "FeatureCollection" || len(fc.Features) != 2 {
+		t.Fatalf("got %s of %d features", fc.Type, len(fc.Features))
+	}
+	feature := fc.Features[1]
+	if feature.Type != "Feature" || feature.Geometry.Type != "Point" || !reflect.DeepEqual(feature.Geometry.Coordinates, []float64{-179.0, -17.7}) {
+		t.Errorf("got %+v", feature)
+	}
+	want := map[string]interface{}{"device_urn": "safecast:4", "device_class": "solarcast", "lnd_7318u": 40.0}
+	if !reflect.DeepEqual(feature.Properties, want) {
+		t.Errorf("properties %v, want %v", feature.Properties, want)
+	}
+
+	// Devices without a location are left out, and no devices is an empty collection rather than null
+	rw = devicesTestRequest(t, "?format=geojson&class=^none")
+	if got := rw.Body.String(); got != `{"type":"FeatureCollection","features":[]}` {
+		t.Errorf("empty: got %s", got)
+	}
+	rw = devicesTestRequest(t, "?format=geojson")
+	if err := json.Unmarshal(rw.Body.Bytes(), &fc); err != nil || len(fc.Features) != 5 {
+		t.Errorf("all: got %d features, %v", len(fc.Features), err)
+	}
+}
+
+func TestDevicesCSV(t *testing.T) {
+	devicesTestSetup(t)
+	rw := devicesTestRequest(t, "?format=csv&class=^pointcast")
+	if rw.Code != http.StatusOK || rw.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("got %d, %s", rw.Code, rw.Header().Get("Content-Type"))
+	}
+	records, err := csv.NewReader(strings.NewReader(rw.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || !reflect.DeepEqual(records[0], devicesFields) {
+		t.Fatalf("got %q", records)
+	}
+	column := map[string]int{}
+	for i, field := range devicesFields {
+		column[field] = i
+	}
+	for i, want := range []struct{ uid, lat, lon, cpm string }{{"safecast:1", "35.6", "139.7", "10"}, {"safecast:2", "51.5", "-0.1", "20"}} {
+		record := records[i+1]
+		if len(record) != len(devicesFields) {
+			t.Fatalf("%d columns, want %d", len(record), len(devicesFields))
+		}
+		got := []string{record[column["device_urn"]], record[column["loc_lat"]], record[column["loc_lon"]], record[column["lnd_7318u"]], record[column["pms_aqi"]]}
+		if !reflect.DeepEqual(got, []string{want.uid, want.lat, want.lon, want.cpm, ""}) {
+			t.Errorf("got %q", got)
+		}
+	}
+}
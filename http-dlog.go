@@ -2,36 +2,305 @@
 // Use of this source code is governed by licenses granted by the
 // copyright holder including that found in the LICENSE file.
 
-// Inbound support for the "/log" HTTP topic
+// Inbound support for the "/device-log" HTTP topic, where GET of
+// "/device-log/<deviceUID>?from=&to=&fields=&format=json|ndjson|csv&limit=" returns the
+// entries that a device logged, across however many months, captured within a range of
+// times and with only the fields requested.  The result is streamed as it is read.  GET of
+// "/device-log/<month>$<device>.json" returns all of a single month's log as newline-delimited
+// JSON, whatever format it was logged in, where it was once returned exactly as it was stored.
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Handle inbound HTTP requests to fetch log files
+// Formats in which a device log may be returned
+const deviceLogFormatJSON = "json"
+const deviceLogFormatNDJSON = "ndjson"
+const deviceLogFormatCSV = "csv"
+
+// The columns of CSV unless fields are requested
+var deviceLogCSVFields = []string{"device_urn", "device", "when_captured", "loc_lat", "loc_lon",
+	"lnd_7318u", "lnd_7128ec", "lnd_712u", "lnd_usv", "pms_pm01_0", "pms_pm02_5", "pms_pm10_0", "pms_aqi",
+	"env_temp", "env_humid", "env_press", "bat_voltage", "service_uploaded"}
+
+// How many entries we write between flushes to the client
+const deviceLogFlushEntries = 100
+
+// A query of a device's logs
+type deviceLogQuery struct {
+	deviceUID string
+	from      time.Time
+	to        time.Time
+	bounded   bool
+	fields    []string
+	format    string
+	limit     int
+}
+
+// Handle inbound HTTP requests to fetch device logs
 func inboundWebDeviceLogHandler(rw http.ResponseWriter, req *http.Request) {
 	stats.Count.HTTP++
 
+	target, args, err := HTTPArgs(req, TTServerTopicDeviceLog)
+	if err == nil {
+		target, err = url.PathUnescape(target)
+	}
+	if err != nil {
+		http.Error(rw, ErrorString(err), http.StatusBadRequest)
+		return
+	}
+
 	// Log it
-	filename := req.RequestURI[len(TTServerTopicDeviceLog):]
-	fmt.Printf("%s LOG request for %s\n", LogTime(), filename)
+	fmt.Printf("%s LOG request for %s\n", LogTime(), target)
+
+	// A single month's log, named as it is stored
+	if strings.Contains(target, DeviceLogSep()) {
+		deviceLogSingle(rw, strings.TrimSuffix(target, ".json"))
+		return
+	}
+
+	query, err := deviceLogParseQuery(target, args)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logs, err := DeviceLogMonths(query.deviceUID, query.from, query.to)
+	if err != nil {
+		http.Error(rw, ErrorString(err), http.StatusInternalServerError)
+		return
+	}
+	if len(logs) == 0 {
+		http.Error(rw, fmt.Sprintf("no logs for %s", query.deviceUID), http.StatusNotFound)
+		return
+	}
+
+	deviceLogStream(rw, query, logs)
+
+}
+
+// deviceLogSingle copies the entries of a log to output as newline-delimited JSON, whatever format they were logged in
+func deviceLogSingle(rw http.ResponseWriter, name string) {
 
-	// Open the file
-	file := SafecastDirectory() + TTDeviceLogPath + "/" + filename
-	fd, err := os.Open(file)
+	fd, err := store.Open(TTDeviceLogPath, name)
 	if err != nil {
-		io.WriteString(rw, ErrorString(err))
+		deviceLogOpenError(rw, err)
 		return
 	}
 	defer fd.Close()
 
-	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+
+	reader := NewDeviceLogReader(fd)
+	for {
+		raw, ok := reader.NextRaw()
+		if !ok {
+			break
+		}
+		rw.Write(append(raw, '\n'))
+	}
+
+}
+
+// deviceLogOpenError reports a log that can't be opened, before anything else has been written
+func deviceLogOpenError(rw http.ResponseWriter, err error) {
+	if os.IsNotExist(err) {
+		http.Error(rw, "no such log", http.StatusNotFound)
+		return
+	}
+	http.Error(rw, ErrorString(err), http.StatusInternalServerError)
+}
+
+// deviceLogParseQuery interprets the arguments of a query
+func deviceLogParseQuery(deviceUID string, args map[string]string) (query deviceLogQuery, err error) {
+
+	query.deviceUID = deviceUID
+	if deviceUID == "" {
+		return query, fmt.Errorf("a device UID is required")
+	}
+
+	query.to = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	if args["from"] != "" {
+		query.from, err = ParseDateOrTime(args["from"], false)
+		if err != nil {
+			return
+		}
+		query.bounded = true
+	}
+	if args["to"] != "" {
+		query.to, err = ParseDateOrTime(args["to"], true)
+		if err != nil {
+			return
+		}
+		query.bounded = true
+	}
+	if query.to.Before(query.from) {
+		return query, fmt.Errorf("'to' is before 'from'")
+	}
+
+	for _, field := range strings.Split(args["fields"], ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			query.fields = append(query.fields, field)
+		}
+	}
+
+	query.format = args["format"]
+	switch query.format {
+	case "":
+		query.format = deviceLogFormatJSON
+	case deviceLogFormatJSON, deviceLogFormatNDJSON, deviceLogFormatCSV:
+	default:
+		return query, fmt.Errorf("unknown format '%s'", query.format)
+	}
+
+	if args["limit"] != "" {
+		query.limit, err = strconv.Atoi(args["limit"])
+		if err != nil || query.limit <= 0 {
+			return query, fmt.Errorf("invalid limit '%s'", args["limit"])
+		}
+	}
+
+	return
+
+}
+
+// deviceLogStream writes the entries of the logs that match the query, as they are read
+func deviceLogStream(rw http.ResponseWriter, query deviceLogQuery, logs []string) {
+
+	// Open the first log before writing anything, so that if it can't be read we can say so
+	fd, err := store.Open(TTDeviceLogPath, logs[0])
+	if err != nil {
+		deviceLogOpenError(rw, err)
+		return
+	}
+
+	flusher, _ := rw.(http.Flusher)
+	var csvWriter *csv.Writer
+
+	switch query.format {
+	case deviceLogFormatJSON:
+		rw.Header().Set("Content-Type", "application/json")
+		io.WriteString(rw, "[")
+	case deviceLogFormatNDJSON:
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+	case deviceLogFormatCSV:
+		rw.Header().Set("Content-Type", "text/csv")
+		if len(query.fields) == 0 {
+			query.fields = deviceLogCSVFields
+		}
+		csvWriter = csv.NewWriter(rw)
+		csvWriter.Write(query.fields)
+	}
+
+	count := 0
+	for i, log := range logs {
+
+		if i != 0 {
+			fd, err = store.Open(TTDeviceLogPath, log)
+			if err != nil {
+				fmt.Printf("*** can't read device log %s: %s\n", log, err)
+				continue
+			}
+		}
+		reader := NewDeviceLogReader(fd)
+
+		for query.limit == 0 || count < query.limit {
+			raw, ok := reader.NextRaw()
+			if !ok {
+				break
+			}
+			entry := map[string]json.RawMessage{}
+			if json.Unmarshal(raw, &entry) != nil {
+				continue
+			}
+			if query.bounded && !deviceLogInRange(entry, query) {
+				continue
+			}
+
+			switch query.format {
+			case deviceLogFormatJSON, deviceLogFormatNDJSON:
+				if len(query.fields) != 0 {
+					projected := map[string]json.RawMessage{}
+					for _, field := range query.fields {
+						value, present := entry[field]
+						if present {
+							projected[field] = value
+						}
+					}
+					raw, _ = json.Marshal(projected)
+				}
+				if query.format == deviceLogFormatNDJSON {
+					rw.Write(append(raw, '\n'))
+				} else {
+					if count != 0 {
+						io.WriteString(rw, ",")
+					}
+					io.WriteString(rw, "\n")
+					rw.Write(raw)
+				}
+			case deviceLogFormatCSV:
+				record := make([]string, len(query.fields))
+				for i, field := range query.fields {
+					record[i] = deviceLogCSVValue(entry[field])
+				}
+				csvWriter.Write(record)
+			}
 
-	// Copy the file to output
-	io.Copy(rw, fd)
+			count++
+			if count%deviceLogFlushEntries == 0 {
+				if csvWriter != nil {
+					csvWriter.Flush()
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+
+		fd.Close()
+
+	}
+
+	switch query.format {
+	case deviceLogFormatJSON:
+		io.WriteString(rw, "\n]\n")
+	case deviceLogFormatCSV:
+		csvWriter.Flush()
+	}
 
 }
+
+// deviceLogInRange returns true if the entry was captured within the range of the query
+func deviceLogInRange(entry map[string]json.RawMessage, query deviceLogQuery) bool {
+	var when string
+	if json.Unmarshal(entry["when_captured"], &when) != nil {
+		return false
+	}
+	captured, err := time.Parse(time.RFC3339, when)
+	if err != nil {
+		return false
+	}
+	return !captured.Before(query.from) && !captured.After(query.to)
+}
+
+// deviceLogCSVValue formats a field as a CSV value, being a string without its quotes, or JSON otherwise
+func deviceLogCSVValue(value json.RawMessage) string {
+	if len(value) == 0 || string(value) == "null" {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(value, &s) == nil {
+		return s
+	}
+	return string(value)
+}
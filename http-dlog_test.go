@@ -0,0 +1,140 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deviceLogTestRequest sends a GET to the device log handler
+func deviceLogTestRequest(t *testing.T, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, TTServerTopicDeviceLog+path, nil)
+	rw := httptest.NewRecorder()
+	inboundWebDeviceLogHandler(rw, req)
+	return rw
+}
+
+func TestDeviceLogParseQuery(t *testing.T) {
+	unbounded := time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		device string
+		args   map[string]string
+		want   deviceLogQuery
+		err    bool
+	}{
+		{"defaults", "safecast:7", map[string]string{}, deviceLogQuery{deviceUID: "safecast:7", to: unbounded, format: deviceLogFormatJSON}, false},
+		{"everything", "safecast:7", map[string]string{"from": "2024-05-01", "to": "2024-05-31", "fields": " device_urn, ,bat_voltage", "format": "csv", "limit": "10"},
+			deviceLogQuery{deviceUID: "safecast:7", from: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), to: time.Date(2024, 5, 31, 23, 59, 59, 999999999, time.UTC), bounded: true,
+				fields: []string{"device_urn", "bat_voltage"}, format: deviceLogFormatCSV, limit: 10}, false},
+		{"ndjson", "safecast:7", map[string]string{"format": "ndjson"}, deviceLogQuery{deviceUID: "safecast:7", to: unbounded, format: deviceLogFormatNDJSON}, false},
+		{"no device", "", map[string]string{}, deviceLogQuery{}, true},
+		{"bad from", "safecast:7", map[string]string{"from": "May 1"}, deviceLogQuery{}, true},
+		{"bad to", "safecast:7", map[string]string{"to": "2024-13-01"}, deviceLogQuery{}, true},
+		{"backwards", "safecast:7", map[string]string{"from": "2024-05-02", "to": "2024-05-01"}, deviceLogQuery{}, true},
+		{"unknown format", "safecast:7", map[string]string{"format": "xml"}, deviceLogQuery{}, true},
+		{"zero limit", "safecast:7", map[string]string{"limit": "0"}, deviceLogQuery{}, true},
+		{"negative limit", "safecast:7", map[string]string{"limit": "-1"}, deviceLogQuery{}, true},
+		{"bad limit", "safecast:7", map[string]string{"limit": "ten"}, deviceLogQuery{}, true},
+	}
+	for _, tt := range tests {
+		query, err := deviceLogParseQuery(tt.device, tt.args)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(query, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, query, tt.want)
+		}
+	}
+}
+
+func TestDeviceLogQuery(t *testing.T) {
+	noteBatchTestSetup(t, TTServeConfig{})
+	backfillTestLogs(t)
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		want        string
+	}{
+		{"json", "safecast:7?fields=bat_voltage", "application/json",
+			"[\n{\"bat_voltage\":1},\n{\"bat_voltage\":1},\n{\"bat_voltage\":2},\n{\"bat_voltage\":3}\n]\n"},
+		{"ndjson", "safecast:7?format=ndjson&fields=bat_voltage", "application/x-ndjson",
+			"{\"bat_voltage\":1}\n{\"bat_voltage\":1}\n{\"bat_voltage\":2}\n{\"bat_voltage\":3}\n"},
+		{"whole entries", "safecast:8?format=ndjson", "application/x-ndjson",
+			"{\"device_urn\":\"safecast:8\",\"device\":8,\"when_captured\":\"2024-05-10T01:02:03Z\",\"bat_voltage\":5}\n"},
+		{"projection keeps only fields present", "safecast:8?format=ndjson&fields=device,loc_lat", "application/x-ndjson",
+			"{\"device\":8}\n"},
+		{"range", "safecast:7?format=ndjson&fields=bat_voltage&from=2024-05-04&to=2024-06-30", "application/x-ndjson",
+			"{\"bat_voltage\":2}\n{\"bat_voltage\":3}\n"},
+		{"limit", "safecast:7?format=ndjson&fields=bat_voltage&limit=3", "application/x-ndjson",
+			"{\"bat_voltage\":1}\n{\"bat_voltage\":1}\n{\"bat_voltage\":2}\n"},
+		{"limit across months", "safecast:7?format=ndjson&fields=bat_voltage&from=2024-05-04&limit=2", "application/x-ndjson",
+			"{\"bat_voltage\":2}\n{\"bat_voltage\":3}\n"},
+		{"csv", "safecast:7?format=csv&fields=device_urn,when_captured,bat_voltage,loc_lat&from=2024-05-04", "text/csv",
+			"device_urn,when_captured,bat_voltage,loc_lat\nsafecast:7,2024-05-20T01:02:03Z,2,\nsafecast:7,2024-06-02T01:02:03Z,3,\n"},
+		{"csv, common columns", "safecast:8?format=csv", "text/csv",
+			strings.Join(deviceLogCSVFields, ",") + "\nsafecast:8,8,2024-05-10T01:02:03Z,,,,,,,,,,,,,,5,\n"},
+		{"single month, converted", "2024-05$safecast-8.json", "application/x-ndjson",
+			"{\"device_urn\":\"safecast:8\",\"device\":8,\"when_captured\":\"2024-05-10T01:02:03Z\",\"bat_voltage\":5}\n"},
+	}
+	for _, tt := range tests {
+		rw := deviceLogTestRequest(t, tt.path)
+		if rw.Code != http.StatusOK {
+			t.Errorf("%s: got %d, %s", tt.name, rw.Code, rw.Body.String())
+			continue
+		}
+		if got := rw.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%s: content type %s, want %s", tt.name, got, tt.contentType)
+		}
+		if got := rw.Body.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A month logged in the legacy format is returned as newline-delimited JSON
+func TestDeviceLogSingleLegacy(t *testing.T) {
+	noteBatchTestSetup(t, TTServeConfig{})
+	store.Put(TTDeviceLogPath, "2024-05$safecast-7", []byte("{\"a\":1}\n,\n{\"a\":2}\n,\ngarbage\n"))
+	rw := deviceLogTestRequest(t, "2024-05$safecast-7.json")
+	if rw.Code != http.StatusOK || rw.Body.String() != "{\"a\":1}\n{\"a\":2}\n" {
+		t.Errorf("got %d, %q", rw.Code, rw.Body.String())
+	}
+}
+
+// Errors are reported with a status, and before anything else is written
+func TestDeviceLogErrors(t *testing.T) {
+	noteBatchTestSetup(t, TTServeConfig{})
+	backfillTestLogs(t)
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"no device", "", http.StatusBadRequest},
+		{"bad query", "safecast:7?from=yesterday", http.StatusBadRequest},
+		{"unknown format", "safecast:7?format=xml", http.StatusBadRequest},
+		{"no logs", "safecast:9", http.StatusNotFound},
+		{"no logs in range", "safecast:7?from=2024-07-01&to=2024-07-31", http.StatusNotFound},
+		{"no such month", "2024-07$safecast-7.json", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rw := deviceLogTestRequest(t, tt.path)
+		if rw.Code != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.name, rw.Code, tt.status)
+		}
+		if strings.HasPrefix(rw.Body.String(), "[") || !strings.HasPrefix(rw.Header().Get("Content-Type"), "text/plain") {
+			t.Errorf("%s: streamed before the error: %s %q", tt.name, rw.Header().Get("Content-Type"), rw.Body.String())
+		}
+	}
+}
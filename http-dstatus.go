@@ -24,17 +24,15 @@ func inboundWebDeviceStatusHandler(rw http.ResponseWriter, req *http.Request) {
 	deviceUID := req.RequestURI[len(TTServerTopicDeviceStatus):]
 	fmt.Printf("%s Device information request for %s\n", LogTime(), deviceUID)
 
-	// Open the file
-	file := GetDeviceStatusFilePath(deviceUID)
-	fd, err := os.Open(file)
+	// Get the status
+	contents, err := store.Get(TTDeviceStatusPath, DeviceUIDFilename(deviceUID))
 	if err != nil {
 		io.WriteString(rw, ErrorString(err))
 		return
 	}
-	defer fd.Close()
 
-	// Copy the file to output
-	io.Copy(rw, fd)
+	// Copy it to output
+	rw.Write(contents)
 
 }
 
@@ -10,7 +10,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 )
 
 // Handle inbound HTTP requests to fetch log files
@@ -40,7 +39,7 @@ func inboundWebGatewayUpdateHandler(rw http.ResponseWriter, req *http.Request) {
 
 	fmt.Printf("\n%s Received gateway update for %s %s (%s)\n", LogTime(), ttg.GatewayID, ttg.GatewayName, ttg.GatewayRegion)
 
-	go WriteGatewayStatus(ttg, requestor)
+	trackedGo(func() { WriteGatewayStatus(ttg, requestor) })
 	stats.Count.HTTPGUpdate++
 }
 
@@ -58,17 +57,15 @@ func inboundWebGatewayStatusHandler(rw http.ResponseWriter, req *http.Request) {
 
 			fmt.Printf("%s Gateway information request for %s\n", LogTime(), filename)
 
-			// Open the file
-			file := SafecastDirectory() + TTGatewayStatusPath + "/" + filename + ".json"
-			fd, err := os.Open(file)
+			// Get the status
+			contents, err := store.Get(TTGatewayStatusPath, filename)
 			if err != nil {
 				io.WriteString(rw, ErrorString(err))
 				return
 			}
-			defer fd.Close()
 
-			// Copy the file to output
-			io.Copy(rw, fd)
+			// Copy it to output
+			rw.Write(contents)
 			return
 
 		}
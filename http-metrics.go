@@ -0,0 +1,186 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Inbound support for the "/metrics" HTTP topic, which exports this instance's
+// counters and gauges in the Prometheus text exposition format
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A metrics page being generated
+type metricsPage struct {
+	b strings.Builder
+}
+
+// Begin a metric family with its help and type
+func (p *metricsPage) family(name string, mtype string, help string) {
+	p.b.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, mtype))
+}
+
+// Add a single sample to the current metric family
+func (p *metricsPage) sample(name string, labels map[string]string, value float64) {
+	p.b.WriteString(name)
+	if len(labels) != 0 {
+		var keys []string
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var pairs []string
+		for _, k := range keys {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", k, strconv.Quote(labels[k])))
+		}
+		p.b.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	p.b.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// Handle inbound HTTP requests to fetch metrics
+func inboundWebMetricsHandler(rw http.ResponseWriter, req *http.Request) {
+	stats.Count.HTTP++
+
+	p := &metricsPage{}
+
+	// Counts since restart, including those not yet flushed to the status file
+	count := currentCountsSinceRestart()
+
+	p.family("ttserve_started_timestamp_seconds", "gauge", "Time at which this instance started.")
+	p.sample("ttserve_started_timestamp_seconds", nil, float64(stats.Started.Unix()))
+
+	p.family("ttserve_received_total", "counter", "Messages received, by transport.")
+	received := map[string]uint32{
+		"udp":           count.UDP,
+		"tcp":           count.TCP,
+		"http_relay":    count.HTTPRelay,
+		"http_device":   count.HTTPDevice,
+		"http_gateway":  count.HTTPGateway,
+		"http_gupdate":  count.HTTPGUpdate,
+		"http_redirect": count.HTTPRedirect,
+		"ttn_http":      count.HTTPTTN,
+		"ttn_mqtt":      count.MQTTTTN,
+		"note":          count.HTTPNote,
+		"slack":         count.HTTPSlack,
+		"github":        count.HTTPGithub,
+	}
+	var transports []string
+	for transport := range received {
+		transports = append(transports, transport)
+	}
+	sort.Strings(transports)
+	for _, transport := range transports {
+		p.sample("ttserve_received_total", map[string]string{"transport": transport}, float64(received[transport]))
+	}
+
+	p.family("ttserve_rejected_total", "counter", "Messages rejected for failing authentication, by transport.")
+	p.sample("ttserve_rejected_total", map[string]string{"transport": "note"}, float64(count.HTTPNoteRejected))
+
+	p.family("ttserve_device_rejected_total", "counter", "Device messages rejected for being unsigned or badly signed, by reason.")
+	p.sample("ttserve_device_rejected_total", map[string]string{"reason": "unsigned"}, float64(count.DeviceUnsigned))
+	p.sample("ttserve_device_rejected_total", map[string]string{"reason": "signature"}, float64(count.DeviceBadSigned))
+	p.sample("ttserve_device_rejected_total", map[string]string{"reason": "replayed"}, float64(count.DeviceReplayed))
+
+	p.family("ttserve_abuse_rejected_total", "counter", "Messages rejected as abusive, by reason.")
+	p.sample("ttserve_abuse_rejected_total", map[string]string{"reason": "refused"}, float64(count.Refused))
+	p.sample("ttserve_abuse_rejected_total", map[string]string{"reason": "rate_limited"}, float64(count.RateLimited))
+
+	p.family("ttserve_malformed_total", "counter", "Malformed payloads received.")
+	p.sample("ttserve_malformed_total", nil, float64(count.Malformed))
+
+	p.family("ttserve_bans_total", "counter", "Addresses banned for sending floods of malformed payloads.")
+	p.sample("ttserve_bans_total", nil, float64(count.Bans))
+
+	p.family("ttserve_http_requests_total", "counter", "HTTP requests of any kind.")
+	p.sample("ttserve_http_requests_total", nil, float64(count.HTTP))
+
+	// Upload outcomes, by sink
+	sinkStatus := sinkStatus()
+	var sinkNames []string
+	for name := range sinkStatus {
+		sinkNames = append(sinkNames, name)
+	}
+	sort.Strings(sinkNames)
+	p.family("ttserve_sink_uploads_total", "counter", "Uploads to each sink, by outcome.")
+	for _, name := range sinkNames {
+		st := sinkStatus[name]
+		p.sample("ttserve_sink_uploads_total", map[string]string{"sink": name, "outcome": "sent"}, float64(st.Sent))
+		p.sample("ttserve_sink_uploads_total", map[string]string{"sink": name, "outcome": "failed"}, float64(st.Failed))
+		p.sample("ttserve_sink_uploads_total", map[string]string{"sink": name, "outcome": "skipped"}, float64(st.Skipped))
+	}
+	p.family("ttserve_sink_up", "gauge", "Whether each sink is able to accept uploads.")
+	for _, name := range sinkNames {
+		up := 0.0
+		if sinkStatus[name].Health == "ok" {
+			up = 1.0
+		}
+		p.sample("ttserve_sink_up", map[string]string{"sink": name}, up)
+	}
+
+	// Upload transactions, by destination
+	uploads := metricsSnapshot()
+	var destinations []string
+	for destination := range uploads {
+		destinations = append(destinations, destination)
+	}
+	sort.Strings(destinations)
+	p.family("ttserve_upload_errors_total", "counter", "Upload transactions that failed, by destination.")
+	for _, destination := range destinations {
+		p.sample("ttserve_upload_errors_total", map[string]string{"destination": destination}, float64(uploads[destination].Errors))
+	}
+	p.family("ttserve_uploads_in_progress", "gauge", "Upload transactions in progress, by destination.")
+	for _, destination := range destinations {
+		p.sample("ttserve_uploads_in_progress", map[string]string{"destination": destination}, float64(uploads[destination].InProgress))
+	}
+	p.family("ttserve_upload_duration_seconds", "histogram", "Latency of upload transactions, by destination.")
+	for _, destination := range destinations {
+		m := uploads[destination]
+		var cumulative uint64
+		for i, bucket := range m.Histogram {
+			cumulative += bucket.Count
+			le := "+Inf"
+			if i < len(metricsLatencyBuckets) {
+				le = strconv.FormatFloat(metricsLatencyBuckets[i].Seconds(), 'g', -1, 64)
+			}
+			p.sample("ttserve_upload_duration_seconds_bucket", map[string]string{"destination": destination, "le": le}, float64(cumulative))
+		}
+		p.sample("ttserve_upload_duration_seconds_sum", map[string]string{"destination": destination}, float64(m.TotalMs)/1000)
+		p.sample("ttserve_upload_duration_seconds_count", map[string]string{"destination": destination}, float64(m.Count))
+	}
+
+	// Queued uploads awaiting retry
+	p.family("ttserve_upload_queue_depth", "gauge", "Failed uploads awaiting retry, by sink.")
+	queue := uploadQueueDepth()
+	var names []string
+	for name := range queue {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.sample("ttserve_upload_queue_depth", map[string]string{"sink": name}, float64(queue[name]))
+	}
+
+	// What we've seen
+	p.family("ttserve_seen_devices", "gauge", "Devices seen since restart.")
+	p.sample("ttserve_seen_devices", nil, float64(seenDeviceCount()))
+	p.family("ttserve_seen_gateways", "gauge", "Gateways seen since restart.")
+	p.sample("ttserve_seen_gateways", nil, float64(seenGatewayCount()))
+
+	// Runtime
+	p.family("ttserve_goroutines", "gauge", "Goroutines currently running.")
+	p.sample("ttserve_goroutines", nil, float64(runtime.NumGoroutine()))
+	p.family("ttserve_uptime_seconds", "gauge", "Seconds since this instance started.")
+	p.sample("ttserve_uptime_seconds", nil, float64(time.Since(stats.Started)/time.Second))
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(rw, p.b.String())
+
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Authentication of the Notehub routes that post events to the note topics.  A
+// route proves that it is ours either by sending a shared secret in a custom
+// header, or by signing the body with an HMAC-SHA256 keyed by that secret.
+// Independently, events may be restricted to a set of known products.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/blues/note-go/note"
+)
+
+// Headers used unless otherwise configured
+const noteSecretHeaderDefault = "X-Safecast-Secret"
+const noteSignatureHeaderDefault = "X-Safecast-Signature"
+
+// noteAuthenticate returns an error if the request isn't from a route that we trust, along
+// with the HTTP status that should be returned to the requestor
+func noteAuthenticate(req *http.Request, body []byte, e note.Event) (status int, err error) {
+	status, err = noteAuthenticateRequest(req, body)
+	if err != nil {
+		return
+	}
+	return noteAuthenticateProduct(e)
+}
+
+// noteAuthenticateRequest checks the secret or signature of a request, which may contain many events
+func noteAuthenticateRequest(req *http.Request, body []byte) (status int, err error) {
+
+	config := CurrentServiceConfig()
+
+	if len(config.NoteSecrets) != 0 {
+		secret := req.Header.Get(config.NoteSecretHeader)
+		signature := req.Header.Get(config.NoteSignatureHeader)
+		if secret == "" && signature == "" {
+			return http.StatusUnauthorized, fmt.Errorf("no secret or signature")
+		}
+		if !noteSecretValid(config.NoteSecrets, secret) && !noteSignatureValid(config.NoteSecrets, signature, body) {
+			return http.StatusUnauthorized, fmt.Errorf("invalid secret or signature")
+		}
+	}
+
+	return http.StatusOK, nil
+
+}
+
+// noteRequestTrusted returns true if a request presents one of the configured secrets, or a signature
+// made with one, which is never so when none are configured
+func noteRequestTrusted(req *http.Request, body []byte) bool {
+	config := CurrentServiceConfig()
+	if len(config.NoteSecrets) == 0 {
+		return false
+	}
+	return noteSecretValid(config.NoteSecrets, req.Header.Get(config.NoteSecretHeader)) ||
+		noteSignatureValid(config.NoteSecrets, req.Header.Get(config.NoteSignatureHeader), body)
+}
+
+// noteAuthenticateProduct checks that an event is from one of the products that we accept
+func noteAuthenticateProduct(e note.Event) (status int, err error) {
+
+	config := CurrentServiceConfig()
+
+	if len(config.NoteProductUIDs) != 0 {
+		allowed := false
+		for _, productUID := range config.NoteProductUIDs {
+			if e.ProductUID == productUID {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return http.StatusForbidden, fmt.Errorf("product '%s' is not allowed", e.ProductUID)
+		}
+	}
+
+	return http.StatusOK, nil
+
+}
+
+// noteSecretValid returns true if the secret is one of those configured
+func noteSecretValid(secrets []string, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	for _, s := range secrets {
+		if subtle.ConstantTimeCompare([]byte(s), []byte(secret)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// noteSignatureValid returns true if the signature, in hex or base64 and optionally
+// prefixed by "sha256=", is the HMAC-SHA256 of the body using one of the configured secrets
+func noteSignatureValid(secrets []string, signature string, body []byte) bool {
+	if signature == "" {
+		return false
+	}
+	signature = strings.TrimPrefix(signature, "sha256=")
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		sig, err = base64.StdEncoding.DecodeString(signature)
+		if err != nil {
+			return false
+		}
+	}
+	for _, s := range secrets {
+		mac := hmac.New(sha256.New, []byte(s))
+		mac.Write(body)
+		if hmac.Equal(sig, mac.Sum(nil)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Inbound support for batches of events posted to the note topics, either as a
+// JSON array or as newline-delimited JSON, as chosen by the content type.  Each
+// event is processed just as if it had been posted on its own, except that the
+// events of any given device are uploaded and logged in the order received.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+
+	ttdata "github.com/Safecast/safecast-go"
+	"github.com/blues/note-go/note"
+)
+
+// Batch formats
+const noteBatchArray = "array"
+const noteBatchNDJSON = "ndjson"
+
+// Content types that indicate newline-delimited JSON
+var noteBatchNDJSONTypes = []string{
+	"application/x-ndjson",
+	"application/ndjson",
+	"application/jsonl",
+	"application/x-jsonlines",
+}
+
+// Outcomes of processing an event
+const noteBatchAccepted = "accepted"
+const noteBatchQuarantined = "quarantined"
+const noteBatchRejected = "rejected"
+
+// NoteBatchResult is the outcome of processing a single event of a batch
+type NoteBatchResult struct {
+	Index     int    `json:"index"`
+	EventUID  string `json:"event,omitempty"`
+	DeviceUID string `json:"device,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// NoteBatchResponse summarizes the outcome of processing a batch
+type NoteBatchResponse struct {
+	Accepted    int               `json:"accepted"`
+	Quarantined int               `json:"quarantined"`
+	Rejected    int               `json:"rejected"`
+	Events      []NoteBatchResult `json:"events"`
+}
+
+// An event that has been converted, awaiting upload and logging
+type noteBatchEntry struct {
+	sd     ttdata.SafecastData
+	upload bool
+	log    bool
+	body   []byte
+}
+
+// noteBatchFormat determines whether or not the request is a batch and, if so, of what format
+func noteBatchFormat(req *http.Request, body []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	for _, t := range noteBatchNDJSONTypes {
+		if mediaType == t {
+			return noteBatchNDJSON
+		}
+	}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		return noteBatchArray
+	}
+	return ""
+}
+
+// noteBatchEvents splits the body of a batch into the JSON of its events
+func noteBatchEvents(format string, body []byte) (events []json.RawMessage, err error) {
+
+	if format == noteBatchArray {
+		err = json.Unmarshal(body, &events)
+		return
+	}
+
+	// Each line is an event, so that a malformed line is rejected on its own
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) != 0 {
+			events = append(events, json.RawMessage(line))
+		}
+	}
+	return
+
+}
+
+// noteBatchHandler processes a batch of events, replying with the outcome of each
+func noteBatchHandler(rw http.ResponseWriter, req *http.Request, format string, body []byte, transportStr string, testMode bool) {
+
+	// The secret or signature covers the batch as a whole
+	status, err := noteAuthenticateRequest(req, body)
+	if err != nil {
+		stats.Count.HTTPNoteRejected++
+		ServerLog(fmt.Sprintf("NOTE batch rejected from %s: %s\n", transportStr, err))
+		http.Error(rw, http.StatusText(status), status)
+		return
+	}
+
+	events, err := noteBatchEvents(format, body)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("badly formatted %s batch: %s", format, err), http.StatusBadRequest)
+		return
+	}
+
+	// Convert each event, remembering those to be uploaded in order by device
+	response := NoteBatchResponse{}
+	response.Events = []NoteBatchResult{}
+	var devices []string
+	pending := map[string][]noteBatchEntry{}
+	for i, eventJSON := range events {
+		result := NoteBatchResult{Index: i}
+
+		e := note.Event{}
+		err = json.Unmarshal(eventJSON, &e)
+		if err == nil {
+			result.EventUID = e.EventUID
+			result.DeviceUID = e.DeviceUID
+			_, err = noteAuthenticateProduct(e)
+			if err != nil {
+				stats.Count.HTTPNoteRejected++
+			}
+		}
+
+		var sd ttdata.SafecastData
+		var upload, log bool
+		if err == nil {
+			sd, upload, log, err = noteToSD(e, transportStr, testMode)
+		}
+		if err == nil && !abuseDeviceAllowed(sd.DeviceID) {
+			err = fmt.Errorf("device %d is rate limited", sd.DeviceID)
+		}
+
+		switch {
+		case err == errNoteUnknownNotefile:
+			quarantineAdd(e, eventJSON, transportStr, testMode)
+			result.Status = noteBatchQuarantined
+			response.Quarantined++
+		case err != nil:
+			result.Status = noteBatchRejected
+			result.Error = ErrorString(err)
+			response.Rejected++
+		default:
+			notePrepare(e, &sd, transportStr)
+			if pending[e.DeviceUID] == nil {
+				devices = append(devices, e.DeviceUID)
+			}
+			pending[e.DeviceUID] = append(pending[e.DeviceUID], noteBatchEntry{sd, upload, log, eventJSON})
+			result.Status = noteBatchAccepted
+			response.Accepted++
+		}
+
+		response.Events = append(response.Events, result)
+	}
+
+	ServerLog(fmt.Sprintf("NOTE batch of %d from %s: %d accepted, %d quarantined, %d rejected\n",
+		len(events), transportStr, response.Accepted, response.Quarantined, response.Rejected))
+
+	// Upload and log each device's events one at a time, but devices in parallel
+	for _, deviceUID := range devices {
+		entries := pending[deviceUID]
+		trackedGo(func() {
+			for _, entry := range entries {
+				if entry.upload {
+					SafecastUploadInOrder(entry.sd)
+				}
+				if entry.log {
+					native := noteNative(entry.body)
+					if native != nil {
+						entry.sd.Native = native
+						SafecastLogInOrder(entry.sd)
+					}
+				}
+			}
+		})
+	}
+
+	responseJSON, _ := json.MarshalIndent(response, "", "    ")
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(responseJSON)
+
+}
@@ -0,0 +1,218 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	ttdata "github.com/Safecast/safecast-go"
+)
+
+// A sink that records the battery voltage of what it is sent, by device
+type sinkBatchTest struct {
+	sinkBase
+	lock     sync.Mutex
+	voltages map[string][]float64
+}
+
+func (s *sinkBatchTest) Send(sd ttdata.SafecastData) error {
+	time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sd.Bat != nil && sd.Bat.Voltage != nil {
+		s.voltages[sd.DeviceUID] = append(s.voltages[sd.DeviceUID], float64(*sd.Bat.Voltage))
+	}
+	return nil
+}
+
+// noteBatchTestSetup prepares to process batches, uploading only to the returned sink
+func noteBatchTestSetup(t *testing.T, config TTServeConfig) *sinkBatchTest {
+	t.Helper()
+	testServiceConfig(t, config)
+	testDataDirectory(t)
+	os.MkdirAll(SafecastDirectory()+TTServerLogPath, 0777)
+	noteTestSchemas(t)
+	prevStore := store
+	store = storeMemoryNew()
+	s := &sinkBatchTest{sinkBase: sinkBase{name: "test"}, voltages: map[string][]float64{}}
+	sinkLock.Lock()
+	prevSinks := sinks
+	sinks = []*sinkEntry{{sink: s}}
+	sinkLock.Unlock()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		trackedWait(ctx)
+		store = prevStore
+		sinkLock.Lock()
+		sinks = prevSinks
+		sinkLock.Unlock()
+	})
+	return s
+}
+
+// noteBatchTestEvent gets the JSON of an event from a device
+func noteBatchTestEvent(t *testing.T, deviceUID string, notefileID string, body string) string {
+	t.Helper()
+	e := noteTestEvent(t, notefileID, body)
+	e.DeviceUID = deviceUID
+	eventJSON, _ := json.Marshal(e)
+	return string(eventJSON)
+}
+
+// noteBatchTestPost posts a batch, returning the response
+func noteBatchTestPost(t *testing.T, contentType string, body string) NoteBatchResponse {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, TTServerTopicNote, nil)
+	req.Header.Set("Content-Type", contentType)
+	format := noteBatchFormat(req, []byte(body))
+	if format == "" {
+		t.Fatalf("not a batch: %s", body)
+	}
+	rw := httptest.NewRecorder()
+	noteBatchHandler(rw, req, format, []byte(body), "notehub:test", false)
+	response := NoteBatchResponse{}
+	err := json.Unmarshal(rw.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("%d %s", rw.Code, rw.Body.String())
+	}
+	return response
+}
+
+func TestNoteBatchFormat(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		format      string
+	}{
+		{"application/json", `{"file":"bat.qo"}`, ""},
+		{"application/json", `[{"file":"bat.qo"}]`, noteBatchArray},
+		{"", " \n\t[{}]", noteBatchArray},
+		{"application/x-ndjson", `{"file":"bat.qo"}`, noteBatchNDJSON},
+		{"application/ndjson; charset=utf-8", "{}\n{}\n", noteBatchNDJSON},
+		{"application/jsonl", "{}", noteBatchNDJSON},
+		{"application/x-jsonlines", "{}", noteBatchNDJSON},
+		{"text/plain", "{}\n{}\n", ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, TTServerTopicNote, nil)
+		req.Header.Set("Content-Type", test.contentType)
+		format := noteBatchFormat(req, []byte(test.body))
+		if format != test.format {
+			t.Errorf("%q %q: got %q, want %q", test.contentType, test.body, format, test.format)
+		}
+	}
+}
+
+func TestNoteBatchEvents(t *testing.T) {
+	events, err := noteBatchEvents(noteBatchNDJSON, []byte("{\"a\":1}\n\n  {\"a\":2}  \r\n{bad\n"))
+	if err != nil || len(events) != 3 || string(events[1]) != `{"a":2}` || string(events[2]) != `{bad` {
+		t.Errorf("ndjson: %q %v", events, err)
+	}
+	events, err = noteBatchEvents(noteBatchArray, []byte(`[{"a":1},{"a":2}]`))
+	if err != nil || len(events) != 2 {
+		t.Errorf("array: %q %v", events, err)
+	}
+	_, err = noteBatchEvents(noteBatchArray, []byte(`[{"a":1},`))
+	if err == nil {
+		t.Errorf("a truncated array must be rejected as a whole")
+	}
+}
+
+func TestNoteBatchResults(t *testing.T) {
+	noteBatchTestSetup(t, TTServeConfig{NoteProductUIDs: []string{"product:org.safecast.test"}})
+
+	other := noteTestEvent(t, "bat.qo", `{"voltage":3.1}`)
+	other.ProductUID = "product:org.example.other"
+	otherJSON, _ := json.Marshal(other)
+	lines := []string{
+		noteBatchTestEvent(t, "dev:1", "bat.qo", `{"voltage":3.1}`),
+		`{"file":`,
+		noteBatchTestEvent(t, "dev:1", "unknown.qo", `{"x":1}`),
+		string(otherJSON),
+		noteBatchTestEvent(t, "dev:2", "bat.qo", `{"voltage":3.2}`),
+	}
+	body := ""
+	for _, line := range lines {
+		body += line + "\n"
+	}
+
+	response := noteBatchTestPost(t, "application/x-ndjson", body)
+	if response.Accepted != 2 || response.Quarantined != 1 || response.Rejected != 2 {
+		t.Errorf("accepted %d, quarantined %d, rejected %d", response.Accepted, response.Quarantined, response.Rejected)
+	}
+	statuses := []string{noteBatchAccepted, noteBatchRejected, noteBatchQuarantined, noteBatchRejected, noteBatchAccepted}
+	if len(response.Events) != len(statuses) {
+		t.Fatalf("%d results", len(response.Events))
+	}
+	for i, result := range response.Events {
+		if result.Index != i || result.Status != statuses[i] {
+			t.Errorf("event %d: %+v, want %s", i, result, statuses[i])
+		}
+		if (result.Status == noteBatchRejected) != (result.Error != "") {
+			t.Errorf("event %d: %+v", i, result)
+		}
+	}
+	if response.Events[0].DeviceUID != "dev:1" || response.Events[4].DeviceUID != "dev:2" {
+		t.Errorf("devices %q %q", response.Events[0].DeviceUID, response.Events[4].DeviceUID)
+	}
+}
+
+func TestNoteBatchOrder(t *testing.T) {
+	s := noteBatchTestSetup(t, TTServeConfig{RateLimitDevicePerMinute: -1})
+
+	var events []json.RawMessage
+	for i := 0; i < 20; i++ {
+		for _, device := range []string{"dev:10", "dev:11"} {
+			events = append(events, json.RawMessage(noteBatchTestEvent(t, device, "bat.qo", fmt.Sprintf(`{"voltage":%d}`, i))))
+		}
+	}
+	body, _ := json.Marshal(events)
+	response := noteBatchTestPost(t, "application/json", string(body))
+	if response.Accepted != len(events) {
+		t.Fatalf("accepted %d of %d", response.Accepted, len(events))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	trackedWait(ctx)
+	for _, device := range []string{"note:dev:10", "note:dev:11"} {
+		voltages := s.voltages[device]
+		if len(voltages) != 20 {
+			t.Errorf("%s: sent %d of 20", device, len(voltages))
+			continue
+		}
+		for i, v := range voltages {
+			if v != float64(i) {
+				t.Errorf("%s: sent out of order: %v", device, voltages)
+				break
+			}
+		}
+	}
+
+	// The log of each device is in the same order
+	for _, device := range []string{"dev:10", "dev:11"} {
+		entries, err := DeviceLogRead(DeviceLogName("note:" + device))
+		if err != nil || len(entries) != 20 {
+			t.Errorf("%s: logged %d: %v", device, len(entries), err)
+			continue
+		}
+		for i, entry := range entries {
+			if entry.Bat == nil || entry.Bat.Voltage == nil || float64(*entry.Bat.Voltage) != float64(i) {
+				t.Errorf("%s: logged out of order at %d", device, i)
+				break
+			}
+		}
+	}
+}
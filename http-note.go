@@ -7,6 +7,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -18,74 +19,11 @@ import (
 	"github.com/blues/note-go/note"
 )
 
-// Schemas for the different file types
-type sensorTRACKER struct {
-	Model       string  `json:"sensor,omitempty"`
-	CPM         float64 `json:"cpm,omitempty"`
-	USV         float64 `json:"usv,omitempty"`
-	Temperature float64 `json:"temperature,omitempty"`
-	Humidity    float64 `json:"humidity,omitempty"`
-	Pressure    float64 `json:"pressure,omitempty"`
-	Voltage     float64 `json:"voltage,omitempty"`
-	Distance    float64 `json:"distance,omitempty"`
-	Seconds     float64 `json:"seconds,omitempty"`
-	Velocity    float64 `json:"velocity,omitempty"`
-	Bearing     float64 `json:"bearing,omitempty"`
-}
-type sensorBAT struct {
-	Voltage float64 `json:"voltage,omitempty"`
-}
-type sensorINA struct {
-	Voltage float64 `json:"voltage,omitempty"`
-	Current float64 `json:"current,omitempty"`
-}
-type sensorBME struct {
-	Temperature float64 `json:"temp,omitempty"`
-	Humidity    float64 `json:"humid,omitempty"`
-	Pressure    float64 `json:"press,omitempty"`
-}
-type sensorRAD struct {
-	CPM     float64 `json:"cpm,omitempty"`
-	Seconds float64 `json:"secs,omitempty"`
-}
-type sensorAIR struct {
-	Pm01_0     float64  `json:"pm01_0,omitempty"`
-	Pm02_5     float64  `json:"pm02_5,omitempty"`
-	Pm10_0     float64  `json:"pm10_0,omitempty"`
-	Count00_30 uint32   `json:"c00_30,omitempty"`
-	Count00_50 uint32   `json:"c00_50,omitempty"`
-	Count01_00 uint32   `json:"c01_00,omitempty"`
-	Count02_50 uint32   `json:"c02_50,omitempty"`
-	Count05_00 uint32   `json:"c05_00,omitempty"`
-	Count10_00 uint32   `json:"c10_00,omitempty"`
-	CountSecs  uint32   `json:"csecs,omitempty"`
-	Samples    uint32   `json:"csamples,omitempty"`
-	Pm01_0cf1  *float64 `json:"pm01_0cf1,omitempty"`
-	Pm02_5cf1  *float64 `json:"pm02_5cf1,omitempty"`
-	Pm10_0cf1  *float64 `json:"pm10_0cf1,omitempty"`
-	Model      string   `json:"sensor,omitempty"`
-	Voltage    *float64 `json:"voltage,omitempty"`
-	TempOLD    *float64 `json:"temp,omitempty"`
-	HumidOLD   *float64 `json:"humid,omitempty"`
-	PressOLD   *float64 `json:"press,omitempty"`
-	Temp       *float64 `json:"temperature,omitempty"`
-	Humid      *float64 `json:"humidity,omitempty"`
-	Press      *float64 `json:"pressure,omitempty"`
-	Charging   *bool    `json:"charging,omitempty"`
-	USB        *bool    `json:"usb,omitempty"`
-	Indoors    *bool    `json:"indoors,omitempty"`
-	CPMCount   int      `json:"cpm_count,omitempty"`
-	CPM        float64  `json:"cpm,omitempty"`
-	USV        float64  `json:"usv,omitempty"`
-}
-type sensorTRACK struct {
-	Lat      float64 `json:"lat,omitempty"`
-	Lon      float64 `json:"lon,omitempty"`
-	Distance float64 `json:"distance,omitempty"`
-	Seconds  float64 `json:"seconds,omitempty"`
-	Velocity float64 `json:"velocity,omitempty"`
-	Bearing  float64 `json:"bearing,omitempty"`
-}
+// Returned by noteToSD for events in notefiles for which there is no schema
+var errNoteUnknownNotefile = errors.New("note: no schema for notefile")
+
+// The transport of everything that arrives from Notehub, which is thus never sent there again
+const noteTransport = "notehub"
 
 // Handle inbound HTTP requests from individual data Notes, in test mode
 func inboundWebNoteHandlerTest(rw http.ResponseWriter, req *http.Request) {
@@ -105,26 +43,35 @@ func noteHandler(rw http.ResponseWriter, req *http.Request, testMode bool) {
 	// Count the request
 	stats.Count.HTTP++
 
+	// Read the body as a byte array
+	body, err = io.ReadAll(req.Body)
+	if err != nil {
+		return
+
+	}
+
 	// Get the remote address, and only add this to the count if it's likely from
-	// the internal HTTP load balancer.
+	// the internal HTTP load balancer.  Our own routes are never banned, because
+	// Notehub sends for many devices from a few shared addresses.
 	remoteAddr, isReal, abusive := getRequestorIPv4(req)
-	if abusive {
+	trusted := noteRequestTrusted(req, body)
+	if abusive && !trusted {
 		return
 	}
 	if !isReal {
 		remoteAddr = "internal address"
 	}
-	transportStr := "notehub:" + remoteAddr
+	transportStr := noteTransport + ":" + remoteAddr
 
-	// Read the body as a byte array
-	body, err = io.ReadAll(req.Body)
-	if err != nil {
+	// Exit if it's there's nothing there
+	if len(body) == 0 {
 		return
-
 	}
 
-	// Exit if it's there's nothing there
-	if len(body) == 0 {
+	// Batches of events are processed separately
+	format := noteBatchFormat(req, body)
+	if format != "" {
+		noteBatchHandler(rw, req, format, body, transportStr, testMode)
 		return
 	}
 
@@ -132,45 +79,109 @@ func noteHandler(rw http.ResponseWriter, req *http.Request, testMode bool) {
 	e := note.Event{}
 	err = json.Unmarshal(body, &e)
 	if err != nil {
+		if isReal && !trusted {
+			abuseMalformed(remoteAddr)
+		}
+		return
+	}
+
+	// Reject it if it isn't from a route that we trust
+	status, err := noteAuthenticate(req, body, e)
+	if err != nil {
+		stats.Count.HTTPNoteRejected++
+		ServerLog(fmt.Sprintf("NOTE rejected from %s for %s %s: %s\n", transportStr, e.ProductUID, e.DeviceUID, err))
+		http.Error(rw, http.StatusText(status), status)
 		return
 	}
 
-	// Convert to Safecast data, and exit if failure
+	// Convert to Safecast data, holding onto it if it's from a notefile that we don't yet understand
 	sd, upload, log, err := noteToSD(e, transportStr, testMode)
+	if err == errNoteUnknownNotefile {
+		fmt.Printf("NOTE quarantined: no schema for %s from %s\n", e.NotefileID, e.ProductUID)
+		trackedGo(func() { quarantineAdd(e, body, transportStr, testMode) })
+		return
+	}
 	if err != nil {
 		fmt.Printf("NOTE ignored: %s\n%s\n", err, body)
 		return
 	}
 
-	// Display info about it
-	fmt.Printf("\n%s Received payload for %s from %s in %s\n", LogTime(), sd.DeviceUID, transportStr,
-		e.TowerLocation+" "+e.TowerCountry)
+	// Drop it if the device is sending far more often than it should
+	if !abuseDeviceAllowed(sd.DeviceID) {
+		fmt.Printf("NOTE ignored: device %d is rate limited\n", sd.DeviceID)
+		http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
 
-	// If this is an air reading, annotate it with AQI if possible
-	aqiCalculate(&sd)
+	// Process it
+	noteProcess(e, body, sd, upload, log, transportStr)
+
+}
+
+// Upload and log the Safecast data converted from an event
+func noteProcess(e note.Event, body []byte, sd ttdata.SafecastData, upload bool, log bool, transportStr string) {
+
+	notePrepare(e, &sd, transportStr)
 
 	// Send it to the Ingest service
 	if upload {
-		go SafecastUpload(sd)
+		trackedGo(func() { SafecastUpload(sd) })
 	}
 
 	// Add native event data and log it
 	if log {
-		native := map[string]interface{}{}
-		err = json.Unmarshal(body, &native)
-		if err == nil {
-			sd.Native = &native
-			go SafecastLog(sd)
+		native := noteNative(body)
+		if native != nil {
+			sdLog := sd
+			sdLog.Native = native
+			trackedGo(func() { SafecastLog(sdLog) })
 		}
 	}
 
 }
 
+// Display, annotate, and count the Safecast data converted from an event
+func notePrepare(e note.Event, sd *ttdata.SafecastData, transportStr string) {
+
+	// Display info about it
+	fmt.Printf("\n%s Received payload for %s from %s in %s\n", LogTime(), sd.DeviceUID, transportStr,
+		e.TowerLocation+" "+e.TowerCountry)
+
+	// If this is a radiation reading, make sure that it has a dose rate
+	tubeCalculate(sd)
+
+	// If this is an air reading, annotate it with AQI if possible
+	aqiCalculate(sd)
+
+	stats.Count.HTTPNote++
+
+}
+
+// Get the native event data that is logged along with the Safecast data
+func noteNative(body []byte) *map[string]interface{} {
+	native := map[string]interface{}{}
+	err := json.Unmarshal(body, &native)
+	if err != nil {
+		return nil
+	}
+	return &native
+}
+
 // Determines whether or not this deviceUID came from notehub
 func safecastDeviceUIDIsFromNotehub(deviceUID string) bool {
 	return strings.HasPrefix(deviceUID, "note:")
 }
 
+// Determines whether or not a measurement arrived from notehub, which is what marks those that
+// we sent to Notehub and that came back, whatever their device UID
+func safecastArrivedFromNotehub(sd ttdata.SafecastData) bool {
+	if sd.Service == nil || sd.Service.Transport == nil {
+		return false
+	}
+	transport := *sd.Service.Transport
+	return transport == noteTransport || strings.HasPrefix(transport, noteTransport+":")
+}
+
 // Deterministic way to convert a Notecard DeviceUID to a Safecast DeviceID, in a way that
 // reserves the low 2^20 addresses for fixed allocation as per Rob agreement (see ttnode/src/io.c)
 func notecardDeviceUIDToSafecastDeviceID(notecardDeviceUID string) (safecastDeviceURN string, safecastDeviceID uint32) {
@@ -280,265 +291,19 @@ func noteToSD(e note.Event, transport string, testMode bool) (sd ttdata.Safecast
 		err = fmt.Errorf("note: no recognizable sensor data")
 		return
 	}
-	var sensorJSON []byte
-	sensorJSON, err = json.Marshal(e.Body)
-	if err != nil {
-		return
-	}
 
-	// Decompose the body with a per-notefile schema
-	upload = true
-	log = true
-	switch e.NotefileID {
-
-	case "_session.qo":
-		upload = false
-		// Everything in session has been captured above
+	// Decompose the body with the schema registered for the notefile
+	schema, found := noteSchemaFind(e.NotefileID)
+	if !found {
+		err = errNoteUnknownNotefile
 		return
-
-	case "_air.qo":
-		s := sensorAIR{}
-		err = json.Unmarshal(sensorJSON, &s)
-		if err != nil {
-			return
-		}
-		switch s.Model {
-		case "lnd712": // Airnote Radiation
-			var lnd ttdata.Lnd
-			lnd.U712 = &s.CPM
-			lnd.USv = &s.USV
-			sd.Lnd = &lnd
-		case "lnd7317": // Radnote, which is covered/shielded by default
-			var lnd ttdata.Lnd
-			lnd.C7318 = &s.CPM
-			lnd.USv = &s.USV
-			sd.Lnd = &lnd
-		default:
-			var pms ttdata.Pms
-			pms.Pm01_0 = &s.Pm01_0
-			pms.Pm02_5 = &s.Pm02_5
-			pms.Pm10_0 = &s.Pm10_0
-			pms.Count00_30 = &s.Count00_30
-			pms.Count00_50 = &s.Count00_50
-			pms.Count01_00 = &s.Count01_00
-			pms.Count02_50 = &s.Count02_50
-			pms.Count05_00 = &s.Count05_00
-			pms.Count10_00 = &s.Count10_00
-			pms.CountSecs = &s.CountSecs
-			pms.Samples = &s.Samples
-			pms.Pm01_0cf1 = s.Pm01_0cf1
-			pms.Pm02_5cf1 = s.Pm02_5cf1
-			pms.Pm10_0cf1 = s.Pm10_0cf1
-			pms.Model = &s.Model
-			sd.Pms = &pms
-		}
-		if s.Indoors != nil {
-			indoors := true
-			sd.Dev.Indoors = &indoors
-		}
-		if s.Voltage != nil {
-			var bat ttdata.Bat
-			bat.Voltage = s.Voltage
-			bat.Charging = s.Charging
-			bat.Line = s.USB
-			sd.Bat = &bat
-		}
-		if s.TempOLD != nil {
-			var env ttdata.Env
-			env.Temp = s.TempOLD
-			env.Humid = s.HumidOLD
-			env.Press = s.PressOLD
-			sd.Env = &env
-		}
-		if s.Temp != nil {
-			var env ttdata.Env
-			env.Temp = s.Temp
-			env.Humid = s.Humid
-			env.Press = s.Press
-			sd.Env = &env
-		}
-
-	case "_track.qo":
-		s := sensorTRACKER{}
-		err = json.Unmarshal(sensorJSON, &s)
-		if err != nil {
-			return
-		}
-		var bat ttdata.Bat
-		bat.Voltage = &s.Voltage
-		sd.Bat = &bat
-		var env ttdata.Env
-		env.Temp = &s.Temperature
-		if s.Humidity != 0 {
-			env.Humid = &s.Humidity
-		}
-		if s.Pressure != 0 {
-			env.Press = &s.Pressure
-		}
-		sd.Env = &env
-		if s.CPM > 0 {
-			switch s.Model {
-			default: // Airnote Radiation had no model field
-				fallthrough
-			case "lnd712": // Airnote Radiation
-				var lnd ttdata.Lnd
-				lnd.U712 = &s.CPM
-				lnd.USv = &s.USV
-				sd.Lnd = &lnd
-			case "lnd7317": // Radnote, which is covered/shielded by default
-				var lnd ttdata.Lnd
-				lnd.C7318 = &s.CPM
-				lnd.USv = &s.USV
-				sd.Lnd = &lnd
-			}
-		}
-		var track ttdata.Track
-		track.Distance = &s.Distance
-		var secs = uint32(s.Seconds)
-		track.Seconds = &secs
-		track.Velocity = &s.Velocity
-		track.Bearing = &s.Bearing
-		sd.Track = &track
-
-	case "bat.qo":
-		s := sensorBAT{}
-		err = json.Unmarshal(sensorJSON, &s)
-		if err != nil {
-			return
-		}
-		var bat ttdata.Bat
-		bat.Voltage = &s.Voltage
-		sd.Bat = &bat
-
-	case "bat-ina219.qo":
-		s := sensorINA{}
-		err = json.Unmarshal(sensorJSON, &s)
-		if err != nil {
-			return
-		}
-		var bat ttdata.Bat
-		bat.Voltage = &s.Voltage
-		bat.Current = &s.Current
-		sd.Bat = &bat
-
-	case "air-bme280.qo":
-		s := sensorBME{}
-		err = json.Unmarshal(sensorJSON, &s)
-		if err != nil {
-			return
-		}
-		var env ttdata.Env
-		env.Temp = &s.Temperature
-		env.Humid = &s.Humidity
-		env.Press = &s.Pressure
-		sd.Env = &env
-
-	case "rad1-lnd7318u.qo":
-		fallthrough
-	case "rad0-lnd7318u.qo":
-		s := sensorRAD{}
-		err = json.Unmarshal(sensorJSON, &s)
-		if err != nil {
-			return
-		}
-		var lnd ttdata.Lnd
-		lnd.U7318 = &s.CPM
-		sd.Lnd = &lnd
-
-	case "rad1-lnd7318c.qo":
-		fallthrough
-	case "rad0-lnd7318c.qo":
-		s := sensorRAD{}
-		err = json.Unmarshal(sensorJSON, &s)
-		if err != nil {
-			return
-		}
-		var lnd ttdata.Lnd
-		lnd.C7318 = &s.CPM
-		sd.Lnd = &lnd
-
-	case "rad1-lnd7128ec.qo":
-		fallthrough
-	case "rad0-lnd7128ec.qo":
-		s := sensorRAD{}
-		err = json.Unmarshal(sensorJSON, &s)
-		if err != nil {
-			return
-		}
-		var lnd ttdata.Lnd
-		lnd.EC7128 = &s.CPM
-		sd.Lnd = &lnd
-
-	case "aq0-pms7003.qo":
-		fallthrough
-	case "aq0-pms5003.qo":
-		s := sensorAIR{}
-		err = json.Unmarshal(sensorJSON, &s)
-		if err != nil {
-			return
-		}
-		var pms ttdata.Pms
-		pms.Pm01_0 = &s.Pm01_0
-		pms.Pm02_5 = &s.Pm02_5
-		pms.Pm10_0 = &s.Pm10_0
-		pms.Count00_30 = &s.Count00_30
-		pms.Count00_50 = &s.Count00_50
-		pms.Count01_00 = &s.Count01_00
-		pms.Count02_50 = &s.Count02_50
-		pms.Count05_00 = &s.Count05_00
-		pms.Count10_00 = &s.Count10_00
-		pms.CountSecs = &s.CountSecs
-		pms.Samples = &s.Samples
-		model := strings.Split(strings.Split(e.NotefileID, "-")[1], ".")[0]
-		pms.Model = &model
-		sd.Pms = &pms
-
-	case "aq1-pms7003.qo":
-		fallthrough
-	case "aq1-pms5003.qo":
-		s := sensorAIR{}
-		err = json.Unmarshal(sensorJSON, &s)
-		if err != nil {
-			return
-		}
-		var pms ttdata.Pms2
-		pms.Pm01_0 = &s.Pm01_0
-		pms.Pm02_5 = &s.Pm02_5
-		pms.Pm10_0 = &s.Pm10_0
-		pms.Count00_30 = &s.Count00_30
-		pms.Count00_50 = &s.Count00_50
-		pms.Count01_00 = &s.Count01_00
-		pms.Count02_50 = &s.Count02_50
-		pms.Count05_00 = &s.Count05_00
-		pms.Count10_00 = &s.Count10_00
-		pms.CountSecs = &s.CountSecs
-		pms.Samples = &s.Samples
-		model := strings.Split(strings.Split(e.NotefileID, "-")[1], ".")[0]
-		pms.Model = &model
-		sd.Pms2 = &pms
-
-	case "track.qo":
-		s := sensorTRACK{}
-		err = json.Unmarshal(sensorJSON, &s)
-		if err != nil {
-			return
-		}
-		var track ttdata.Track
-		track.Lat = &s.Lat
-		track.Lon = &s.Lon
-		track.Distance = &s.Distance
-		var secs = uint32(s.Seconds)
-		track.Seconds = &secs
-		track.Velocity = &s.Velocity
-		track.Bearing = &s.Bearing
-		sd.Track = &track
-
-	default:
-		upload = false
-		log = false
-		fmt.Printf("*** note-go: no sensor data in file %s", e.NotefileID)
+	}
+	upload = schema.Upload == nil || *schema.Upload
+	log = schema.Log == nil || *schema.Log
+	err = noteSchemaApply(schema, e.NotefileID, *e.Body, &sd)
+	if err != nil {
+		err = fmt.Errorf("note: %s: %s", e.NotefileID, err)
 		return
-
 	}
 
 	// Done
@@ -546,102 +311,19 @@ func noteToSD(e note.Event, transport string, testMode bool) (sd ttdata.Safecast
 
 }
 
-// notehubWebhookEventFromSD converts an SD to a Notehub webhook event
-func notehubWebhookEventFromSD(sd ttdata.SafecastData) (deviceUID string, eventJSON []byte, err error) {
+// Prefix of the notefiles, one per sensor, in which we send Safecast data to Notehub
+const notehubNotefilePrefix = "safecast-"
 
-	// Form the body and event structures
-	var body sensorAIR
-	var event note.Event
-
-	if sd.Lnd != nil {
-		usvConversionFactor := 0
-		if sd.Lnd.U7318 != nil {
-			body.Model = "lnd7317"
-			body.CPM = *sd.Lnd.U7318
-			usvConversionFactor = 334
-		}
-		if sd.Lnd.C7318 != nil {
-			body.Model = "lnd7317"
-			body.CPM = *sd.Lnd.C7318
-			usvConversionFactor = 334
-		}
-		if sd.Lnd.EC7128 != nil {
-			body.Model = "lnd7128"
-			body.CPM = *sd.Lnd.EC7128
-			usvConversionFactor = 108
-		}
-		if sd.Lnd.U712 != nil {
-			body.Model = "lnd712"
-			body.CPM = *sd.Lnd.U712
-			usvConversionFactor = 108
-		}
-		if sd.Lnd.W78017 != nil {
-			body.Model = "lnd78017"
-			body.CPM = *sd.Lnd.W78017
-		}
-		if sd.Lnd.USv != nil {
-			body.USV = *sd.Lnd.USv
-		} else if usvConversionFactor != 0 {
-			body.USV = body.CPM / float64(usvConversionFactor)
-		}
-	}
+// notehubWebhookEventsFromSD converts an SD to Notehub webhook events, one per sensor.  The body of
+// each holds the sensor's fields along with the capture time, location, and contacts of the
+// measurement, all named exactly as in the SD, so that noteToSD decodes them with nothing lost.
+// The identity of the device is in the envelope, from which noteToSD forms a "note:" device UID.
+// What comes back from Notehub arrives with Notehub as its transport, which is what keeps it from
+// ever being sent there again, and our own service metadata is added anew upon ingestion.
+func notehubWebhookEventsFromSD(sd ttdata.SafecastData) (deviceUID string, eventsJSON [][]byte, err error) {
 
-	if sd.Pms != nil {
-		if sd.Pms.Pm01_0 != nil {
-			body.Pm01_0 = *sd.Pms.Pm01_0
-		}
-		if sd.Pms.Pm02_5 != nil {
-			body.Pm02_5 = *sd.Pms.Pm02_5
-		}
-		if sd.Pms.Pm10_0 != nil {
-			body.Pm10_0 = *sd.Pms.Pm10_0
-		}
-		if sd.Pms.Count00_30 != nil {
-			body.Count00_30 = *sd.Pms.Count00_30
-		}
-		if sd.Pms.Count00_50 != nil {
-			body.Count00_50 = *sd.Pms.Count00_50
-		}
-		if sd.Pms.Count01_00 != nil {
-			body.Count01_00 = *sd.Pms.Count01_00
-		}
-		if sd.Pms.Count02_50 != nil {
-			body.Count02_50 = *sd.Pms.Count02_50
-		}
-		if sd.Pms.Count05_00 != nil {
-			body.Count05_00 = *sd.Pms.Count05_00
-		}
-		if sd.Pms.Count10_00 != nil {
-			body.Count10_00 = *sd.Pms.Count10_00
-		}
-		if sd.Pms.CountSecs != nil {
-			body.CountSecs = *sd.Pms.CountSecs
-		}
-	}
-
-	if sd.Env != nil {
-		if sd.Env.Temp != nil {
-			body.Temp = sd.Env.Temp
-		}
-		if sd.Env.Humid != nil {
-			body.Humid = sd.Env.Humid
-		}
-		if sd.Env.Press != nil {
-			body.Press = sd.Env.Press
-		}
-	}
-
-	if sd.Bat != nil {
-		if sd.Bat.Voltage != nil {
-			body.Voltage = sd.Bat.Voltage
-		}
-		if sd.Bat.Charging != nil {
-			body.Charging = sd.Bat.Charging
-		}
-		if sd.Bat.Line != nil {
-			body.USB = sd.Bat.Line
-		}
-	}
+	// Form the event envelope, which is shared by all of the events
+	var event note.Event
 
 	if sd.Loc != nil {
 		if sd.Loc.Lat != nil {
@@ -656,18 +338,6 @@ func notehubWebhookEventFromSD(sd ttdata.SafecastData) (deviceUID string, eventJ
 	}
 
 	if sd.Dev != nil {
-		if sd.Dev.Indoors != nil {
-			body.Indoors = sd.Dev.Indoors
-		}
-		if sd.Dev.Temp != nil {
-			body.Temp = sd.Dev.Temp
-		}
-		if sd.Dev.Humid != nil {
-			body.Humid = sd.Dev.Humid
-		}
-		if sd.Dev.Press != nil {
-			body.Press = sd.Dev.Press
-		}
 		if sd.Dev.Rat != nil {
 			event.Rat = *sd.Dev.Rat
 		}
@@ -703,27 +373,79 @@ func notehubWebhookEventFromSD(sd ttdata.SafecastData) (deviceUID string, eventJ
 
 	event.DeviceUID = sd.DeviceUID
 	event.DeviceSN = sd.DeviceSN
-	event.NotefileID = "_air.qo"
 
-	var bodyJSON []byte
-	bodyJSON, err = json.Marshal(body)
-	if err != nil {
-		return
+	// Fields that describe the measurement as a whole, which are included in every body
+	common := ttdata.SafecastData{}
+	common.DeviceContactName = sd.DeviceContactName
+	common.DeviceContactOrg = sd.DeviceContactOrg
+	common.DeviceContactRole = sd.DeviceContactRole
+	common.DeviceContactEmail = sd.DeviceContactEmail
+	common.CapturedAt = sd.CapturedAt
+	common.Loc = sd.Loc
+	if sd.Dev != nil && sd.Dev.Test != nil {
+		common.Dev = &ttdata.Dev{Test: sd.Dev.Test}
+	}
+
+	// The sensors, each of which is sent in its own notefile
+	sensors := []struct {
+		name string
+		sd   ttdata.SafecastData
+	}{
+		{"lnd", ttdata.SafecastData{Lnd: sd.Lnd}},
+		{"pms", ttdata.SafecastData{Pms: sd.Pms}},
+		{"pms2", ttdata.SafecastData{Pms2: sd.Pms2}},
+		{"opc", ttdata.SafecastData{Opc: sd.Opc}},
+		{"env", ttdata.SafecastData{Env: sd.Env}},
+		{"bat", ttdata.SafecastData{Bat: sd.Bat}},
+		{"track", ttdata.SafecastData{Track: sd.Track}},
+		{"dev", ttdata.SafecastData{Dev: sd.Dev}},
+		{"gateway", ttdata.SafecastData{Gateway: sd.Gateway}},
+	}
+
+	for _, sensor := range sensors {
+		var body map[string]interface{}
+		body, err = notehubWebhookBody(sensor.sd)
+		if err != nil {
+			return
+		}
+		if len(body) == 0 {
+			continue
+		}
+		var commonBody map[string]interface{}
+		commonBody, err = notehubWebhookBody(common)
+		if err != nil {
+			return
+		}
+		for k, v := range commonBody {
+			body[k] = v
+		}
+		event.NotefileID = notehubNotefilePrefix + sensor.name + ".qo"
+		event.Body = &body
+		var eventJSON []byte
+		eventJSON, err = json.Marshal(event)
+		if err != nil {
+			return
+		}
+		eventsJSON = append(eventsJSON, eventJSON)
 	}
-	if string(bodyJSON) == "{}" {
+
+	if len(eventsJSON) == 0 {
 		err = fmt.Errorf("no data")
 		return
 	}
-	var bodyObj map[string]interface{}
-	err = json.Unmarshal(bodyJSON, &bodyObj)
-	if err != nil {
-		return
-	}
-	event.Body = &bodyObj
-
-	eventJSON, err = json.Marshal(event)
 
 	deviceUID = event.DeviceUID
 	return
 
 }
+
+// notehubWebhookBody flattens an SD into the fields of a webhook event body
+func notehubWebhookBody(sd ttdata.SafecastData) (body map[string]interface{}, err error) {
+	var bodyJSON []byte
+	bodyJSON, err = json.Marshal(sd)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(bodyJSON, &body)
+	return
+}
@@ -0,0 +1,281 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ttdata "github.com/Safecast/safecast-go"
+	"github.com/blues/note-go/note"
+)
+
+// noteTestRoundTripSD gets a measurement from a device that isn't a Notecard, with every sensor group
+func noteTestRoundTripSD(t *testing.T) ttdata.SafecastData {
+	t.Helper()
+	sd := ttdata.SafecastData{}
+	err := json.Unmarshal([]byte(`{
+		"device_urn":"pointcast:10042","device_class":"pointcast","device_sn":"pc-42","device":10042,
+		"device_contact_name":"Ray","device_contact_email":"ray@example.com",
+		"when_captured":"2024-05-01T12:34:56Z",
+		"loc_lat":37.5,"loc_lon":140.4,"loc_alt":92,"loc_olc":"8R9V2C00+","loc_name":"Fukushima","loc_country":"JP","loc_zone":"Asia/Tokyo",
+		"lnd_7318u":41,"lnd_7318c":12,"lnd_7128ec":18,"lnd_712u":22,"lnd_78017w":5,"lnd_usv":0.123,
+		"pms_pm01_0":1.5,"pms_pm02_5":2.5,"pms_pm10_0":10.5,"pms_std01_0":1.4,"pms_c00_30":300,"pms_c00_50":50,"pms_csecs":60,"pms_csamples":12,
+		"pms_pm02_5_cf1":2.6,"pms_model":"pms5003","pms_aqi_notes":"cf-atm","pms_aqi_level":"good","pms_aqi_pm":2.5,"pms_aqi":10,
+		"pms2_pm01_0":1.6,"pms2_pm02_5":2.7,"pms2_pm10_0":11,"pms2_model":"pms7003","pms2_aqi_level":"moderate","pms2_aqi":55,
+		"opc_pm01_0":0.9,"opc_pm02_5":1.9,"opc_pm10_0":8.8,"opc_c00_38":380,"opc_csecs":60,"opc_aqi_level":"good","opc_aqi":8,
+		"env_temp":21.5,"env_humid":44,"env_press":1003,
+		"bat_voltage":3.95,"bat_current":-12,"bat_charge":88,"bat_charging":true,"bat_line":false,
+		"track_lat":37.6,"track_lon":140.5,"track_distance":12.5,"track_seconds":600,"track_velocity":0.4,"track_bearing":270,
+		"dev_test":true,"dev_indoors":true,"dev_label":"Pointcast 42","dev_uptime":1440,"dev_firmware":"3.2.1","dev_restarts":4,
+		"dev_temp":30.5,"dev_rat":"lte","dev_bars":3,"dev_err_pms":2,
+		"gateway_received":"2024-05-01T12:35:00Z","gateway_lora_snr":-7.5,"gateway_loc_lat":37.4,"gateway_loc_lon":140.3
+	}`), &sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sd
+}
+
+// noteTestDecode decodes an event that we sent to Notehub as it comes back to us from Notehub
+func noteTestDecode(t *testing.T, eventJSON []byte) (e note.Event, sd ttdata.SafecastData) {
+	t.Helper()
+	err := json.Unmarshal(eventJSON, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.ProductUID = "product:org.safecast.relay"
+	sd, upload, log, err := noteToSD(e, "notehub", false)
+	if err != nil {
+		t.Fatalf("%s: %s", e.NotefileID, err)
+	}
+	if !upload || !log {
+		t.Errorf("%s: upload %t log %t", e.NotefileID, upload, log)
+	}
+	return
+}
+
+// noteTestJSON marshals something for comparison
+func noteTestJSON(v interface{}) string {
+	j, _ := json.Marshal(v)
+	return string(j)
+}
+
+// Every sensor group sent to Notehub comes back in its own notefile exactly as it was sent
+func TestNotehubRoundTrip(t *testing.T) {
+	noteTestSchemas(t)
+	sd := noteTestRoundTripSD(t)
+
+	deviceUID, eventsJSON, err := notehubWebhookEventsFromSD(sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deviceUID != sd.DeviceUID {
+		t.Errorf("device UID %s", deviceUID)
+	}
+
+	groups := map[string]func(sd ttdata.SafecastData) interface{}{
+		"lnd":     func(sd ttdata.SafecastData) interface{} { return sd.Lnd },
+		"pms":     func(sd ttdata.SafecastData) interface{} { return sd.Pms },
+		"pms2":    func(sd ttdata.SafecastData) interface{} { return sd.Pms2 },
+		"opc":     func(sd ttdata.SafecastData) interface{} { return sd.Opc },
+		"env":     func(sd ttdata.SafecastData) interface{} { return sd.Env },
+		"bat":     func(sd ttdata.SafecastData) interface{} { return sd.Bat },
+		"track":   func(sd ttdata.SafecastData) interface{} { return sd.Track },
+		"dev":     func(sd ttdata.SafecastData) interface{} { return sd.Dev },
+		"gateway": func(sd ttdata.SafecastData) interface{} { return sd.Gateway },
+	}
+
+	seen := map[string]bool{}
+	for _, eventJSON := range eventsJSON {
+		e, decoded := noteTestDecode(t, eventJSON)
+		group := strings.TrimSuffix(strings.TrimPrefix(e.NotefileID, notehubNotefilePrefix), ".qo")
+		get, known := groups[group]
+		if !known {
+			t.Errorf("unexpected notefile %s", e.NotefileID)
+			continue
+		}
+		seen[group] = true
+
+		if noteTestJSON(get(decoded)) != noteTestJSON(get(sd)) {
+			t.Errorf("%s:\n got %s\nwant %s", group, noteTestJSON(get(decoded)), noteTestJSON(get(sd)))
+		}
+
+		// What describes the measurement as a whole comes back with every sensor
+		if noteTestJSON(decoded.Loc) != noteTestJSON(sd.Loc) {
+			t.Errorf("%s: location %s", group, noteTestJSON(decoded.Loc))
+		}
+		if decoded.CapturedAt == nil || *decoded.CapturedAt != *sd.CapturedAt {
+			t.Errorf("%s: captured %v", group, decoded.CapturedAt)
+		}
+		if decoded.DeviceSN != sd.DeviceSN || decoded.DeviceContactName != sd.DeviceContactName || decoded.DeviceContactEmail != sd.DeviceContactEmail {
+			t.Errorf("%s: serial number or contact %s %s %s", group, decoded.DeviceSN, decoded.DeviceContactName, decoded.DeviceContactEmail)
+		}
+		if decoded.Dev == nil || decoded.Dev.Test == nil || !*decoded.Dev.Test {
+			t.Errorf("%s: test flag lost", group)
+		}
+
+		// What comes back is marked as being from Notehub, so that it's never sent there again
+		if decoded.DeviceUID != "note:"+sd.DeviceUID || !safecastDeviceUIDIsFromNotehub(decoded.DeviceUID) {
+			t.Errorf("%s: device UID %s", group, decoded.DeviceUID)
+		}
+		if (&sinkNotehub{}).Filter(decoded) {
+			t.Errorf("%s: would be sent back to Notehub", group)
+		}
+	}
+
+	for group := range groups {
+		if !seen[group] {
+			t.Errorf("no notefile for %s", group)
+		}
+	}
+
+}
+
+// Sensors that a measurement doesn't have aren't sent
+func TestNotehubRoundTripPartial(t *testing.T) {
+	noteTestSchemas(t)
+	usv := 0.05
+	sd := ttdata.SafecastData{DeviceUID: "pointcast:10043", Lnd: &ttdata.Lnd{USv: &usv}}
+
+	_, eventsJSON, err := notehubWebhookEventsFromSD(sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eventsJSON) != 1 {
+		t.Fatalf("%d events", len(eventsJSON))
+	}
+	e, decoded := noteTestDecode(t, eventsJSON[0])
+	if e.NotefileID != "safecast-lnd.qo" || noteTestJSON(decoded.Lnd) != noteTestJSON(sd.Lnd) {
+		t.Errorf("%s: %s", e.NotefileID, noteTestJSON(decoded.Lnd))
+	}
+	if decoded.Pms != nil || decoded.Env != nil || decoded.Track != nil {
+		t.Errorf("sensors appeared: %s", noteTestJSON(decoded))
+	}
+
+}
+
+// A Notecard can't use a body in Safecast form to pose as another device or to change how we
+// handled its event
+func TestNotehubPassthroughIdentity(t *testing.T) {
+	noteTestSchemas(t)
+
+	e := noteTestEvent(t, "safecast-env.qo", `{"env_temp":20,
+		"device_urn":"pointcast:10042","device":10042,"device_class":"pointcast","device_sn":"pc-42",
+		"service_transport":"spoofed","service_uploaded":"2000-01-01T00:00:00Z","service_handler":"spoofed"}`)
+	sd, _, _, err := noteToSD(e, "test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sd.Env == nil || sd.Env.Temp == nil || *sd.Env.Temp != 20 {
+		t.Errorf("sensor not copied: %s", noteTestJSON(sd.Env))
+	}
+	if sd.DeviceUID != "note:"+e.DeviceUID || sd.DeviceClass != e.ProductUID || sd.DeviceSN != e.DeviceSN {
+		t.Errorf("identity taken from body: %s %s %s", sd.DeviceUID, sd.DeviceClass, sd.DeviceSN)
+	}
+	_, expectedID := notecardDeviceUIDToSafecastDeviceID(e.DeviceUID)
+	if sd.DeviceID != expectedID {
+		t.Errorf("device ID taken from body: %d", sd.DeviceID)
+	}
+	if sd.Service == nil || *sd.Service.Transport != "test" || *sd.Service.UploadedAt == "2000-01-01T00:00:00Z" || sd.Service.Handler != nil {
+		t.Errorf("service taken from body: %s", noteTestJSON(sd.Service))
+	}
+
+}
+
+// TestNoteRouteNotLimited makes sure that our own Notehub routes aren't limited or banned by address,
+// while others sending from the same address are
+func TestNoteRouteNotLimited(t *testing.T) {
+	abuseTestSetup(t, TTServeConfig{NoteSecrets: []string{"route-secret"}, NoteSecretHeader: noteSecretHeaderDefault,
+		NoteSignatureHeader: noteSignatureHeaderDefault, RateLimitIPPerMinute: 1, RateLimitIPBurst: 1})
+	const requestor = "198.51.100.7"
+	abuseLock.Lock()
+	abuseBans[requestor] = time.Now().Add(time.Hour)
+	abuseLock.Unlock()
+
+	var handled []byte
+	handler := abuseHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handled, _ = io.ReadAll(req.Body)
+	}))
+	send := func(path string, secret string) int {
+		handled = nil
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"file":"_air.qo"}`))
+		req.RemoteAddr = requestor + ":4321"
+		if secret != "" {
+			req.Header.Set(noteSecretHeaderDefault, secret)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if status := send(TTServerTopicNote, "route-secret"); status != http.StatusOK || string(handled) != `{"file":"_air.qo"}` {
+			t.Fatalf("route: status %d, body %q", status, handled)
+		}
+	}
+	if status := send(TTServerTopicNote, "wrong-secret"); status != http.StatusForbidden || handled != nil {
+		t.Errorf("wrong secret: status %d", status)
+	}
+	if status := send(TTServerTopicRegistry, "route-secret"); status != http.StatusForbidden || handled != nil {
+		t.Errorf("other topic: status %d", status)
+	}
+}
+
+// All of a measurement's sensors are sent to Notehub in a single request
+func TestNotehubUploadBatched(t *testing.T) {
+	testServiceConfig(t, TTServeConfig{})
+	var requests []string
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		requests = append(requests, string(body))
+		paths = append(paths, req.URL.Path)
+	}))
+	defer server.Close()
+
+	sd := noteTestRoundTripSD(t)
+	err := doUploadToNotehub(sd, server.URL+"/{deviceUID}", "token", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || paths[0] != "/"+sd.DeviceUID {
+		t.Fatalf("%d requests to %v", len(requests), paths)
+	}
+	_, eventsJSON, _ := notehubWebhookEventsFromSD(sd)
+	var events []note.Event
+	err = json.Unmarshal([]byte(requests[0]), &events)
+	if err != nil || len(events) != len(eventsJSON) {
+		t.Errorf("%d events: %v", len(events), err)
+	}
+}
+
+// Whatever arrives from Notehub is never sent there again, whatever its device UID
+func TestNotehubLoopMark(t *testing.T) {
+	transport := func(s string) *ttdata.Service { return &ttdata.Service{Transport: &s} }
+	tests := []struct {
+		deviceUID string
+		service   *ttdata.Service
+		send      bool
+	}{
+		{"pointcast:10042", nil, true},
+		{"pointcast:10042", transport("device-udp:203.0.113.1"), true},
+		{"pointcast:10042", transport(noteTransport + ":203.0.113.1"), false},
+		{"pointcast:10042", transport(noteTransport), false},
+		{"note:dev:864475044204278", nil, false},
+	}
+	for _, test := range tests {
+		sd := ttdata.SafecastData{DeviceUID: test.deviceUID, Service: test.service}
+		if (&sinkNotehub{}).Filter(sd) != test.send {
+			t.Errorf("%s %s: send %t", test.deviceUID, noteTestJSON(test.service), !test.send)
+		}
+	}
+}
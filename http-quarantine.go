@@ -0,0 +1,121 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Inbound support for the "/quarantine" HTTP topic, where GET of "/quarantine" or
+// "/quarantine/<productUID>" summarizes what is held for all products or for one,
+// GET of "/quarantine/<productUID>/<notefileID>?limit=N" returns the most recent
+// events held for a notefile, and POST to either of the latter replays them.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Number of events returned unless otherwise requested
+const quarantineEventsLimitDefault = 100
+
+// Handle inbound HTTP requests to examine or replay quarantined events
+func inboundWebQuarantineHandler(rw http.ResponseWriter, req *http.Request) {
+	stats.Count.HTTP++
+
+	target, args, err := HTTPArgs(req, TTServerTopicQuarantine)
+	if err != nil {
+		http.Error(rw, ErrorString(err), http.StatusBadRequest)
+		return
+	}
+	productUID, notefileID, _ := strings.Cut(strings.TrimSuffix(target, "/"), "/")
+
+	var response interface{}
+	switch req.Method {
+
+	case http.MethodGet, http.MethodHead:
+		if notefileID == "" {
+			response, err = quarantineSummaries(productUID)
+			break
+		}
+		limit, _ := strconv.Atoi(args["limit"])
+		if limit <= 0 {
+			limit = quarantineEventsLimitDefault
+		}
+		result := struct {
+			Summary QuarantineSummary `json:"summary"`
+			Events  []QuarantineEvent `json:"events"`
+		}{}
+		result.Summary, err = quarantineReadSummary(quarantineFilename(productUID, notefileID))
+		if err == nil {
+			result.Events, err = quarantineEvents(productUID, notefileID, limit)
+		}
+		response = result
+
+	case http.MethodPost:
+		if productUID == "" {
+			http.Error(rw, "product required", http.StatusBadRequest)
+			return
+		}
+		var status int
+		status, err = quarantineAuthenticate(req)
+		if err != nil {
+			requestor, _, _ := getRequestorIPv4(req)
+			ServerLog(fmt.Sprintf("QUARANTINE replay rejected from %s: %s\n", requestor, err))
+			http.Error(rw, http.StatusText(status), status)
+			return
+		}
+		notefiles := []string{notefileID}
+		if notefileID == "" {
+			notefiles = nil
+			summaries, _ := quarantineSummaries(productUID)
+			for _, summary := range summaries {
+				notefiles = append(notefiles, summary.NotefileID)
+			}
+		}
+		replayed := []QuarantineSummary{}
+		for _, notefile := range notefiles {
+			summary, err2 := quarantineReplay(productUID, notefile)
+			if err2 != nil {
+				err = err2
+				break
+			}
+			replayed = append(replayed, summary)
+		}
+		response = replayed
+
+	default:
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+
+	}
+
+	if err != nil {
+		http.Error(rw, ErrorString(err), http.StatusNotFound)
+		return
+	}
+
+	responseJSON, _ := json.MarshalIndent(response, "", "    ")
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(responseJSON)
+
+}
+
+// quarantineAuthenticate makes sure that replays, which upload data, come from someone
+// who knows the same secret that Notehub routes must present
+func quarantineAuthenticate(req *http.Request) (status int, err error) {
+	config := CurrentServiceConfig()
+	if len(config.NoteSecrets) == 0 {
+		return http.StatusOK, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if noteSecretValid(config.NoteSecrets, req.Header.Get(config.NoteSecretHeader)) ||
+		noteSignatureValid(config.NoteSecrets, req.Header.Get(config.NoteSignatureHeader), body) {
+		return http.StatusOK, nil
+	}
+	return http.StatusUnauthorized, fmt.Errorf("invalid secret or signature")
+}
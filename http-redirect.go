@@ -11,7 +11,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strings"
 
 	ttdata "github.com/Safecast/safecast-go"
@@ -100,8 +99,7 @@ func inboundWebRedirectHandler(rw http.ResponseWriter, req *http.Request) {
 
 			// See if this is nothing but a device ID
 			deviceUID := req.RequestURI[len("/"):]
-			file := GetDeviceStatusFilePath(deviceUID)
-			contents, err := os.ReadFile(file)
+			contents, err := store.Get(TTDeviceStatusPath, DeviceUIDFilename(deviceUID))
 			if err == nil {
 				GenerateDeviceSummaryWebPage(rw, contents)
 				return
@@ -204,6 +202,15 @@ func inboundWebRedirectHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Drop it if the device is sending far more often than it should
+	if !abuseDeviceAllowed(sd.DeviceID) {
+		fmt.Printf("%s *** Ignoring because device %d is rate limited\n", LogTime(), sd.DeviceID)
+		return
+	}
+
+	// If this is a radiation reading, make sure that it has a dose rate
+	tubeCalculate(&sd)
+
 	// If this is an air reading, annotate it with AQI if possible
 	aqiCalculate(&sd)
 
@@ -0,0 +1,194 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Inbound support for the "/registry" HTTP topic, where GET of "/registry" lists the
+// registered devices and GET of "/registry/<deviceid>" returns one of them, PUT or POST
+// of "/registry/<deviceid>" adds or replaces a device, DELETE removes one, and POST of
+// "/registry/import" imports the tracker sheet.  Custodian contacts are only shown to
+// administrators, and keys are never shown.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The target that imports the tracker sheet
+const registryImportTarget = "import"
+
+// What is shown in place of a device's key or custodian contact, which may be given back to leave it unchanged
+const registryRedacted = "redacted"
+
+// The header in which administrative requests present their secret
+const adminSecretHeader = "X-Safecast-Admin-Secret"
+
+// Handle inbound HTTP requests to examine or change the device registry
+func inboundWebRegistryHandler(rw http.ResponseWriter, req *http.Request) {
+	stats.Count.HTTP++
+
+	target, _, err := HTTPArgs(req, TTServerTopicRegistry)
+	if err != nil {
+		http.Error(rw, ErrorString(err), http.StatusBadRequest)
+		return
+	}
+	target = strings.TrimSuffix(target, "/")
+
+	// Everything other than reading requires that the requestor be an administrator, and
+	// only administrators may read custodian contacts
+	status, err := adminAuthenticate(req)
+	admin := err == nil
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		if !admin {
+			requestor, _, _ := getRequestorIPv4(req)
+			ServerLog(fmt.Sprintf("REGISTRY %s rejected from %s: %s\n", req.Method, requestor, err))
+			http.Error(rw, http.StatusText(status), status)
+			return
+		}
+	}
+
+	// Import the tracker sheet
+	if target == registryImportTarget {
+		if req.Method != http.MethodPost {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		added, updated, err := registryImportSheet()
+		if err != nil {
+			http.Error(rw, ErrorString(err), http.StatusBadGateway)
+			return
+		}
+		ServerLog(fmt.Sprintf("REGISTRY imported tracker sheet: %d added, %d updated\n", added, updated))
+		httpRespondJSON(rw, http.StatusOK, struct {
+			Added   int `json:"added"`
+			Updated int `json:"updated"`
+		}{added, updated})
+		return
+	}
+
+	// The list of devices
+	if target == "" {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		devices := registryList()
+		for i := range devices {
+			devices[i] = registryRedact(devices[i], admin)
+		}
+		httpRespondJSON(rw, http.StatusOK, devices)
+		return
+	}
+
+	// A single device
+	u64, err := strconv.ParseUint(target, 10, 32)
+	if err != nil || u64 == 0 {
+		http.Error(rw, "invalid device ID", http.StatusBadRequest)
+		return
+	}
+	deviceID := uint32(u64)
+
+	switch req.Method {
+
+	case http.MethodGet, http.MethodHead:
+		device, found := registryGet(deviceID, "")
+		if !found {
+			http.Error(rw, "device not registered", http.StatusNotFound)
+			return
+		}
+		httpRespondJSON(rw, http.StatusOK, registryRedact(device, admin))
+
+	case http.MethodPut, http.MethodPost:
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(rw, ErrorString(err), http.StatusBadRequest)
+			return
+		}
+		device := RegistryDevice{}
+		err = json.Unmarshal(body, &device)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("can't parse JSON: %s", err), http.StatusBadRequest)
+			return
+		}
+		if device.DeviceID != 0 && device.DeviceID != deviceID {
+			http.Error(rw, "device ID doesn't match", http.StatusBadRequest)
+			return
+		}
+		device.DeviceID = deviceID
+		existing, _ := registryGet(deviceID, "")
+		if device.CustodianContact == registryRedacted {
+			device.CustodianContact = existing.CustodianContact
+		}
+		if device.Key == registryRedacted {
+			device.Key = existing.Key
+		} else if device.Key != "" {
+			_, err = appReqKey(device.Key)
+			if err != nil {
+				http.Error(rw, ErrorString(err), http.StatusBadRequest)
+				return
+			}
+		}
+		if device.Tube != "" {
+			_, found := tubeModel(tubeCurrentModels(), device.Tube)
+			if !found {
+				http.Error(rw, fmt.Sprintf("unknown tube '%s'", device.Tube), http.StatusBadRequest)
+				return
+			}
+		}
+		err = registryPut(device)
+		if err != nil {
+			http.Error(rw, ErrorString(err), http.StatusInternalServerError)
+			return
+		}
+		ServerLog(fmt.Sprintf("REGISTRY updated device %d\n", deviceID))
+		device, _ = registryGet(deviceID, "")
+		httpRespondJSON(rw, http.StatusOK, registryRedact(device, admin))
+
+	case http.MethodDelete:
+		found, err := registryDelete(deviceID)
+		if err != nil {
+			http.Error(rw, ErrorString(err), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(rw, "device not registered", http.StatusNotFound)
+			return
+		}
+		ServerLog(fmt.Sprintf("REGISTRY deleted device %d\n", deviceID))
+		rw.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+	}
+
+}
+
+// registryRedact hides a device's key, which is a secret shared only with the device, and
+// unless the requestor is an administrator the contact details of its custodian
+func registryRedact(device RegistryDevice, admin bool) RegistryDevice {
+	if device.Key != "" {
+		device.Key = registryRedacted
+	}
+	if device.CustodianContact != "" && !admin {
+		device.CustodianContact = registryRedacted
+	}
+	return device
+}
+
+// adminAuthenticate makes sure that an administrative request comes from someone who knows an
+// admin secret, refusing all of them if none are configured
+func adminAuthenticate(req *http.Request) (status int, err error) {
+	config := CurrentServiceConfig()
+	if len(config.AdminSecrets) == 0 {
+		return http.StatusForbidden, fmt.Errorf("no admin secret is configured")
+	}
+	if noteSecretValid(config.AdminSecrets, req.Header.Get(adminSecretHeader)) {
+		return http.StatusOK, nil
+	}
+	return http.StatusUnauthorized, fmt.Errorf("invalid admin secret")
+}
@@ -0,0 +1,142 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// registryTestSetup uses an empty registry file in an empty data folder for the duration of a test
+func registryTestSetup(t *testing.T) {
+	t.Helper()
+	testServiceConfig(t, TTServeConfig{AdminSecrets: []string{"admin-secret"}})
+	testDataDirectory(t)
+	os.MkdirAll(SafecastDirectory()+TTServerLogPath, 0777)
+	registryLock.Lock()
+	prevDevices, prevModTime := registryDevices, registryModTime
+	registryDevices = map[uint32]RegistryDevice{}
+	registryLock.Unlock()
+	t.Cleanup(func() {
+		registryLock.Lock()
+		registryDevices, registryModTime = prevDevices, prevModTime
+		registryLock.Unlock()
+	})
+}
+
+// registryTestRequest sends a request to the registry handler, as an administrator if secret is set
+func registryTestRequest(t *testing.T, method string, path string, secret string, body string) (status int, device RegistryDevice) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if secret != "" {
+		req.Header.Set(adminSecretHeader, secret)
+	}
+	rw := httptest.NewRecorder()
+	inboundWebRegistryHandler(rw, req)
+	if rw.Code == http.StatusOK && !strings.HasSuffix(path, TTServerTopicRegistry) {
+		err := json.Unmarshal(rw.Body.Bytes(), &device)
+		if err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+	}
+	return rw.Code, device
+}
+
+func TestRegistryRedaction(t *testing.T) {
+	registryTestSetup(t)
+
+	body := `{"sn":"100","custodian_name":"Ray","custodian_contact":"ray@example.com","key":"000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"}`
+	if status, _ := registryTestRequest(t, http.MethodPut, "/registry/42", "", body); status != http.StatusForbidden && status != http.StatusUnauthorized {
+		t.Fatalf("PUT without the admin secret: got %d", status)
+	}
+	if status, _ := registryTestRequest(t, http.MethodPut, "/registry/42", "admin-secret", body); status != http.StatusOK {
+		t.Fatalf("PUT: got %d", status)
+	}
+
+	tests := []struct {
+		name        string
+		secret      string
+		wantContact string
+	}{
+		{"anonymous", "", registryRedacted},
+		{"wrong secret", "guess", registryRedacted},
+		{"admin", "admin-secret", "ray@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, device := registryTestRequest(t, http.MethodGet, "/registry/42", tt.secret, "")
+			if status != http.StatusOK {
+				t.Fatalf("GET: got %d", status)
+			}
+			if device.CustodianContact != tt.wantContact {
+				t.Errorf("contact: got %q, want %q", device.CustodianContact, tt.wantContact)
+			}
+			if device.Key != registryRedacted {
+				t.Errorf("key: got %q, want it redacted", device.Key)
+			}
+			if device.Custodian != "Ray" {
+				t.Errorf("custodian: got %q", device.Custodian)
+			}
+		})
+	}
+
+	// The list is redacted the same way
+	req := httptest.NewRequest(http.MethodGet, "/registry", nil)
+	rw := httptest.NewRecorder()
+	inboundWebRegistryHandler(rw, req)
+	if rw.Code != http.StatusOK || strings.Contains(rw.Body.String(), "ray@example.com") || strings.Contains(rw.Body.String(), "0001020304") {
+		t.Errorf("list: got %d %s", rw.Code, rw.Body.String())
+	}
+
+	// Giving redacted fields back leaves them unchanged
+	_, device := registryTestRequest(t, http.MethodGet, "/registry/42", "", "")
+	device.Location = "Tokyo"
+	contents, _ := json.Marshal(device)
+	if status, _ := registryTestRequest(t, http.MethodPut, "/registry/42", "admin-secret", string(contents)); status != http.StatusOK {
+		t.Fatalf("PUT of redacted device: got %d", status)
+	}
+	stored, _ := registryGet(42, "")
+	if stored.CustodianContact != "ray@example.com" || !strings.HasPrefix(stored.Key, "0001020304") || stored.Location != "Tokyo" {
+		t.Errorf("stored: got %+v", stored)
+	}
+
+}
+
+func TestRegistryModifyKeepsOtherInstancesChanges(t *testing.T) {
+	registryTestSetup(t)
+
+	err := registryPut(RegistryDevice{DeviceID: 1, SN: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance adds a device to the file, which we haven't yet reloaded
+	rf := registryFile{Devices: []RegistryDevice{{DeviceID: 1, SN: "1"}, {DeviceID: 2, SN: "2"}}}
+	contents, _ := json.Marshal(rf)
+	err = fileWriteAtomic(registryFilename(), contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = registryPut(RegistryDevice{DeviceID: 3, SN: "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint32{1, 2, 3} {
+		if _, found := registryGet(id, ""); !found {
+			t.Errorf("device %d not registered", id)
+		}
+	}
+
+	devices, _, err := registryRead()
+	if err != nil || len(devices) != 3 {
+		t.Errorf("file: got %d devices, %v", len(devices), err)
+	}
+
+}
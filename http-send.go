@@ -54,11 +54,19 @@ func inboundWebSendHandler(rw http.ResponseWriter, req *http.Request) {
 
 	switch req.UserAgent() {
 
-	// UDP messages that were relayed to the TTSERVE HTTP load balancer, JSON-formatted
-	case "TTSERVE":
+	// UDP messages that were relayed to the TTSERVE HTTP load balancer, JSON-formatted, which
+	// must be signed by the instance that relayed them if relay secrets are configured
+	case relayUserAgent:
 		{
 			var ttg TTGateReq
 
+			if len(CurrentServiceConfig().RelaySecrets) != 0 && !relayRequestTrusted(req, body) {
+				requestor, _, _ := getRequestorIPv4(req)
+				ServerLog(fmt.Sprintf("SEND relayed payload rejected from %s: bad relay signature\n", requestor))
+				http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
 			err = json.Unmarshal(body, &ttg)
 			if err != nil {
 				fmt.Printf("*** Received badly formatted HTTP request from %s: \n%v\n", req.UserAgent(), body)
@@ -69,7 +77,7 @@ func inboundWebSendHandler(rw http.ResponseWriter, req *http.Request) {
 			AppReq := newAppReqFromGateway(&ttg, ttg.Transport)
 
 			// Process it.  Note there is no possibility of a reply.
-			go AppReqPushPayload(AppReq, ttg.Payload, "device directly")
+			trackedGo(func() { AppReqPushPayload(AppReq, ttg.Payload, "device directly") })
 			stats.Count.HTTPRelay++
 
 		}
@@ -79,16 +87,17 @@ func inboundWebSendHandler(rw http.ResponseWriter, req *http.Request) {
 		{
 			var ttg TTGateReq
 
-			err = json.Unmarshal(body, &ttg)
-			if err != nil {
-				return
-			}
-
 			// Figure out the transport based upon whether or not a gateway ID was included
 			requestor, _, abusive := getRequestorIPv4(req)
 			if abusive {
 				return
 			}
+
+			err = json.Unmarshal(body, &ttg)
+			if err != nil {
+				abuseMalformed(requestor)
+				return
+			}
 			Transport := "lora-http:" + requestor
 			if ttg.GatewayID != "" {
 				Transport = "lora:" + ttg.GatewayID
@@ -98,7 +107,7 @@ func inboundWebSendHandler(rw http.ResponseWriter, req *http.Request) {
 			AppReq := newAppReqFromGateway(&ttg, Transport)
 
 			// Process it
-			go AppReqPushPayload(AppReq, ttg.Payload, "Lora gateway")
+			trackedGo(func() { AppReqPushPayload(AppReq, ttg.Payload, "Lora gateway") })
 			stats.Count.HTTPGateway++
 
 		}
@@ -108,22 +117,23 @@ func inboundWebSendHandler(rw http.ResponseWriter, req *http.Request) {
 		{
 
 			// After the single solarproto unit is upgraded, we can remove this.
+			requestor, _, abusive := getRequestorIPv4(req)
+			if abusive {
+				return
+			}
 			buf, err := hex.DecodeString(string(body))
 			if err != nil {
+				abuseMalformed(requestor)
 				fmt.Printf("Hex decoding error: %v\n%v\n", err, string(body))
 				return
 			}
 
 			// Initialize a new AppReq
 			AppReq := IncomingAppReq{}
-			requestor, _, abusive := getRequestorIPv4(req)
-			if abusive {
-				return
-			}
 			AppReq.SvTransport = "device-http:" + requestor
 
 			// Push it
-			go AppReqPushPayload(AppReq, buf, "device directly")
+			trackedGo(func() { AppReqPushPayload(AppReq, buf, "device directly") })
 			stats.Count.HTTPDevice++
 
 		}
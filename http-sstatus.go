@@ -6,10 +6,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 )
 
 // Handle inbound HTTP requests to fetch log files
@@ -26,20 +26,22 @@ func inboundWebServerStatusHandler(rw http.ResponseWriter, req *http.Request) {
 
 			fmt.Printf("%s Server information request for %s\n", LogTime(), filename)
 
-			// Open the file
-			file := SafecastDirectory() + TTServerStatusPath + "/" + filename + ".json"
-			fd, err := os.Open(file)
+			// Get the status
+			contents, err := store.Get(TTServerStatusPath, filename)
 			if err != nil {
 				io.WriteString(rw, ErrorString(err))
 				return
 			}
-			defer fd.Close()
 
-			// Copy the file to output
-			io.Copy(rw, fd)
+			// Copy it to output
+			rw.Write(contents)
 			return
 
 		}
 	}
 
+	// With no instance specified, return the live status of this instance
+	statusJSON, _ := json.MarshalIndent(CurrentServerStatus(), "", "    ")
+	rw.Write(statusJSON)
+
 }
@@ -0,0 +1,215 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Optional HTTPS listener, so that secrets posted by webhooks needn't travel in
+// the clear.  Certificates come either from files named in the service config,
+// which are re-read when they change, or from an ACME provider such as Let's
+// Encrypt, in which case they are cached in a local directory.
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Topics that only ever return data, and which may thus be redirected to HTTPS
+var httpsRedirectTopics = []string{
+	TTServerTopicDevices,
+	TTServerTopicDeviceLog,
+	TTServerTopicFile,
+	TTServerTopicDeviceCheck,
+	TTServerTopicDeviceStatus,
+	TTServerTopicServerLog,
+	TTServerTopicServerStatus,
+	TTServerTopicGatewayStatus,
+	TTServerTopicMetrics,
+	TTServerTopicQuarantine,
+	TTServerTopicQuarantine + "/",
+	TTServerTopicRegistry,
+	TTServerTopicRegistry + "/",
+	TTServerTopicBackfill,
+}
+
+// Certificate loaded from files, along with the modified time of the files when loaded
+var tlsCertLock sync.Mutex
+var tlsCert *tls.Certificate
+var tlsCertModTime time.Time
+
+// The ACME manager, if we're getting certificates that way
+var acmeManager *autocert.Manager
+
+// The port on which HTTPS is actually being served, if it is, to which we may thus redirect
+var httpsServingPort atomic.Pointer[string]
+
+// HTTPSEnabled returns true if we are configured to serve HTTPS
+func HTTPSEnabled() bool {
+	config := CurrentServiceConfig()
+	return config.HTTPSPort != "" && (config.TLSCertFile != "" || config.ACMEDirectory != "" || len(config.ACMEHosts) != 0)
+}
+
+// httpsInit prepares for serving HTTPS, returning the handler that the plain HTTP listener should use
+func httpsInit() (plainHandler http.Handler, tlsConfig *tls.Config, err error) {
+
+	plainHandler = http.HandlerFunc(httpsRedirectHandler)
+
+	config := CurrentServiceConfig()
+	if !HTTPSEnabled() {
+		return
+	}
+
+	// Certificates from files take precedence over ACME
+	if config.TLSCertFile != "" {
+		_, err = tlsCertificate(nil)
+		if err != nil {
+			return
+		}
+		tlsConfig = &tls.Config{GetCertificate: tlsCertificate}
+		return
+	}
+
+	directory := config.ACMEDirectory
+	if directory == "" {
+		directory = SafecastDirectory() + TTServerACMEPath
+	}
+	hosts := config.ACMEHosts
+	if len(hosts) == 0 {
+		hosts = []string{config.HTTPAddress}
+	}
+	acmeManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(directory),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      config.ACMEEmail,
+	}
+	tlsConfig = acmeManager.TLSConfig()
+
+	// The ACME provider verifies that we own the host by fetching a challenge over plain HTTP
+	plainHandler = acmeManager.HTTPHandler(plainHandler)
+
+	return
+
+}
+
+// tlsCertificate returns the certificate from the configured files, re-reading them if they've changed
+func tlsCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	config := CurrentServiceConfig()
+	keyFile := config.TLSKeyFile
+	if keyFile == "" {
+		keyFile = config.TLSCertFile
+	}
+
+	var modTime time.Time
+	for _, filename := range []string{config.TLSCertFile, keyFile} {
+		file, err := os.Stat(filename)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %s", err)
+		}
+		if file.ModTime().After(modTime) {
+			modTime = file.ModTime()
+		}
+	}
+
+	tlsCertLock.Lock()
+	defer tlsCertLock.Unlock()
+
+	if tlsCert == nil || !modTime.Equal(tlsCertModTime) {
+		cert, err := tls.LoadX509KeyPair(config.TLSCertFile, keyFile)
+		if err != nil {
+			// Keep using what we had, if anything, rather than taking HTTPS down
+			if tlsCert != nil {
+				fmt.Printf("%s *** Can't reload TLS certificate: %s\n", LogTime(), err)
+				return tlsCert, nil
+			}
+			return nil, fmt.Errorf("tls: %s", err)
+		}
+		tlsCert = &cert
+		tlsCertModTime = modTime
+	}
+
+	return tlsCert, nil
+
+}
+
+// HTTPSInboundHandler serves HTTPS
+func HTTPSInboundHandler(tlsConfig *tls.Config) {
+
+	port := CurrentServiceConfig().HTTPSPort
+	server := &http.Server{
+		Addr:      port,
+		Handler:   abuseHandler(http.DefaultServeMux),
+		TLSConfig: tlsConfig,
+	}
+	shutdownAddServer(server)
+
+	listener, err := net.Listen("tcp", port)
+	if err != nil {
+		fmt.Printf("*** HTTPS: %s\n", err)
+		return
+	}
+
+	fmt.Printf("Now handling inbound HTTPS on %s%s\n", ThisServerAddressIPv4, port)
+	httpsServingPort.Store(&port)
+	err = server.ServeTLS(listener, "", "")
+	httpsServingPort.Store(nil)
+	if err != nil && err != http.ErrServerClosed {
+		fmt.Printf("*** HTTPS: %s\n", err)
+	}
+
+}
+
+// Redirect read-only requests arriving over plain HTTP to HTTPS if configured to do so and
+// we're actually serving it, which we may not be if it was configured after we started or
+// couldn't be set up, passing everything else (including device uploads, which can't do
+// TLS) through.
+func httpsRedirectHandler(rw http.ResponseWriter, req *http.Request) {
+
+	config := CurrentServiceConfig()
+	servingPort := httpsServingPort.Load()
+	if !config.HTTPSRedirect || servingPort == nil || req.TLS != nil ||
+		(req.Method != "GET" && req.Method != "HEAD") ||
+		strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https") ||
+		!httpsRedirectTopic(req.URL.Path) {
+		http.DefaultServeMux.ServeHTTP(rw, req)
+		return
+	}
+
+	host := req.Host
+	h, _, err := net.SplitHostPort(host)
+	if err == nil {
+		host = h
+	}
+	if *servingPort != ":443" {
+		_, port, err := net.SplitHostPort(*servingPort)
+		if err == nil {
+			host = net.JoinHostPort(host, port)
+		}
+	}
+
+	http.Redirect(rw, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+
+}
+
+// httpsRedirectTopic returns true if the path is one of the read-only topics
+func httpsRedirectTopic(path string) bool {
+	for _, topic := range httpsRedirectTopics {
+		if strings.HasSuffix(topic, "/") {
+			if strings.HasPrefix(path, topic) {
+				return true
+			}
+		} else if path == topic {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSRedirectOnlyWhenServing(t *testing.T) {
+	testServiceConfig(t, TTServeConfig{HTTPSRedirect: true, HTTPSPort: ":8443", TLSCertFile: "cert.pem"})
+	t.Cleanup(func() { httpsServingPort.Store(nil) })
+
+	tests := []struct {
+		name     string
+		serving  string
+		method   string
+		path     string
+		location string
+	}{
+		{"configured but not serving", "", http.MethodGet, TTServerTopicMetrics, ""},
+		{"serving", ":8443", http.MethodGet, TTServerTopicMetrics, "https://example.org:8443" + TTServerTopicMetrics},
+		{"serving on the default port", ":443", http.MethodGet, TTServerTopicMetrics, "https://example.org" + TTServerTopicMetrics},
+		{"upload", ":8443", http.MethodPost, TTServerTopicMetrics, ""},
+		{"not read-only", ":8443", http.MethodGet, TTServerTopicSend, ""},
+	}
+	for _, test := range tests {
+		if test.serving == "" {
+			httpsServingPort.Store(nil)
+		} else {
+			port := test.serving
+			httpsServingPort.Store(&port)
+		}
+		req := httptest.NewRequest(test.method, "http://example.org:8080"+test.path, nil)
+		rw := httptest.NewRecorder()
+		httpsRedirectHandler(rw, req)
+		location := rw.Header().Get("Location")
+		if location != test.location {
+			t.Errorf("%s: redirected to %q, want %q", test.name, location, test.location)
+		}
+	}
+}
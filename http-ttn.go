@@ -51,7 +51,7 @@ func inboundWebTTNHandler(rw http.ResponseWriter, req *http.Request) {
 	AppReq.SvTransport = "ttn-http:" + ttn.DevID
 
 	// Push it to be processed
-	go AppReqPushPayload(AppReq, ttn.PayloadRaw, "TTN")
+	trackedGo(func() { AppReqPushPayload(AppReq, ttn.PayloadRaw, "TTN") })
 	stats.Count.HTTPTTN++
 
 }
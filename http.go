@@ -6,6 +6,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -43,6 +44,12 @@ func HTTPInboundHandler() {
 	http.HandleFunc(TTServerTopicSend, inboundWebSendHandler)
 	http.HandleFunc(TTServerTopicNote, inboundWebNoteHandler)
 	http.HandleFunc(TTServerTopicNoteTest, inboundWebNoteHandlerTest)
+	http.HandleFunc(TTServerTopicMetrics, inboundWebMetricsHandler)
+	http.HandleFunc(TTServerTopicQuarantine, inboundWebQuarantineHandler)
+	http.HandleFunc(TTServerTopicQuarantine+"/", inboundWebQuarantineHandler)
+	http.HandleFunc(TTServerTopicRegistry, inboundWebRegistryHandler)
+	http.HandleFunc(TTServerTopicRegistry+"/", inboundWebRegistryHandler)
+	http.HandleFunc(TTServerTopicBackfill, inboundWebBackfillHandler)
 	http.HandleFunc(TTServerTopicRedirect1, inboundWebRedirectHandler)
 	http.HandleFunc(TTServerTopicRedirect2, inboundWebRedirectHandler)
 	http.HandleFunc(TTServerTopicID, inboundWebIDHandler)
@@ -50,15 +57,29 @@ func HTTPInboundHandler() {
 	http.HandleFunc(TTServerTopicDashboard, inboundWebDashboardHandler)
 	http.HandleFunc(TTServerTopicProfile, inboundWebProfileHandler)
 
+	// Listen on the HTTPS port, if configured to do so
+	config := CurrentServiceConfig()
+	handler, tlsConfig, err := httpsInit()
+	handler = abuseHandler(handler)
+	if err != nil {
+		fmt.Printf("*** HTTPS disabled: %s\n", err)
+	} else if tlsConfig != nil {
+		go HTTPSInboundHandler(tlsConfig)
+	}
+
 	// Listen on the alternate HTTP port
+	alternate := &http.Server{Addr: config.HTTPPortAlternate, Handler: handler}
+	shutdownAddServer(alternate)
 	go func() {
-		fmt.Printf("Now handling inbound HTTP on %s:%s\n", ThisServerAddressIPv4, TTServerHTTPPortAlternate)
-		http.ListenAndServe(TTServerHTTPPortAlternate, nil)
+		fmt.Printf("Now handling inbound HTTP on %s%s\n", ThisServerAddressIPv4, config.HTTPPortAlternate)
+		alternate.ListenAndServe()
 	}()
 
 	// Listen on the primary HTTP port
-	fmt.Printf("Now handling inbound HTTP on %s:%s\n", ThisServerAddressIPv4, TTServerHTTPPort)
-	http.ListenAndServe(TTServerHTTPPort, nil)
+	primary := &http.Server{Addr: config.HTTPPort, Handler: handler}
+	shutdownAddServer(primary)
+	fmt.Printf("Now handling inbound HTTP on %s%s\n", ThisServerAddressIPv4, config.HTTPPort)
+	primary.ListenAndServe()
 
 }
 
@@ -68,6 +89,14 @@ func inboundWebRootHandler(rw http.ResponseWriter, req *http.Request) {
 	io.WriteString(rw, fmt.Sprintf("Hello. (%s)\n", ThisServerAddressIPv4))
 }
 
+// httpRespondJSON replies with the JSON of a response
+func httpRespondJSON(rw http.ResponseWriter, status int, response interface{}) {
+	responseJSON, _ := json.MarshalIndent(response, "", "    ")
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(responseJSON)
+}
+
 // HTTPArgs parses the request URI and returns interesting things
 func HTTPArgs(req *http.Request, topic string) (target string, args map[string]string, err error) {
 	args = map[string]string{}
@@ -20,7 +20,10 @@ func inputHandler() {
 	for {
 
 		fmt.Print("\n> ")
-		scanner.Scan()
+		if !scanner.Scan() {
+			// No console, as when running detached in a container or in CI
+			return
+		}
 		text = scanner.Text()
 
 		switch strings.ToLower(text) {
@@ -29,7 +32,7 @@ func inputHandler() {
 
 		case "q":
 			ServerLog("*** RESTARTING at console request\n")
-			os.Exit(0)
+			Shutdown()
 
 		default:
 			fmt.Printf("Unrecognized: '%s'\n", text)
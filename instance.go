@@ -0,0 +1,214 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Identification of this server instance, and of the roles that it plays.
+// On AWS this comes from the EC2 metadata service and from DNS, and when
+// running standalone (on bare metal, in a container, or in CI) it comes
+// from the service config or from the command line.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Roles that an instance may be configured to play, rather than discovering them from DNS
+const instanceRoleMonitor = "monitor"
+const instanceRoleUDP = "udp"
+const instanceRoleMQTT = "mqtt"
+
+// Command line flags, which take precedence over the service config
+var flagStandalone = flag.Bool("standalone", false, "run without AWS instance metadata or checkip")
+var flagInstanceID = flag.String("instance", "", "instance ID when standalone (default hostname)")
+var flagPublicIP = flag.String("ip", "", "public IPv4 address when standalone (default first non-loopback)")
+var flagDataDirectory = flag.String("data", "", "folder for safecast data, if not the folder containing the config")
+var flagRoles = flag.String("roles", "", "comma-separated roles: monitor, udp, mqtt (default from DNS, or all when standalone)")
+
+// InstanceStandalone is true if we're not running on AWS
+var InstanceStandalone = false
+
+// instanceFlags overrides the service config with the command line
+func instanceFlags(config *TTServeConfig) {
+	if *flagStandalone {
+		config.Standalone = true
+	}
+	if *flagInstanceID != "" {
+		config.InstanceID = *flagInstanceID
+	}
+	if *flagPublicIP != "" {
+		config.PublicIPv4 = *flagPublicIP
+	}
+	if *flagDataDirectory != "" {
+		config.DataDirectory = *flagDataDirectory
+	}
+	if *flagRoles != "" {
+		config.Roles = configList(*flagRoles)
+	}
+}
+
+// instanceConfigure adopts the parts of the config that are fixed for the life of the instance
+func instanceConfigure(config TTServeConfig) {
+	InstanceStandalone = config.Standalone
+	safecastDataDirectory = config.DataDirectory
+}
+
+// instanceIdentify determines our instance ID and public address
+func instanceIdentify(config TTServeConfig) {
+	if InstanceStandalone {
+		instanceIdentifyStandalone(config)
+	} else {
+		instanceIdentifyAWS()
+	}
+	stats.AddressIPv4 = ThisServerAddressIPv4
+}
+
+// instanceIdentifyAWS asks AWS who we are, and exits if we can't find out
+func instanceIdentifyAWS() {
+
+	// Get our external IP address
+	rsp, err := http.Get("http://checkip.amazonaws.com")
+	if err != nil {
+		fmt.Printf("Can't get our own IP address: %v\n", err)
+		os.Exit(0)
+	}
+	defer rsp.Body.Close()
+	buf, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		fmt.Printf("Error fetching IP addr: %v\n", err)
+		os.Exit(0)
+	}
+	ThisServerAddressIPv4 = string(bytes.TrimSpace(buf))
+
+	// Get AWS info about this instance
+	// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instance-identity-documents.html
+	rsp, erraws := http.Get("http://169.254.169.254/latest/dynamic/instance-identity/document")
+	if erraws != nil {
+		fmt.Printf("Can't get our own instance info: %v\n", erraws)
+		os.Exit(0)
+	}
+	defer rsp.Body.Close()
+	buf, errread := io.ReadAll(rsp.Body)
+	if errread != nil {
+		fmt.Printf("Error fetching instance info: %v\n", errread)
+		os.Exit(0)
+	}
+
+	err = json.Unmarshal(buf, &stats.AWSInstance)
+	if err != nil {
+		fmt.Printf("*** Badly formatted AWS Info ***\n")
+		os.Exit(0)
+	}
+
+	TTServeInstanceID = stats.AWSInstance.InstanceID
+	ServerLog("*** STARTUP\n")
+	fmt.Printf("\n%s *** AWS %s %s\n", LogTime(), stats.AWSInstance.Region, stats.AWSInstance.InstanceID)
+
+}
+
+// instanceIdentifyStandalone takes who we are from config, defaulting to what we can learn locally
+func instanceIdentifyStandalone(config TTServeConfig) {
+
+	TTServeInstanceID = config.InstanceID
+	if TTServeInstanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			hostname = "standalone"
+		}
+		TTServeInstanceID = hostname
+	}
+
+	ThisServerAddressIPv4 = config.PublicIPv4
+	if ThisServerAddressIPv4 == "" {
+		ThisServerAddressIPv4 = instanceLocalIPv4()
+	}
+
+	ServerLog("*** STARTUP\n")
+	fmt.Printf("\n%s *** STANDALONE %s %s\n", LogTime(), TTServeInstanceID, ThisServerAddressIPv4)
+
+}
+
+// instanceLocalIPv4 gets the first non-loopback IPv4 address of this machine
+func instanceLocalIPv4() string {
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+				return ipnet.IP.String()
+			}
+		}
+	}
+	return "127.0.0.1"
+}
+
+// instanceAssignRoles determines which of the singleton services this instance provides
+func instanceAssignRoles(config TTServeConfig) {
+
+	// Roles that are configured explicitly take precedence
+	if InstanceStandalone || len(config.Roles) != 0 {
+		roles := config.Roles
+		if len(roles) == 0 {
+			roles = []string{instanceRoleMonitor, instanceRoleUDP}
+			if TTNMQTTMode {
+				roles = append(roles, instanceRoleMQTT)
+			}
+		}
+		for _, role := range roles {
+			switch strings.ToLower(role) {
+			case instanceRoleMonitor:
+				ThisServerIsMonitor = true
+			case instanceRoleUDP:
+				ThisServerServesUDP = true
+			case instanceRoleMQTT:
+				ThisServerServesMQTT = true
+			default:
+				fmt.Printf("*** Unrecognized role '%s' ignored\n", role)
+			}
+		}
+		if ThisServerServesUDP {
+			TTServerUDPAddressIPv4 = ThisServerAddressIPv4
+		}
+		if ThisServerIsMonitor {
+			fmt.Printf("THIS SERVER IS THE MONITOR INSTANCE\n")
+		}
+		return
+	}
+
+	// Look up the two IP addresses that we KNOW have only a single A record,
+	// and determine if WE are the server for those protocols
+	for {
+		addrs, err := net.LookupHost(config.UDPAddress)
+		if err == nil {
+			if len(addrs) >= 1 {
+				TTServerUDPAddressIPv4 = addrs[0]
+				break
+			}
+			err = fmt.Errorf("insufficient addr records for UDP")
+		}
+		fmt.Printf("Can't resolve %s: %v\n", config.UDPAddress, err)
+		time.Sleep(3 * time.Second)
+	}
+	ThisServerServesUDP = TTServerUDPAddressIPv4 == ThisServerAddressIPv4
+
+	// We have one server instance that is configured to field inbound requests
+	// from web hooks configured on external websites.
+	ThisServerIsMonitor = ThisServerServesUDP
+	if ThisServerIsMonitor {
+		fmt.Printf("THIS SERVER IS THE MONITOR INSTANCE\n")
+	}
+
+	// If and only if we're using MQTT (rather than TTN HTTP), do it on the UDP server
+	if TTNMQTTMode {
+		ThisServerServesMQTT = ThisServerServesUDP
+	}
+
+}
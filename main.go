@@ -5,12 +5,7 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -20,8 +15,20 @@ import (
 // Main service entry point
 func main() {
 
-	// Read our service config file
-	ServiceConfig = ServiceReadConfig()
+	// Commands other than running the service, each of which parses its own flags in the same way
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		backfillCommand(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "convert-logs" {
+		deviceLogConvertCommand(os.Args[2:])
+	}
+
+	// Parse the command line, whose flags precede the folder containing safecast data
+	flagParse(os.Args[1:])
+
+	// Read our service config file, overriding it with the command line
+	ServiceReadConfig()
+	instanceConfigure(CurrentServiceConfig())
 
 	// Spawn our signal handler
 	go signalHandler()
@@ -30,70 +37,23 @@ func main() {
 	stats.Started = time.Now()
 	stats.Count.Restarts++
 
-	// Get our external IP address
-	rsp, err := http.Get("http://checkip.amazonaws.com")
-	if err != nil {
-		fmt.Printf("Can't get our own IP address: %v\n", err)
-		os.Exit(0)
-	}
-	defer rsp.Body.Close()
-	buf, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		fmt.Printf("Error fetching IP addr: %v\n", err)
-		os.Exit(0)
-	}
-	ThisServerAddressIPv4 = string(bytes.TrimSpace(buf))
-	stats.AddressIPv4 = ThisServerAddressIPv4
-
-	// Get AWS info about this instance
-	// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instance-identity-documents.html
-	rsp, erraws := http.Get("http://169.254.169.254/latest/dynamic/instance-identity/document")
-	if erraws != nil {
-		fmt.Printf("Can't get our own instance info: %v\n", erraws)
-		os.Exit(0)
-	}
-	defer rsp.Body.Close()
-	buf, errread := io.ReadAll(rsp.Body)
-	if errread != nil {
-		fmt.Printf("Error fetching instance info: %v\n", errread)
-		os.Exit(0)
-	}
-
-	err = json.Unmarshal(buf, &stats.AWSInstance)
-	if err != nil {
-		fmt.Printf("*** Badly formatted AWS Info ***\n")
-		os.Exit(0)
-	}
-
-	TTServeInstanceID = stats.AWSInstance.InstanceID
-	ServerLog("*** STARTUP\n")
-	fmt.Printf("\n%s *** AWS %s %s\n", LogTime(), stats.AWSInstance.Region, stats.AWSInstance.InstanceID)
+	// Find out who we are, from AWS or, if standalone, from config
+	instanceIdentify(CurrentServiceConfig())
 
 	// Init our utility packages, but only after we've got our server instance ID
 	UtilInit()
 
-	// Look up the two IP addresses that we KNOW have only a single A record,
-	// and determine if WE are the server for those protocols
-	for {
-		addrs, err := net.LookupHost(TTServerUDPAddress)
-		if err == nil {
-			if len(addrs) >= 1 {
-				TTServerUDPAddressIPv4 = addrs[0]
-				break
-			}
-			err = fmt.Errorf("insufficient addr records for UDP")
-		}
-		fmt.Printf("Can't resolve %s: %v\n", TTServerUDPAddress, err)
-		time.Sleep(3 * time.Second)
-	}
-	ThisServerServesUDP = TTServerUDPAddressIPv4 == ThisServerAddressIPv4
+	// Load the schemas by which we interpret notefiles
+	noteSchemaInit()
 
-	// We have one server instance that is configured to field inbound requests
-	// from web hooks configured on external websites.
-	ThisServerIsMonitor = ThisServerServesUDP
-	if ThisServerIsMonitor {
-		fmt.Printf("THIS SERVER IS THE MONITOR INSTANCE\n")
-	}
+	// Open where we keep status and logs
+	storeInit()
+
+	// Load the device registry
+	registryInit()
+
+	// Determine if WE are the server for the singleton protocols and services
+	instanceAssignRoles(CurrentServiceConfig())
 
 	// We all support TCP because it's load-balanced.
 	ThisServerServesTCP := true
@@ -101,14 +61,12 @@ func main() {
 	// We all support HTTP because it's load-balanced.
 	ThisServerServesHTTP := true
 
-	// If and only if we're using MQTT (rather than TTN HTTP), do it on the UDP server
-	if TTNMQTTMode {
-		ThisServerServesMQTT = ThisServerServesUDP
-	}
-
 	// Get the date/time of the special files that we monitor
 	AllServersSlackRestartRequestTime = ControlFileTime(TTServerRestartAllControlFile, "")
 
+	// Set up the destinations to which we upload, before anything can arrive to be uploaded
+	sinkInit()
+
 	// Init our web request inbound server
 	if ThisServerServesHTTP {
 		go HTTPInboundHandler()
@@ -133,6 +91,9 @@ func main() {
 		stats.Services += ", MQTT"
 	}
 
+	// Spawn the retrier of uploads that failed
+	go uploadQueueHandler()
+
 	// Spawn the broker publisher
 	// DISABLED 2020-08 by Ray because CloudMQTT got rid of their free plan
 	// and it doesn't appear that anyone was using this feature of ttserve.
@@ -179,7 +140,8 @@ func signalHandler() {
 			fmt.Printf("*** Exiting %s because of SIGNAL \n", LogTime())
 			os.Exit(0)
 		case syscall.SIGTERM:
-			return
+			ServerLog("*** RESTARTING because of SIGTERM\n")
+			go Shutdown()
 		}
 	}
 }
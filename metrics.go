@@ -0,0 +1,329 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Upload transaction metrics, tracked per destination.  Every outbound upload
+// is bracketed by beginTransaction/endTransaction, which count it and record
+// its latency in a histogram.  Totals are kept since restart, and a second set
+// of "period" totals is reset each time it is summarized to Slack.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Debugging
+const verboseTransactions bool = true
+
+// Upload destinations whose transactions we track
+const metricsDestV1 = "V1"
+const metricsDestD1 = "D1"
+const metricsDestV2 = "V2"
+const metricsDestNotehub = "Notehub"
+
+// Upper bounds of the latency histogram buckets, beyond which is overflow
+var metricsLatencyBuckets = []time.Duration{
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	60 * time.Second,
+}
+
+// A transaction is considered slow beyond this, and when this many in a row
+// are slow we complain about it in Slack
+const metricsSlowTransaction = 5 * time.Second
+const metricsSlowTransactionsToReport = 500
+
+// LatencyBucket is a single histogram bucket, with its upper bound
+type LatencyBucket struct {
+	Le    string `json:"le,omitempty"`
+	Count uint64 `json:"count"`
+}
+
+// TransactionMetrics are the metrics of a single destination
+type TransactionMetrics struct {
+	Count              uint64          `json:"count,omitempty"`
+	Errors             uint64          `json:"errors,omitempty"`
+	InProgress         int64           `json:"in_progress,omitempty"`
+	MinMs              int64           `json:"min_ms,omitempty"`
+	MaxMs              int64           `json:"max_ms,omitempty"`
+	MeanMs             int64           `json:"mean_ms,omitempty"`
+	TotalMs            int64           `json:"total_ms,omitempty"`
+	Histogram          []LatencyBucket `json:"histogram,omitempty"`
+	FirstErrorAt       string          `json:"when_first_error,omitempty"`
+	FirstErrorEndpoint string          `json:"first_error_endpoint,omitempty"`
+	FirstError         string          `json:"first_error,omitempty"`
+}
+
+// Accumulated metrics of a single destination
+type destinationMetrics struct {
+	total      TransactionMetrics
+	period     TransactionMetrics
+	buckets    []uint64
+	pbuckets   []uint64
+	slowCount  int
+	slowErrors int
+	slowMin    time.Duration
+	slowMax    time.Duration
+	slowTotal  time.Duration
+}
+
+// An upload transaction in progress
+type uploadTransaction struct {
+	id          uint64
+	destination string
+	began       time.Time
+}
+
+// Statics
+var metricsLock sync.Mutex
+var metricsTransactions uint64
+var metricsByDestination = map[string]*destinationMetrics{}
+
+// Get the metrics for a destination, creating them if necessary.  Must be called with lock held.
+func metricsDestination(destination string) *destinationMetrics {
+	dm, present := metricsByDestination[destination]
+	if !present {
+		dm = &destinationMetrics{}
+		dm.buckets = make([]uint64, len(metricsLatencyBuckets)+1)
+		dm.pbuckets = make([]uint64, len(metricsLatencyBuckets)+1)
+		metricsByDestination[destination] = dm
+	}
+	return dm
+}
+
+// Add a completed transaction to a set of metrics
+func metricsAdd(m *TransactionMetrics, duration time.Duration, endpoint string, errstr string) {
+	ms := int64(duration / time.Millisecond)
+	m.Count++
+	m.InProgress--
+	m.TotalMs += ms
+	if m.Count == 1 || ms < m.MinMs {
+		m.MinMs = ms
+	}
+	if ms > m.MaxMs {
+		m.MaxMs = ms
+	}
+	m.MeanMs = m.TotalMs / int64(m.Count)
+	if errstr != "" {
+		m.Errors++
+		if m.FirstError == "" {
+			m.FirstErrorAt = LogTime()
+			m.FirstErrorEndpoint = endpoint
+			m.FirstError = errstr
+		}
+	}
+}
+
+// Begin transaction and return the transaction
+func beginTransaction(destination string, message1 string, message2 string) uploadTransaction {
+	metricsLock.Lock()
+	metricsTransactions++
+	transaction := uploadTransaction{id: metricsTransactions, destination: destination, began: time.Now()}
+	dm := metricsDestination(destination)
+	dm.total.InProgress++
+	dm.period.InProgress++
+	metricsLock.Unlock()
+	if verboseTransactions {
+		fmt.Printf("%s >>> %s [%d] %s %s\n", LogTime(), destination, transaction.id, message1, message2)
+	}
+	return transaction
+}
+
+// End transaction and issue warnings
+func endTransaction(transaction uploadTransaction, endpoint string, errstr string) {
+	transactionEnd(transaction, endpoint, errstr, true)
+}
+
+// End transaction, recording the error in metrics but without issuing warnings
+func endTransactionQuietly(transaction uploadTransaction, endpoint string, errstr string) {
+	transactionEnd(transaction, endpoint, errstr, false)
+}
+
+// Record the completion of a transaction to an endpoint, named such that no API key is exposed
+func transactionEnd(transaction uploadTransaction, endpoint string, errstr string, warn bool) {
+	duration := time.Since(transaction.began)
+
+	if errstr != "" {
+		if verboseTransactions {
+			fmt.Printf("%s <<<    [%d] *** ERROR\n", LogTime(), transaction.id)
+		}
+		if warn {
+			ServerLog(fmt.Sprintf("After %.1f seconds, error uploading to %s %s\n", duration.Seconds(), endpoint, errstr))
+		}
+	} else {
+		if verboseTransactions {
+			if duration < metricsSlowTransaction {
+				fmt.Printf("%s <<<    [%d]\n", LogTime(), transaction.id)
+			} else {
+				fmt.Printf("%s <<<    [%d] completed after %.1f seconds\n", LogTime(), transaction.id, duration.Seconds())
+			}
+		}
+	}
+
+	metricsLock.Lock()
+
+	dm := metricsDestination(transaction.destination)
+	metricsAdd(&dm.total, duration, endpoint, errstr)
+	if warn {
+		metricsAdd(&dm.period, duration, endpoint, errstr)
+	} else {
+		metricsAdd(&dm.period, duration, endpoint, "")
+	}
+	bucket := len(metricsLatencyBuckets)
+	for i, le := range metricsLatencyBuckets {
+		if duration <= le {
+			bucket = i
+			break
+		}
+	}
+	dm.buckets[bucket]++
+	dm.pbuckets[bucket]++
+
+	// Track runs of slow transactions, which is what tells us that the service is in trouble
+	report := ""
+	if duration <= metricsSlowTransaction || !warn {
+		dm.slowCount = 0
+	} else {
+		if dm.slowCount == 0 {
+			dm.slowErrors = 0
+			dm.slowMin = duration
+			dm.slowMax = duration
+			dm.slowTotal = 0
+		}
+		dm.slowCount++
+		dm.slowTotal += duration
+		if duration < dm.slowMin {
+			dm.slowMin = duration
+		}
+		if duration > dm.slowMax {
+			dm.slowMax = duration
+		}
+		if errstr != "" {
+			dm.slowErrors++
+		}
+		if dm.slowCount%metricsSlowTransactionsToReport == 0 {
+			if dm.slowErrors == dm.slowCount {
+				report = fmt.Sprintf("HTTP Upload: all of the most recent %d uploads to %s failed. Please check the service.",
+					dm.slowCount, transaction.destination)
+			} else {
+				report = fmt.Sprintf("HTTP Upload: of the previous %d uploads to %s, min=%.1fs, max=%.1fs, avg=%.1fs",
+					dm.slowCount, transaction.destination, dm.slowMin.Seconds(), dm.slowMax.Seconds(),
+					(dm.slowTotal / time.Duration(dm.slowCount)).Seconds())
+			}
+		}
+	}
+	slowCount := dm.slowCount
+
+	metricsLock.Unlock()
+
+	// Output to console every time we are in a "slow mode"
+	if slowCount > 0 {
+		fmt.Printf("%s *** %d consecutive slow uploads to %s\n", LogTime(), slowCount, transaction.destination)
+	}
+
+	// If there's a problem, output to Slack periodically
+	if report != "" {
+		sendToSafecastOps(report, SlackMsgUnsolicitedOps)
+	}
+
+}
+
+// metricsSnapshot returns a copy of the metrics since restart, by destination
+func metricsSnapshot() map[string]TransactionMetrics {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	if len(metricsByDestination) == 0 {
+		return nil
+	}
+	snapshot := map[string]TransactionMetrics{}
+	for destination, dm := range metricsByDestination {
+		m := dm.total
+		m.Histogram = metricsHistogram(dm.buckets)
+		snapshot[destination] = m
+	}
+	return snapshot
+}
+
+// Convert bucket counts to their external form.  Must be called with lock held.
+func metricsHistogram(buckets []uint64) (histogram []LatencyBucket) {
+	for i, count := range buckets {
+		le := "+Inf"
+		if i < len(metricsLatencyBuckets) {
+			le = metricsLatencyBuckets[i].String()
+		}
+		histogram = append(histogram, LatencyBucket{Le: le, Count: count})
+	}
+	return
+}
+
+// Estimate a latency percentile from a histogram, as the upper bound of the bucket containing it
+func metricsPercentile(buckets []uint64, percentile float64) string {
+	var total uint64
+	for _, count := range buckets {
+		total += count
+	}
+	if total == 0 {
+		return "-"
+	}
+	var cumulative uint64
+	for i, count := range buckets {
+		cumulative += count
+		if float64(cumulative) >= percentile*float64(total) {
+			if i < len(metricsLatencyBuckets) {
+				return "<" + metricsLatencyBuckets[i].String()
+			}
+			break
+		}
+	}
+	return ">" + metricsLatencyBuckets[len(metricsLatencyBuckets)-1].String()
+}
+
+// Summarize upload errors and latency since the last summary, and notify
+func sendSafecastCommsErrorsToSlack(PeriodMinutes uint32) {
+
+	metricsLock.Lock()
+
+	var destinations []string
+	for destination := range metricsByDestination {
+		destinations = append(destinations, destination)
+	}
+	sort.Strings(destinations)
+
+	errors := uint64(0)
+	warnings := ""
+	summary := ""
+	for _, destination := range destinations {
+		dm := metricsByDestination[destination]
+		p := dm.period
+		if p.Count == 0 {
+			continue
+		}
+		errors += p.Errors
+		if p.Errors != 0 {
+			warnings += fmt.Sprintf("\n%s: %d errors after %s UTC uploading to %s:%s",
+				destination, p.Errors, p.FirstErrorAt, p.FirstErrorEndpoint, p.FirstError)
+		}
+		summary += fmt.Sprintf("\n%s: %d uploads, p50 %s, p95 %s, max %.1fs",
+			destination, p.Count, metricsPercentile(dm.pbuckets, 0.50), metricsPercentile(dm.pbuckets, 0.95),
+			float64(p.MaxMs)/1000)
+		dm.period = TransactionMetrics{InProgress: p.InProgress}
+		dm.pbuckets = make([]uint64, len(metricsLatencyBuckets)+1)
+	}
+
+	metricsLock.Unlock()
+
+	if errors != 0 {
+		sendToSafecastOps(fmt.Sprintf("** Warning **  In the last %d mins there were errors uploading:%s%s",
+			PeriodMinutes, warnings, summary), SlackMsgUnsolicitedOps)
+	}
+
+}
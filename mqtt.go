@@ -64,7 +64,7 @@ func MQTTInboundHandler() {
 			AppReq.SvTransport = "ttn-mqtt:" + AppReq.TTNDevID
 			fmt.Printf("\n%s Received %d-byte payload from %s\n", LogTime(), len(AppReq.Payload), AppReq.SvTransport)
 			AppReq.SvUploadedAt = NowInUTC()
-			go AppReqPushPayload(AppReq, AppReq.Payload, "device via ttn")
+			trackedGo(func() { AppReqPushPayload(AppReq, AppReq.Payload, "device via ttn") })
 			stats.Count.MQTTTTN++
 
 		}
@@ -99,7 +99,7 @@ func mqttSubscriptionMonitor() {
 		mqttOpts := MQTT.NewClientOptions()
 		mqttOpts.AddBroker(ttnServer)
 		mqttOpts.SetUsername(ttnAppID)
-		mqttOpts.SetPassword(ServiceConfig.TtnAppAccessKey)
+		mqttOpts.SetPassword(CurrentServiceConfig().TtnAppAccessKey)
 
 		// Do NOT automatically reconnect upon failure
 		mqttOpts.SetAutoReconnect(false)
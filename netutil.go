@@ -25,11 +25,17 @@ func ipv4(Str1 string) string {
 // Utility to extract the true IP address of a request forwarded by intermediate
 // nodes such as the AWS Route 53 load balancer.  This is a vast improvement
 // over just calling ipv4(req.RemoteAddr), which returns the internal LB address.
+// The forwarding headers are only believed when they were added by a trusted
+// proxy, because anyone else may put whatever they like in them.
 // Thanks to https://husobee.github.io/golang/ip-address/2015/12/17/remote-ip-go.html
 func getRequestorIPv4(r *http.Request) (IPstr string, isReal bool, isAbusive bool) {
 	if false {
 		fmt.Printf("GetRequestorIPv4: \n%v\n", r.Header)
 	}
+	remote := ipv4(r.RemoteAddr)
+	if !abuseTrustedProxy(net.ParseIP(remote)) {
+		return remote, !isPrivateSubnet(net.ParseIP(remote)), isAbusiveIP(remote)
+	}
 	for _, h := range []string{"X-Forwarded-For", "X-Real-Ip"} {
 		addresses := strings.Split(r.Header.Get(h), ",")
 		// march from right to left until we get a public address
@@ -38,14 +44,14 @@ func getRequestorIPv4(r *http.Request) (IPstr string, isReal bool, isAbusive boo
 			ip := strings.TrimSpace(addresses[i])
 			// header can contain spaces too, strip those out.
 			realIP := net.ParseIP(ip)
-			if !realIP.IsGlobalUnicast() || isPrivateSubnet(realIP) {
+			if !realIP.IsGlobalUnicast() || isPrivateSubnet(realIP) || abuseTrustedProxy(realIP) {
 				// bad address, go to next
 				continue
 			}
 			return ip, true, isAbusiveIP(ip)
 		}
 	}
-	return ipv4(r.RemoteAddr), !isPrivateSubnet(net.ParseIP(ipv4(r.RemoteAddr))), isAbusiveIP(ipv4(r.RemoteAddr))
+	return remote, !isPrivateSubnet(net.ParseIP(remote)), isAbusiveIP(remote)
 }
 
 // Private IP ranges
@@ -0,0 +1,622 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Registry of the schemas by which the bodies of Notecard events are mapped onto
+// Safecast data.  Each schema names the notefiles to which it applies, and maps
+// fields of the note body onto the (flattened) JSON fields of ttdata.SafecastData,
+// optionally converting units, choosing the tube field by sensor model, or
+// applying only under certain conditions.  The built-in schemas may be overridden
+// or added to, without a redeploy, by a JSON or YAML file in the config folder.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	ttdata "github.com/Safecast/safecast-go"
+	"gopkg.in/yaml.v3"
+)
+
+// NoteSchemaFile is the format of the schema registry file
+type NoteSchemaFile struct {
+	Schemas []NoteSchema `json:"schemas,omitempty"`
+}
+
+// NoteSchema maps the body of the events in a set of notefiles onto Safecast data
+type NoteSchema struct {
+	// Notefile IDs to which this applies, which may be patterns such as "rad?-lnd7318u.qo"
+	Notefiles []string `json:"notefiles,omitempty"`
+	// Whether or not the result is uploaded and logged, which defaults to true
+	Upload *bool `json:"upload,omitempty"`
+	Log    *bool `json:"log,omitempty"`
+	// Copy body fields that are named exactly as Safecast data fields, other than those of the device's
+	// identity and of the service, before applying the mappings
+	Passthrough bool `json:"passthrough,omitempty"`
+	// Mappings, applied in order so that later ones take precedence
+	Fields []NoteSchemaField `json:"fields,omitempty"`
+}
+
+// NoteSchemaField maps a single body field onto a Safecast data field
+type NoteSchemaField struct {
+	// Body field, or "$notefile_model" for the part of the notefile ID between "-" and "."
+	From string `json:"from,omitempty"`
+	// Safecast data field, or a choice of them by sensor model
+	To        string                `json:"to,omitempty"`
+	ToByModel *NoteSchemaModelTubes `json:"to_by_model,omitempty"`
+	// A constant to use instead of the body field's value if it is present, and a value to use if it isn't
+	Value   interface{} `json:"value,omitempty"`
+	Default interface{} `json:"default,omitempty"`
+	// Skip numeric values of zero
+	OmitZero bool `json:"omit_zero,omitempty"`
+	// Safecast data fields to remove when this one is mapped, so that a group of them is replaced as a whole
+	Clear []string `json:"clear,omitempty"`
+	// Unit conversion of numeric values, as value*scale+offset
+	Scale  float64 `json:"scale,omitempty"`
+	Offset float64 `json:"offset,omitempty"`
+	// Only map this field if the condition is met
+	When *NoteSchemaCondition `json:"when,omitempty"`
+}
+
+// NoteSchemaModelTubes chooses the Safecast data field by the value of a model field in the body
+type NoteSchemaModelTubes struct {
+	Field string `json:"field,omitempty"`
+	// By model, with "*" matching any other model including none at all
+	Targets map[string]string `json:"targets,omitempty"`
+}
+
+// NoteSchemaCondition is a test of a body field, where an absent field is treated as ""
+type NoteSchemaCondition struct {
+	Field   string   `json:"field,omitempty"`
+	Present *bool    `json:"present,omitempty"`
+	In      []string `json:"in,omitempty"`
+	NotIn   []string `json:"not_in,omitempty"`
+	Above   *float64 `json:"above,omitempty"`
+}
+
+// Source that refers to the model embedded in the notefile ID
+const noteSchemaNotefileModel = "$notefile_model"
+
+// Fields that passthrough never copies, because they identify the device or describe our own handling
+// of the event, and so must come from the event's envelope rather than from whatever a device put in
+// its body.  This is what keeps a device from posing as another, and what keeps data that we sent to
+// Notehub marked as being from Notehub when it comes back, so that we never send it there again.
+var noteSchemaPassthroughExcluded = map[string]bool{"device_urn": true, "device": true, "device_class": true, "device_sn": true}
+
+// Prefix of the fields that describe our own handling of the event, which passthrough never copies
+const noteSchemaPassthroughExcludedPrefix = "service_"
+
+// TTNoteSchemaPath is where the schema registry may be found, with a .json, .yaml, or .yml extension
+const TTNoteSchemaPath = "/config/note-schemas"
+
+// Statics
+var noteSchemaLock sync.Mutex
+var noteSchemas []NoteSchema
+var noteSchemaFilename string
+var noteSchemaModTime time.Time
+var noteSchemaCheckLock sync.Mutex
+var noteSchemaTargets map[string]reflect.Type
+
+// noteSchemaInit loads the registry, falling back to the built-in schemas if the file is unusable
+func noteSchemaInit() {
+	noteSchemaTargets = noteSchemaFields(reflect.TypeOf(ttdata.SafecastData{}))
+	schemas, err := noteSchemaLoad()
+	if err != nil {
+		fmt.Printf("*** Note schemas: %s; using built-in schemas\n", err)
+		schemas, _ = noteSchemaParse([]byte(noteSchemaDefaults), ".json")
+	}
+	noteSchemaLock.Lock()
+	noteSchemas = schemas
+	noteSchemaLock.Unlock()
+}
+
+// noteSchemaCheck reloads the registry if the file has changed, keeping the current one if it's unusable
+func noteSchemaCheck() {
+
+	// Held so that concurrent checks don't both reload it
+	noteSchemaCheckLock.Lock()
+	defer noteSchemaCheckLock.Unlock()
+
+	filename, modTime := noteSchemaFile()
+	if filename == noteSchemaFilename && modTime.Equal(noteSchemaModTime) {
+		return
+	}
+
+	schemas, err := noteSchemaLoad()
+	if err != nil {
+		ServerLog(fmt.Sprintf("*** NOTE SCHEMAS not reloaded: %s\n", err))
+		return
+	}
+
+	noteSchemaLock.Lock()
+	noteSchemas = schemas
+	noteSchemaLock.Unlock()
+	ServerLog("*** NOTE SCHEMAS reloaded\n")
+
+}
+
+// noteSchemaFile finds the registry file, if any, and its modified time
+func noteSchemaFile() (filename string, modTime time.Time) {
+	for _, ext := range []string{".json", ".yaml", ".yml"} {
+		name := SafecastConfigDirectory() + TTNoteSchemaPath + ext
+		file, err := os.Stat(name)
+		if err == nil {
+			return name, file.ModTime()
+		}
+	}
+	return "", time.Time{}
+}
+
+// noteSchemaLoad builds the registry from the built-in schemas and those in the file
+func noteSchemaLoad() (schemas []NoteSchema, err error) {
+
+	schemas, err = noteSchemaParse([]byte(noteSchemaDefaults), ".json")
+	if err != nil {
+		return nil, fmt.Errorf("built-in: %s", err)
+	}
+
+	filename, modTime := noteSchemaFile()
+	noteSchemaFilename = filename
+	noteSchemaModTime = modTime
+	if filename == "" {
+		return
+	}
+
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%s", ErrorString(err))
+	}
+	configured, err := noteSchemaParse(contents, path.Ext(filename))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path.Base(filename), err)
+	}
+
+	// Those in the file take precedence, because they're searched first
+	return append(configured, schemas...), nil
+
+}
+
+// noteSchemaParse parses and validates schemas in either JSON or YAML
+func noteSchemaParse(contents []byte, ext string) (schemas []NoteSchema, err error) {
+
+	// Convert YAML to JSON, so that there is only one set of field names
+	if ext == ".yaml" || ext == ".yml" {
+		var generic interface{}
+		err = yaml.Unmarshal(contents, &generic)
+		if err != nil {
+			return
+		}
+		contents, err = json.Marshal(generic)
+		if err != nil {
+			return
+		}
+	}
+
+	file := NoteSchemaFile{}
+	err = json.Unmarshal(contents, &file)
+	if err != nil {
+		return
+	}
+
+	for i, schema := range file.Schemas {
+		err = noteSchemaValidate(schema)
+		if err != nil {
+			return nil, fmt.Errorf("schema %d: %s", i+1, err)
+		}
+	}
+
+	return file.Schemas, nil
+
+}
+
+// noteSchemaValidate makes sure that a schema refers only to fields that exist
+func noteSchemaValidate(schema NoteSchema) error {
+
+	if len(schema.Notefiles) == 0 {
+		return fmt.Errorf("no notefiles")
+	}
+	for _, notefile := range schema.Notefiles {
+		_, err := path.Match(notefile, "")
+		if err != nil {
+			return fmt.Errorf("bad notefile pattern '%s'", notefile)
+		}
+	}
+
+	for _, field := range schema.Fields {
+		if field.From == "" && field.Value == nil {
+			return fmt.Errorf("field mapping to '%s' has neither 'from' nor 'value'", field.To)
+		}
+		var targets []string
+		if field.ToByModel != nil {
+			if field.ToByModel.Field == "" || len(field.ToByModel.Targets) == 0 {
+				return fmt.Errorf("field '%s' has an incomplete to_by_model", field.From)
+			}
+			for _, target := range field.ToByModel.Targets {
+				targets = append(targets, target)
+			}
+		} else {
+			targets = append(targets, field.To)
+		}
+		for _, target := range targets {
+			_, known := noteSchemaTargets[target]
+			if !known {
+				return fmt.Errorf("field '%s' maps to unknown safecast field '%s'", field.From, target)
+			}
+		}
+		for _, target := range field.Clear {
+			_, known := noteSchemaTargets[target]
+			if !known {
+				return fmt.Errorf("field '%s' clears unknown safecast field '%s'", field.From, target)
+			}
+		}
+		if field.When != nil && field.When.Field == "" {
+			return fmt.Errorf("field '%s' has a condition without a field", field.From)
+		}
+	}
+
+	return nil
+
+}
+
+// noteSchemaFields gets the types of the flattened JSON fields of a struct
+func noteSchemaFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && ft.Kind() == reflect.Struct {
+			for k, v := range noteSchemaFields(ft) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name != "" && name != "-" {
+			fields[name] = ft
+		}
+	}
+	return fields
+}
+
+// noteSchemaFind gets the schema for a notefile
+func noteSchemaFind(notefileID string) (schema NoteSchema, found bool) {
+	noteSchemaLock.Lock()
+	defer noteSchemaLock.Unlock()
+	for _, s := range noteSchemas {
+		for _, pattern := range s.Notefiles {
+			match, _ := path.Match(pattern, notefileID)
+			if match {
+				return s, true
+			}
+		}
+	}
+	return
+}
+
+// noteSchemaApply maps the body of an event onto Safecast data using a schema
+func noteSchemaApply(schema NoteSchema, notefileID string, body map[string]interface{}, sd *ttdata.SafecastData) (err error) {
+
+	// Work with the flattened form of the data
+	sdJSON, err := json.Marshal(sd)
+	if err != nil {
+		return
+	}
+	fields := map[string]interface{}{}
+	err = json.Unmarshal(sdJSON, &fields)
+	if err != nil {
+		return
+	}
+
+	// Fields that are already in Safecast form
+	if schema.Passthrough {
+		for name, value := range body {
+			t, known := noteSchemaTargets[name]
+			if !known || value == nil || noteSchemaPassthroughExcluded[name] || strings.HasPrefix(name, noteSchemaPassthroughExcludedPrefix) {
+				continue
+			}
+			value, err = noteSchemaConvert(value, t)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			fields[name] = value
+		}
+	}
+
+	for _, field := range schema.Fields {
+
+		if field.When != nil && !noteSchemaConditionMet(*field.When, body) {
+			continue
+		}
+
+		// Get the value
+		var value interface{}
+		present := false
+		if field.From == noteSchemaNotefileModel {
+			value, present = noteSchemaModel(notefileID)
+		} else if field.From != "" {
+			value, present = body[field.From]
+			if present && value == nil {
+				present = false
+			}
+		}
+		if present && field.Value != nil {
+			value = field.Value
+		}
+		if field.From == "" {
+			value, present = field.Value, true
+		}
+		if !present {
+			if field.Default == nil {
+				continue
+			}
+			value = field.Default
+		}
+
+		// Convert units
+		number, isNumber := value.(float64)
+		if isNumber {
+			if field.Scale != 0 {
+				number *= field.Scale
+			}
+			number += field.Offset
+			if number == 0 && field.OmitZero {
+				continue
+			}
+			value = number
+		}
+
+		// Choose where it goes
+		target := field.To
+		if field.ToByModel != nil {
+			model, _ := body[field.ToByModel.Field].(string)
+			t, found := field.ToByModel.Targets[model]
+			if !found {
+				t, found = field.ToByModel.Targets["*"]
+			}
+			if !found {
+				continue
+			}
+			target = t
+		}
+
+		value, err = noteSchemaConvert(value, noteSchemaTargets[target])
+		if err != nil {
+			return fmt.Errorf("%s: %s", target, err)
+		}
+		for _, name := range field.Clear {
+			delete(fields, name)
+		}
+		fields[target] = value
+
+	}
+
+	// Convert back
+	sdJSON, err = json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	result := ttdata.SafecastData{}
+	err = json.Unmarshal(sdJSON, &result)
+	if err != nil {
+		return
+	}
+	*sd = result
+
+	return
+
+}
+
+// noteSchemaConditionMet tests a condition against the body
+func noteSchemaConditionMet(when NoteSchemaCondition, body map[string]interface{}) bool {
+
+	value, present := body[when.Field]
+	if present && value == nil {
+		present = false
+	}
+
+	if when.Present != nil && *when.Present != present {
+		return false
+	}
+
+	str := ""
+	if present {
+		str = fmt.Sprintf("%v", value)
+	}
+	if len(when.In) != 0 {
+		found := false
+		for _, s := range when.In {
+			if s == str {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, s := range when.NotIn {
+		if s == str {
+			return false
+		}
+	}
+
+	if when.Above != nil {
+		number, isNumber := value.(float64)
+		if !isNumber || number <= *when.Above {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// noteSchemaModel gets the model embedded in a notefile ID such as "aq0-pms5003.qo"
+func noteSchemaModel(notefileID string) (model string, present bool) {
+	parts := strings.SplitN(notefileID, "-", 2)
+	if len(parts) < 2 {
+		return "", false
+	}
+	return strings.Split(parts[1], ".")[0], true
+}
+
+// noteSchemaConvert converts a value to the type of the Safecast data field to which it is mapped
+func noteSchemaConvert(value interface{}, t reflect.Type) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		number, isNumber := value.(float64)
+		if !isNumber {
+			return nil, fmt.Errorf("'%v' is not a number", value)
+		}
+		return number, nil
+	case reflect.Uint32, reflect.Uint64, reflect.Int, reflect.Int32, reflect.Int64:
+		number, isNumber := value.(float64)
+		if !isNumber {
+			return nil, fmt.Errorf("'%v' is not a number", value)
+		}
+		if t.Kind() != reflect.Int && t.Kind() != reflect.Int32 && t.Kind() != reflect.Int64 && number < 0 {
+			return nil, fmt.Errorf("'%v' is negative", value)
+		}
+		return int64(number), nil
+	case reflect.Bool:
+		b, isBool := value.(bool)
+		if !isBool {
+			return nil, fmt.Errorf("'%v' is not true or false", value)
+		}
+		return b, nil
+	case reflect.String:
+		s, isString := value.(string)
+		if !isString {
+			return fmt.Sprintf("%v", value), nil
+		}
+		return s, nil
+	}
+	return value, nil
+}
+
+// Built-in schemas, equivalent to what was once hard-coded for each notefile
+const noteSchemaDefaults = `{"schemas":[
+
+{"notefiles":["_session.qo"], "upload":false},
+
+{"notefiles":["safecast-*.qo"], "passthrough":true},
+
+{"notefiles":["_air.qo"], "fields":[
+	{"from":"cpm", "to":"lnd_712u", "default":0, "when":{"field":"sensor", "in":["lnd712"]}},
+	{"from":"cpm", "to":"lnd_7318c", "default":0, "when":{"field":"sensor", "in":["lnd7317"]}},
+	{"from":"usv", "to":"lnd_usv", "default":0, "when":{"field":"sensor", "in":["lnd712","lnd7317"]}},
+	{"from":"pm01_0", "to":"pms_pm01_0", "default":0, "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"pm02_5", "to":"pms_pm02_5", "default":0, "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"pm10_0", "to":"pms_pm10_0", "default":0, "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"c00_30", "to":"pms_c00_30", "default":0, "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"c00_50", "to":"pms_c00_50", "default":0, "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"c01_00", "to":"pms_c01_00", "default":0, "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"c02_50", "to":"pms_c02_50", "default":0, "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"c05_00", "to":"pms_c05_00", "default":0, "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"c10_00", "to":"pms_c10_00", "default":0, "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"csecs", "to":"pms_csecs", "default":0, "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"csamples", "to":"pms_csamples", "default":0, "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"pm01_0cf1", "to":"pms_pm01_0_cf1", "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"pm02_5cf1", "to":"pms_pm02_5_cf1", "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"pm10_0cf1", "to":"pms_pm10_0_cf1", "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"sensor", "to":"pms_model", "default":"", "when":{"field":"sensor", "not_in":["lnd712","lnd7317"]}},
+	{"from":"indoors", "to":"dev_indoors", "value":true},
+	{"from":"voltage", "to":"bat_voltage"},
+	{"from":"charging", "to":"bat_charging", "when":{"field":"voltage", "present":true}},
+	{"from":"usb", "to":"bat_line", "when":{"field":"voltage", "present":true}},
+	{"from":"temp", "to":"env_temp"},
+	{"from":"humid", "to":"env_humid", "when":{"field":"temp", "present":true}},
+	{"from":"press", "to":"env_press", "when":{"field":"temp", "present":true}},
+	{"from":"temperature", "to":"env_temp", "clear":["env_humid","env_press"]},
+	{"from":"humidity", "to":"env_humid", "when":{"field":"temperature", "present":true}},
+	{"from":"pressure", "to":"env_press", "when":{"field":"temperature", "present":true}}
+]},
+
+{"notefiles":["_track.qo"], "fields":[
+	{"from":"voltage", "to":"bat_voltage", "default":0},
+	{"from":"temperature", "to":"env_temp", "default":0},
+	{"from":"humidity", "to":"env_humid", "omit_zero":true},
+	{"from":"pressure", "to":"env_press", "omit_zero":true},
+	{"from":"cpm", "to_by_model":{"field":"sensor", "targets":{"lnd7317":"lnd_7318c", "*":"lnd_712u"}}, "when":{"field":"cpm", "above":0}},
+	{"from":"usv", "to":"lnd_usv", "default":0, "when":{"field":"cpm", "above":0}},
+	{"from":"distance", "to":"track_distance", "default":0},
+	{"from":"seconds", "to":"track_seconds", "default":0},
+	{"from":"velocity", "to":"track_velocity", "default":0},
+	{"from":"bearing", "to":"track_bearing", "default":0}
+]},
+
+{"notefiles":["bat.qo"], "fields":[
+	{"from":"voltage", "to":"bat_voltage", "default":0}
+]},
+
+{"notefiles":["bat-ina219.qo"], "fields":[
+	{"from":"voltage", "to":"bat_voltage", "default":0},
+	{"from":"current", "to":"bat_current", "default":0}
+]},
+
+{"notefiles":["air-bme280.qo"], "fields":[
+	{"from":"temp", "to":"env_temp", "default":0},
+	{"from":"humid", "to":"env_humid", "default":0},
+	{"from":"press", "to":"env_press", "default":0}
+]},
+
+{"notefiles":["rad[01]-lnd7318u.qo"], "fields":[
+	{"from":"cpm", "to":"lnd_7318u", "default":0}
+]},
+
+{"notefiles":["rad[01]-lnd7318c.qo"], "fields":[
+	{"from":"cpm", "to":"lnd_7318c", "default":0}
+]},
+
+{"notefiles":["rad[01]-lnd7128ec.qo"], "fields":[
+	{"from":"cpm", "to":"lnd_7128ec", "default":0}
+]},
+
+{"notefiles":["aq0-pms5003.qo","aq0-pms7003.qo"], "fields":[
+	{"from":"pm01_0", "to":"pms_pm01_0", "default":0},
+	{"from":"pm02_5", "to":"pms_pm02_5", "default":0},
+	{"from":"pm10_0", "to":"pms_pm10_0", "default":0},
+	{"from":"c00_30", "to":"pms_c00_30", "default":0},
+	{"from":"c00_50", "to":"pms_c00_50", "default":0},
+	{"from":"c01_00", "to":"pms_c01_00", "default":0},
+	{"from":"c02_50", "to":"pms_c02_50", "default":0},
+	{"from":"c05_00", "to":"pms_c05_00", "default":0},
+	{"from":"c10_00", "to":"pms_c10_00", "default":0},
+	{"from":"csecs", "to":"pms_csecs", "default":0},
+	{"from":"csamples", "to":"pms_csamples", "default":0},
+	{"from":"$notefile_model", "to":"pms_model"}
+]},
+
+{"notefiles":["aq1-pms5003.qo","aq1-pms7003.qo"], "fields":[
+	{"from":"pm01_0", "to":"pms2_pm01_0", "default":0},
+	{"from":"pm02_5", "to":"pms2_pm02_5", "default":0},
+	{"from":"pm10_0", "to":"pms2_pm10_0", "default":0},
+	{"from":"c00_30", "to":"pms2_c00_30", "default":0},
+	{"from":"c00_50", "to":"pms2_c00_50", "default":0},
+	{"from":"c01_00", "to":"pms2_c01_00", "default":0},
+	{"from":"c02_50", "to":"pms2_c02_50", "default":0},
+	{"from":"c05_00", "to":"pms2_c05_00", "default":0},
+	{"from":"c10_00", "to":"pms2_c10_00", "default":0},
+	{"from":"csecs", "to":"pms2_csecs", "default":0},
+	{"from":"csamples", "to":"pms2_csamples", "default":0},
+	{"from":"$notefile_model", "to":"pms2_model"}
+]},
+
+{"notefiles":["track.qo"], "fields":[
+	{"from":"lat", "to":"track_lat", "default":0},
+	{"from":"lon", "to":"track_lon", "default":0},
+	{"from":"distance", "to":"track_distance", "default":0},
+	{"from":"seconds", "to":"track_seconds", "default":0},
+	{"from":"velocity", "to":"track_velocity", "default":0},
+	{"from":"bearing", "to":"track_bearing", "default":0}
+]}
+
+]}`
@@ -0,0 +1,161 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	ttdata "github.com/Safecast/safecast-go"
+	"github.com/blues/note-go/note"
+)
+
+// The fields that noteToSD takes from the envelope of noteTestEvent, whatever the notefile
+const noteTestEnvelope = `{"device_urn":"note:dev:864475044204278","device_class":"product:org.safecast.test",
+	"device_sn":"sn-1","device":2944184646,"when_captured":"2023-11-14T22:13:20Z",
+	"loc_lat":35.6,"loc_lon":139.7,"loc_olc":"8Q7XJQ00+","loc_name":"Tokyo","loc_country":"JP","loc_zone":"Asia/Tokyo",
+	"dev_temp":22,"dev_rat":"lte","dev_bars":3,"dev_moved":"2023-11-14T19:26:40Z","dev_orientation":"face-up",
+	"service_transport":"test"}`
+
+// noteTestSchemas loads the built-in schemas
+func noteTestSchemas(t *testing.T) {
+	t.Helper()
+	noteSchemaTargets = noteSchemaFields(reflect.TypeOf(ttdata.SafecastData{}))
+	schemas, err := noteSchemaParse([]byte(noteSchemaDefaults), ".json")
+	if err != nil {
+		t.Fatalf("built-in schemas: %s", err)
+	}
+	noteSchemaLock.Lock()
+	noteSchemas = schemas
+	noteSchemaLock.Unlock()
+}
+
+// noteTestEvent makes an event from a Notecard with the given body
+func noteTestEvent(t *testing.T, notefileID string, body string) note.Event {
+	t.Helper()
+	e := note.Event{DeviceUID: "dev:864475044204278", DeviceSN: "sn-1", ProductUID: "product:org.safecast.test",
+		NotefileID: notefileID, When: 1700000000, Where: "8Q7XJQ00+", WhereLat: 35.6, WhereLon: 139.7,
+		WhereLocation: "Tokyo", WhereCountry: "JP", WhereTimeZone: "Asia/Tokyo",
+		Voltage: 3.9, Temp: 22, Rat: "lte", Bars: 3, Orientation: "face-up", Moved: 1699990000}
+	b := map[string]interface{}{}
+	err := json.Unmarshal([]byte(body), &b)
+	if err != nil {
+		t.Fatalf("%s: %s", body, err)
+	}
+	e.Body = &b
+	return e
+}
+
+// noteTestFields flattens Safecast data, leaving out when it was uploaded, which is always now
+func noteTestFields(t *testing.T, sd ttdata.SafecastData) map[string]interface{} {
+	t.Helper()
+	sdJSON, err := json.Marshal(sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]interface{}{}
+	json.Unmarshal(sdJSON, &fields)
+	delete(fields, "service_uploaded")
+	return fields
+}
+
+// The built-in schemas must decode each notefile exactly as the switch that they replaced
+// did, whose output is recorded here as the fields beyond those of the envelope
+func TestNoteSchemaDefaults(t *testing.T) {
+	noteTestSchemas(t)
+
+	tests := []struct {
+		notefile string
+		body     string
+		upload   bool
+		expected string
+	}{
+		{"_session.qo", `{}`, false, `{"bat_voltage":3.9}`},
+		{"_air.qo", `{"sensor":"lnd712","cpm":30,"usv":0.2,"voltage":4.1,"charging":true,"usb":true,"indoors":false,"temp":20,"humid":50,"press":1000}`, true, `{"env_temp":20,"env_humid":50,"env_press":1000,"bat_voltage":4.1,"bat_charging":true,"bat_line":true,"lnd_712u":30,"lnd_usv":0.2,"dev_indoors":true}`},
+		{"_air.qo", `{"sensor":"lnd7317","cpm":12,"usv":0.1}`, true, `{"bat_voltage":3.9,"lnd_7318c":12,"lnd_usv":0.1}`},
+		{"_air.qo", `{"sensor":"pms5003","pm01_0":1,"pm02_5":2.5,"pm10_0":10,"c00_30":300,"c00_50":50,"c01_00":10,"c02_50":25,"c05_00":5,"c10_00":1,"csecs":60,"csamples":12,"pm01_0cf1":1.1,"pm02_5cf1":2.6,"pm10_0cf1":10.1,"temperature":21,"humidity":40,"pressure":990}`, true, `{"env_temp":21,"env_humid":40,"env_press":990,"bat_voltage":3.9,"pms_pm01_0":1,"pms_pm02_5":2.5,"pms_pm10_0":10,"pms_c00_30":300,"pms_c00_50":50,"pms_c01_00":10,"pms_c02_50":25,"pms_c05_00":5,"pms_c10_00":1,"pms_csecs":60,"pms_csamples":12,"pms_pm01_0_cf1":1.1,"pms_pm02_5_cf1":2.6,"pms_pm10_0_cf1":10.1,"pms_model":"pms5003"}`},
+		{"_air.qo", `{"pm02_5":3,"temp":20,"humid":50,"press":1000,"temperature":21}`, true, `{"env_temp":21,"bat_voltage":3.9,"pms_pm01_0":0,"pms_pm02_5":3,"pms_pm10_0":0,"pms_c00_30":0,"pms_c00_50":0,"pms_c01_00":0,"pms_c02_50":0,"pms_c05_00":0,"pms_c10_00":0,"pms_csecs":0,"pms_csamples":0,"pms_model":""}`},
+		{"_air.qo", `{"pm02_5":3,"humidity":40}`, true, `{"bat_voltage":3.9,"pms_pm01_0":0,"pms_pm02_5":3,"pms_pm10_0":0,"pms_c00_30":0,"pms_c00_50":0,"pms_c01_00":0,"pms_c02_50":0,"pms_c05_00":0,"pms_c10_00":0,"pms_csecs":0,"pms_csamples":0,"pms_model":""}`},
+		{"_track.qo", `{"cpm":40,"usv":0.3,"voltage":3.7,"temperature":18,"humidity":0,"pressure":1000,"distance":12,"seconds":60,"velocity":0.2,"bearing":90}`, true, `{"env_temp":18,"env_press":1000,"bat_voltage":3.7,"lnd_712u":40,"lnd_usv":0.3,"track_distance":12,"track_seconds":60,"track_velocity":0.2,"track_bearing":90}`},
+		{"_track.qo", `{"sensor":"lnd7317","cpm":5,"usv":0.05,"temperature":18,"humidity":33}`, true, `{"env_temp":18,"env_humid":33,"bat_voltage":0,"lnd_7318c":5,"lnd_usv":0.05,"track_distance":0,"track_seconds":0,"track_velocity":0,"track_bearing":0}`},
+		{"_track.qo", `{"cpm":0,"temperature":18}`, true, `{"env_temp":18,"bat_voltage":0,"track_distance":0,"track_seconds":0,"track_velocity":0,"track_bearing":0}`},
+		{"bat.qo", `{"voltage":3.8}`, true, `{"bat_voltage":3.8}`},
+		{"bat.qo", `{}`, true, `{"bat_voltage":0}`},
+		{"bat-ina219.qo", `{"voltage":3.8,"current":120}`, true, `{"bat_voltage":3.8,"bat_current":120}`},
+		{"air-bme280.qo", `{"temp":21,"humid":45,"press":1001}`, true, `{"env_temp":21,"env_humid":45,"env_press":1001,"bat_voltage":3.9}`},
+		{"rad0-lnd7318u.qo", `{"cpm":33,"secs":60}`, true, `{"bat_voltage":3.9,"lnd_7318u":33}`},
+		{"rad1-lnd7318u.qo", `{"cpm":34}`, true, `{"bat_voltage":3.9,"lnd_7318u":34}`},
+		{"rad0-lnd7318c.qo", `{"cpm":11}`, true, `{"bat_voltage":3.9,"lnd_7318c":11}`},
+		{"rad1-lnd7318c.qo", `{}`, true, `{"bat_voltage":3.9,"lnd_7318c":0}`},
+		{"rad0-lnd7128ec.qo", `{"cpm":21}`, true, `{"bat_voltage":3.9,"lnd_7128ec":21}`},
+		{"rad1-lnd7128ec.qo", `{"cpm":22}`, true, `{"bat_voltage":3.9,"lnd_7128ec":22}`},
+		{"aq0-pms5003.qo", `{"pm01_0":1,"pm02_5":2,"pm10_0":3,"c00_30":4,"c00_50":5,"c01_00":6,"c02_50":7,"c05_00":8,"c10_00":9,"csecs":10,"csamples":11}`, true, `{"bat_voltage":3.9,"pms_pm01_0":1,"pms_pm02_5":2,"pms_pm10_0":3,"pms_c00_30":4,"pms_c00_50":5,"pms_c01_00":6,"pms_c02_50":7,"pms_c05_00":8,"pms_c10_00":9,"pms_csecs":10,"pms_csamples":11,"pms_model":"pms5003"}`},
+		{"aq0-pms7003.qo", `{"pm02_5":2}`, true, `{"bat_voltage":3.9,"pms_pm01_0":0,"pms_pm02_5":2,"pms_pm10_0":0,"pms_c00_30":0,"pms_c00_50":0,"pms_c01_00":0,"pms_c02_50":0,"pms_c05_00":0,"pms_c10_00":0,"pms_csecs":0,"pms_csamples":0,"pms_model":"pms7003"}`},
+		{"aq1-pms5003.qo", `{"pm01_0":1,"pm02_5":2,"pm10_0":3,"c00_30":4,"csecs":10,"csamples":11}`, true, `{"bat_voltage":3.9,"pms2_pm01_0":1,"pms2_pm02_5":2,"pms2_pm10_0":3,"pms2_c00_30":4,"pms2_c00_50":0,"pms2_c01_00":0,"pms2_c02_50":0,"pms2_c05_00":0,"pms2_c10_00":0,"pms2_csecs":10,"pms2_csamples":11,"pms2_model":"pms5003"}`},
+		{"aq1-pms7003.qo", `{}`, true, `{"bat_voltage":3.9,"pms2_pm01_0":0,"pms2_pm02_5":0,"pms2_pm10_0":0,"pms2_c00_30":0,"pms2_c00_50":0,"pms2_c01_00":0,"pms2_c02_50":0,"pms2_c05_00":0,"pms2_c10_00":0,"pms2_csecs":0,"pms2_csamples":0,"pms2_model":"pms7003"}`},
+		{"track.qo", `{"lat":35.1,"lon":139.2,"distance":5,"seconds":30,"velocity":0.1,"bearing":45}`, true, `{"bat_voltage":3.9,"track_lat":35.1,"track_lon":139.2,"track_distance":5,"track_seconds":30,"track_velocity":0.1,"track_bearing":45}`},
+	}
+
+	for _, test := range tests {
+		sd, upload, log, err := noteToSD(noteTestEvent(t, test.notefile, test.body), "test", false)
+		if err != nil {
+			t.Errorf("%s %s: %s", test.notefile, test.body, err)
+			continue
+		}
+		if upload != test.upload || !log {
+			t.Errorf("%s %s: upload %t log %t", test.notefile, test.body, upload, log)
+		}
+		expected := map[string]interface{}{}
+		json.Unmarshal([]byte(noteTestEnvelope), &expected)
+		json.Unmarshal([]byte(test.expected), &expected)
+		actual := noteTestFields(t, sd)
+		if !reflect.DeepEqual(actual, expected) {
+			actualJSON, _ := json.Marshal(actual)
+			expectedJSON, _ := json.Marshal(expected)
+			t.Errorf("%s %s:\n got %s\nwant %s", test.notefile, test.body, actualJSON, expectedJSON)
+		}
+	}
+
+}
+
+// A mapping that clears fields replaces them as a group rather than merging with them
+func TestNoteSchemaClear(t *testing.T) {
+	noteTestSchemas(t)
+
+	schema := NoteSchema{Notefiles: []string{"x.qo"}, Fields: []NoteSchemaField{
+		{From: "temp", To: "env_temp"},
+		{From: "humid", To: "env_humid"},
+		{From: "temperature", To: "env_temp", Clear: []string{"env_humid", "env_press"}},
+	}}
+	err := noteSchemaValidate(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sd := ttdata.SafecastData{}
+	err = noteSchemaApply(schema, "x.qo", map[string]interface{}{"temp": 20.0, "humid": 50.0}, &sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.Env == nil || sd.Env.Humid == nil || *sd.Env.Humid != 50 {
+		t.Errorf("humid was cleared without temperature: %+v", sd.Env)
+	}
+
+	sd = ttdata.SafecastData{}
+	err = noteSchemaApply(schema, "x.qo", map[string]interface{}{"temp": 20.0, "humid": 50.0, "temperature": 21.0}, &sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.Env == nil || sd.Env.Temp == nil || *sd.Env.Temp != 21 || sd.Env.Humid != nil {
+		t.Errorf("humid wasn't cleared by temperature: %+v", sd.Env)
+	}
+
+	schema.Fields[2].Clear = []string{"env_nonsense"}
+	if noteSchemaValidate(schema) == nil {
+		t.Errorf("clearing an unknown field was accepted")
+	}
+
+}
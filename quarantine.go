@@ -0,0 +1,425 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Quarantine of Notehub events from notefiles for which we have no schema.  New
+// firmware regularly ships notefiles that we don't yet know about, and so rather
+// than dropping those events we hold onto them, in a directory per product, so
+// that they may be replayed once a schema has been added.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+// QuarantineSummary describes the events held for a single notefile of a product
+type QuarantineSummary struct {
+	ProductUID    string `json:"product,omitempty"`
+	NotefileID    string `json:"notefile,omitempty"`
+	Count         int    `json:"count,omitempty"`
+	FirstSeen     string `json:"first_seen,omitempty"`
+	LastSeen      string `json:"last_seen,omitempty"`
+	LastDeviceUID string `json:"last_device,omitempty"`
+	Replayed      int    `json:"replayed,omitempty"`
+	Discarded     int    `json:"discarded,omitempty"`
+}
+
+// QuarantineEvent is a single held event, along with what we need to process it as if it just arrived
+type QuarantineEvent struct {
+	Received  string          `json:"received,omitempty"`
+	Transport string          `json:"transport,omitempty"`
+	Test      bool            `json:"test,omitempty"`
+	Event     json.RawMessage `json:"event,omitempty"`
+}
+
+// Suffixes of the files kept for each notefile
+const quarantineSummarySuffix = ".json"
+const quarantineEventsSuffix = ".events"
+
+// Suffix of the events of a notefile that have been set aside to be replayed
+const quarantineReplayingSuffix = ".replaying"
+
+// Events set aside are touched every so often while being replayed, and if they haven't been
+// for this long then whoever was replaying them died, and so we put them back
+const quarantineReplayExpiration = 15 * time.Minute
+const quarantineReplayTouchEvents = 100
+
+// Quarantine files are only ever modified while holding this, along with the file lock of the
+// notefile's events that keeps other instances from modifying them at the same time
+var quarantineLock sync.Mutex
+
+// quarantineName makes a product or notefile ID safe for use as a file name
+func quarantineName(id string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, id)
+	if name == "" || strings.HasPrefix(name, ".") {
+		name = "_" + name
+	}
+	return name
+}
+
+// quarantineDirectory is where the files for a product are kept
+func quarantineDirectory(productUID string) string {
+	return SafecastDirectory() + TTQuarantinePath + "/" + quarantineName(productUID)
+}
+
+// quarantineFilename is the base name, without suffix, of the files for a notefile
+func quarantineFilename(productUID string, notefileID string) string {
+	return quarantineDirectory(productUID) + "/" + quarantineName(notefileID)
+}
+
+// quarantineAdd holds onto an event that we couldn't convert, and counts it
+func quarantineAdd(e note.Event, body []byte, transport string, testMode bool) {
+
+	// Keep the event on a single line
+	compact := bytes.Buffer{}
+	err := json.Compact(&compact, body)
+	if err != nil {
+		fmt.Printf("*** Quarantine: %s\n", err)
+		return
+	}
+	qe := QuarantineEvent{}
+	qe.Received = NowInUTC()
+	qe.Transport = transport
+	qe.Test = testMode
+	qe.Event = compact.Bytes()
+	line, err := json.Marshal(qe)
+	if err != nil {
+		fmt.Printf("*** Quarantine: %s\n", err)
+		return
+	}
+
+	err = os.MkdirAll(quarantineDirectory(e.ProductUID), 0777)
+	if err != nil {
+		fmt.Printf("*** Quarantine: %s\n", err)
+		return
+	}
+
+	filename := quarantineFilename(e.ProductUID, e.NotefileID)
+	summary := QuarantineSummary{}
+	err = quarantineLocked(filename, func() error {
+
+		fd, err := os.OpenFile(filename+quarantineEventsSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		_, err = fd.Write(append(line, '\n'))
+		err2 := fd.Close()
+		if err == nil {
+			err = err2
+		}
+		if err != nil {
+			return err
+		}
+
+		// Update the summary
+		summary, err = quarantineReadSummary(filename)
+		if err != nil {
+			summary = QuarantineSummary{}
+		}
+		summary.ProductUID = e.ProductUID
+		summary.NotefileID = e.NotefileID
+		summary.Count++
+		if summary.FirstSeen == "" {
+			summary.FirstSeen = qe.Received
+		}
+		summary.LastSeen = qe.Received
+		summary.LastDeviceUID = e.DeviceUID
+		return quarantineWriteSummary(filename, summary)
+
+	})
+	if err != nil {
+		fmt.Printf("*** Quarantine: %s\n", err)
+		return
+	}
+
+	// Let ops know the first time that we see something new
+	if summary.Count == 1 {
+		sendToSafecastOps(fmt.Sprintf("Quarantining events in unrecognized notefile %s from %s", e.NotefileID, e.ProductUID), SlackMsgUnsolicitedOps)
+	}
+
+}
+
+// quarantineLocked does something to the files of a notefile while holding the locks that
+// keep this and other instances from modifying them at the same time
+func quarantineLocked(filename string, do func() error) error {
+	quarantineLock.Lock()
+	defer quarantineLock.Unlock()
+	lock, err := fileLock(filename + quarantineEventsSuffix)
+	if err != nil {
+		return err
+	}
+	defer fileUnlock(lock)
+	return do()
+}
+
+// quarantineReadSummary reads the summary for a notefile
+func quarantineReadSummary(filename string) (summary QuarantineSummary, err error) {
+	contents, err := os.ReadFile(filename + quarantineSummarySuffix)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(contents, &summary)
+	return
+}
+
+// quarantineWriteSummary writes the summary for a notefile
+func quarantineWriteSummary(filename string, summary QuarantineSummary) error {
+	contents, err := json.MarshalIndent(summary, "", "    ")
+	if err != nil {
+		return err
+	}
+	return fileWriteAtomic(filename+quarantineSummarySuffix, contents)
+}
+
+// quarantineProducts lists the directories of the products for which events are held
+func quarantineProducts() (directories []string, err error) {
+	files, err := os.ReadDir(SafecastDirectory() + TTQuarantinePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			directories = append(directories, file.Name())
+		}
+	}
+	return
+}
+
+// quarantineSummaries gets the summaries for all notefiles held for a product, or for all products if none specified
+func quarantineSummaries(productUID string) (summaries []QuarantineSummary, err error) {
+
+	directories := []string{quarantineName(productUID)}
+	if productUID == "" {
+		directories, err = quarantineProducts()
+		if err != nil {
+			return
+		}
+	}
+
+	summaries = []QuarantineSummary{}
+	for _, directory := range directories {
+		var files []string
+		files, err = filepath.Glob(SafecastDirectory() + TTQuarantinePath + "/" + directory + "/*" + quarantineSummarySuffix)
+		if err != nil {
+			return
+		}
+		for _, file := range files {
+			summary, err2 := quarantineReadSummary(strings.TrimSuffix(file, quarantineSummarySuffix))
+			if err2 == nil {
+				summaries = append(summaries, summary)
+			}
+		}
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].ProductUID != summaries[j].ProductUID {
+			return summaries[i].ProductUID < summaries[j].ProductUID
+		}
+		return summaries[i].NotefileID < summaries[j].NotefileID
+	})
+
+	return
+
+}
+
+// quarantineEvents gets the most recent events held for a notefile
+func quarantineEvents(productUID string, notefileID string, limit int) (events []QuarantineEvent, err error) {
+	events, err = quarantineReadEvents(quarantineFilename(productUID, notefileID))
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return
+}
+
+// quarantineReadEvents reads all the events held for a notefile
+func quarantineReadEvents(filename string) (events []QuarantineEvent, err error) {
+	return quarantineReadEventsFile(filename + quarantineEventsSuffix)
+}
+
+// quarantineReadEventsFile reads all the events in a file of them
+func quarantineReadEventsFile(eventsFilename string) (events []QuarantineEvent, err error) {
+	events = []QuarantineEvent{}
+	fd, err := os.Open(eventsFilename)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		qe := QuarantineEvent{}
+		if json.Unmarshal(scanner.Bytes(), &qe) == nil {
+			events = append(events, qe)
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// quarantineReplay runs the events held for a notefile through the conversion again, processing those
+// that can now be converted and holding onto only those that still can't.  The events are set aside
+// while they're replayed, so that those that arrive in the meantime are kept, and so that no other
+// replay of the notefile, by this or any other instance, processes them too.
+func quarantineReplay(productUID string, notefileID string) (summary QuarantineSummary, err error) {
+
+	filename := quarantineFilename(productUID, notefileID)
+	replayingFilename := filename + quarantineEventsSuffix + quarantineReplayingSuffix
+	_, err = quarantineReadSummary(filename)
+	if err != nil {
+		return
+	}
+
+	// Set aside the events, first putting back any left behind by a replay that never finished,
+	// some of which may thus be sent again
+	held := false
+	err = quarantineLocked(filename, func() error {
+		file, err := os.Stat(replayingFilename)
+		if err == nil {
+			if time.Since(file.ModTime()) < quarantineReplayExpiration {
+				return fmt.Errorf("%s %s is already being replayed", productUID, notefileID)
+			}
+			contents, err := os.ReadFile(replayingFilename)
+			if err != nil {
+				return err
+			}
+			err = quarantineRestore(filename, replayingFilename, contents)
+			if err != nil {
+				return err
+			}
+			ServerLog(fmt.Sprintf("QUARANTINE put back %s %s, left behind by a replay that never finished\n", productUID, notefileID))
+		}
+		err = os.Rename(filename+quarantineEventsSuffix, replayingFilename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		held = err == nil
+		return err
+	})
+	if err != nil {
+		return
+	}
+	events := []QuarantineEvent{}
+	if held {
+		events, err = quarantineReadEventsFile(replayingFilename)
+		if err != nil {
+			quarantineLocked(filename, func() error {
+				contents, err := os.ReadFile(replayingFilename)
+				if err != nil {
+					return err
+				}
+				return quarantineRestore(filename, replayingFilename, contents)
+			})
+			return
+		}
+	}
+
+	var remaining []QuarantineEvent
+	replayed := 0
+	discarded := 0
+	for i, qe := range events {
+		if i%quarantineReplayTouchEvents == quarantineReplayTouchEvents-1 {
+			now := time.Now()
+			os.Chtimes(replayingFilename, now, now)
+		}
+		e := note.Event{}
+		err = json.Unmarshal(qe.Event, &e)
+		if err != nil {
+			discarded++
+			continue
+		}
+		sd, upload, log, err := noteToSD(e, qe.Transport, qe.Test)
+		if err == errNoteUnknownNotefile {
+			remaining = append(remaining, qe)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("NOTE ignored on replay: %s\n%s\n", err, qe.Event)
+			discarded++
+			continue
+		}
+		noteProcess(e, qe.Event, sd, upload, log, qe.Transport)
+		replayed++
+	}
+
+	// Put back the events that we're still holding onto, ahead of those that arrived while replaying,
+	// and keep the summary even when empty, as a record of what was replayed
+	err = quarantineLocked(filename, func() error {
+		if held {
+			var contents []byte
+			for _, qe := range remaining {
+				line, _ := json.Marshal(qe)
+				contents = append(contents, line...)
+				contents = append(contents, '\n')
+			}
+			err := quarantineRestore(filename, replayingFilename, contents)
+			if err != nil {
+				return err
+			}
+		}
+		events, err := quarantineReadEvents(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		summary, err = quarantineReadSummary(filename)
+		if err != nil {
+			return err
+		}
+		summary.Count = len(events)
+		summary.Replayed += replayed
+		summary.Discarded += discarded
+		return quarantineWriteSummary(filename, summary)
+	})
+	if err != nil {
+		return
+	}
+
+	ServerLog(fmt.Sprintf("QUARANTINE replayed %s %s: %d processed, %d discarded, %d held\n",
+		summary.ProductUID, summary.NotefileID, replayed, discarded, summary.Count))
+
+	return
+
+}
+
+// quarantineRestore puts events that were set aside back ahead of those that have since arrived, and
+// removes what was set aside, which must be called while holding the notefile's locks
+func quarantineRestore(filename string, replayingFilename string, contents []byte) error {
+
+	arrived, err := os.ReadFile(filename + quarantineEventsSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	contents = append(contents, arrived...)
+
+	if len(contents) == 0 {
+		err = os.Remove(filename + quarantineEventsSuffix)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		err = fileWriteAtomic(filename+quarantineEventsSuffix, contents)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(replayingFilename)
+
+}
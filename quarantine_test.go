@@ -0,0 +1,79 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// quarantineTestAdd quarantines events from a notefile for which there is no schema
+func quarantineTestAdd(t *testing.T, count int) (filename string) {
+	t.Helper()
+	testServiceConfig(t, TTServeConfig{})
+	testDataDirectory(t)
+	os.MkdirAll(SafecastDirectory()+TTServerLogPath, 0777)
+	noteTestSchemas(t)
+	e := noteTestEvent(t, "unknown.qo", `{"counts":1}`)
+	body, _ := json.Marshal(e)
+	for i := 0; i < count; i++ {
+		quarantineAdd(e, body, "notehub:test", false)
+	}
+	return quarantineFilename(e.ProductUID, e.NotefileID)
+}
+
+func TestQuarantineReplayInProgress(t *testing.T) {
+	filename := quarantineTestAdd(t, 2)
+	replaying := filename + quarantineEventsSuffix + quarantineReplayingSuffix
+	err := os.Rename(filename+quarantineEventsSuffix, replaying)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = quarantineReplay("product:org.safecast.test", "unknown.qo")
+	if err == nil || !strings.Contains(err.Error(), "already being replayed") {
+		t.Fatalf("replay while another is in progress: %v", err)
+	}
+	_, err = os.Stat(replaying)
+	if err != nil {
+		t.Errorf("events set aside by the other replay were disturbed: %s", err)
+	}
+}
+
+func TestQuarantineReplayRecovers(t *testing.T) {
+	filename := quarantineTestAdd(t, 2)
+
+	// A replay that died, after which another event arrived
+	replaying := filename + quarantineEventsSuffix + quarantineReplayingSuffix
+	err := os.Rename(filename+quarantineEventsSuffix, replaying)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := time.Now().Add(-quarantineReplayExpiration - time.Minute)
+	os.Chtimes(replaying, stale, stale)
+	e := noteTestEvent(t, "unknown.qo", `{"counts":2}`)
+	body, _ := json.Marshal(e)
+	quarantineAdd(e, body, "notehub:test", false)
+
+	// Still without a schema, the events that were left behind are put back along with the new one
+	summary, err := quarantineReplay("product:org.safecast.test", "unknown.qo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Count != 3 || summary.Replayed != 0 {
+		t.Errorf("count %d, replayed %d", summary.Count, summary.Replayed)
+	}
+	_, err = os.Stat(replaying)
+	if !os.IsNotExist(err) {
+		t.Errorf("events still set aside: %v", err)
+	}
+	events, _ := quarantineReadEvents(filename)
+	if len(events) != 3 {
+		t.Errorf("%d events held", len(events))
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Durable outbound queue of ingest uploads that failed.  Each failed upload
+// is written as a file into a per-sink folder on the file system shared among
+// all instances, and is retried through that sink with exponential backoff until
+// it succeeds or is too old to be worth sending.  Because the queue lives on the
+// shared file system, entries survive restarts and may be retried by any instance.
+// Entries name the sink rather than holding its URL, which contains the API key.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ttdata "github.com/Safecast/safecast-go"
+)
+
+// Debugging
+const uploadQueueDebug bool = false
+
+// How often we scan the queue, and the bounds of the backoff between retries
+const uploadQueueScanInterval = 1 * time.Minute
+const uploadQueueRetryMin = 1 * time.Minute
+const uploadQueueRetryMax = 6 * time.Hour
+
+// If an instance claims an entry and then dies, this is when we take it back
+const uploadQueueClaimExpiration = 15 * time.Minute
+
+// By this age the measurement is of no more use to anyone, and so we give up on it
+const uploadQueueMaxAge = 7 * 24 * time.Hour
+
+// Suffixes of queue entries, of entries being written, and of entries claimed for retry
+const uploadQueueEntrySuffix = ".json"
+const uploadQueueTempSuffix = ".tmp"
+const uploadQueueClaimSeparator = "$"
+
+// uploadQueueEntry is the format of a single queued upload
+type uploadQueueEntry struct {
+	Sink        string              `json:"sink,omitempty"`
+	QueuedAt    string              `json:"when_queued,omitempty"`
+	QueuedBy    string              `json:"queued_by,omitempty"`
+	Attempts    uint32              `json:"attempts,omitempty"`
+	NextAttempt time.Time           `json:"next_attempt,omitempty"`
+	LastError   string              `json:"last_error,omitempty"`
+	Data        ttdata.SafecastData `json:"data,omitempty"`
+}
+
+// Statics, for reporting depth in server status
+var uploadQueueLock sync.Mutex
+var uploadQueueDepthBySink = map[string]uint32{}
+
+// uploadQueueDirectory gets the folder holding queue entries for a sink
+func uploadQueueDirectory(sink string) string {
+	clean := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '-'
+	}, sink)
+	return SafecastDirectory() + TTUploadQueuePath + "/" + clean
+}
+
+// uploadQueueBackoff computes the delay before the next attempt
+func uploadQueueBackoff(attempts uint32) time.Duration {
+	delay := uploadQueueRetryMin
+	for i := uint32(1); i < attempts; i++ {
+		delay *= 2
+		if delay >= uploadQueueRetryMax {
+			return uploadQueueRetryMax
+		}
+	}
+	return delay
+}
+
+// uploadQueueWrite writes an entry so that readers never see a partially-written file
+func uploadQueueWrite(filename string, entry uploadQueueEntry) (err error) {
+
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	tempname := filename + uploadQueueTempSuffix
+	err = os.WriteFile(tempname, entryJSON, 0666)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tempname, filename)
+	if err != nil {
+		os.Remove(tempname)
+	}
+
+	return
+
+}
+
+// uploadQueueAdd queues an upload to a sink that failed so that it will be retried
+func uploadQueueAdd(sink string, sd ttdata.SafecastData, errString string) (err error) {
+
+	directory := uploadQueueDirectory(sink)
+	err = os.MkdirAll(directory, 0777)
+	if err != nil {
+		return
+	}
+
+	entry := uploadQueueEntry{}
+	entry.Sink = sink
+	entry.QueuedAt = NowInUTC()
+	entry.QueuedBy = TTServeInstanceID
+	entry.Attempts = 1
+	entry.NextAttempt = time.Now().Add(uploadQueueBackoff(entry.Attempts))
+	entry.LastError = errString
+	entry.Data = sd
+
+	// Name the file so that lexical order is the order in which the entries were queued
+	filename := fmt.Sprintf("%s/%019d-%s%s", directory, time.Now().UnixNano(), TTServeInstanceID, uploadQueueEntrySuffix)
+	err = uploadQueueWrite(filename, entry)
+	if err != nil {
+		return
+	}
+
+	uploadQueueLock.Lock()
+	uploadQueueDepthBySink[sink]++
+	uploadQueueLock.Unlock()
+
+	if uploadQueueDebug {
+		fmt.Printf("%s Upload queue: queued %s for %s\n", LogTime(), filename, sink)
+	}
+
+	return
+
+}
+
+// uploadQueueDepth returns a copy of the current queue depth by sink
+func uploadQueueDepth() map[string]uint32 {
+	uploadQueueLock.Lock()
+	defer uploadQueueLock.Unlock()
+	if len(uploadQueueDepthBySink) == 0 {
+		return nil
+	}
+	depth := map[string]uint32{}
+	for sink, count := range uploadQueueDepthBySink {
+		if count != 0 {
+			depth[sink] = count
+		}
+	}
+	return depth
+}
+
+// uploadQueueHandler retries queued uploads forever
+func uploadQueueHandler() {
+	for {
+		uploadQueueScan()
+		time.Sleep(uploadQueueScanInterval)
+	}
+}
+
+// uploadQueueScan makes a single pass over all sinks
+func uploadQueueScan() {
+
+	depth := map[string]uint32{}
+
+	// What was queued for a sink that is no longer enabled stays queued until it is again, or it gets too old
+	folders, err := os.ReadDir(SafecastDirectory() + TTUploadQueuePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("*** Upload queue: %s\n", err)
+		}
+		return
+	}
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+		sink, pending := uploadQueueRetryDirectory(SafecastDirectory() + TTUploadQueuePath + "/" + folder.Name())
+		if sink != "" {
+			depth[sink] += pending
+		}
+	}
+
+	uploadQueueLock.Lock()
+	uploadQueueDepthBySink = depth
+	uploadQueueLock.Unlock()
+
+}
+
+// uploadQueueRetryDirectory retries the due entries of a single sink, returning
+// the sink and the number of entries that remain queued for it.
+func uploadQueueRetryDirectory(directory string) (sink string, pending uint32) {
+
+	files, err := os.ReadDir(directory)
+	if err != nil {
+		fmt.Printf("*** Upload queue: %s\n", err)
+		return
+	}
+
+	// Oldest first, so that measurements are retried in the order captured
+	var names []string
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		name := file.Name()
+
+		// Take back entries claimed by an instance that never finished with them
+		if strings.Contains(name, uploadQueueEntrySuffix+uploadQueueClaimSeparator) {
+			info, err := file.Info()
+			if err == nil && time.Since(info.ModTime()) > uploadQueueClaimExpiration {
+				unclaimed := strings.Split(name, uploadQueueClaimSeparator)[0]
+				os.Rename(directory+"/"+name, directory+"/"+unclaimed)
+			}
+			pending++
+			continue
+		}
+
+		if strings.HasSuffix(name, uploadQueueEntrySuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// Once a retry fails, the destination is likely still down, so leave the rest for later
+	destinationDown := false
+	for _, name := range names {
+		filename := directory + "/" + name
+
+		// Read the entry
+		contents, err := os.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		entry := uploadQueueEntry{}
+		err = json.Unmarshal(contents, &entry)
+		if err != nil {
+			fmt.Printf("*** Upload queue: %s appears to be corrupt - removing ***\n", filename)
+			os.Remove(filename)
+			continue
+		}
+		sink = entry.Sink
+
+		// Give up on it if it has been waiting too long
+		queuedAt, err := time.Parse(time.RFC3339, entry.QueuedAt)
+		if err == nil && time.Since(queuedAt) > uploadQueueMaxAge {
+			os.Remove(filename)
+			ServerLog(fmt.Sprintf("Upload queue: gave up on %s for %s after %d attempts:%s\n", name, sink, entry.Attempts, entry.LastError))
+			continue
+		}
+
+		// Skip if not yet due, or if the sink isn't enabled
+		se, ingest := sinkIngestNamed(entry.Sink)
+		if destinationDown || ingest == nil || time.Now().Before(entry.NextAttempt) {
+			pending++
+			continue
+		}
+
+		// Claim it, which fails if another instance got to it first
+		claimed := filename + uploadQueueClaimSeparator + TTServeInstanceID
+		err = os.Rename(filename, claimed)
+		if err != nil {
+			pending++
+			continue
+		}
+		now := time.Now()
+		os.Chtimes(claimed, now, now)
+
+		// Retry it through the sink, so that it is counted as the sink's
+		errString := doUploadToSafecastIngest(entry.Data, ingest.name, ingest.url, ingest.timeout)
+		if errString == "" {
+			sinkCount(se, nil)
+			os.Remove(claimed)
+			if uploadQueueDebug {
+				fmt.Printf("%s Upload queue: delivered %s after %d attempts\n", LogTime(), name, entry.Attempts+1)
+			}
+			continue
+		}
+
+		// Put it back with a longer delay
+		sinkCount(se, fmt.Errorf("%s: retry failed:%s", ingest.name, errString))
+		destinationDown = true
+		entry.Attempts++
+		entry.NextAttempt = time.Now().Add(uploadQueueBackoff(entry.Attempts))
+		entry.LastError = errString
+		err = uploadQueueWrite(filename, entry)
+		if err != nil {
+			fmt.Printf("*** Upload queue: can't requeue %s: %s\n", filename, err)
+			os.Rename(claimed, filename)
+		} else {
+			os.Remove(claimed)
+		}
+		pending++
+
+	}
+
+	return
+
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ttdata "github.com/Safecast/safecast-go"
+)
+
+// queueTestSink makes an ingest sink, named "ingest", uploading to a server that replies with the given status
+func queueTestSink(t *testing.T, status int) (entry *sinkEntry, received *int32) {
+	t.Helper()
+	received = new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(received, 1)
+		rw.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	entry = &sinkEntry{sink: &sinkIngest{sinkBase: sinkBase{name: "ingest"}, url: server.URL + "/v1/measurements?api_key=secret", timeout: 5 * time.Second}}
+	sinkLock.Lock()
+	prev := sinks
+	sinks = []*sinkEntry{entry}
+	sinkLock.Unlock()
+	t.Cleanup(func() {
+		sinkLock.Lock()
+		sinks = prev
+		sinkLock.Unlock()
+	})
+	return
+}
+
+// queueTestSetup prepares an empty queue
+func queueTestSetup(t *testing.T) {
+	t.Helper()
+	testServiceConfig(t, TTServeConfig{})
+	testDataDirectory(t)
+	os.MkdirAll(SafecastDirectory()+TTServerLogPath, 0777)
+}
+
+// queueTestEntries reads what is queued for the "ingest" sink, by file name
+func queueTestEntries(t *testing.T) map[string]uploadQueueEntry {
+	t.Helper()
+	entries := map[string]uploadQueueEntry{}
+	files, _ := os.ReadDir(uploadQueueDirectory("ingest"))
+	for _, file := range files {
+		contents, err := os.ReadFile(uploadQueueDirectory("ingest") + "/" + file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := uploadQueueEntry{}
+		json.Unmarshal(contents, &entry)
+		entries[file.Name()] = entry
+	}
+	return entries
+}
+
+// queueTestDue makes every queued entry due, having been queued the given time ago
+func queueTestDue(t *testing.T, ago time.Duration) {
+	t.Helper()
+	for name, entry := range queueTestEntries(t) {
+		entry.NextAttempt = time.Now().Add(-time.Second)
+		entry.QueuedAt = time.Now().Add(-ago).UTC().Format("2006-01-02T15:04:05Z")
+		err := uploadQueueWrite(uploadQueueDirectory("ingest")+"/"+name, entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUploadQueueBackoff(t *testing.T) {
+	tests := []struct {
+		attempts uint32
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, uploadQueueRetryMax},
+		{1000, uploadQueueRetryMax},
+	}
+	for _, test := range tests {
+		got := uploadQueueBackoff(test.attempts)
+		if got != test.want {
+			t.Errorf("attempts %d: got %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestUploadQueueRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		ago       time.Duration
+		received  int32
+		pending   uint32
+		attempts  uint32
+		sent      uint32
+		failed    uint32
+		remaining int
+	}{
+		{"delivered", http.StatusOK, time.Hour, 1, 0, 0, 1, 0, 0},
+		{"still down", http.StatusServiceUnavailable, time.Hour, 1, 1, 2, 0, 1, 1},
+		{"too old", http.StatusOK, uploadQueueMaxAge + time.Hour, 0, 0, 0, 0, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queueTestSetup(t)
+			entry, received := queueTestSink(t, test.status)
+			uploadQueueAdd("ingest", ttdata.SafecastData{}, " 503 Service Unavailable")
+			queueTestDue(t, test.ago)
+
+			sink, pending := uploadQueueRetryDirectory(uploadQueueDirectory("ingest"))
+			if sink != "ingest" {
+				t.Errorf("sink %q", sink)
+			}
+			if pending != test.pending || *received != test.received {
+				t.Errorf("pending %d, received %d", pending, *received)
+			}
+			if entry.status.Sent != test.sent || entry.status.Failed != test.failed {
+				t.Errorf("sent %d, failed %d", entry.status.Sent, entry.status.Failed)
+			}
+			remaining := queueTestEntries(t)
+			if len(remaining) != test.remaining {
+				t.Fatalf("%d remaining", len(remaining))
+			}
+			for name, e := range remaining {
+				if !strings.HasSuffix(name, uploadQueueEntrySuffix) || e.Attempts != test.attempts || !e.NextAttempt.After(time.Now()) {
+					t.Errorf("requeued as %s with %d attempts, next at %s", name, e.Attempts, e.NextAttempt)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadQueueClaim(t *testing.T) {
+	queueTestSetup(t)
+	_, received := queueTestSink(t, http.StatusOK)
+	uploadQueueAdd("ingest", ttdata.SafecastData{}, " timeout")
+	queueTestDue(t, time.Hour)
+
+	// An entry claimed by another instance is left to it, but still counted
+	directory := uploadQueueDirectory("ingest")
+	files, _ := os.ReadDir(directory)
+	if len(files) != 1 {
+		t.Fatalf("%d queued", len(files))
+	}
+	name := files[0].Name()
+	claimed := directory + "/" + name + uploadQueueClaimSeparator + "other"
+	err := os.Rename(directory+"/"+name, claimed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pending := uploadQueueRetryDirectory(directory)
+	if pending != 1 || *received != 0 {
+		t.Fatalf("claimed: pending %d, received %d", pending, *received)
+	}
+
+	// Once the claim expires, it is taken back and retried
+	expired := time.Now().Add(-uploadQueueClaimExpiration - time.Minute)
+	os.Chtimes(claimed, expired, expired)
+	uploadQueueRetryDirectory(directory)
+	_, pending = uploadQueueRetryDirectory(directory)
+	if pending != 0 || *received != 1 {
+		t.Fatalf("expired: pending %d, received %d", pending, *received)
+	}
+}
+
+func TestUploadQueueNoURL(t *testing.T) {
+	queueTestSetup(t)
+	queueTestSink(t, http.StatusServiceUnavailable)
+	uploadQueueAdd("ingest", ttdata.SafecastData{}, " 503 Service Unavailable")
+	queueTestDue(t, time.Hour)
+	uploadQueueRetryDirectory(uploadQueueDirectory("ingest"))
+
+	// Neither the queue nor the metrics may hold the API key within the URL
+	files, _ := os.ReadDir(uploadQueueDirectory("ingest"))
+	for _, file := range files {
+		contents, _ := os.ReadFile(uploadQueueDirectory("ingest") + "/" + file.Name())
+		if strings.Contains(string(contents), "api_key") || strings.Contains(string(contents), "http") {
+			t.Errorf("%s holds the URL: %s", file.Name(), contents)
+		}
+	}
+	metricsJSON, _ := json.Marshal(metricsSnapshot())
+	if strings.Contains(string(metricsJSON), "api_key") {
+		t.Errorf("metrics hold the URL: %s", metricsJSON)
+	}
+}
@@ -17,7 +17,7 @@ import (
 
 // SafecastDeviceIsSolarcastNano determines if this is a Solarcast Nano
 func SafecastDeviceIsSolarcastNano(deviceid uint32) bool {
-	sn, _ := sheetDeviceIDToSN(deviceid)
+	sn, _ := registryDeviceIDToSN(deviceid)
 	if sn == "" {
 		return false
 	}
@@ -150,20 +150,7 @@ func SafecastReformatFromV1(v1 *SafecastDataV1, isTestMeasurement bool) (devicei
 	}
 
 	// THIS is where we determine sensor types based on device ID
-	tubeType := "unknown"
-	if v2DeviceID == 100 || v2DeviceID == 63 || v2DeviceID == 54 {
-		tubeType = "U712"
-	} else if v2DeviceID == 78 || v2DeviceID == 20105 {
-		tubeType = "W78017"
-	} else if devicetype == "ngeigie" {
-		tubeType = "U7318"
-	} else if devicetype == "geigiecast" || devicetype == "geigiecast-zen" {
-		tubeType = "U7318"
-	} else if devicetype == "pointcast" && v1DeviceID%10 == 1 {
-		tubeType = "U7318"
-	} else if devicetype == "pointcast" && v1DeviceID%10 == 2 {
-		tubeType = "EC7128"
-	}
+	tubeType := tubeForV1(devicetype, v1DeviceID, v2DeviceID)
 
 	// Device ID
 	sd.DeviceID = v2DeviceID
@@ -174,7 +161,7 @@ func SafecastReformatFromV1(v1 *SafecastDataV1, isTestMeasurement bool) (devicei
 	sd.DeviceClass = devicetype
 
 	// Device Serial Number
-	sn, _ := sheetDeviceIDToSN(v2DeviceID)
+	sn, _ := registryDeviceIDToSN(v2DeviceID)
 	if sn != "" {
 		u64, err2 := strconv.ParseUint(sn, 10, 32)
 		if err2 == nil {
@@ -258,20 +245,9 @@ func SafecastReformatFromV1(v1 *SafecastDataV1, isTestMeasurement bool) (devicei
 			if v1DeviceID == 1001 && cpm == 0 {
 				return 0, "", sd
 			}
-			switch tubeType {
-			case "U7318":
-				lnd.U7318 = &cpm
-				sd.Lnd = &lnd
-			case "U712":
-				lnd.U712 = &cpm
-				sd.Lnd = &lnd
-			case "EC7128":
-				lnd.EC7128 = &cpm
-				sd.Lnd = &lnd
-			case "W78017":
-				lnd.W78017 = &cpm
+			if tubeSetCPM(&lnd, tubeType, cpm) {
 				sd.Lnd = &lnd
-			default:
+			} else {
 				fmt.Printf("*** Reformat: Received CPM for unrecognized device %d\n", sd.DeviceID)
 			}
 
@@ -420,7 +396,7 @@ func SafecastReformatToV1(sd ttdata.SafecastData) (v1Data1 *SafecastDataV1ToEmit
 	}
 
 	// Solarcast.  Return S/N as V1 device ID
-	id, _ := sheetDeviceIDToSN(sd.DeviceID)
+	id, _ := registryDeviceIDToSN(sd.DeviceID)
 	if id == "" {
 		return
 	}
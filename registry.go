@@ -0,0 +1,335 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// The device registry, which is our own record of the serial number, custodian, location,
+// dashboard, tube, and signing key of each device.  It is kept in a single JSON file that
+// is shared by all instances, and reloaded whenever another changes it.  Changes are made
+// to what is in the file, re-read while holding its file lock, so that none made by other
+// instances are lost.  The tracker sheet is consulted for devices that aren't registered,
+// and may be imported into the registry.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RegistryDevice is what we know about a device
+type RegistryDevice struct {
+	DeviceID         uint32 `json:"device,omitempty"`
+	SN               string `json:"sn,omitempty"`
+	Custodian        string `json:"custodian_name,omitempty"`
+	CustodianContact string `json:"custodian_contact,omitempty"`
+	Location         string `json:"location,omitempty"`
+	Dashboard        string `json:"dashboard,omitempty"`
+	Tube             string `json:"tube,omitempty"`
+	Notes            string `json:"notes,omitempty"`
+	Key              string `json:"key,omitempty"`
+	Secure           bool   `json:"secure,omitempty"`
+	Source           string `json:"source,omitempty"`
+	Modified         string `json:"modified,omitempty"`
+}
+
+// The registry file format
+type registryFile struct {
+	Devices []RegistryDevice `json:"devices,omitempty"`
+}
+
+// Source of devices that were imported from the tracker sheet, and which are thus updated by subsequent imports
+const registrySourceSheet = "sheet"
+
+// Statics
+var registryLock sync.RWMutex
+var registryDevices = map[uint32]RegistryDevice{}
+var registryModTime time.Time
+var registryCheckLock sync.Mutex
+
+// registryFilename is the path of the registry
+func registryFilename() string {
+	return SafecastDirectory() + TTDeviceRegistryPath
+}
+
+// registryInit loads the registry
+func registryInit() {
+	err := registryLoad()
+	if err != nil {
+		fmt.Printf("*** Device registry: %s\n", err)
+	}
+}
+
+// registryCheck reloads the registry if another instance has changed it
+func registryCheck() {
+	registryCheckLock.Lock()
+	defer registryCheckLock.Unlock()
+	file, err := os.Stat(registryFilename())
+	if err != nil {
+		return
+	}
+	registryLock.RLock()
+	changed := !file.ModTime().Equal(registryModTime)
+	registryLock.RUnlock()
+	if changed {
+		err = registryLoad()
+		if err != nil {
+			ServerLog(fmt.Sprintf("*** DEVICE REGISTRY not reloaded: %s\n", err))
+		}
+	}
+}
+
+// registryLoad reads the registry, leaving what we've got in place if it can't be read
+func registryLoad() error {
+
+	devices, modTime, err := registryRead()
+	if err != nil {
+		return err
+	}
+
+	registryLock.Lock()
+	registryDevices = devices
+	registryModTime = modTime
+	registryLock.Unlock()
+
+	return nil
+
+}
+
+// registryRead reads the devices in the registry file, of which there are none if there's no file
+func registryRead() (devices map[uint32]RegistryDevice, modTime time.Time, err error) {
+
+	devices = map[uint32]RegistryDevice{}
+	filename := registryFilename()
+	file, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return devices, modTime, nil
+		}
+		return nil, modTime, fmt.Errorf("%s", ErrorString(err))
+	}
+	modTime = file.ModTime()
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, modTime, fmt.Errorf("%s", ErrorString(err))
+	}
+	rf := registryFile{}
+	err = json.Unmarshal(contents, &rf)
+	if err != nil {
+		return nil, modTime, fmt.Errorf("can't parse JSON: %s", err)
+	}
+
+	for _, d := range rf.Devices {
+		if d.DeviceID != 0 {
+			devices[d.DeviceID] = d
+		}
+	}
+
+	return
+
+}
+
+// registryModify changes the registry as it is in the file, re-reading it while holding the file lock
+// so that changes made by other instances aren't lost, and writing it if modify says that it changed.
+// The file lock serializes writers, so readers are only held up while the new map is swapped in.
+func registryModify(modify func(devices map[uint32]RegistryDevice) (changed bool, err error)) error {
+
+	filename := registryFilename()
+	lock, err := fileLock(filename)
+	if err != nil {
+		return err
+	}
+	defer fileUnlock(lock)
+
+	devices, modTime, err := registryRead()
+	if err != nil {
+		return err
+	}
+	changed, err := modify(devices)
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		rf := registryFile{}
+		for _, d := range devices {
+			rf.Devices = append(rf.Devices, d)
+		}
+		sort.Slice(rf.Devices, func(i, j int) bool { return rf.Devices[i].DeviceID < rf.Devices[j].DeviceID })
+		contents, err := json.MarshalIndent(rf, "", "    ")
+		if err != nil {
+			return err
+		}
+		err = fileWriteAtomic(filename, contents)
+		if err != nil {
+			return err
+		}
+		file, err := os.Stat(filename)
+		if err == nil {
+			modTime = file.ModTime()
+		}
+	}
+
+	registryLock.Lock()
+	registryDevices = devices
+	registryModTime = modTime
+	registryLock.Unlock()
+	return nil
+
+}
+
+// registryList gets all registered devices
+func registryList() (devices []RegistryDevice) {
+	registryLock.RLock()
+	devices = []RegistryDevice{}
+	for _, d := range registryDevices {
+		devices = append(devices, d)
+	}
+	registryLock.RUnlock()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+	return
+}
+
+// registryGet finds a device by ID or, if specified, by serial number
+func registryGet(DeviceID uint32, DeviceSN string) (device RegistryDevice, found bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	device, found = registryDevices[DeviceID]
+	if found || DeviceSN == "" {
+		return
+	}
+	for _, d := range registryDevices {
+		if d.SN == DeviceSN {
+			return d, true
+		}
+	}
+	return
+}
+
+// registryPut adds or replaces a device
+func registryPut(device RegistryDevice) error {
+	if device.DeviceID == 0 {
+		return fmt.Errorf("device ID is required")
+	}
+	device.Modified = NowInUTC()
+	return registryModify(func(devices map[uint32]RegistryDevice) (bool, error) {
+		devices[device.DeviceID] = device
+		return true, nil
+	})
+}
+
+// registryDelete removes a device
+func registryDelete(DeviceID uint32) (found bool, err error) {
+	err = registryModify(func(devices map[uint32]RegistryDevice) (bool, error) {
+		_, found = devices[DeviceID]
+		delete(devices, DeviceID)
+		return found, nil
+	})
+	return
+}
+
+// registryImportSheet imports the tracker sheet.  Devices that aren't yet registered are added, those
+// previously imported are updated, and those that have been edited locally only have their blanks filled.
+func registryImportSheet() (added int, updated int, err error) {
+
+	config := CurrentServiceConfig()
+	if config.DeviceSheetDisabled {
+		return 0, 0, fmt.Errorf("tracker sheet is disabled")
+	}
+	rows, err := sheetRead(config.DeviceSheetURL)
+	if err != nil {
+		return
+	}
+
+	err = registryModify(func(devices map[uint32]RegistryDevice) (bool, error) {
+		added, updated = 0, 0
+		now := NowInUTC()
+		for _, row := range rows {
+			if row.DeviceID == 0 {
+				continue
+			}
+			d, found := devices[row.DeviceID]
+			if !found {
+				d = RegistryDevice{DeviceID: row.DeviceID, Source: registrySourceSheet}
+				added++
+			}
+			overwrite := d.Source == registrySourceSheet
+			before := d
+			registryImportField(&d.SN, row.SN, overwrite)
+			registryImportField(&d.Custodian, row.Custodian, overwrite)
+			registryImportField(&d.CustodianContact, row.CustodianContact, overwrite)
+			registryImportField(&d.Location, row.Location, overwrite)
+			registryImportField(&d.Dashboard, row.Dashboard, overwrite)
+			if found && d != before {
+				updated++
+			}
+			if !found || d != before {
+				d.Modified = now
+				devices[d.DeviceID] = d
+			}
+		}
+		return added != 0 || updated != 0, nil
+	})
+
+	return
+
+}
+
+// registryImportField imports a single field from the sheet
+func registryImportField(field *string, value string, overwrite bool) {
+	if value != "" && (overwrite || *field == "") {
+		*field = value
+	}
+}
+
+// registryDeviceInfo gets what we know about a device, from the registry or else from the tracker sheet
+func registryDeviceInfo(DeviceID uint32, DeviceSN string) (info RegistryDevice, err error) {
+
+	info, found := registryGet(DeviceID, DeviceSN)
+	if found {
+		return
+	}
+
+	si, err2 := sheetDeviceInfo(DeviceID, DeviceSN)
+	if err2 == nil {
+		info.DeviceID = si.DeviceID
+		info.SN = si.SN
+		info.Custodian = si.Custodian
+		info.CustodianContact = si.CustodianContact
+		info.Location = si.Location
+		info.Dashboard = si.Dashboard
+		info.Source = registrySourceSheet
+		return
+	}
+
+	// It was agreed with Rob t(see ttnode/src/io.c) that we would reserve the low 2^20 addresses
+	// for fixed allocation.  If we didn't find the device ID here and if it was in that range,
+	// use THAT as the serial number.
+	if DeviceID < 1048576 {
+		info.DeviceID = DeviceID
+		return
+	}
+
+	err = fmt.Errorf("device not registered")
+	return
+
+}
+
+// registryDeviceIDToSN converts a Safecast device ID to its manufacturing serial number
+func registryDeviceIDToSN(DeviceID uint32) (sn string, infoStr string) {
+	info, err := registryDeviceInfo(DeviceID, "")
+	if err != nil {
+		return "", ""
+	}
+	sn = info.SN
+	if info.Custodian == "" && info.Location != "" {
+		infoStr = info.Location
+	} else if info.Custodian != "" && info.Location == "" {
+		infoStr = info.Custodian
+	} else {
+		infoStr = fmt.Sprintf("%s, %s", info.Custodian, info.Location)
+	}
+	return
+}
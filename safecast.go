@@ -15,6 +15,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	ttdata "github.com/Safecast/safecast-go"
@@ -24,28 +25,12 @@ import (
 
 // Debugging
 const v1UploadDebug bool = true
-const v1UploadSolarcast bool = true
 const v1UploadSolarcastDebug bool = true
-const verboseTransactions bool = true
 
 // Synchronous vs asynchronous V1 API requests
 const v1UploadAsyncFakeResults bool = false
 const v1UploadFakeResult string = "{\"id\":00000001}"
 
-// For dealing with transaction timeouts
-var httpTransactionsInProgress int
-var httpTransactions int
-
-const httpTransactionsRecorded = 500
-
-var httpTransactionDurations [httpTransactionsRecorded]int
-var httpTransactionTimes [httpTransactionsRecorded]time.Time
-var httpTransactionErrorTime string
-var httpTransactionErrorURL string
-var httpTransactionErrorString string
-var httpTransactionErrors int
-var httpTransactionErrorFirst = true
-
 // SendSafecastMessage processes an inbound Safecast message as an asynchronous goroutine
 func SendSafecastMessage(req IncomingAppReq, msg *ttproto.Telecast) {
 
@@ -75,7 +60,7 @@ func SendSafecastMessage(req IncomingAppReq, msg *ttproto.Telecast) {
 	sd.DeviceClass = devicetype
 
 	// Generate a Serial Number
-	sn, _ := sheetDeviceIDToSN(did)
+	sn, _ := registryDeviceIDToSN(did)
 	if sn != "" {
 		u64, err2 := strconv.ParseUint(sn, 10, 32)
 		if err2 == nil {
@@ -656,6 +641,9 @@ func SendSafecastMessage(req IncomingAppReq, msg *ttproto.Telecast) {
 		sd.Lnd = &lnd
 	}
 
+	// If this is a radiation reading, make sure that it has a dose rate
+	tubeCalculate(&sd)
+
 	// If this is an air reading, annotate it with AQI if possible
 	aqiCalculate(&sd)
 
@@ -687,102 +675,42 @@ func SafecastLog(sd ttdata.SafecastData) {
 
 }
 
-// Begin transaction and return the transaction ID
-func beginTransaction(version string, message1 string, message2 string) int {
-	httpTransactionsInProgress++
-	httpTransactions++
-	transaction := httpTransactions % httpTransactionsRecorded
-	httpTransactionTimes[transaction] = time.Now()
-	if verboseTransactions {
-		fmt.Printf("%s >>> %s [%d] %s %s\n", LogTime(), version, transaction, message1, message2)
-	}
-	return transaction
-}
+// SafecastUploadInOrder uploads the event, only returning once every sink has been sent it, so that
+// successive events from the same device reach each sink in the order in which they were captured
+func SafecastUploadInOrder(sd ttdata.SafecastData) {
 
-// End transaction and issue warnings
-func endTransaction(transaction int, url string, errstr string) {
-	httpTransactionsInProgress--
-	duration := int(time.Since(httpTransactionTimes[transaction]) / time.Second)
-	httpTransactionDurations[transaction] = duration
-
-	if errstr != "" {
-		httpTransactionErrors = httpTransactionErrors + 1
-		if httpTransactionErrorFirst {
-			httpTransactionErrorTime = LogTime()
-			httpTransactionErrorURL = url
-			httpTransactionErrorString = errstr
-			httpTransactionErrorFirst = false
-		}
-		if verboseTransactions {
-			fmt.Printf("%s <<<    [%d] *** ERROR\n", LogTime(), transaction)
-		}
-		ServerLog(fmt.Sprintf("After %d seconds, error uploading to %s %s\n", duration, url, errstr))
-	} else {
-		if verboseTransactions {
-			if duration < 5 {
-				fmt.Printf("%s <<<    [%d]\n", LogTime(), transaction)
-			} else {
-				fmt.Printf("%s <<<    [%d] completed after %d seconds\n", LogTime(), transaction, duration)
-			}
-		}
-	}
+	// Add info about the server instance that actually did the upload
+	sd.Service.Handler = &TTServeInstanceID
 
-	theMin := 99999
-	theMax := 0
-	theTotal := 0
-	theCount := 0
-	for theCount < httpTransactions && theCount < httpTransactionsRecorded {
-		theTotal += httpTransactionDurations[theCount]
-		if httpTransactionDurations[theCount] < theMin {
-			theMin = httpTransactionDurations[theCount]
-		}
-		if httpTransactionDurations[theCount] > theMax {
-			theMax = httpTransactionDurations[theCount]
-		}
-		theCount++
+	// Upload to all sinks at once, waiting for them all
+	var wg sync.WaitGroup
+	for _, s := range sinksEnabled() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sinkSend(s, sd)
+		}()
 	}
-	theMean := theTotal / theCount
+	wg.Wait()
 
-	// Output to console every time we are in a "slow mode"
-	if theMin > 5 {
-		fmt.Printf("%s Safecast Upload Statistics\n", LogTime())
-		fmt.Printf("%s *** %d total uploads since restart\n", LogTime(), httpTransactions)
-		if httpTransactionsInProgress > 0 {
-			fmt.Printf("%s *** %d uploads still in progress\n", LogTime(), httpTransactionsInProgress)
-		}
-		fmt.Printf("%s *** Last %d: min=%ds, max=%ds, avg=%ds\n", LogTime(), theCount, theMin, theMax, theMean)
+}
 
-	}
+// SafecastLogInOrder logs the event, only returning once it has been written
+func SafecastLogInOrder(sd ttdata.SafecastData) {
 
-	// If there's a problem, output to Slack once every 25 transactions
-	if theMin > 5 && transaction == 0 {
-		// If all of them have the same timeout value, the server must be down.
-		s := ""
-		if theMin == theMax && theMin == theMean {
-			s = fmt.Sprintf("HTTP Upload: all of the most recent %d uploads failed. Please check the service.", theCount)
-		} else {
-			s = fmt.Sprintf("HTTP Upload: of the previous %d uploads, min=%ds, max=%ds, avg=%ds", theCount, theMin, theMax, theMean)
-		}
-		sendToSafecastOps(s, SlackMsgUnsolicitedOps)
-	}
+	// Add info about the server instance that actually did the upload
+	sd.Service.Handler = &TTServeInstanceID
 
-}
+	// Log as accurately as we can with regard to what came in
+	WriteToLogsInOrder(sd)
 
-// Update message ages and notify
-func sendSafecastCommsErrorsToSlack(PeriodMinutes uint32) {
-	if httpTransactionErrors != 0 {
-		sendToSafecastOps(fmt.Sprintf("** Warning **  In the %d mins after %s UTC there were errors uploading to %s:%s",
-			PeriodMinutes, httpTransactionErrorTime, httpTransactionErrorURL, httpTransactionErrorString), SlackMsgUnsolicitedOps)
-		httpTransactionErrors = 0
-		httpTransactionErrorFirst = true
-	}
 }
 
 // SafecastV1Upload uploads a Safecast data structure to the Safecast service
 func SafecastV1Upload(body []byte, url string, isDev bool, unit string, value string) (fSuccess bool, result string) {
 
 	if v1UploadAsyncFakeResults {
-		go doSafecastV1Upload(body, url, isDev, unit, value)
+		trackedGo(func() { doSafecastV1Upload(body, url, isDev, unit, value) })
 		return true, v1UploadFakeResult
 	}
 
@@ -797,11 +725,11 @@ func doSafecastV1Upload(body []byte, url string, isDev bool, unit string, value
 	response := v1UploadFakeResult
 
 	// Figure out what domain we're posting to
-	domain := SafecastV1UploadDomain
-	v1str := "V1"
+	domain := CurrentServiceConfig().V1UploadDomain
+	v1str := metricsDestV1
 	if isDev {
-		domain = SafecastV1UploadDomainDev
-		v1str = "D1"
+		domain = CurrentServiceConfig().V1UploadDomainDev
+		v1str = metricsDestD1
 	}
 
 	// Figure out the correct request URI
@@ -867,7 +795,7 @@ func doSafecastV1Upload(body []byte, url string, isDev bool, unit string, value
 		if errString != "" {
 			fmt.Printf("*** Error uploading to %s: %v\n", domain, errString)
 		}
-		endTransaction(transaction, domain, "")
+		endTransactionQuietly(transaction, domain, errString)
 	}
 
 	return errString == "", response
@@ -895,7 +823,7 @@ func HashSafecastData(sd ttdata.SafecastData) string {
 }
 
 // Do a single solarcast v1 upload
-func doSolarcastV1Upload(sdV1Emit *SafecastDataV1ToEmit) {
+func doSolarcastV1Upload(sdV1Emit *SafecastDataV1ToEmit, url string, timeout time.Duration) (err error) {
 
 	sdV1EmitJSON, _ := json.Marshal(sdV1Emit)
 
@@ -903,119 +831,122 @@ func doSolarcastV1Upload(sdV1Emit *SafecastDataV1ToEmit) {
 		fmt.Printf("$$$ Uploading Solarcast to V1 service:\n%s\n", sdV1EmitJSON)
 	}
 
-	req, _ := http.NewRequest("POST", SafecastV1SolarcastUploadURL, bytes.NewBuffer(sdV1EmitJSON))
+	deviceID := ""
+	if sdV1Emit.DeviceID != nil {
+		deviceID = *sdV1Emit.DeviceID
+	}
+	transaction := beginTransaction(metricsDestV1, "solarcast", deviceID)
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(sdV1EmitJSON))
 	req.Header.Set("User-Agent", "TTSERVE")
 	req.Header.Set("Content-Type", "application/json")
 	httpclient := &http.Client{
-		Timeout: time.Second * 15,
+		Timeout: timeout,
 	}
 	resp, err := httpclient.Do(req)
 	if err != nil {
 		fmt.Printf("$$$ httpclient.Do error: %s\n", err)
+		err = fmt.Errorf("solarcast v1: %s", ErrorString(err))
+		endTransaction(transaction, CurrentServiceConfig().V1UploadDomain, ErrorString(err))
 	} else {
-		buf, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Printf("$$$ readAll error: %s\n", err)
+		buf, err2 := io.ReadAll(resp.Body)
+		if err2 != nil {
+			fmt.Printf("$$$ readAll error: %s\n", err2)
 		} else {
 			if v1UploadSolarcastDebug {
 				fmt.Printf("$$$ V1 service response:\n%s\n", string(buf))
 			}
 		}
 		resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			err = fmt.Errorf("solarcast v1: %s", resp.Status)
+			endTransaction(transaction, CurrentServiceConfig().V1UploadDomain, resp.Status)
+		} else {
+			endTransaction(transaction, CurrentServiceConfig().V1UploadDomain, "")
+		}
 	}
 
 	// Don't overload the server
 	time.Sleep(1 * time.Second)
 
+	return
+
 }
 
-// Process solarcast uploads to v1, for "realtime" support
-func doSolarcastV1Uploads(sd ttdata.SafecastData) {
-	sd1, sd2, sd9, err := SafecastReformatToV1(sd)
-	if err != nil {
-		return
-	}
-	if sd1 != nil {
-		doSolarcastV1Upload(sd1)
-	}
-	if sd2 != nil {
-		doSolarcastV1Upload(sd2)
-	}
-	if sd9 != nil {
-		doSolarcastV1Upload(sd9)
+// Process solarcast uploads to v1, for "realtime" support, skipping devices that aren't solarcasts
+func doSolarcastV1Uploads(sd ttdata.SafecastData, url string, timeout time.Duration) (err error) {
+	sd1, sd2, sd9, err2 := SafecastReformatToV1(sd)
+	if err2 != nil || (sd1 == nil && sd2 == nil && sd9 == nil) {
+		return errSinkSkipped
+	}
+	for _, sdV1 := range []*SafecastDataV1ToEmit{sd1, sd2, sd9} {
+		if sdV1 != nil {
+			err2 = doSolarcastV1Upload(sdV1, url, timeout)
+			if err2 != nil {
+				err = err2
+			}
+		}
 	}
+	return
 }
 
-// Upload uploads a Safecast data structure to the Safecast service, either serially or massively in parallel
+// Upload uploads a Safecast data structure to all enabled sinks, massively in parallel
 func Upload(sd ttdata.SafecastData) bool {
 
-	// Upload to all URLs
-	for _, url := range SafecastUploadURLs {
-		go doUploadToSafecast(sd, url)
-	}
-
-	// Upload Safecast data to the v1 production server
-	if v1UploadSolarcast {
-		go doSolarcastV1Uploads(sd)
+	for _, s := range sinksEnabled() {
+		trackedGo(func() { sinkSend(s, sd) })
 	}
 
-	// Upload safecast data to those listening on MQTT
-	go brokerPublish(sd)
-
-	// Upload data to the notehub that didn't actually come from notehub
-	go doUploadToNotehub(sd)
-
 	return true
 }
 
 // Upload a Safecast data structure to the Notehub service
-func doUploadToNotehub(sd ttdata.SafecastData) {
-
-	// Do NOT, under any circumstances, send Notehub-originated data back to Notehub
-	// else we will be in a circular loop of data that will never end.
-	if safecastDeviceUIDIsFromNotehub(sd.DeviceUID) {
-		return
-	}
-
-	// Exit if not configured
-	if ServiceConfig.NotehubURL == "" || ServiceConfig.NotehubToken == "" {
-		fmt.Printf("notehub: not configured for upload\n")
-		return
-	}
+func doUploadToNotehub(sd ttdata.SafecastData, notehubURL string, notehubToken string, timeout time.Duration) (err error) {
 
-	// Convert the Safecast data structure to a Notehub webhook event
-	deviceUID, eventJSON, err := notehubWebhookEventFromSD(sd)
+	// Convert the Safecast data structure to Notehub webhook events, one per sensor
+	deviceUID, eventsJSON, err := notehubWebhookEventsFromSD(sd)
 	if err != nil {
-		fmt.Printf("can't upload event to notehub: %s\n", err)
-		return
+		return fmt.Errorf("can't upload event to notehub: %s", err)
 	}
 
-	// Construct the request
-	url := strings.ReplaceAll(ServiceConfig.NotehubURL, "{deviceUID}", deviceUID)
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(eventJSON))
+	// Send them all in a single request, as a JSON array of events such as the note topics accept
+	// in a batch, so that each measurement costs one request no matter how many sensors it has
+	batchJSON := append([]byte("["), bytes.Join(eventsJSON, []byte(","))...)
+	batchJSON = append(batchJSON, ']')
+	url := strings.ReplaceAll(notehubURL, "{deviceUID}", deviceUID)
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(batchJSON))
 	req.Header.Set("User-Agent", "TTSERVE")
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Session-Token", ServiceConfig.NotehubToken)
+	req.Header.Set("X-Session-Token", notehubToken)
 	httpclient := &http.Client{
-		Timeout: time.Second * 10,
+		Timeout: timeout,
 	}
+	transaction := beginTransaction(metricsDestNotehub, "device", deviceUID)
 	resp, err := httpclient.Do(req)
 	if err != nil {
-		fmt.Printf("can't upload event to notehub: %s\n", err)
-		return
+		endTransaction(transaction, "notehub", ErrorString(err))
+		return fmt.Errorf("can't upload event to notehub: %s", ErrorString(err))
 	}
-	defer resp.Body.Close()
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		endTransaction(transaction, "notehub", resp.Status)
+		return fmt.Errorf("can't upload event to notehub: %s", resp.Status)
+	}
+	endTransaction(transaction, "notehub", "")
+
+	return
 
 }
 
-// Upload a Safecast data structure to the Safecast service
-func doUploadToSafecast(sd ttdata.SafecastData, url string) bool {
+// Perform a single attempt at uploading to the Safecast service, returning "" on success.  The
+// upload is reported by the name of the sink, because the URL contains the API key.
+func doUploadToSafecastIngest(sd ttdata.SafecastData, name string, url string, timeout time.Duration) string {
 
 	var CapturedAt string
 	if sd.CapturedAt != nil {
 		CapturedAt = *sd.CapturedAt
 	}
-	transaction := beginTransaction("V2", "captured", CapturedAt)
+	transaction := beginTransaction(metricsDestV2, "captured", CapturedAt)
 
 	// Marshal it to json text
 	scJSON, _ := json.Marshal(sd)
@@ -1027,12 +958,16 @@ func doUploadToSafecast(sd ttdata.SafecastData, url string) bool {
 	req.Header.Set("User-Agent", "TTSERVE")
 	req.Header.Set("Content-Type", "application/json")
 	httpclient := &http.Client{
-		Timeout: time.Second * 60,
+		Timeout: timeout,
 	}
 	resp, err := httpclient.Do(req)
 
 	errString := ""
 	if err == nil {
+		// The service being unavailable is just as much of a failure as not reaching it
+		if resp.StatusCode >= http.StatusInternalServerError {
+			errString = fmt.Sprintf(" %s", resp.Status)
+		}
 		resp.Body.Close()
 	} else {
 		// Eliminate the URL from the string because exposing the API key is not secure.
@@ -1042,7 +977,7 @@ func doUploadToSafecast(sd ttdata.SafecastData, url string) bool {
 		errString = s[len(s)-1]
 	}
 
-	endTransaction(transaction, url, errString)
+	endTransaction(transaction, name, errString)
 
-	return errString == ""
+	return errString
 }
@@ -7,7 +7,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"sort"
 	"strings"
 	"time"
@@ -94,28 +93,11 @@ func trackServer(ServerID string, whenSeen time.Time) {
 // Update the list of seen devices
 func trackAllServers() {
 
-	// Loop over the file system, tracking all devices
-	files, err := os.ReadDir(SafecastDirectory() + TTServerStatusPath)
+	// Loop over the store, tracking all of them
+	entries, err := store.List(TTServerStatusPath)
 	if err == nil {
-
-		// Iterate over each of the values
-		for _, file := range files {
-
-			if !file.IsDir() {
-
-				// Extract device ID from filename
-				Str0 := file.Name()
-				serverID := strings.Split(Str0, ".")[0]
-
-				// Track the device
-				if serverID != "" {
-					info, err := file.Info()
-					if err == nil {
-						trackServer(serverID, info.ModTime())
-					}
-				}
-
-			}
+		for _, entry := range entries {
+			trackServer(entry.Key, entry.Modified)
 		}
 	}
 }
@@ -171,9 +153,9 @@ func sendSafecastServerSummaryToSlack(header string) {
 			if s != "" {
 				s += "\n"
 			}
-			s += fmt.Sprintf("<http://%s%s%s|%s>", TTServerHTTPAddress, TTServerTopicServerStatus, serverID, serverID)
+			s += fmt.Sprintf("<http://%s%s%s|%s>", CurrentServiceConfig().HTTPAddress, TTServerTopicServerStatus, serverID, serverID)
 			s += " "
-			s += fmt.Sprintf("<http://%s%s%s$%s|log>", TTServerHTTPAddress, TTServerTopicServerLog, ServerLogSecret(), ServerLogFilename(".log"))
+			s += fmt.Sprintf("<http://%s%s%s$%s|log>", CurrentServiceConfig().HTTPAddress, TTServerTopicServerLog, ServerLogSecret(), ServerLogFilename(".log"))
 			if summary != "" {
 				s += fmt.Sprintf(" %s", summary)
 			}
@@ -2,15 +2,21 @@
 // Use of this source code is governed by licenses granted by the
 // copyright holder including that found in the LICENSE file.
 
-// Retrieve the manufacturing ID for a given device ID
+// Retrieve device information from the Solarcast Tracker sheet, which is an optional
+// source of the information that is otherwise held in the device registry.  The sheet
+// is cached, indexed, and refreshed in the background, and the last good copy is kept
+// on disk so that lookups work across restarts and when the sheet can't be fetched.
 package main
 
 import (
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -23,174 +29,293 @@ type sheetInfo struct {
 	Dashboard        string `json:"dashboard,omitempty"`
 }
 
-var sheet []sheetInfo
+// The cached copy of the sheet, as persisted so that lookups work across restarts
+type sheetCache struct {
+	URL       string      `json:"url,omitempty"`
+	Retrieved time.Time   `json:"retrieved,omitempty"`
+	Rows      []sheetInfo `json:"rows,omitempty"`
+}
+
+// How long the sheet is used before being refreshed, and how long we wait after a failed refresh
+const sheetRefreshMinutes = 15
+
+// How long we wait for the sheet to be fetched, which must be bounded because lookups may wait for it
+const sheetFetchTimeout = 60 * time.Second
+
+// Statics, with the indexes only ever being replaced as a whole while holding the lock
+var sheetLock sync.RWMutex
+var sheetURL string
+var sheetByID = map[uint32]sheetInfo{}
+var sheetBySN = map[string]sheetInfo{}
+var sheetStale bool
+var sheetAttemptURL string
+var sheetLastAttempt time.Time
+var sheetLoadOnce sync.Once
+
+// Only one refresh is ever in progress
+var sheetRefreshLock sync.Mutex
 
-// Statics
-var fRetrieve bool
-var lastRetrieved time.Time
+// sheetCacheFilename is where the last good copy of the sheet is kept
+func sheetCacheFilename() string {
+	return SafecastDirectory() + TTDeviceSheetCachePath
+}
 
-// sheetInvalidateCache forces a reload
+// sheetInvalidateCache forces a reload, which completes before returning so that the caller sees the latest
 func sheetInvalidateCache() {
-	fRetrieve = true
+	config := CurrentServiceConfig()
+	if config.DeviceSheetDisabled {
+		return
+	}
+	sheetLoadOnce.Do(sheetLoadCache)
+	sheetLock.Lock()
+	sheetStale = true
+	sheetLock.Unlock()
+	sheetRefresh(config.DeviceSheetURL, true)
 }
 
-// sheetDeviceIDToSN converts a Safecast device ID to its manufacturing serial number
-func sheetDeviceIDToSN(DeviceID uint32) (sn string, infoStr string) {
-	info, err := sheetDeviceInfo(DeviceID, "")
-	if err != nil {
-		return "", ""
+// sheetDeviceInfo retrieves sheetInfo for a given device, from the copy that we've got, refreshing
+// it in the background if it is out of date.  We only wait for the sheet if we have no copy at all.
+func sheetDeviceInfo(DeviceID uint32, DeviceSN string) (info sheetInfo, err error) {
+
+	config := CurrentServiceConfig()
+	if config.DeviceSheetDisabled {
+		err = fmt.Errorf("tracker sheet is disabled")
+		return
 	}
-	sn = info.SN
-	if info.Custodian == "" && info.Location != "" {
-		infoStr = info.Location
-	} else if info.Custodian != "" && info.Location == "" {
-		infoStr = info.Custodian
-	} else {
-		infoStr = fmt.Sprintf("%s, %s", info.Custodian, info.Location)
+
+	sheetLoadOnce.Do(sheetLoadCache)
+
+	sheetLock.RLock()
+	haveCopy := sheetURL == config.DeviceSheetURL
+	refresh := sheetRefreshNeeded(config.DeviceSheetURL)
+	sheetLock.RUnlock()
+	if !haveCopy {
+		sheetRefresh(config.DeviceSheetURL, true)
+	} else if refresh {
+		url := config.DeviceSheetURL
+		trackedGo(func() { sheetRefresh(url, false) })
+	}
+
+	// Look up the device
+	sheetLock.RLock()
+	defer sheetLock.RUnlock()
+	found := false
+	if DeviceID != 0 {
+		info, found = sheetByID[DeviceID]
+	}
+	if !found && DeviceSN != "" {
+		info, found = sheetBySN[DeviceSN]
+	}
+	if !found {
+		err = fmt.Errorf("not found in Tracker Sheet")
 	}
 	return
+
 }
 
-// sheetDeviceInfo retrieves sheetInfo for a given device
-func sheetDeviceInfo(DeviceID uint32, DeviceSN string) (info sheetInfo, err error) {
+// sheetRefresh fetches the sheet and, if it could be fetched and parsed, replaces what we've got.  When
+// waiting, it waits for any refresh in progress; otherwise, it leaves it to that refresh.
+func sheetRefresh(url string, wait bool) {
 
-	// Cache for some time, for performance
-	if (time.Since(lastRetrieved) / time.Minute) > 15 {
-		fRetrieve = true
+	if wait {
+		sheetRefreshLock.Lock()
+	} else if !sheetRefreshLock.TryLock() {
+		return
 	}
+	defer sheetRefreshLock.Unlock()
 
-	// Fetch and parse the sheet
-	if fRetrieve {
+	// If someone else just refreshed it while we were waiting, there's nothing to do
+	sheetLock.Lock()
+	if !sheetRefreshNeeded(url) {
+		sheetLock.Unlock()
+		return
+	}
 
-		// Set retrieved date regardless of error, so we don't thrash trying to reload
-		fRetrieve = false
-		lastRetrieved = time.Now()
+	// Note the attempt regardless of error, so we don't thrash trying to reload
+	sheetStale = false
+	sheetAttemptURL = url
+	sheetLastAttempt = time.Now()
+	sheetLock.Unlock()
 
-		// Preset for parsing
-		sheet = nil
-		colSerialNumber := -1
-		colDeviceID := -1
-		colCustodian := -1
-		colCustodianContact := -1
-		colLocation := -1
-		colDashboard := -1
+	rows, err := sheetRead(url)
+	if err != nil {
+		fmt.Printf("%s *** Tracker sheet not refreshed, keeping last good copy: %s\n", LogTime(), err)
+		return
+	}
 
-		// Reload
-		rsp, err2 := http.Get(sheetsSolarcastTracker)
-		if err2 != nil {
-			err = fmt.Errorf("sheet: open: %s", err2)
-			return
-		}
-		defer rsp.Body.Close()
-		r := csv.NewReader(rsp.Body)
-		sheetRowsTotal := 0
-		sheetRowsRecognized := 0
-		for row := 0; ; row++ {
-			record, err2 := r.Read()
-			if err2 == io.EOF {
-				break
-			}
-			if err2 != nil {
-				err = fmt.Errorf("sheet: read: %s", err2)
-				return
-			}
-			sheetRowsTotal++
-			rec := sheetInfo{}
-			for col := 0; col < len(record); col++ {
-				val := record[col]
-				// Header row with field names
-				if row == 0 {
-					switch val {
-					case "Serial Number":
-						colSerialNumber = col
-					case "Device ID":
-						colDeviceID = col
-					case "Custodian":
-						colCustodian = col
-					case "Custodian Contact":
-						colCustodianContact = col
-					case "Location":
-						colLocation = col
-					case "Dashboard":
-						colDashboard = col
-					}
-				} else {
-					if colSerialNumber == -1 {
-						err = fmt.Errorf("no 'Serial Number' column")
-						return
-					}
-					if colDeviceID == -1 {
-						err = fmt.Errorf("no 'Device ID' column")
-						return
-					}
-					if colCustodian == -1 {
-						err = fmt.Errorf("no 'Custodian' column")
-						return
-					}
-					if colCustodianContact == -1 {
-						err = fmt.Errorf("no 'Custodian Contact' column")
-						return
-					}
-					if colLocation == -1 {
-						err = fmt.Errorf("no 'Location' column")
-						return
-					}
-					if col == colSerialNumber {
-						rec.SN = val
-					} else if col == colDeviceID {
-						u64, err2 := strconv.ParseUint(val, 10, 32)
-						if err2 == nil {
-							rec.DeviceID = uint32(u64)
-						}
-					} else if col == colCustodian {
-						rec.Custodian = val
-					} else if col == colDashboard {
-						rec.Dashboard = val
-					} else if col == colCustodianContact {
-						rec.CustodianContact = val
-					} else if col == colLocation {
-						rec.Location = val
-					}
-				}
-			}
+	cache := sheetCache{URL: url, Retrieved: time.Now().UTC(), Rows: rows}
+	sheetSetCache(cache)
 
-			if rec.DeviceID != 0 || rec.SN != "" {
-				sheet = append(sheet, rec)
-				sheetRowsRecognized++
-			}
+	// Save it so that it's there when we restart
+	contents, err := json.Marshal(cache)
+	if err == nil {
+		err = fileWriteAtomic(sheetCacheFilename(), contents)
+	}
+	if err != nil {
+		fmt.Printf("%s *** Tracker sheet not saved: %s\n", LogTime(), err)
+	}
 
-		}
+}
 
-		// Summary
-		fmt.Printf("\n%s *** Parsed Device Tracker CSV: recognized %d rows of %d total\n\n", LogTime(), sheetRowsRecognized, sheetRowsTotal)
+// sheetRefreshNeeded returns true if it's time to fetch the sheet again.  It must be called with the lock held.
+func sheetRefreshNeeded(url string) bool {
+	return sheetStale || sheetAttemptURL != url || time.Since(sheetLastAttempt) > sheetRefreshMinutes*time.Minute
+}
 
+// sheetLoadCache loads the copy of the sheet saved by the last refresh by this or any other instance
+func sheetLoadCache() {
+	contents, err := os.ReadFile(sheetCacheFilename())
+	if err != nil {
+		return
+	}
+	cache := sheetCache{}
+	err = json.Unmarshal(contents, &cache)
+	if err != nil {
+		fmt.Printf("*** Tracker sheet cache: %s\n", err)
+		return
 	}
+	sheetSetCache(cache)
+	sheetLock.Lock()
+	sheetAttemptURL = cache.URL
+	sheetLastAttempt = cache.Retrieved
+	sheetLock.Unlock()
+}
 
-	// Iterate over the rows to find the device
-	deviceIDFound := false
-	for _, r := range sheet {
-		if r.DeviceID == DeviceID || (DeviceSN != "" && r.SN == DeviceSN) {
-			deviceIDFound = true
-			info = r
-			break
+// sheetSetCache indexes a copy of the sheet and starts using it
+func sheetSetCache(cache sheetCache) {
+	byID := map[uint32]sheetInfo{}
+	bySN := map[string]sheetInfo{}
+	for _, r := range cache.Rows {
+		if r.DeviceID != 0 {
+			if _, present := byID[r.DeviceID]; !present {
+				byID[r.DeviceID] = r
+			}
+		}
+		if r.SN != "" {
+			if _, present := bySN[r.SN]; !present {
+				bySN[r.SN] = r
+			}
 		}
 	}
+	sheetLock.Lock()
+	sheetURL = cache.URL
+	sheetByID = byID
+	sheetBySN = bySN
+	sheetLock.Unlock()
+}
 
-	// Device not found
-	if !deviceIDFound {
+// sheetRead fetches and parses the tracker sheet
+func sheetRead(url string) (rows []sheetInfo, err error) {
 
-		// It was agreed with Rob t(see ttnode/src/io.c) that we would reserve the low 2^20 addresses
-		// for fixed allocation.  If we didn't find the device ID here and if it was in that range,
-		// use THAT as the serial number.
-		if DeviceID < 1048576 {
-			info.DeviceID = DeviceID
-		} else {
-			err = fmt.Errorf("not found in Tracker Sheet")
+	// Preset for parsing
+	colSerialNumber := -1
+	colDeviceID := -1
+	colCustodian := -1
+	colCustodianContact := -1
+	colLocation := -1
+	colDashboard := -1
+
+	// Reload
+	httpclient := &http.Client{
+		Timeout: sheetFetchTimeout,
+	}
+	rsp, err2 := httpclient.Get(url)
+	if err2 != nil {
+		err = fmt.Errorf("sheet: open: %s", err2)
+		return
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("sheet: open: %s", rsp.Status)
+		return
+	}
+	r := csv.NewReader(rsp.Body)
+	sheetRowsTotal := 0
+	sheetRowsRecognized := 0
+	for row := 0; ; row++ {
+		record, err2 := r.Read()
+		if err2 == io.EOF {
+			break
+		}
+		if err2 != nil {
+			err = fmt.Errorf("sheet: read: %s", err2)
 			return
 		}
+		sheetRowsTotal++
+		rec := sheetInfo{}
+		for col := 0; col < len(record); col++ {
+			val := record[col]
+			// Header row with field names
+			if row == 0 {
+				switch val {
+				case "Serial Number":
+					colSerialNumber = col
+				case "Device ID":
+					colDeviceID = col
+				case "Custodian":
+					colCustodian = col
+				case "Custodian Contact":
+					colCustodianContact = col
+				case "Location":
+					colLocation = col
+				case "Dashboard":
+					colDashboard = col
+				}
+			} else {
+				if colSerialNumber == -1 {
+					err = fmt.Errorf("no 'Serial Number' column")
+					return
+				}
+				if colDeviceID == -1 {
+					err = fmt.Errorf("no 'Device ID' column")
+					return
+				}
+				if colCustodian == -1 {
+					err = fmt.Errorf("no 'Custodian' column")
+					return
+				}
+				if colCustodianContact == -1 {
+					err = fmt.Errorf("no 'Custodian Contact' column")
+					return
+				}
+				if colLocation == -1 {
+					err = fmt.Errorf("no 'Location' column")
+					return
+				}
+				if col == colSerialNumber {
+					rec.SN = val
+				} else if col == colDeviceID {
+					u64, err2 := strconv.ParseUint(val, 10, 32)
+					if err2 == nil {
+						rec.DeviceID = uint32(u64)
+					}
+				} else if col == colCustodian {
+					rec.Custodian = val
+				} else if col == colDashboard {
+					rec.Dashboard = val
+				} else if col == colCustodianContact {
+					rec.CustodianContact = val
+				} else if col == colLocation {
+					rec.Location = val
+				}
+			}
+		}
 
+		if rec.DeviceID != 0 || rec.SN != "" {
+			rows = append(rows, rec)
+			sheetRowsRecognized++
+		}
+
+	}
+
+	// A sheet without any devices is surely not the sheet
+	if sheetRowsRecognized == 0 {
+		err = fmt.Errorf("sheet: no devices in %d rows", sheetRowsTotal)
+		return
 	}
 
-	// return the info
+	// Summary
+	fmt.Printf("\n%s *** Parsed Device Tracker CSV: recognized %d rows of %d total\n\n", LogTime(), sheetRowsRecognized, sheetRowsTotal)
+
 	return
 }
@@ -0,0 +1,118 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Coordinated shutdown.  Rather than exiting abruptly, we stop accepting new
+// work on our listeners, give the work already in flight (status and log
+// writes, uploads, and Slack messages) a chance to finish, and only then exit.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long we wait for in-flight work to finish before exiting anyway
+const shutdownDeadline = 30 * time.Second
+
+// Statics
+var shutdownLock sync.Mutex
+var shutdownStarted bool
+var shutdownServers []*http.Server
+var shutdownClosers []func()
+var shutdownPending int64
+
+// trackedGo runs work in the background, such that shutdown waits for it to complete
+func trackedGo(work func()) {
+	atomic.AddInt64(&shutdownPending, 1)
+	go func() {
+		defer atomic.AddInt64(&shutdownPending, -1)
+		work()
+	}()
+}
+
+// trackedWait waits for the work started by trackedGo to complete, returning false if the context ends first
+func trackedWait(ctx context.Context) bool {
+	for atomic.LoadInt64(&shutdownPending) > 0 {
+		if ctx.Err() != nil {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// shutdownAddServer registers an HTTP server to be stopped gracefully upon shutdown
+func shutdownAddServer(server *http.Server) {
+	shutdownLock.Lock()
+	shutdownServers = append(shutdownServers, server)
+	shutdownLock.Unlock()
+}
+
+// shutdownAddListener registers a function that stops a listener upon shutdown
+func shutdownAddListener(stop func()) {
+	shutdownLock.Lock()
+	shutdownClosers = append(shutdownClosers, stop)
+	shutdownLock.Unlock()
+}
+
+// ShuttingDown returns true once shutdown has begun, so that listeners know that errors are expected
+func ShuttingDown() bool {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	return shutdownStarted
+}
+
+// Shutdown stops our listeners, drains in-flight work, and exits.  Because HTTP servers
+// wait for active requests to complete, an HTTP handler must call this asynchronously.
+func Shutdown() {
+
+	shutdownLock.Lock()
+	if shutdownStarted {
+		shutdownLock.Unlock()
+		return
+	}
+	shutdownStarted = true
+	servers := shutdownServers
+	closers := shutdownClosers
+	shutdownLock.Unlock()
+
+	fmt.Printf("\n%s *** Shutting down\n", LogTime())
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownDeadline)
+	defer cancel()
+
+	// Stop accepting, waiting for HTTP requests in progress to complete
+	for _, stop := range closers {
+		stop()
+	}
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			err := server.Shutdown(ctx)
+			if err != nil {
+				fmt.Printf("*** HTTP shutdown %s: %s\n", server.Addr, err)
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	// Wait for work in progress, including messages to Slack
+	if !trackedWait(ctx) {
+		fmt.Printf("%s *** Exiting with %d tasks still pending\n", LogTime(), atomic.LoadInt64(&shutdownPending))
+	}
+
+	// Save what we've counted since we last wrote our status
+	WriteServerStatus()
+	store.Close()
+
+	fmt.Printf("%s *** Exiting\n", LogTime())
+	os.Exit(0)
+
+}
@@ -0,0 +1,454 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Upload destinations ("sinks").  Every measurement that we upload is fanned out
+// to each enabled sink.  The built-in sinks reproduce the destinations that we've
+// always uploaded to, and the "sinks" section of the service config may disable
+// them, override their settings by name, or add new ones.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	ttdata "github.com/Safecast/safecast-go"
+)
+
+// Sink types that may be specified in the service config
+const sinkTypeIngest = "ingest"
+const sinkTypeSolarcastV1 = "solarcast-v1"
+const sinkTypeBroker = "broker"
+const sinkTypeNotehub = "notehub"
+const sinkTypeWebhook = "webhook"
+
+// Default timeouts, by sink type
+const sinkIngestTimeout = 60 * time.Second
+const sinkSolarcastV1Timeout = 15 * time.Second
+const sinkNotehubTimeout = 10 * time.Second
+const sinkWebhookTimeout = 15 * time.Second
+
+// Returned by Send when the measurement turns out not to be one that the sink handles
+var errSinkSkipped = errors.New("sink: not handled")
+
+// Sink is a destination to which measurements are uploaded
+type Sink interface {
+	// Name uniquely identifies the sink in config and in status
+	Name() string
+	// Filter returns true if the measurement should be sent to this sink
+	Filter(sd ttdata.SafecastData) bool
+	// Send uploads the measurement, returning an error on failure, or errSinkSkipped if it isn't handled
+	Send(sd ttdata.SafecastData) error
+	// Health returns nil if the sink is able to accept uploads
+	Health() error
+}
+
+// SinkStatus is the per-sink portion of the server status
+type SinkStatus struct {
+	Type        string `json:"type,omitempty"`
+	Sent        uint32 `json:"sent,omitempty"`
+	Failed      uint32 `json:"failed,omitempty"`
+	Skipped     uint32 `json:"skipped,omitempty"`
+	Health      string `json:"health,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+	LastErrorAt string `json:"when_last_error,omitempty"`
+}
+
+// A registered sink, along with its counters
+type sinkEntry struct {
+	sink   Sink
+	status SinkStatus
+}
+
+// Statics
+var sinkLock sync.Mutex
+var sinks []*sinkEntry
+
+// Filtering common to all configurable sinks
+type sinkBase struct {
+	name  string
+	class *regexp.Regexp
+}
+
+func (s *sinkBase) Name() string {
+	return s.name
+}
+
+func (s *sinkBase) Filter(sd ttdata.SafecastData) bool {
+	if s.class != nil && !s.class.MatchString(sd.DeviceClass) {
+		return false
+	}
+	return true
+}
+
+func (s *sinkBase) Health() error {
+	return nil
+}
+
+// Safecast V2 ingest service, with failed uploads queued for retry
+type sinkIngest struct {
+	sinkBase
+	url     string
+	timeout time.Duration
+}
+
+func (s *sinkIngest) Send(sd ttdata.SafecastData) error {
+	errString := doUploadToSafecastIngest(sd, s.name, s.url, s.timeout)
+	if errString == "" {
+		return nil
+	}
+	err := uploadQueueAdd(s.name, sd, errString)
+	if err != nil {
+		return fmt.Errorf("%s: upload failed:%s, and can't be queued for retry: %s", s.name, errString, err)
+	}
+	return fmt.Errorf("%s: upload failed:%s, and was queued for retry", s.name, errString)
+}
+
+// Safecast V1 API, for "realtime" support of solarcast devices
+type sinkSolarcastV1 struct {
+	sinkBase
+	url     string
+	timeout time.Duration
+}
+
+func (s *sinkSolarcastV1) Send(sd ttdata.SafecastData) error {
+	return doSolarcastV1Uploads(sd, s.url, s.timeout)
+}
+
+// Those listening on the MQTT broker
+type sinkBroker struct {
+	sinkBase
+}
+
+func (s *sinkBroker) Filter(sd ttdata.SafecastData) bool {
+	// We don't publish anything without a captured date, because it confuses too many systems
+	if sd.CapturedAt == nil || *sd.CapturedAt == "" {
+		return false
+	}
+	return s.sinkBase.Filter(sd)
+}
+
+func (s *sinkBroker) Send(sd ttdata.SafecastData) error {
+	return brokerPublish(sd)
+}
+
+func (s *sinkBroker) Health() error {
+	if !brokerConnected {
+		return fmt.Errorf("broker: not connected")
+	}
+	return nil
+}
+
+// Notehub, for data that didn't actually come from notehub
+type sinkNotehub struct {
+	sinkBase
+	url     string
+	token   string
+	timeout time.Duration
+}
+
+func (s *sinkNotehub) Filter(sd ttdata.SafecastData) bool {
+	// Do NOT, under any circumstances, send Notehub-originated data back to Notehub
+	// else we will be in a circular loop of data that will never end.
+	if safecastDeviceUIDIsFromNotehub(sd.DeviceUID) || safecastArrivedFromNotehub(sd) {
+		return false
+	}
+	return s.sinkBase.Filter(sd)
+}
+
+func (s *sinkNotehub) Send(sd ttdata.SafecastData) error {
+	return doUploadToNotehub(sd, s.url, s.token, s.timeout)
+}
+
+func (s *sinkNotehub) Health() error {
+	if s.url == "" || s.token == "" {
+		return fmt.Errorf("notehub: not configured for upload")
+	}
+	return nil
+}
+
+// Any other service that accepts Safecast data as JSON
+type sinkWebhook struct {
+	sinkBase
+	url     string
+	headers map[string]string
+	timeout time.Duration
+}
+
+func (s *sinkWebhook) Send(sd ttdata.SafecastData) error {
+
+	scJSON, _ := json.Marshal(sd)
+	req, _ := http.NewRequest("POST", s.url, bytes.NewBuffer(scJSON))
+	req.Header.Set("User-Agent", "TTSERVE")
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	httpclient := &http.Client{
+		Timeout: s.timeout,
+	}
+	resp, err := httpclient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %s", s.name, ErrorString(err))
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s: %s", s.name, resp.Status)
+	}
+
+	return nil
+}
+
+func (s *sinkWebhook) Health() error {
+	if s.url == "" {
+		return fmt.Errorf("%s: no url configured", s.name)
+	}
+	return nil
+}
+
+// sinkDefaultConfigs returns the config of the destinations we upload to unless told otherwise
+func sinkDefaultConfigs(config TTServeConfig) (defaults []SinkConfig) {
+
+	for i, url := range config.IngestURLs {
+		name := sinkTypeIngest
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d", sinkTypeIngest, i+1)
+		}
+		defaults = append(defaults, SinkConfig{Name: name, Type: sinkTypeIngest, URL: url})
+	}
+
+	defaults = append(defaults, SinkConfig{Name: sinkTypeSolarcastV1, Type: sinkTypeSolarcastV1, URL: config.V1SolarcastUploadURL})
+	defaults = append(defaults, SinkConfig{Name: sinkTypeBroker, Type: sinkTypeBroker})
+	defaults = append(defaults, SinkConfig{Name: sinkTypeNotehub, Type: sinkTypeNotehub, URL: config.NotehubURL, Token: config.NotehubToken})
+
+	return
+
+}
+
+// sinkConfigs merges the configured sinks into the defaults, by name
+func sinkConfigs(config TTServeConfig) (configs []SinkConfig) {
+
+	configs = sinkDefaultConfigs(config)
+
+	for _, sc := range config.Sinks {
+		if sc.Name == "" {
+			sc.Name = sc.Type
+		}
+		found := false
+		for i := range configs {
+			if configs[i].Name != sc.Name {
+				continue
+			}
+			found = true
+			if sc.Type != "" {
+				configs[i].Type = sc.Type
+			}
+			if sc.URL != "" {
+				configs[i].URL = sc.URL
+			}
+			if sc.Token != "" {
+				configs[i].Token = sc.Token
+			}
+			if sc.Headers != nil {
+				configs[i].Headers = sc.Headers
+			}
+			if sc.TimeoutSecs != 0 {
+				configs[i].TimeoutSecs = sc.TimeoutSecs
+			}
+			if sc.Class != "" {
+				configs[i].Class = sc.Class
+			}
+			configs[i].Disabled = sc.Disabled
+			break
+		}
+		if !found {
+			configs = append(configs, sc)
+		}
+	}
+
+	return
+
+}
+
+// sinkNew instantiates a sink from its config
+func sinkNew(sc SinkConfig) (s Sink, err error) {
+
+	base := sinkBase{name: sc.Name}
+	if sc.Class != "" {
+		base.class, err = regexp.Compile(sc.Class)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: bad class filter: %s", sc.Name, err)
+		}
+	}
+
+	timeout := time.Duration(sc.TimeoutSecs) * time.Second
+
+	switch sc.Type {
+
+	case sinkTypeIngest:
+		if timeout == 0 {
+			timeout = sinkIngestTimeout
+		}
+		s = &sinkIngest{sinkBase: base, url: sc.URL, timeout: timeout}
+
+	case sinkTypeSolarcastV1:
+		if timeout == 0 {
+			timeout = sinkSolarcastV1Timeout
+		}
+		s = &sinkSolarcastV1{sinkBase: base, url: sc.URL, timeout: timeout}
+
+	case sinkTypeBroker:
+		s = &sinkBroker{sinkBase: base}
+
+	case sinkTypeNotehub:
+		if timeout == 0 {
+			timeout = sinkNotehubTimeout
+		}
+		s = &sinkNotehub{sinkBase: base, url: sc.URL, token: sc.Token, timeout: timeout}
+
+	case sinkTypeWebhook:
+		if timeout == 0 {
+			timeout = sinkWebhookTimeout
+		}
+		s = &sinkWebhook{sinkBase: base, url: sc.URL, headers: sc.Headers, timeout: timeout}
+
+	default:
+		err = fmt.Errorf("sink %s: unrecognized type '%s'", sc.Name, sc.Type)
+
+	}
+
+	return
+
+}
+
+// sinkInit (re)builds the registry of sinks from the current service config
+func sinkInit() {
+
+	var registry []*sinkEntry
+	for _, sc := range sinkConfigs(CurrentServiceConfig()) {
+		if sc.Disabled {
+			continue
+		}
+		s, err := sinkNew(sc)
+		if err != nil {
+			fmt.Printf("*** %s\n", err)
+			continue
+		}
+		entry := &sinkEntry{sink: s}
+		entry.status.Type = sc.Type
+		registry = append(registry, entry)
+	}
+
+	sinkLock.Lock()
+
+	// Carry the counters across for sinks that are still present
+	for _, entry := range registry {
+		for _, prev := range sinks {
+			if prev.sink.Name() == entry.sink.Name() {
+				entry.status.Sent = prev.status.Sent
+				entry.status.Failed = prev.status.Failed
+				entry.status.Skipped = prev.status.Skipped
+				entry.status.LastError = prev.status.LastError
+				entry.status.LastErrorAt = prev.status.LastErrorAt
+			}
+		}
+	}
+	sinks = registry
+
+	sinkLock.Unlock()
+
+	names := ""
+	for _, entry := range registry {
+		if names != "" {
+			names += ", "
+		}
+		names += entry.sink.Name()
+	}
+	fmt.Printf("Uploading to: %s\n", names)
+
+}
+
+// sinksEnabled returns the current set of sinks
+func sinksEnabled() []*sinkEntry {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	return sinks
+}
+
+// sinkSend uploads to a single sink, counting the outcome
+func sinkSend(entry *sinkEntry, sd ttdata.SafecastData) {
+
+	s := entry.sink
+	if !s.Filter(sd) || s.Health() != nil {
+		sinkLock.Lock()
+		entry.status.Skipped++
+		sinkLock.Unlock()
+		return
+	}
+
+	err := s.Send(sd)
+	if err == errSinkSkipped {
+		sinkLock.Lock()
+		entry.status.Skipped++
+		sinkLock.Unlock()
+		return
+	}
+	sinkCount(entry, err)
+
+}
+
+// sinkCount counts the outcome of sending to a sink
+func sinkCount(entry *sinkEntry, err error) {
+
+	sinkLock.Lock()
+	if err == nil {
+		entry.status.Sent++
+	} else {
+		entry.status.Failed++
+		entry.status.LastError = fmt.Sprintf("%s", err)
+		entry.status.LastErrorAt = NowInUTC()
+	}
+	sinkLock.Unlock()
+
+	if err != nil {
+		fmt.Printf("%s *** %s\n", LogTime(), err)
+	}
+
+}
+
+// sinkIngestNamed finds the enabled ingest sink of the given name, if there is one
+func sinkIngestNamed(name string) (*sinkEntry, *sinkIngest) {
+	for _, entry := range sinksEnabled() {
+		ingest, isIngest := entry.sink.(*sinkIngest)
+		if isIngest && ingest.name == name {
+			return entry, ingest
+		}
+	}
+	return nil, nil
+}
+
+// sinkStatus returns a copy of the status of all sinks, by name
+func sinkStatus() map[string]SinkStatus {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	if len(sinks) == 0 {
+		return nil
+	}
+	status := map[string]SinkStatus{}
+	for _, entry := range sinks {
+		st := entry.status
+		st.Health = "ok"
+		err := entry.sink.Health()
+		if err != nil {
+			st.Health = fmt.Sprintf("%s", err)
+		}
+		status[entry.sink.Name()] = st
+	}
+	return status
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	ttdata "github.com/Safecast/safecast-go"
+)
+
+// A sink whose Send returns what it is told to
+type sinkTest struct {
+	sinkBase
+	err error
+}
+
+func (s *sinkTest) Send(sd ttdata.SafecastData) error {
+	return s.err
+}
+
+func TestSinkSendCounts(t *testing.T) {
+	testServiceConfig(t, TTServeConfig{})
+	tests := []struct {
+		name    string
+		err     error
+		sent    uint32
+		failed  uint32
+		skipped uint32
+	}{
+		{"sent", nil, 1, 0, 0},
+		{"failed", fmt.Errorf("test: down"), 0, 1, 0},
+		{"skipped", errSinkSkipped, 0, 0, 1},
+	}
+	for _, test := range tests {
+		entry := &sinkEntry{sink: &sinkTest{sinkBase: sinkBase{name: "test"}, err: test.err}}
+		sinkSend(entry, ttdata.SafecastData{})
+		if entry.status.Sent != test.sent || entry.status.Failed != test.failed || entry.status.Skipped != test.skipped {
+			t.Errorf("%s: sent %d, failed %d, skipped %d", test.name, entry.status.Sent, entry.status.Failed, entry.status.Skipped)
+		}
+	}
+}
+
+func TestSinkSolarcastV1SkipsOthers(t *testing.T) {
+	testServiceConfig(t, TTServeConfig{})
+	entry := &sinkEntry{sink: &sinkSolarcastV1{sinkBase: sinkBase{name: sinkTypeSolarcastV1}, url: "http://127.0.0.1:1/", timeout: 1}}
+	sinkSend(entry, ttdata.SafecastData{DeviceUID: "note:dev:864475044204278"})
+	if entry.status.Skipped != 1 || entry.status.Sent != 0 {
+		t.Errorf("sent %d, skipped %d", entry.status.Sent, entry.status.Skipped)
+	}
+}
+
+func TestSinkIngestQueueResult(t *testing.T) {
+	queueTestSetup(t)
+	queueTestSink(t, http.StatusServiceUnavailable)
+	_, ingest := sinkIngestNamed("ingest")
+
+	err := ingest.Send(ttdata.SafecastData{})
+	if err == nil || !strings.HasSuffix(err.Error(), "was queued for retry") {
+		t.Errorf("queued: %v", err)
+	}
+
+	// When the queue can't be written, we must say so
+	os.RemoveAll(SafecastDirectory() + TTUploadQueuePath)
+	os.WriteFile(SafecastDirectory()+TTUploadQueuePath, nil, 0666)
+	err = ingest.Send(ttdata.SafecastData{})
+	if err == nil || !strings.Contains(err.Error(), "can't be queued for retry") {
+		t.Errorf("not queued: %v", err)
+	}
+}
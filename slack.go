@@ -12,7 +12,6 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 )
@@ -80,7 +79,7 @@ func inboundWebSlackHandler(rw http.ResponseWriter, req *http.Request) {
 
 	// Figure out who is sending this to us
 	SlackCommandSource = SlackOpsNone
-	str := strings.Split(ServiceConfig.SlackInboundTokens, ",")
+	str := strings.Split(CurrentServiceConfig().SlackInboundTokens, ",")
 	for source, tok := range str {
 		if tok == token {
 			SlackCommandSource = source
@@ -125,12 +124,10 @@ func inboundWebSlackHandler(rw http.ResponseWriter, req *http.Request) {
 	case "reboot-all":
 	case "restart-all":
 		sendToSafecastOps("Restarting all service instances.", SlackMsgReply)
-		time.Sleep(2 * time.Second)
 		ServerLog("*** RESTARTING because of Slack 'restart-all' command\n")
 		ControlFileTime(TTServerRestartAllControlFile, user)
 		sendToSafecastOps(fmt.Sprintf("** %s restarting **", TTServeInstanceID), SlackMsgUnsolicitedOps)
-		time.Sleep(3 * time.Second)
-		os.Exit(0)
+		go Shutdown()
 
 	case "reboot":
 	case "restart":
@@ -156,17 +153,18 @@ func inboundWebSlackHandler(rw http.ResponseWriter, req *http.Request) {
 // back to the callers.
 func sendToSafecastOps(msg string, destination int) {
 	if destination == SlackMsgUnsolicitedAll {
-		str := strings.Split(ServiceConfig.SlackOutboundUrls, ",")
+		str := strings.Split(CurrentServiceConfig().SlackOutboundUrls, ",")
 		for _, url := range str {
-			go sendToOpsViaSlack(msg, url)
+			trackedGo(func() { sendToOpsViaSlack(msg, url) })
 		}
 	} else if destination == SlackMsgUnsolicitedOps {
-		str := strings.Split(ServiceConfig.SlackOutboundUrls, ",")
-		go sendToOpsViaSlack(msg, str[SlackOpsSafecast])
+		str := strings.Split(CurrentServiceConfig().SlackOutboundUrls, ",")
+		trackedGo(func() { sendToOpsViaSlack(msg, str[SlackOpsSafecast]) })
 	} else {
 		if SlackCommandSource != SlackOpsNone {
-			str := strings.Split(ServiceConfig.SlackOutboundUrls, ",")
-			go sendToOpsViaSlack(msg, str[SlackCommandSource])
+			str := strings.Split(CurrentServiceConfig().SlackOutboundUrls, ",")
+			source := SlackCommandSource
+			trackedGo(func() { sendToOpsViaSlack(msg, str[source]) })
 		}
 	}
 }
@@ -191,7 +189,9 @@ func sendToOpsViaSlack(msg string, SlackOpsPostURL string) {
 	req.Header.Set("User-Agent", "TTSERVE")
 	req.Header.Set("Content-Type", "application/json")
 
-	httpclient := &http.Client{}
+	httpclient := &http.Client{
+		Timeout: 15 * time.Second,
+	}
 	resp, err := httpclient.Do(req)
 	if err != nil {
 		fmt.Printf("*** Error uploading %s to Slack  %s\n\n", msg, err)
@@ -199,7 +199,4 @@ func sendToOpsViaSlack(msg string, SlackOpsPostURL string) {
 		resp.Body.Close()
 	}
 
-	// Wait for it to complete, because we seem to lose it on os.Exit()
-	time.Sleep(5 * time.Second)
-
 }
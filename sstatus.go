@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -16,6 +17,12 @@ import (
 var lastCount TTServeCounts
 var firstSummary = true
 
+// Counts since restart, which unlike those in the status file are never reset
+var countSinceRestart TTServeCounts
+
+// Held while the counts are being moved into those since restart, so they're never seen half-moved
+var serverStatusLock sync.Mutex
+
 // ServerStatus is the data structure for the "Server Status" files
 type ServerStatus struct {
 	UpdatedAt string        `json:"when_updated,omitempty"`
@@ -24,63 +31,83 @@ type ServerStatus struct {
 
 // ReadServerStatus gets the current value
 func ReadServerStatus(serverID string) (isAvail bool, isReset bool, sv ServerStatus) {
-	valueEmpty := ServerStatus{}
-	valueEmpty.UpdatedAt = time.Now().UTC().Format("2006-01-02T15:04:05Z")
-	valueEmpty.Tts = stats
 
-	// Generate the filename, which we'll use twice
-	filename := SafecastDirectory() + TTServerStatusPath + "/" + serverID + ".json"
-
-	// If the file doesn't exist, don't even try
-	_, err := os.Stat(filename)
+	contents, err := store.Get(TTServerStatusPath, serverID)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// We did not reinitialize it - it's truly empty.
-			return true, false, valueEmpty
+			return true, false, serverStatusEmpty()
 		}
-		return false, true, valueEmpty
+		return false, true, serverStatusEmpty()
 	}
 
-	// Read the file
-	contents, errRead := os.ReadFile(filename)
-	if errRead != nil {
-		return false, true, valueEmpty
-	}
+	isReset, sv = serverStatusParse(serverID, contents)
+	return true, isReset, sv
+
+}
+
+// serverStatusEmpty gets the status of a server that has yet to write it
+func serverStatusEmpty() (value ServerStatus) {
+	value.UpdatedAt = time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	value.Tts = stats
+	return
+}
 
-	// Unmarshal
-	valueToRead := ServerStatus{}
-	err = json.Unmarshal(contents, &valueToRead)
+// serverStatusParse unmarshals a server status, which is reset to empty if there is none or it is corrupt
+func serverStatusParse(serverID string, contents []byte) (isReset bool, value ServerStatus) {
+	if contents == nil {
+		return false, serverStatusEmpty()
+	}
+	err := json.Unmarshal(contents, &value)
 	if err != nil {
 		// Malformed JSON
-		fmt.Printf("*** %s appears to be corrupt - erasing ***\n", filename)
-		return true, true, valueEmpty
+		fmt.Printf("*** status of %s appears to be corrupt - erasing ***\n", serverID)
+		return true, serverStatusEmpty()
 	}
-
-	// Done
-	return true, false, valueToRead
+	return false, value
 }
 
-// WriteServerStatus saves the current value into the file
+// WriteServerStatus saves the current value into the store
 func WriteServerStatus() {
 
-	// Read the current value
-	isAvail, _, value := ReadServerStatus(TTServeInstanceID)
-	if !isAvail {
-		return
+	err := store.Update(TTServerStatusPath, TTServeInstanceID, func(contents []byte) ([]byte, error) {
+		_, value := serverStatusParse(TTServeInstanceID, contents)
+		serverStatusUpdate(&value)
+		return json.MarshalIndent(value, "", "    ")
+	})
+	if err != nil {
+		fmt.Printf("*** Unable to write status of %s: %s\n", TTServeInstanceID, err)
 	}
 
+}
+
+// serverStatusUpdate moves what we've counted since the last time into the status
+func serverStatusUpdate(value *ServerStatus) {
+
 	// Update the modification date
 	value.UpdatedAt = time.Now().UTC().Format("2006-01-02T15:04:05Z")
 
+	serverStatusLock.Lock()
+	defer serverStatusLock.Unlock()
+
 	// By default, copy all Tts fields
 	prevCount := value.Tts.Count
 	value.Tts = stats
+	value.Tts.UploadQueue = uploadQueueDepth()
+	value.Tts.Sinks = sinkStatus()
+	value.Tts.Uploads = metricsSnapshot()
+	value.Tts.Banned = abuseBanned()
+
+	// Before they're reset, accumulate the counts since restart
+	countSinceRestart = addCounts(countSinceRestart, stats.Count)
 
 	// For certain fields, be additive to the prior values
 	value.Tts.Count.Restarts += prevCount.Restarts
 	stats.Count.Restarts = 0
 	value.Tts.Count.UDP += prevCount.UDP
 	stats.Count.UDP = 0
+	value.Tts.Count.TCP += prevCount.TCP
+	stats.Count.TCP = 0
 	value.Tts.Count.HTTP += prevCount.HTTP
 	stats.Count.HTTP = 0
 	value.Tts.Count.HTTPSlack += prevCount.HTTPSlack
@@ -101,24 +128,44 @@ func WriteServerStatus() {
 	stats.Count.HTTPTTN = 0
 	value.Tts.Count.MQTTTTN += prevCount.MQTTTTN
 	stats.Count.MQTTTTN = 0
+	value.Tts.Count.HTTPNote += prevCount.HTTPNote
+	stats.Count.HTTPNote = 0
+	value.Tts.Count.HTTPNoteRejected += prevCount.HTTPNoteRejected
+	stats.Count.HTTPNoteRejected = 0
+	value.Tts.Count.DeviceUnsigned += prevCount.DeviceUnsigned
+	stats.Count.DeviceUnsigned = 0
+	value.Tts.Count.DeviceBadSigned += prevCount.DeviceBadSigned
+	stats.Count.DeviceBadSigned = 0
+	value.Tts.Count.DeviceReplayed += prevCount.DeviceReplayed
+	stats.Count.DeviceReplayed = 0
+	value.Tts.Count.Refused += prevCount.Refused
+	stats.Count.Refused = 0
+	value.Tts.Count.RateLimited += prevCount.RateLimited
+	stats.Count.RateLimited = 0
+	value.Tts.Count.Malformed += prevCount.Malformed
+	stats.Count.Malformed = 0
+	value.Tts.Count.Bans += prevCount.Bans
+	stats.Count.Bans = 0
 
-	// Write it to the file
-	filename := SafecastDirectory() + TTServerStatusPath + "/" + TTServeInstanceID + ".json"
-	valueJSON, err := json.MarshalIndent(value, "", "    ")
-	if err != nil {
-		fmt.Printf("*** Error marshaling for '%s': \n%v\n", filename, value)
-		return
-	}
+}
 
-	// Write the value
-	fd, err := os.OpenFile(filename, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
-	if err != nil {
-		fmt.Printf("*** Unable to write %s: %v\n", filename, err)
-		return
-	}
-	fd.WriteString(string(valueJSON))
-	fd.Close()
+// currentCountsSinceRestart gets the counts since restart, including those not yet written to the status
+func currentCountsSinceRestart() TTServeCounts {
+	serverStatusLock.Lock()
+	defer serverStatusLock.Unlock()
+	return addCounts(countSinceRestart, stats.Count)
+}
 
+// CurrentServerStatus gets the live status of this instance, including the counts
+// that have accumulated since the last time they were written
+func CurrentServerStatus() (value ServerStatus) {
+	value.UpdatedAt = time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	value.Tts = stats
+	value.Tts.UploadQueue = uploadQueueDepth()
+	value.Tts.Sinks = sinkStatus()
+	value.Tts.Uploads = metricsSnapshot()
+	value.Tts.Banned = abuseBanned()
+	return
 }
 
 // SummarizeStatsDelta gets a running total of server stats
@@ -148,6 +195,7 @@ func SummarizeStatsDelta() string {
 	var diff = TTServeCounts{}
 	diff.Restarts = thisCount.Restarts - prevCount.Restarts
 	diff.UDP = thisCount.UDP - prevCount.UDP
+	diff.TCP = thisCount.TCP - prevCount.TCP
 	diff.HTTP = thisCount.HTTP - prevCount.HTTP
 	diff.HTTPSlack = thisCount.HTTPSlack - prevCount.HTTPSlack
 	diff.HTTPGithub = thisCount.HTTPGithub - prevCount.HTTPGithub
@@ -158,6 +206,15 @@ func SummarizeStatsDelta() string {
 	diff.HTTPRedirect = thisCount.HTTPRedirect - prevCount.HTTPRedirect
 	diff.HTTPTTN = thisCount.HTTPTTN - prevCount.HTTPTTN
 	diff.MQTTTTN = thisCount.MQTTTTN - prevCount.MQTTTTN
+	diff.HTTPNote = thisCount.HTTPNote - prevCount.HTTPNote
+	diff.HTTPNoteRejected = thisCount.HTTPNoteRejected - prevCount.HTTPNoteRejected
+	diff.DeviceUnsigned = thisCount.DeviceUnsigned - prevCount.DeviceUnsigned
+	diff.DeviceBadSigned = thisCount.DeviceBadSigned - prevCount.DeviceBadSigned
+	diff.DeviceReplayed = thisCount.DeviceReplayed - prevCount.DeviceReplayed
+	diff.Refused = thisCount.Refused - prevCount.Refused
+	diff.RateLimited = thisCount.RateLimited - prevCount.RateLimited
+	diff.Malformed = thisCount.Malformed - prevCount.Malformed
+	diff.Bans = thisCount.Bans - prevCount.Bans
 
 	// Return the jsonified summary
 	statsdata, err := json.Marshal(&diff)
@@ -169,6 +226,33 @@ func SummarizeStatsDelta() string {
 
 }
 
+// addCounts returns the sum of two sets of counts
+func addCounts(a TTServeCounts, b TTServeCounts) (sum TTServeCounts) {
+	sum.Restarts = a.Restarts + b.Restarts
+	sum.UDP = a.UDP + b.UDP
+	sum.TCP = a.TCP + b.TCP
+	sum.HTTP = a.HTTP + b.HTTP
+	sum.HTTPSlack = a.HTTPSlack + b.HTTPSlack
+	sum.HTTPGithub = a.HTTPGithub + b.HTTPGithub
+	sum.HTTPGUpdate = a.HTTPGUpdate + b.HTTPGUpdate
+	sum.HTTPDevice = a.HTTPDevice + b.HTTPDevice
+	sum.HTTPGateway = a.HTTPGateway + b.HTTPGateway
+	sum.HTTPRelay = a.HTTPRelay + b.HTTPRelay
+	sum.HTTPRedirect = a.HTTPRedirect + b.HTTPRedirect
+	sum.HTTPTTN = a.HTTPTTN + b.HTTPTTN
+	sum.MQTTTTN = a.MQTTTTN + b.MQTTTTN
+	sum.HTTPNote = a.HTTPNote + b.HTTPNote
+	sum.HTTPNoteRejected = a.HTTPNoteRejected + b.HTTPNoteRejected
+	sum.DeviceUnsigned = a.DeviceUnsigned + b.DeviceUnsigned
+	sum.DeviceBadSigned = a.DeviceBadSigned + b.DeviceBadSigned
+	sum.DeviceReplayed = a.DeviceReplayed + b.DeviceReplayed
+	sum.Refused = a.Refused + b.Refused
+	sum.RateLimited = a.RateLimited + b.RateLimited
+	sum.Malformed = a.Malformed + b.Malformed
+	sum.Bans = a.Bans + b.Bans
+	return
+}
+
 // GetServerSummary gets a summary of a server's status
 func GetServerSummary(ServerID string, bol string) string {
 
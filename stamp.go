@@ -12,7 +12,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 	"sync"
 
 	ttproto "github.com/Safecast/ttproto/golang"
@@ -50,11 +49,9 @@ type cachedDevice struct {
 var cacheLock sync.RWMutex
 var cachedDevices []cachedDevice
 
-// Construct the path of a command file
-func stpFilename(DeviceID uint32) string {
-	directory := SafecastDirectory()
-	file := directory + TTDeviceStampPath + "/" + fmt.Sprintf("%d", DeviceID) + ".json"
-	return file
+// Construct the key of a device's stamp in the store
+func stpKey(DeviceID uint32) string {
+	return fmt.Sprintf("%d", DeviceID)
 }
 
 // Set or apply the stamp
@@ -157,16 +154,11 @@ func stpSet(message *ttproto.Telecast, DeviceID uint32, CacheEntry int) (isValid
 
 				sfJSON, _ := json.Marshal(sf)
 
-				file := stpFilename(DeviceID)
-				fd, err := os.OpenFile(file, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+				err := store.Put(TTDeviceStampPath, stpKey(DeviceID), sfJSON)
 				if err != nil {
-					fmt.Printf("error creating file %s: %s\n", file, err)
+					fmt.Printf("error saving stamp for %d: %s\n", DeviceID, err)
 				} else {
 
-					// Write and close the file
-					fd.WriteString(string(sfJSON))
-					fd.Close()
-
 					// Write the cache entry
 					cachedDevices[CacheEntry].cache = *sf
 					cachedDevices[CacheEntry].valid = true
@@ -196,8 +188,8 @@ func stpApply(message *ttproto.Telecast, DeviceID uint32, CacheEntry int) (isVal
 	// If there's no valid cache entry, or if the cache entry is wrong, refresh the cache
 	if !cachedDevices[CacheEntry].valid || (cachedDevices[CacheEntry].valid && cachedDevices[CacheEntry].cache.Stamp != message.GetStamp()) {
 
-		// Read the file and delete it
-		file, err := os.ReadFile(stpFilename(DeviceID))
+		// Read the stamp
+		file, err := store.Get(TTDeviceStampPath, stpKey(DeviceID))
 		if err != nil {
 			cachedDevices[CacheEntry].valid = false
 		} else {
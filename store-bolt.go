@@ -0,0 +1,188 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// The store kept in an embedded bbolt database, for deployments that don't have a file
+// system shared among instances.  The database may only be opened by one process at a
+// time, and so such a deployment has a single instance.  Each kind of document is a
+// bucket, and each document a bucket within it holding when it was modified along with
+// its contents, in the chunks in which they were appended.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// How long we'll wait for another process to close the database
+const storeBoltTimeout = 10 * time.Second
+
+// The key, within a document's bucket, of when it was modified.  The keys of its chunks are
+// sequence numbers, which are longer.
+var storeBoltModified = []byte("m")
+
+type storeBolt struct {
+	db *bolt.DB
+}
+
+// storeBoltNew opens, creating if necessary, the database at the path
+func storeBoltNew(path string) (*storeBolt, error) {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: storeBoltTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &storeBolt{db: db}, nil
+}
+
+func storeBoltKind(kind string) []byte {
+	return []byte(strings.TrimPrefix(kind, "/"))
+}
+
+// storeBoltContents gets the contents of a document's bucket
+func storeBoltContents(doc *bolt.Bucket) []byte {
+	var contents []byte
+	c := doc.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if len(k) == 8 {
+			contents = append(contents, v...)
+		}
+	}
+	if contents == nil {
+		contents = []byte{}
+	}
+	return contents
+}
+
+// storeBoltWrite appends a chunk to a document's bucket, creating it if necessary and
+// emptying it first if it is to be replaced
+func storeBoltWrite(tx *bolt.Tx, kind string, key string, contents []byte, replace bool) error {
+	bucket, err := tx.CreateBucketIfNotExists(storeBoltKind(kind))
+	if err != nil {
+		return err
+	}
+	if replace && bucket.Bucket([]byte(key)) != nil {
+		err = bucket.DeleteBucket([]byte(key))
+		if err != nil {
+			return err
+		}
+	}
+	doc, err := bucket.CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return err
+	}
+	seq, err := doc.NextSequence()
+	if err != nil {
+		return err
+	}
+	chunkKey := make([]byte, 8)
+	binary.BigEndian.PutUint64(chunkKey, seq)
+	err = doc.Put(chunkKey, contents)
+	if err != nil {
+		return err
+	}
+	modified := make([]byte, 8)
+	binary.BigEndian.PutUint64(modified, uint64(time.Now().UnixNano()))
+	return doc.Put(storeBoltModified, modified)
+}
+
+// storeBoltDocument gets a document's bucket, if it exists
+func storeBoltDocument(tx *bolt.Tx, kind string, key string) *bolt.Bucket {
+	bucket := tx.Bucket(storeBoltKind(kind))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Bucket([]byte(key))
+}
+
+func (s *storeBolt) Name() string {
+	return storeTypeBolt
+}
+
+func (s *storeBolt) Get(kind string, key string) (contents []byte, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		doc := storeBoltDocument(tx, kind, key)
+		if doc == nil {
+			return storeNotFound(kind, key)
+		}
+		contents = storeBoltContents(doc)
+		return nil
+	})
+	return
+}
+
+func (s *storeBolt) Put(kind string, key string, contents []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return storeBoltWrite(tx, kind, key, contents, true)
+	})
+}
+
+func (s *storeBolt) Update(kind string, key string, update func(contents []byte) ([]byte, error)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var contents []byte
+		doc := storeBoltDocument(tx, kind, key)
+		if doc != nil {
+			contents = storeBoltContents(doc)
+		}
+		contents, err := update(contents)
+		if err != nil {
+			return err
+		}
+		return storeBoltWrite(tx, kind, key, contents, true)
+	})
+}
+
+func (s *storeBolt) Append(kind string, key string, contents []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return storeBoltWrite(tx, kind, key, contents, false)
+	})
+}
+
+func (s *storeBolt) Open(kind string, key string) (io.ReadCloser, error) {
+	contents, err := s.Get(kind, key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(contents)), nil
+}
+
+func (s *storeBolt) Delete(kind string, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(storeBoltKind(kind))
+		if bucket == nil || bucket.Bucket([]byte(key)) == nil {
+			return storeNotFound(kind, key)
+		}
+		return bucket.DeleteBucket([]byte(key))
+	})
+}
+
+func (s *storeBolt) List(kind string) (entries []StoreEntry, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(storeBoltKind(kind))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v != nil {
+				continue
+			}
+			entry := StoreEntry{Key: string(k)}
+			modified := bucket.Bucket(k).Get(storeBoltModified)
+			if len(modified) == 8 {
+				entry.Modified = time.Unix(0, int64(binary.BigEndian.Uint64(modified)))
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return
+}
+
+func (s *storeBolt) Close() error {
+	return s.db.Close()
+}
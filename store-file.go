@@ -0,0 +1,142 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// The store of files in the data folder, shared among instances, in which each kind of
+// document is a folder and each document is a JSON file named by its key.
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+)
+
+// The extension of every document's file
+const storeFileExtension = ".json"
+
+type storeFile struct{}
+
+// storeFileNew creates a store of files
+func storeFileNew() *storeFile {
+	return &storeFile{}
+}
+
+func (s *storeFile) filename(kind string, key string) string {
+	return SafecastDirectory() + kind + "/" + key + storeFileExtension
+}
+
+// folder makes sure that the folder of a kind of document is there, so that the first can be written
+func (s *storeFile) folder(kind string) error {
+	return os.MkdirAll(SafecastDirectory()+kind, 0777)
+}
+
+func (s *storeFile) Name() string {
+	return storeTypeFile
+}
+
+func (s *storeFile) Get(kind string, key string) ([]byte, error) {
+	return os.ReadFile(s.filename(kind, key))
+}
+
+func (s *storeFile) Put(kind string, key string, contents []byte) error {
+	err := s.folder(kind)
+	if err != nil {
+		return err
+	}
+	return fileWriteAtomic(s.filename(kind, key), contents)
+}
+
+func (s *storeFile) Update(kind string, key string, update func(contents []byte) ([]byte, error)) error {
+
+	err := s.folder(kind)
+	if err != nil {
+		return err
+	}
+	filename := s.filename(kind, key)
+	lock, err := fileLock(filename)
+	if err != nil {
+		return err
+	}
+	defer fileUnlock(lock)
+
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		contents = nil
+	}
+
+	contents, err = update(contents)
+	if err != nil {
+		return err
+	}
+
+	return fileWriteAtomic(filename, contents)
+
+}
+
+func (s *storeFile) Append(kind string, key string, contents []byte) error {
+
+	// Appends take the lock so that they are never interleaved, and so that none are
+	// lost while the file is being replaced by Update
+	err := s.folder(kind)
+	if err != nil {
+		return err
+	}
+	filename := s.filename(kind, key)
+	lock, err := fileLock(filename)
+	if err != nil {
+		return err
+	}
+	defer fileUnlock(lock)
+
+	fd, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(contents)
+	err2 := fd.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+
+}
+
+func (s *storeFile) Open(kind string, key string) (io.ReadCloser, error) {
+	return os.Open(s.filename(kind, key))
+}
+
+func (s *storeFile) Delete(kind string, key string) error {
+	return os.Remove(s.filename(kind, key))
+}
+
+func (s *storeFile) List(kind string) (entries []StoreEntry, err error) {
+	// There are none of a kind whose folder hasn't yet been created
+	files, err := os.ReadDir(SafecastDirectory() + kind)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return
+	}
+	for _, file := range files {
+		// Skip folders, and the lock and temp files of those being updated
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, storeFileExtension) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, StoreEntry{Key: strings.TrimSuffix(name, storeFileExtension), Modified: info.ModTime()})
+	}
+	return entries, nil
+}
+
+func (s *storeFile) Close() error {
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// The store kept in memory, which is forgotten upon restart and isn't shared among
+// instances, for testing and for trying things out.
+package main
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+type storeMemoryDocument struct {
+	contents []byte
+	modified time.Time
+}
+
+type storeMemory struct {
+	lock  sync.Mutex
+	kinds map[string]map[string]*storeMemoryDocument
+}
+
+// storeMemoryNew creates an empty store in memory
+func storeMemoryNew() *storeMemory {
+	return &storeMemory{kinds: map[string]map[string]*storeMemoryDocument{}}
+}
+
+// get gets a document, which must be called with the lock held
+func (s *storeMemory) get(kind string, key string) (doc *storeMemoryDocument, present bool) {
+	doc, present = s.kinds[kind][key]
+	return
+}
+
+// put sets a document, which must be called with the lock held
+func (s *storeMemory) put(kind string, key string, contents []byte) {
+	docs, present := s.kinds[kind]
+	if !present {
+		docs = map[string]*storeMemoryDocument{}
+		s.kinds[kind] = docs
+	}
+	docs[key] = &storeMemoryDocument{contents: append([]byte{}, contents...), modified: time.Now()}
+}
+
+func (s *storeMemory) Name() string {
+	return storeTypeMemory
+}
+
+func (s *storeMemory) Get(kind string, key string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	doc, present := s.get(kind, key)
+	if !present {
+		return nil, storeNotFound(kind, key)
+	}
+	return append([]byte{}, doc.contents...), nil
+}
+
+func (s *storeMemory) Put(kind string, key string, contents []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.put(kind, key, contents)
+	return nil
+}
+
+func (s *storeMemory) Update(kind string, key string, update func(contents []byte) ([]byte, error)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var contents []byte
+	doc, present := s.get(kind, key)
+	if present {
+		contents = append([]byte{}, doc.contents...)
+	}
+	contents, err := update(contents)
+	if err != nil {
+		return err
+	}
+	s.put(kind, key, contents)
+	return nil
+}
+
+func (s *storeMemory) Append(kind string, key string, contents []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	doc, present := s.get(kind, key)
+	if !present {
+		s.put(kind, key, contents)
+		return nil
+	}
+
+	// Append in place rather than copying what is there, which nobody else can see because
+	// documents are only ever given out as copies
+	doc.contents = append(doc.contents, contents...)
+	doc.modified = time.Now()
+	return nil
+}
+
+func (s *storeMemory) Open(kind string, key string) (io.ReadCloser, error) {
+	contents, err := s.Get(kind, key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(contents)), nil
+}
+
+func (s *storeMemory) Delete(kind string, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, present := s.get(kind, key)
+	if !present {
+		return storeNotFound(kind, key)
+	}
+	delete(s.kinds[kind], key)
+	return nil
+}
+
+func (s *storeMemory) List(kind string) (entries []StoreEntry, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, doc := range s.kinds[kind] {
+		entries = append(entries, StoreEntry{Key: key, Modified: doc.modified})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return
+}
+
+func (s *storeMemory) Close() error {
+	return nil
+}
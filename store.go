@@ -0,0 +1,101 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Storage of the status of devices, gateways, and servers, the stamps of devices, and
+// the logs of devices.  By default these are files in folders of the file system shared
+// among instances, but they may instead be kept in an embedded database by a deployment
+// that has no shared file system, or in memory.  Documents are identified by their kind,
+// which is the name of the folder in which they've always been kept, and by their key.
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Store types that may be specified in the service config
+const storeTypeFile = "file"
+const storeTypeBolt = "bolt"
+const storeTypeMemory = "memory"
+
+// The embedded database, in the data folder unless otherwise configured
+const storeBoltFilename = "/ttserve.db"
+
+// Store is where documents are kept
+type Store interface {
+	// Name identifies the type of store
+	Name() string
+	// Get gets the contents of a document, returning an error satisfying os.IsNotExist if there is none
+	Get(kind string, key string) (contents []byte, err error)
+	// Put replaces the contents of a document, such that readers see either the old or new contents
+	Put(kind string, key string, contents []byte) error
+	// Update replaces the contents of a document with what is returned by the update function, which
+	// is given the current contents, or nil if there is no document.  No one else, in this instance
+	// or another, may change the document in between.
+	Update(kind string, key string, update func(contents []byte) ([]byte, error)) error
+	// Append adds to the end of a document, such as a log, creating it if necessary
+	Append(kind string, key string, contents []byte) error
+	// Open opens a document for reading, which may be larger than is sensible to Get
+	Open(kind string, key string) (io.ReadCloser, error)
+	// Delete removes a document
+	Delete(kind string, key string) error
+	// List lists the documents of a kind, ordered by key
+	List(kind string) ([]StoreEntry, error)
+	// Close releases the store
+	Close() error
+}
+
+// StoreEntry describes a document in the store
+type StoreEntry struct {
+	Key      string
+	Modified time.Time
+}
+
+// The store in use
+var store Store = storeFileNew()
+
+// storeNotFound is the error returned when there is no such document
+func storeNotFound(kind string, key string) error {
+	return &fs.PathError{Op: "open", Path: kind + "/" + key, Err: fs.ErrNotExist}
+}
+
+// storeValidateConfig makes sure that the configured store is one that we know about
+func storeValidateConfig(config TTServeConfig) error {
+	switch config.Store {
+	case "", storeTypeFile, storeTypeBolt, storeTypeMemory:
+		return nil
+	}
+	return fmt.Errorf("unknown store type '%s'", config.Store)
+}
+
+// storeNew creates the configured store
+func storeNew(config TTServeConfig) (Store, error) {
+	switch config.Store {
+	case "", storeTypeFile:
+		return storeFileNew(), nil
+	case storeTypeBolt:
+		path := config.StorePath
+		if path == "" {
+			path = SafecastDirectory() + storeBoltFilename
+		}
+		return storeBoltNew(path)
+	case storeTypeMemory:
+		return storeMemoryNew(), nil
+	}
+	return nil, fmt.Errorf("unknown store type '%s'", config.Store)
+}
+
+// storeInit opens the configured store, which can't be changed without restarting
+func storeInit() {
+	s, err := storeNew(CurrentServiceConfig())
+	if err != nil {
+		fmt.Printf("Can't open store: %s\n", err)
+		os.Exit(0)
+	}
+	store = s
+	fmt.Printf("Using %s store\n", store.Name())
+}
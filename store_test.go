@@ -0,0 +1,252 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// storeTestStores creates an empty store of each type
+func storeTestStores(t *testing.T) map[string]Store {
+	t.Helper()
+	testDataDirectory(t)
+	bolt, err := storeBoltNew(t.TempDir() + storeBoltFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+	return map[string]Store{
+		storeTypeFile:   storeFileNew(),
+		storeTypeBolt:   bolt,
+		storeTypeMemory: storeMemoryNew(),
+	}
+}
+
+// storeTestGet gets a document that must be there
+func storeTestGet(t *testing.T, s Store, kind string, key string) string {
+	t.Helper()
+	contents, err := s.Get(kind, key)
+	if err != nil {
+		t.Fatalf("get %s: %s", key, err)
+	}
+	return string(contents)
+}
+
+// storeTestKeys lists the keys of the documents of a kind
+func storeTestKeys(t *testing.T, s Store, kind string) []string {
+	t.Helper()
+	entries, err := s.List(kind)
+	if err != nil {
+		t.Fatalf("list %s: %s", kind, err)
+	}
+	keys := []string{}
+	for _, entry := range entries {
+		if entry.Modified.IsZero() {
+			t.Errorf("list %s: %s has no modification time", kind, entry.Key)
+		}
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+// Every type of store behaves the same way
+func TestStoreConformance(t *testing.T) {
+	const kind = TTDeviceStatusPath
+	const other = TTGatewayStatusPath
+	const key = "2024-05$safecast-7"
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Store)
+	}{
+
+		{"get of nothing", func(t *testing.T, s Store) {
+			_, err := s.Get(kind, key)
+			if !os.IsNotExist(err) {
+				t.Errorf("got %v, want not found", err)
+			}
+		}},
+
+		{"put and get", func(t *testing.T, s Store) {
+			err := s.Put(kind, key, []byte("one"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := storeTestGet(t, s, kind, key); got != "one" {
+				t.Errorf("got %q", got)
+			}
+			err = s.Put(kind, key, []byte("two"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := storeTestGet(t, s, kind, key); got != "two" {
+				t.Errorf("replaced: got %q", got)
+			}
+			err = s.Put(kind, key, []byte{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := storeTestGet(t, s, kind, key); got != "" {
+				t.Errorf("emptied: got %q", got)
+			}
+		}},
+
+		{"get gets a copy", func(t *testing.T, s Store) {
+			contents := []byte("one")
+			s.Put(kind, key, contents)
+			contents[0] = 'x'
+			got, _ := s.Get(kind, key)
+			got[0] = 'y'
+			if got := storeTestGet(t, s, kind, key); got != "one" {
+				t.Errorf("got %q", got)
+			}
+		}},
+
+		{"kinds are separate", func(t *testing.T, s Store) {
+			s.Put(kind, key, []byte("one"))
+			s.Put(other, key, []byte("two"))
+			if got := storeTestGet(t, s, kind, key); got != "one" {
+				t.Errorf("got %q", got)
+			}
+			if got := storeTestGet(t, s, other, key); got != "two" {
+				t.Errorf("other kind: got %q", got)
+			}
+		}},
+
+		{"update", func(t *testing.T, s Store) {
+			var given []byte
+			given = []byte("not called")
+			err := s.Update(kind, key, func(contents []byte) ([]byte, error) {
+				given = contents
+				return []byte("one"), nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if given != nil {
+				t.Errorf("given %q for a new document, want nil", given)
+			}
+			err = s.Update(kind, key, func(contents []byte) ([]byte, error) {
+				return append(contents, " two"...), nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := storeTestGet(t, s, kind, key); got != "one two" {
+				t.Errorf("got %q", got)
+			}
+			err = s.Update(kind, key, func(contents []byte) ([]byte, error) {
+				return []byte("three"), fmt.Errorf("refused")
+			})
+			if err == nil || err.Error() != "refused" {
+				t.Errorf("got %v, want the update's error", err)
+			}
+			if got := storeTestGet(t, s, kind, key); got != "one two" {
+				t.Errorf("changed by a failed update: got %q", got)
+			}
+		}},
+
+		{"append", func(t *testing.T, s Store) {
+			for _, line := range []string{"one\n", "two\n", "three\n"} {
+				err := s.Append(kind, key, []byte(line))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := storeTestGet(t, s, kind, key); got != "one\ntwo\nthree\n" {
+				t.Errorf("got %q", got)
+			}
+			s.Put(kind, key, []byte("four\n"))
+			s.Append(kind, key, []byte("five\n"))
+			if got := storeTestGet(t, s, kind, key); got != "four\nfive\n" {
+				t.Errorf("after put: got %q", got)
+			}
+			s.Update(kind, key, func(contents []byte) ([]byte, error) { return []byte("six\n"), nil })
+			s.Append(kind, key, []byte("seven\n"))
+			if got := storeTestGet(t, s, kind, key); got != "six\nseven\n" {
+				t.Errorf("after update: got %q", got)
+			}
+		}},
+
+		{"open", func(t *testing.T, s Store) {
+			_, err := s.Open(kind, key)
+			if !os.IsNotExist(err) {
+				t.Errorf("nothing: got %v, want not found", err)
+			}
+			s.Append(kind, key, []byte("one\n"))
+			s.Append(kind, key, []byte("two\n"))
+			fd, err := s.Open(kind, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fd.Close()
+			contents, err := io.ReadAll(fd)
+			if err != nil || string(contents) != "one\ntwo\n" {
+				t.Errorf("got %q, %v", contents, err)
+			}
+		}},
+
+		{"delete", func(t *testing.T, s Store) {
+			err := s.Delete(kind, key)
+			if !os.IsNotExist(err) {
+				t.Errorf("nothing: got %v, want not found", err)
+			}
+			s.Put(kind, key, []byte("one"))
+			s.Put(other, key, []byte("two"))
+			err = s.Delete(kind, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.Get(kind, key)
+			if !os.IsNotExist(err) {
+				t.Errorf("deleted: got %v, want not found", err)
+			}
+			if got := storeTestGet(t, s, other, key); got != "two" {
+				t.Errorf("other kind: got %q", got)
+			}
+			s.Append(kind, key, []byte("three"))
+			if got := storeTestGet(t, s, kind, key); got != "three" {
+				t.Errorf("appended after delete: got %q", got)
+			}
+		}},
+
+		{"list", func(t *testing.T, s Store) {
+			if keys := storeTestKeys(t, s, kind); len(keys) != 0 {
+				t.Errorf("nothing: got %v", keys)
+			}
+			for _, k := range []string{"c", key, "a", "b-1"} {
+				s.Put(kind, k, []byte(k))
+			}
+			s.Append(kind, "d", []byte("d"))
+			s.Update(kind, "e", func(contents []byte) ([]byte, error) { return []byte("e"), nil })
+			s.Put(other, "f", []byte("f"))
+			s.Delete(kind, "c")
+			want := []string{key, "a", "b-1", "d", "e"}
+			if keys := storeTestKeys(t, s, kind); !reflect.DeepEqual(keys, want) {
+				t.Errorf("got %v, want %v", keys, want)
+			}
+			if keys := storeTestKeys(t, s, other); !reflect.DeepEqual(keys, []string{"f"}) {
+				t.Errorf("other kind: got %v", keys)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, s := range storeTestStores(t) {
+				t.Run(name, func(t *testing.T) {
+					if s.Name() != name {
+						t.Errorf("named %s", s.Name())
+					}
+					tt.test(t, s)
+				})
+			}
+		})
+	}
+}
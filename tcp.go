@@ -15,9 +15,9 @@ import (
 // TCPInboundHandler kicks off TCP single-upload request server
 func TCPInboundHandler() {
 
-	fmt.Printf("Now handling inbound TCP on %s%s\n", ThisServerAddressIPv4, TTServerTCPPort)
+	fmt.Printf("Now handling inbound TCP on %s%s\n", ThisServerAddressIPv4, CurrentServiceConfig().TCPPort)
 
-	ServerAddr, err := net.ResolveTCPAddr("tcp", TTServerTCPPort)
+	ServerAddr, err := net.ResolveTCPAddr("tcp", CurrentServiceConfig().TCPPort)
 	if err != nil {
 		fmt.Printf("Error resolving TCP port: \n%v\n", err)
 		return
@@ -29,16 +29,27 @@ func TCPInboundHandler() {
 		return
 	}
 	defer ServerConn.Close()
+	shutdownAddListener(func() { ServerConn.Close() })
 
 	for {
 
 		// Accept the TCP connection
 		conn, err := ServerConn.AcceptTCP()
 		if err != nil {
+			if ShuttingDown() {
+				return
+			}
 			fmt.Printf("\nTCP: rror accepting TCP session: \n%v\n", err)
 			continue
 		}
 
+		// Drop it if it's from an abusive address
+		ipaddr := ipv4(conn.RemoteAddr().String())
+		if !abuseIPAllowed(ipaddr) {
+			conn.Close()
+			continue
+		}
+
 		// Create a reader on that connection
 		rdconn := bufio.NewReader(conn)
 
@@ -56,8 +67,9 @@ func TCPInboundHandler() {
 			conn.Close()
 			continue
 		}
-		if payloadFormat[0] != BuffFormatPBArray {
-			fmt.Printf("\n%s TCP request from %s ignored\n", LogTime(), ipv4(conn.RemoteAddr().String()))
+		if payloadFormat[0] != BuffFormatPBArray && payloadFormat[0] != BuffFormatPBArraySigned {
+			abuseMalformed(ipaddr)
+			fmt.Printf("\n%s TCP request from %s ignored\n", LogTime(), ipaddr)
 			buf1 := make([]byte, 1024)
 			n, err := rdconn.Read(buf1)
 			if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
@@ -103,6 +115,7 @@ func TCPInboundHandler() {
 			continue
 		}
 		if payloadCount[0] == 0 {
+			abuseMalformed(ipaddr)
 			fmt.Printf("\nTCP: unsupported count: %d\n", payloadCount[0])
 			conn.Close()
 			continue
@@ -148,10 +161,10 @@ func TCPInboundHandler() {
 
 		// Initialize a new AppReq
 		AppReq := IncomingAppReq{}
-		AppReq.SvTransport = "device-tcp:" + ipv4(conn.RemoteAddr().String())
+		AppReq.SvTransport = "device-tcp:" + ipaddr
 
 		// Push it to be processed
-		go AppReqPushPayload(AppReq, payload, "device directly")
+		trackedGo(func() { AppReqPushPayload(AppReq, payload, "device directly") })
 		stats.Count.TCP++
 
 		// Close the connection
@@ -17,6 +17,15 @@ func timer1m() {
 		// Restart this instance if instructed to do so
 		ControlFileCheck()
 
+		// Pick up changes to the service config
+		ServiceConfigCheck()
+
+		// Pick up changes to the notefile schemas
+		noteSchemaCheck()
+
+		// Pick up changes made to the device registry by other instances
+		registryCheck()
+
 		// Write out current status to the file system
 		WriteServerStatus()
 
@@ -43,6 +52,9 @@ func timer5m() {
 			sendExpiredSafecastServersToSlack()
 		}
 
+		// Forget those who have stopped sending, and expired bans
+		abuseExpire()
+
 		// Sleep
 		time.Sleep(5 * time.Minute)
 
@@ -113,7 +125,7 @@ func RandomRestart() {
 	ServerLog("*** RESTARTING because of Slack 'restart' command\n")
 
 	// Exit
-	os.Exit(0)
+	Shutdown()
 
 }
 
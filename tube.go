@@ -0,0 +1,256 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Calibration of Geiger tubes.  Each model of tube reports its counts in its
+// own Lnd field, and has a factor by which CPM is converted to µSv/h.  Devices
+// may be individually calibrated, and for V1 devices, which report only "cpm",
+// the table of devices is how we know which tube it is that they're reporting.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	ttdata "github.com/Safecast/safecast-go"
+)
+
+// Lnd fields in which tubes report, in the order in which they are preferred when computing µSv/h
+var tubeFields = []string{"lnd_7318u", "lnd_7318c", "lnd_712u", "lnd_7128ec", "lnd_78017w"}
+
+// The tube models of a service config, computed once per config rather than for every reading
+type tubeModelsOfConfig struct {
+	config *TTServeConfig
+	models []TubeModelConfig
+}
+
+var tubeModelsCache atomic.Pointer[tubeModelsOfConfig]
+
+// tubeField gets the address of the Lnd field of the given name
+func tubeField(lnd *ttdata.Lnd, field string) **float64 {
+	switch field {
+	case "lnd_7318u":
+		return &lnd.U7318
+	case "lnd_7318c":
+		return &lnd.C7318
+	case "lnd_712u":
+		return &lnd.U712
+	case "lnd_7128ec":
+		return &lnd.EC7128
+	case "lnd_78017w":
+		return &lnd.W78017
+	}
+	return nil
+}
+
+// The tube models that we know about unless otherwise configured
+func tubeDefaultModels() []TubeModelConfig {
+	return []TubeModelConfig{
+		{Name: "U7318", Field: "lnd_7318u", CPMPerUSv: 334},
+		{Name: "C7318", Field: "lnd_7318c", CPMPerUSv: 334},
+		{Name: "EC7128", Field: "lnd_7128ec", CPMPerUSv: 108},
+		{Name: "U712", Field: "lnd_712u", CPMPerUSv: 108},
+		{Name: "W78017", Field: "lnd_78017w"},
+	}
+}
+
+// The tubes fitted to devices unless otherwise configured, which is only of interest for V1 devices
+func tubeDefaultDevices() []TubeDeviceConfig {
+	return []TubeDeviceConfig{
+		{DeviceID: 100, Tube: "U712"},
+		{DeviceID: 63, Tube: "U712"},
+		{DeviceID: 54, Tube: "U712"},
+		{DeviceID: 78, Tube: "W78017"},
+		{DeviceID: 20105, Tube: "W78017"},
+		{DeviceClass: "ngeigie", Tube: "U7318"},
+		{DeviceClass: "geigiecast", Tube: "U7318"},
+		{DeviceClass: "geigiecast-zen", Tube: "U7318"},
+		{DeviceClass: "pointcast", V1Suffix: "1", Tube: "U7318"},
+		{DeviceClass: "pointcast", V1Suffix: "2", Tube: "EC7128"},
+	}
+}
+
+// tubeModels gets the tube models, with those configured overriding or adding to the defaults
+func tubeModels(config TTServeConfig) (models []TubeModelConfig) {
+	models = tubeDefaultModels()
+	for _, tm := range config.TubeModels {
+		found := false
+		for i := range models {
+			if models[i].Name != tm.Name {
+				continue
+			}
+			found = true
+			if tm.Field != "" {
+				models[i].Field = tm.Field
+			}
+			if tm.CPMPerUSv != 0 {
+				models[i].CPMPerUSv = tm.CPMPerUSv
+			}
+		}
+		if !found {
+			models = append(models, tm)
+		}
+	}
+	return
+}
+
+// tubeCurrentModels gets the tube models of the current service config
+func tubeCurrentModels() []TubeModelConfig {
+	config := serviceConfig.Load()
+	cached := tubeModelsCache.Load()
+	if cached != nil && cached.config == config {
+		return cached.models
+	}
+	models := tubeModels(*config)
+	tubeModelsCache.Store(&tubeModelsOfConfig{config: config, models: models})
+	return models
+}
+
+// tubeDevices gets the tubes that may be fitted to a device, with those configured taking precedence
+// over that in the device registry, which in turn takes precedence over the defaults
+func tubeDevices(config TTServeConfig, deviceID uint32) []TubeDeviceConfig {
+	devices := append([]TubeDeviceConfig{}, config.TubeDevices...)
+	d, found := registryGet(deviceID, "")
+	if found && d.Tube != "" {
+		devices = append(devices, TubeDeviceConfig{DeviceID: d.DeviceID, Tube: d.Tube})
+	}
+	return append(devices, tubeDefaultDevices()...)
+}
+
+// tubeModel finds a tube model by name
+func tubeModel(models []TubeModelConfig, name string) (model TubeModelConfig, found bool) {
+	for _, tm := range models {
+		if strings.EqualFold(tm.Name, name) {
+			return tm, true
+		}
+	}
+	return
+}
+
+// tubeValidateConfig makes sure that the configured tubes are usable
+func tubeValidateConfig(config TTServeConfig) error {
+
+	models := tubeModels(config)
+	for _, tm := range models {
+		if tm.Name == "" {
+			return fmt.Errorf("tube model has no name")
+		}
+		var lnd ttdata.Lnd
+		if tubeField(&lnd, tm.Field) == nil {
+			return fmt.Errorf("tube model %s: unknown field '%s'", tm.Name, tm.Field)
+		}
+		if tm.CPMPerUSv < 0 {
+			return fmt.Errorf("tube model %s: invalid cpm_per_usv", tm.Name)
+		}
+	}
+
+	for _, td := range config.TubeDevices {
+		if td.DeviceID == 0 && td.DeviceClass == "" {
+			return fmt.Errorf("tube device has neither device nor device_class")
+		}
+		if td.Tube != "" {
+			_, found := tubeModel(models, td.Tube)
+			if !found {
+				return fmt.Errorf("tube device %d %s: unknown tube '%s'", td.DeviceID, td.DeviceClass, td.Tube)
+			}
+		}
+		if td.CPMPerUSv < 0 {
+			return fmt.Errorf("tube device %d %s: invalid cpm_per_usv", td.DeviceID, td.DeviceClass)
+		}
+	}
+
+	return nil
+
+}
+
+// tubeDeviceMatches returns true if the entry describes the specified device
+func tubeDeviceMatches(td TubeDeviceConfig, deviceID uint32, deviceClass string) bool {
+	if td.DeviceID != 0 && td.DeviceID != deviceID {
+		return false
+	}
+	if td.DeviceClass != "" && td.DeviceClass != deviceClass {
+		return false
+	}
+	return true
+}
+
+// tubeForV1 determines the model of the tube whose "cpm" a V1 device reports, or "" if unknown
+func tubeForV1(deviceClass string, v1DeviceID uint32, deviceID uint32) string {
+	v1ID := fmt.Sprintf("%d", v1DeviceID)
+	for _, td := range tubeDevices(CurrentServiceConfig(), deviceID) {
+		if td.Tube == "" || !tubeDeviceMatches(td, deviceID, deviceClass) {
+			continue
+		}
+		if td.V1Suffix != "" && !strings.HasSuffix(v1ID, td.V1Suffix) {
+			continue
+		}
+		return td.Tube
+	}
+	return ""
+}
+
+// tubeSetCPM places a V1 device's "cpm" in the field in which the specified model of tube reports
+func tubeSetCPM(lnd *ttdata.Lnd, tube string, cpm float64) bool {
+	tm, found := tubeModel(tubeCurrentModels(), tube)
+	if !found {
+		return false
+	}
+	field := tubeField(lnd, tm.Field)
+	if field == nil {
+		return false
+	}
+	*field = &cpm
+	return true
+}
+
+// tubeCalculate fills in µSv/h for a radiation reading that doesn't have it, using the
+// calibration of the device if it has been individually calibrated, else that of the tube.
+func tubeCalculate(sd *ttdata.SafecastData) {
+
+	if sd.Lnd == nil || (sd.Lnd.USv != nil && *sd.Lnd.USv != 0) {
+		return
+	}
+
+	models := tubeCurrentModels()
+	devices := tubeDevices(CurrentServiceConfig(), sd.DeviceID)
+
+	for _, fieldName := range tubeFields {
+		cpm := *tubeField(sd.Lnd, fieldName)
+		if cpm == nil {
+			continue
+		}
+
+		// Find the calibration of the tube that reports in this field
+		factor := 0.0
+		for _, tm := range models {
+			if tm.Field == fieldName && tm.CPMPerUSv != 0 {
+				factor = tm.CPMPerUSv
+				break
+			}
+		}
+
+		// Override it with the device's own calibration, if any
+		for _, td := range devices {
+			if td.CPMPerUSv == 0 || td.V1Suffix != "" || !tubeDeviceMatches(td, sd.DeviceID, sd.DeviceClass) {
+				continue
+			}
+			if td.Tube != "" {
+				tm, _ := tubeModel(models, td.Tube)
+				if tm.Field != fieldName {
+					continue
+				}
+			}
+			factor = td.CPMPerUSv
+			break
+		}
+
+		if factor != 0 {
+			usv := *cpm / factor
+			sd.Lnd.USv = &usv
+			return
+		}
+
+	}
+
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	ttdata "github.com/Safecast/safecast-go"
+)
+
+// tubeTestRegistry uses a registry holding only the given devices for the duration of a test
+func tubeTestRegistry(t *testing.T, devices ...RegistryDevice) {
+	t.Helper()
+	registryLock.Lock()
+	prev := registryDevices
+	registryDevices = map[uint32]RegistryDevice{}
+	for _, d := range devices {
+		registryDevices[d.DeviceID] = d
+	}
+	registryLock.Unlock()
+	t.Cleanup(func() {
+		registryLock.Lock()
+		registryDevices = prev
+		registryLock.Unlock()
+	})
+}
+
+func TestTubeCalculate(t *testing.T) {
+	testServiceConfig(t, TTServeConfig{TubeDevices: []TubeDeviceConfig{{DeviceID: 7, CPMPerUSv: 100}}})
+	tubeTestRegistry(t, RegistryDevice{DeviceID: 8, Tube: "EC7128"})
+	cpm := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name     string
+		deviceID uint32
+		lnd      ttdata.Lnd
+		usv      float64
+	}{
+		{"U7318", 1, ttdata.Lnd{U7318: cpm(334)}, 1},
+		{"EC7128", 1, ttdata.Lnd{EC7128: cpm(216)}, 2},
+		{"preferred field", 1, ttdata.Lnd{U7318: cpm(334), EC7128: cpm(1080)}, 1},
+		{"uncalibrated", 1, ttdata.Lnd{W78017: cpm(50)}, 0},
+		{"device calibration", 7, ttdata.Lnd{U7318: cpm(300)}, 3},
+		{"registry tube has no calibration of its own", 8, ttdata.Lnd{EC7128: cpm(108)}, 1},
+	}
+	for _, test := range tests {
+		sd := ttdata.SafecastData{DeviceID: test.deviceID, Lnd: &test.lnd}
+		tubeCalculate(&sd)
+		usv := 0.0
+		if sd.Lnd.USv != nil {
+			usv = *sd.Lnd.USv
+		}
+		if usv != test.usv {
+			t.Errorf("%s: %g µSv/h, want %g", test.name, usv, test.usv)
+		}
+	}
+}
+
+func TestTubeForV1(t *testing.T) {
+	testServiceConfig(t, TTServeConfig{TubeDevices: []TubeDeviceConfig{{DeviceID: 100, Tube: "EC7128"}}})
+	tubeTestRegistry(t, RegistryDevice{DeviceID: 20, Tube: "C7318"}, RegistryDevice{DeviceID: 100, Tube: "U7318"})
+
+	tests := []struct {
+		class    string
+		v1ID     uint32
+		deviceID uint32
+		tube     string
+	}{
+		{"", 100, 100, "EC7128"},
+		{"", 20, 20, "C7318"},
+		{"", 78, 78, "W78017"},
+		{"pointcast", 10001, 1000, "U7318"},
+		{"pointcast", 10002, 1000, "EC7128"},
+		{"pointcast", 10003, 1000, ""},
+		{"unknown", 5, 5, ""},
+	}
+	for _, test := range tests {
+		tube := tubeForV1(test.class, test.v1ID, test.deviceID)
+		if tube != test.tube {
+			t.Errorf("%s %d: got %q, want %q", test.class, test.v1ID, tube, test.tube)
+		}
+	}
+}
+
+// The models are computed once per config, and again when it changes
+func TestTubeModelsPerConfig(t *testing.T) {
+	testServiceConfig(t, TTServeConfig{})
+	models := tubeCurrentModels()
+	if &tubeCurrentModels()[0] != &models[0] {
+		t.Errorf("models recomputed for the same config")
+	}
+	testServiceConfig(t, TTServeConfig{TubeModels: []TubeModelConfig{{Name: "U7318", CPMPerUSv: 300}}})
+	tm, _ := tubeModel(tubeCurrentModels(), "U7318")
+	if tm.CPMPerUSv != 300 {
+		t.Errorf("models not recomputed for a new config: %+v", tm)
+	}
+}
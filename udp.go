@@ -7,6 +7,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -17,9 +20,9 @@ import (
 // UDPInboundHandler kicks off UDP single-upload request server
 func UDPInboundHandler() {
 
-	fmt.Printf("Now handling inbound UDP on %s%s\n", ThisServerAddressIPv4, TTServerUDPPort)
+	fmt.Printf("Now handling inbound UDP on %s%s\n", ThisServerAddressIPv4, CurrentServiceConfig().UDPPort)
 
-	ServerAddr, err := net.ResolveUDPAddr("udp", TTServerUDPPort)
+	ServerAddr, err := net.ResolveUDPAddr("udp", CurrentServiceConfig().UDPPort)
 	if err != nil {
 		fmt.Printf("Error resolving UDP port: \n%v\n", err)
 		return
@@ -31,21 +34,35 @@ func UDPInboundHandler() {
 		return
 	}
 	defer ServerConn.Close()
+	shutdownAddListener(func() { ServerConn.Close() })
 
 	for {
 		buf := make([]byte, 8192)
 
 		n, addr, err := ServerConn.ReadFromUDP(buf)
 		if err != nil {
+			if ShuttingDown() {
+				return
+			}
 			fmt.Printf("UDP read error: \n%v\n", err)
 		} else {
 
+			// Drop it if it's from an abusive address, or so malformed that there's no point relaying it
+			ipaddr := ipv4(addr.String())
+			if !abuseIPAllowed(ipaddr) {
+				continue
+			}
+			if n == 0 || ((buf[0] == BuffFormatPBArray || buf[0] == BuffFormatPBArraySigned) && !validBulkPayload(buf, n)) {
+				abuseMalformed(ipaddr)
+				continue
+			}
+
 			ttg := &TTGateReq{}
 			ttg.Payload = buf[0:n]
-			ttg.Transport = "device-udp:" + ipv4(addr.String())
+			ttg.Transport = "device-udp:" + ipaddr
 			data, err := json.Marshal(ttg)
 			if err == nil {
-				go UploadToWebLoadBalancer(data, n, ttg.Transport)
+				trackedGo(func() { UploadToWebLoadBalancer(data, n, ttg.Transport) })
 				stats.Count.UDP++
 			}
 
@@ -55,6 +72,28 @@ func UDPInboundHandler() {
 
 }
 
+// The user agent with which our instances relay UDP payloads through the web load balancer
+const relayUserAgent = "TTSERVE"
+
+// The header in which relayed UDP payloads carry the HMAC-SHA256 of the body, using a relay secret
+const relaySignatureHeader = "X-Safecast-Relay-Signature"
+
+// relaySignature signs a relayed payload
+func relaySignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// relayRequestTrusted returns true if the request is a payload relayed and signed by one of our own instances
+func relayRequestTrusted(req *http.Request, body []byte) bool {
+	secrets := CurrentServiceConfig().RelaySecrets
+	if len(secrets) == 0 || req.UserAgent() != relayUserAgent {
+		return false
+	}
+	return noteSignatureValid(secrets, req.Header.Get(relaySignatureHeader), body)
+}
+
 // UploadToWebLoadBalancer uploads a UDP packet via a Safecast data structure the load balancer for the web service
 func UploadToWebLoadBalancer(data []byte, datalen int, transport string) {
 
@@ -62,11 +101,15 @@ func UploadToWebLoadBalancer(data []byte, datalen int, transport string) {
 		fmt.Printf("\n%s Received %d-byte payload from %s, routing to HTTP load balancer\n", LogTime(), datalen, transport)
 	}
 
-	url := "http://" + TTServerHTTPAddress + TTServerHTTPPort + TTServerTopicSend
+	url := "http://" + CurrentServiceConfig().HTTPAddress + CurrentServiceConfig().HTTPPort + TTServerTopicSend
 
 	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	req.Header.Set("User-Agent", "TTSERVE")
+	req.Header.Set("User-Agent", relayUserAgent)
 	req.Header.Set("Content-Type", "text/plain")
+	secrets := CurrentServiceConfig().RelaySecrets
+	if len(secrets) != 0 {
+		req.Header.Set(relaySignatureHeader, relaySignature(secrets[0], data))
+	}
 	httpclient := &http.Client{
 		Timeout: time.Second * 15,
 	}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"math/rand"
 	"os"
@@ -22,11 +23,32 @@ func Random(min, max int) int {
 	return rand.Intn(max-min) + min
 }
 
+// Folder for safecast data, if configured to be other than the one containing the config
+var safecastDataDirectory = ""
+
 // SafecastDirectory gets the path of the root safecast file system folder shared among instances
 func SafecastDirectory() string {
-	directory := ""
-	if len(os.Args) > 1 {
-		directory = os.Args[1]
+	if safecastDataDirectory != "" {
+		return safecastDataDirectory
+	}
+	return SafecastConfigDirectory()
+}
+
+// flagParse parses the flags of the command line, all of which must come before the folder because
+// parsing stops at the first argument that isn't a flag, and so we refuse any that follow it
+func flagParse(args []string) {
+	flag.CommandLine.Parse(args)
+	if flag.NArg() > 1 {
+		fmt.Printf("TTSERVE: flags must come before the folder, but '%s' follows it\n", flag.Arg(1))
+		os.Exit(2)
+	}
+}
+
+// SafecastConfigDirectory gets the path of the folder named on the command line, containing the service config
+func SafecastConfigDirectory() string {
+	directory := flag.Arg(0)
+	if directory == "" {
+		directory = os.Getenv("TTSERVE_DIRECTORY")
 	}
 	if directory == "" {
 		fmt.Printf("TTSERVE: first argument must be folder containing safecast data!\n")
@@ -83,6 +105,22 @@ func Ago(when time.Time) string {
 	return AgoMinutes(uint32(int64(time.Since(when) / time.Minute)))
 }
 
+// ParseDateOrTime parses a date or time, where a date is taken as its start or, for the end of a range, its end
+func ParseDateOrTime(s string, end bool) (t time.Time, err error) {
+	t, err = time.Parse(time.RFC3339, s)
+	if err == nil {
+		return
+	}
+	t, err = time.Parse("2006-01-02", s)
+	if err != nil {
+		return t, fmt.Errorf("invalid date '%s'", s)
+	}
+	if end {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return
+}
+
 // GetWhenFromOffset takes a GPS-formatted base date and time, plus offset, and returns a UTC string
 func GetWhenFromOffset(baseDate uint32, baseTime uint32, offset uint32) string {
 	var i64 uint64
@@ -0,0 +1,26 @@
+// Copyright 2017 Inca Roads LLC.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+// testServiceConfig uses a service config for the duration of a test
+func testServiceConfig(t *testing.T, config TTServeConfig) {
+	t.Helper()
+	prev := serviceConfig.Load()
+	serviceConfig.Store(&config)
+	t.Cleanup(func() { serviceConfig.Store(prev) })
+}
+
+// testDataDirectory uses an empty data folder for the duration of a test
+func testDataDirectory(t *testing.T) string {
+	t.Helper()
+	prev := safecastDataDirectory
+	safecastDataDirectory = t.TempDir()
+	t.Cleanup(func() { safecastDataDirectory = prev })
+	return safecastDataDirectory
+}